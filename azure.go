@@ -0,0 +1,865 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+const (
+	// defaultAzureStagedUploadThreshold はブロックをステージしてアップロードするファイルのデフォルトのサイズ
+	defaultAzureStagedUploadThreshold = 64 * 1024 * 1024
+
+	// defaultAzureBlockSize はブロックのデフォルトのサイズ
+	defaultAzureBlockSize = 8 * 1024 * 1024
+
+	// defaultAzureBlockConcurrency は1ファイルあたりの並列にステージするデフォルトのブロック数
+	defaultAzureBlockConcurrency = 4
+
+	// maxAzureBlockSize はブロックの最大サイズ
+	maxAzureBlockSize = 4000 * 1024 * 1024
+
+	// maxAzureBlocks はブロックBLOBあたりの最大のブロック数
+	maxAzureBlocks = 50000
+)
+
+// azureAccessTiers はブロックBLOBのアクセス層
+var azureAccessTiers = []blob.AccessTier{
+	blob.AccessTierHot, blob.AccessTierCool, blob.AccessTierCold, blob.AccessTierArchive,
+}
+
+// AzureBlobAPI defines the interface for Azure Blob Storage operations used by the backup session
+// All operations target the container of the session
+type AzureBlobAPI interface {
+	GetContainerProperties(ctx context.Context) error
+	Upload(ctx context.Context, blobName string, body io.ReadSeekCloser, options *blockblob.UploadOptions) error
+	StageBlock(ctx context.Context, blobName, blockID string, body io.ReadSeekCloser, options *blockblob.StageBlockOptions) error
+	CommitBlockList(ctx context.Context, blobName string, blockIDs []string, options *blockblob.CommitBlockListOptions) error
+	GetProperties(ctx context.Context, blobName string) (blob.GetPropertiesResponse, error)
+	ListBlobs(ctx context.Context, prefix string, fn func(item *container.BlobItem)) error
+}
+
+// azureBlobClient は *container.Client を AzureBlobAPI として使うためのアダプター
+type azureBlobClient struct {
+	container *container.Client
+}
+
+// GetContainerProperties はコンテナにアクセスできることを確認する
+func (c *azureBlobClient) GetContainerProperties(ctx context.Context) error {
+	_, err := c.container.GetProperties(ctx, nil)
+	return err
+}
+
+// Upload はブロックBLOBを1回のリクエストで書き込む
+func (c *azureBlobClient) Upload(ctx context.Context, blobName string, body io.ReadSeekCloser, options *blockblob.UploadOptions) error {
+	_, err := c.container.NewBlockBlobClient(blobName).Upload(ctx, body, options)
+	return err
+}
+
+// StageBlock はブロックをステージする
+func (c *azureBlobClient) StageBlock(ctx context.Context, blobName, blockID string, body io.ReadSeekCloser, options *blockblob.StageBlockOptions) error {
+	_, err := c.container.NewBlockBlobClient(blobName).StageBlock(ctx, blockID, body, options)
+	return err
+}
+
+// CommitBlockList はステージしたブロックをコミットしてBLOBを作成する
+func (c *azureBlobClient) CommitBlockList(ctx context.Context, blobName string, blockIDs []string, options *blockblob.CommitBlockListOptions) error {
+	_, err := c.container.NewBlockBlobClient(blobName).CommitBlockList(ctx, blockIDs, options)
+	return err
+}
+
+// GetProperties はBLOBのプロパティとメタデータを返す
+func (c *azureBlobClient) GetProperties(ctx context.Context, blobName string) (blob.GetPropertiesResponse, error) {
+	return c.container.NewBlobClient(blobName).GetProperties(ctx, nil)
+}
+
+// ListBlobs は prefix で始まるBLOBをメタデータ付きで列挙し、fn に渡す
+func (c *azureBlobClient) ListBlobs(ctx context.Context, prefix string, fn func(item *container.BlobItem)) error {
+	pager := c.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix:  &prefix,
+		Include: container.ListBlobsInclude{Metadata: true},
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Segment.BlobItems {
+			fn(item)
+		}
+	}
+	return nil
+}
+
+// AzureBlobBackupSession はAzure Blob Storageへのバックアップセッション実装
+// ブロックBLOBはアップロードまたはコミットが完了した時点で作成されるため、保存先に書き込み途中のBLOBが現れることはない
+// 保存は呼び出し元のゴルーチンで行われ、複数のゴルーチンから同時に呼び出せる
+type AzureBlobBackupSession struct {
+	config  AzureBlobBackupSessionConfig
+	client  AzureBlobAPI
+	results resultLog // ファイルごとの結果
+	ctx     context.Context
+	cancel  context.CancelFunc // ctx のキャンセル
+	closeMu sync.RWMutex       // closed の排他制御
+	closed  bool
+	saves   sync.WaitGroup // 実行中の保存処理
+}
+
+// NewAzureBlobBackupSession はAzure Blob Storageバックアップセッションインスタンスを作成
+// 作成時にコンテナにアクセスできることを確認する
+func NewAzureBlobBackupSession(config AzureBlobBackupSessionConfig) (*AzureBlobBackupSession, error) {
+	// 設定の検証
+	if err := validateAzureBlobConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	client, err := newAzureBlobClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return newAzureBlobBackupSession(config, client)
+}
+
+// newAzureBlobBackupSession は client を使うAzure Blob Storageバックアップセッションを作成する
+func newAzureBlobBackupSession(config AzureBlobBackupSessionConfig, client AzureBlobAPI) (*AzureBlobBackupSession, error) {
+	if err := validateAzureBlobConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	// デフォルト値の設定
+	if config.StagedUploadThreshold == 0 {
+		config.StagedUploadThreshold = defaultAzureStagedUploadThreshold
+	}
+	if config.BlockSize == 0 {
+		config.BlockSize = defaultAzureBlockSize
+	}
+	if config.BlockConcurrency == 0 {
+		config.BlockConcurrency = defaultAzureBlockConcurrency
+	}
+
+	// コンテナの存在確認
+	if err := client.GetContainerProperties(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to access container %s: %w", config.Container, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &AzureBlobBackupSession{
+		config: config,
+		client: client,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// newAzureBlobClient は認証情報からコンテナのクライアントを作成する
+func newAzureBlobClient(config AzureBlobBackupSessionConfig) (*azureBlobClient, error) {
+	if config.ConnectionString != "" {
+		client, err := container.NewClientFromConnectionString(config.ConnectionString, config.Container, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid connection string: %w", ErrInvalidConfig, err)
+		}
+		return &azureBlobClient{container: client}, nil
+	}
+
+	serviceURL := config.ServiceURL
+	if serviceURL == "" {
+		serviceURL = fmt.Sprintf("https://%s.blob.core.windows.net/", config.AccountName)
+	}
+	containerURL := strings.TrimSuffix(serviceURL, "/") + "/" + config.Container
+
+	var client *container.Client
+	var err error
+	if config.AccountKey != "" {
+		var credential *container.SharedKeyCredential
+		credential, err = container.NewSharedKeyCredential(config.AccountName, config.AccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid account key: %w", ErrInvalidConfig, err)
+		}
+		client, err = container.NewClientWithSharedKeyCredential(containerURL, credential, nil)
+	} else {
+		client, err = container.NewClientWithNoCredential(containerURL+"?"+strings.TrimPrefix(config.SASToken, "?"), nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure Blob client: %w", err)
+	}
+	return &azureBlobClient{container: client}, nil
+}
+
+// Save はファイルをAzure Blob Storageにアップロードする
+func (s *AzureBlobBackupSession) Save(localFilePath, relativePath string) error {
+	return s.SaveContext(context.Background(), localFilePath, relativePath)
+}
+
+// SaveContext はファイルをAzure Blob Storageにアップロードする
+// ctx またはセッションがキャンセルされるとアップロードを中断し、BLOBは作成・更新されない
+func (s *AzureBlobBackupSession) SaveContext(ctx context.Context, localFilePath, relativePath string) error {
+	// 入力検証
+	if localFilePath == "" || relativePath == "" {
+		return fmt.Errorf("%w: empty file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	name := s.blobName(relativePath)
+	start := time.Now()
+	copied, err := s.uploadFile(ctx, localFilePath, name)
+	s.results.add(FileResult{
+		SourcePath:   localFilePath,
+		RelativePath: relativePath,
+		Destination:  name,
+		BytesWritten: copied.written,
+		Duration:     time.Since(start),
+		Checksum:     copied.checksum,
+		Err:          err,
+	})
+
+	return err
+}
+
+// uploadFile はファイルのチェックサムを計算してからアップロードする
+// StagedUploadThreshold 以上のファイルはブロックを並列にステージしてからコミットする
+func (s *AzureBlobBackupSession) uploadFile(ctx context.Context, filePath, name string) (copyResult, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return copyResult{}, fmt.Errorf("%w: source is not a regular file", ErrInvalidConfig)
+	}
+
+	copied, err := s.transferFile(ctx, file, info.Size(), info.ModTime(), name)
+	if err != nil {
+		return copyResult{}, fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	return copied, nil
+}
+
+// transferFile は開いたファイルの内容をアップロードする
+func (s *AzureBlobBackupSession) transferFile(ctx context.Context, file *os.File, size int64, modTime time.Time, name string) (copyResult, error) {
+	// チェックサムを計算してから先頭に戻す
+	hash := sha256.New()
+	contentMD5 := md5.New()
+	if _, err := io.Copy(io.MultiWriter(hash, contentMD5), &contextReader{ctx: ctx, r: file}); err != nil {
+		return copyResult{}, fmt.Errorf("failed to read file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return copyResult{}, fmt.Errorf("failed to seek file: %w", err)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	metadata := azureMetadata(uploadMetadata(checksum, modTime))
+
+	if size < s.config.StagedUploadThreshold {
+		if err := s.upload(ctx, name, file, size, metadata); err != nil {
+			return copyResult{}, err
+		}
+		return copyResult{written: size, checksum: checksum}, nil
+	}
+
+	blockSize, err := s.blockSizeFor(size)
+	if err != nil {
+		return copyResult{}, err
+	}
+	blockIDs, err := s.stageBlocks(ctx, name, func(stop <-chan struct{}, out chan<- azureBlock) error {
+		index := 0
+		for offset := int64(0); offset < size; offset += blockSize {
+			n := min(blockSize, size-offset)
+			block := azureBlock{index: index, body: io.NewSectionReader(file, offset, n)}
+			select {
+			case out <- block:
+			case <-stop:
+				return nil
+			}
+			index++
+		}
+		return nil
+	})
+	if err != nil {
+		return copyResult{}, err
+	}
+	if err := s.commit(ctx, name, blockIDs, contentMD5.Sum(nil), metadata); err != nil {
+		return copyResult{}, err
+	}
+	return copyResult{written: size, checksum: checksum}, nil
+}
+
+// SaveReader はReaderから読み込んだデータをAzure Blob Storageにアップロードする
+// 1ブロックに収まる場合は1回のリクエストで、収まらない場合はブロックをステージしてからコミットする
+// sizeHint はデータサイズが分かっている場合の値（不明な場合は負の値）で、ブロックサイズの決定に使う
+func (s *AzureBlobBackupSession) SaveReader(ctx context.Context, r io.Reader, relativePath string, sizeHint int64) error {
+	// 入力検証
+	if r == nil || relativePath == "" {
+		return fmt.Errorf("%w: empty reader or file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	name := s.blobName(relativePath)
+	start := time.Now()
+	written, checksum, err := s.uploadStream(ctx, r, name, sizeHint)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	result := FileResult{
+		RelativePath: relativePath,
+		Destination:  name,
+		Duration:     time.Since(start),
+		Checksum:     checksum,
+		Err:          err,
+	}
+	if err == nil {
+		result.BytesWritten = written
+	}
+	s.results.add(result)
+
+	return err
+}
+
+// uploadStream は r の内容をアップロードし、書き込んだサイズとSHA-256チェックサムを返す
+// 最初のバッファは sizeHint に合わせて確保し、ステージする場合は並列ブロック数分のバッファを使う
+func (s *AzureBlobBackupSession) uploadStream(ctx context.Context, r io.Reader, name string, sizeHint int64) (int64, string, error) {
+	blockSize := s.config.BlockSize
+	if sizeHint > 0 {
+		var err error
+		if blockSize, err = s.blockSizeFor(sizeHint); err != nil {
+			return 0, "", err
+		}
+	}
+
+	hash := sha256.New()
+	contentMD5 := md5.New()
+	counter := &countingWriter{w: io.MultiWriter(hash, contentMD5)}
+	body := io.TeeReader(&contextReader{ctx: ctx, r: r}, counter)
+
+	first, n, err := readFirstPart(body, blockSize, sizeHint)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// 1ブロックに収まる場合はそのままアップロード
+		checksum := hex.EncodeToString(hash.Sum(nil))
+		metadata := azureMetadata(uploadMetadata(checksum, time.Time{}))
+		if err := s.upload(ctx, name, bytes.NewReader(first[:n]), int64(n), metadata); err != nil {
+			return 0, "", err
+		}
+		return int64(n), checksum, nil
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	// ステージが終わったバッファを再利用する
+	buffers := make(chan []byte, s.config.BlockConcurrency)
+	for i := 1; i < cap(buffers); i++ {
+		buffers <- make([]byte, blockSize)
+	}
+
+	blockIDs, err := s.stageBlocks(ctx, name, func(stop <-chan struct{}, out chan<- azureBlock) error {
+		buf := first
+		for index := 0; ; index++ {
+			if index > 0 {
+				select {
+				case buf = <-buffers:
+				case <-stop:
+					return nil
+				}
+
+				n, err = io.ReadFull(body, buf)
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+					return fmt.Errorf("failed to read stream: %w", err)
+				}
+			}
+
+			if index >= maxAzureBlocks {
+				return fmt.Errorf("stream exceeds %d blocks", maxAzureBlocks)
+			}
+
+			blockBuf := buf
+			block := azureBlock{
+				index: index,
+				body:  bytes.NewReader(buf[:n]),
+				done:  func() { buffers <- blockBuf },
+			}
+			select {
+			case out <- block:
+			case <-stop:
+				return nil
+			}
+
+			if n < len(buf) {
+				// 最終ブロック
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	// 読み終えた後のコミットでチェックサムをメタデータに記録できる
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	metadata := azureMetadata(uploadMetadata(checksum, time.Time{}))
+	if err := s.commit(ctx, name, blockIDs, contentMD5.Sum(nil), metadata); err != nil {
+		return 0, "", err
+	}
+	return counter.n, checksum, nil
+}
+
+// upload はデータを1回のリクエストでブロックBLOBとしてアップロードする
+// 内容のMD5を送ってAzureに検証させる
+func (s *AzureBlobBackupSession) upload(ctx context.Context, name string, body io.ReadSeeker, size int64, metadata map[string]*string) error {
+	sum, err := readSeekerMD5(body)
+	if err != nil {
+		return err
+	}
+
+	err = s.client.Upload(ctx, name, streaming.NopCloser(body), &blockblob.UploadOptions{
+		Metadata:                metadata,
+		Tier:                    s.accessTier(),
+		HTTPHeaders:             &blob.HTTPHeaders{BlobContentMD5: sum},
+		TransactionalValidation: blob.TransferValidationTypeMD5(sum),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload blob %s (%d bytes): %w", name, size, err)
+	}
+	return nil
+}
+
+// azureBlock はステージするブロック
+type azureBlock struct {
+	index int
+	body  io.ReadSeeker
+	done  func() // ステージの後に呼ぶ（オプション、バッファの返却等）
+}
+
+// stageBlocks は produce が送ったブロックを BlockConcurrency 個並列にステージし、ブロックIDを順に返す
+// ブロックIDには呼び出しごとに乱数を含めるため、同じBLOBへの同時のアップロードとブロックが混ざらない
+// 失敗した場合にステージ済みのブロックはコミットされず、Azureが一定期間後に削除する
+func (s *AzureBlobBackupSession) stageBlocks(ctx context.Context, name string, produce func(stop <-chan struct{}, out chan<- azureBlock) error) ([]string, error) {
+	uploadID := make([]byte, 8)
+	if _, err := rand.Read(uploadID); err != nil {
+		return nil, fmt.Errorf("failed to generate block ID: %w", err)
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		count    int // ステージしたブロック数
+		stop     = make(chan struct{})
+		stopOnce sync.Once
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		stopOnce.Do(func() { close(stop) })
+	}
+
+	out := make(chan azureBlock)
+	var wg sync.WaitGroup
+	for i := 0; i < s.config.BlockConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for block := range out {
+				// 失敗した後のブロックはステージしない
+				select {
+				case <-stop:
+					if block.done != nil {
+						block.done()
+					}
+					continue
+				default:
+				}
+
+				err := s.stageBlock(ctx, name, azureBlockID(uploadID, block.index), block.body)
+				if block.done != nil {
+					block.done()
+				}
+				if err != nil {
+					fail(fmt.Errorf("failed to stage block %d: %w", block.index, err))
+					continue
+				}
+
+				mu.Lock()
+				count = max(count, block.index+1)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	if err := produce(stop, out); err != nil {
+		fail(err)
+	}
+	close(out)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	// ブロックは送った順にコミットする
+	blockIDs := make([]string, count)
+	for i := range blockIDs {
+		blockIDs[i] = azureBlockID(uploadID, i)
+	}
+	return blockIDs, nil
+}
+
+// stageBlock はブロックのMD5を送ってステージし、Azureに内容を検証させる
+func (s *AzureBlobBackupSession) stageBlock(ctx context.Context, name, blockID string, body io.ReadSeeker) error {
+	sum, err := readSeekerMD5(body)
+	if err != nil {
+		return err
+	}
+	return s.client.StageBlock(ctx, name, blockID, streaming.NopCloser(body), &blockblob.StageBlockOptions{
+		TransactionalValidation: blob.TransferValidationTypeMD5(sum),
+	})
+}
+
+// commit はステージしたブロックをコミットしてBLOBを作成する
+// 内容全体のMD5はBLOBのプロパティとして記録する
+func (s *AzureBlobBackupSession) commit(ctx context.Context, name string, blockIDs []string, contentMD5 []byte, metadata map[string]*string) error {
+	err := s.client.CommitBlockList(ctx, name, blockIDs, &blockblob.CommitBlockListOptions{
+		Metadata:    metadata,
+		Tier:        s.accessTier(),
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentMD5: contentMD5},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to commit block list of %s: %w", name, err)
+	}
+	return nil
+}
+
+// azureBlockID はアップロードごとの乱数とブロックの番号からブロックIDを作る
+// 1つのBLOBのブロックIDはすべて同じ長さでなければならない
+func azureBlockID(uploadID []byte, index int) string {
+	id := make([]byte, 0, len(uploadID)+8)
+	id = append(id, uploadID...)
+	id = binary.BigEndian.AppendUint64(id, uint64(index))
+	return base64.StdEncoding.EncodeToString(id)
+}
+
+// readSeekerMD5 は body の内容のMD5を計算し、先頭に戻す
+func readSeekerMD5(body io.ReadSeeker) ([]byte, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return nil, fmt.Errorf("failed to read data: %w", err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek data: %w", err)
+	}
+	return hash.Sum(nil), nil
+}
+
+// blockSizeFor はサイズが size のデータのブロックサイズを返す
+// ブロック数が上限を超える場合はブロックを大きくする
+func (s *AzureBlobBackupSession) blockSizeFor(size int64) (int64, error) {
+	blockSize := max(s.config.BlockSize, (size+maxAzureBlocks-1)/maxAzureBlocks)
+	if blockSize > maxAzureBlockSize {
+		return 0, fmt.Errorf("data of %d bytes exceeds the maximum blob size", size)
+	}
+	return blockSize, nil
+}
+
+// accessTier はBLOBに設定するアクセス層を返す（指定しない場合はnil）
+func (s *AzureBlobBackupSession) accessTier() *blob.AccessTier {
+	if s.config.AccessTier == "" {
+		return nil
+	}
+	tier := blob.AccessTier(s.config.AccessTier)
+	return &tier
+}
+
+// azureMetadataName はメタデータのキーをAzureで使える名前（C#の識別子）にする
+func azureMetadataName(key string) string {
+	return strings.ReplaceAll(key, "-", "_")
+}
+
+// azureMetadata はこのライブラリが記録するメタデータのキーをAzureで使える名前にする
+func azureMetadata(metadata map[string]*string) map[string]*string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	result := make(map[string]*string, len(metadata))
+	for key, value := range metadata {
+		result[azureMetadataName(key)] = value
+	}
+	return result
+}
+
+// SaveDir は srcDir 以下のファイルを relativePrefix 以下にアップロードする
+// 失敗したファイルがあっても残りの保存を続け、最後に *BackupError を返す
+func (s *AzureBlobBackupSession) SaveDir(ctx context.Context, srcDir, relativePrefix string, opts SaveDirOptions) error {
+	return walkDir(ctx, srcDir, relativePrefix, opts, func(entry dirEntry) *FileError {
+		var err error
+		if entry.linkTarget != "" {
+			err = s.saveSymlink(ctx, entry.path, entry.linkTarget, entry.relativePath)
+		} else {
+			err = s.SaveContext(ctx, entry.path, entry.relativePath)
+		}
+		if err == nil {
+			return nil
+		}
+		return &FileError{
+			RelativePath: entry.relativePath,
+			Destination:  s.blobName(entry.relativePath),
+			Err:          err,
+		}
+	})
+}
+
+// saveSymlink はシンボリックリンクを、リンク先をメタデータに持つ空のBLOBとしてアップロードする
+func (s *AzureBlobBackupSession) saveSymlink(ctx context.Context, linkPath, target, relativePath string) error {
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	name := s.blobName(relativePath)
+	metadata := map[string]*string{azureMetadataName(symlinkMetadataKey): &target}
+
+	start := time.Now()
+	err := s.upload(ctx, name, bytes.NewReader(nil), 0, metadata)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	s.results.add(FileResult{
+		SourcePath:   linkPath,
+		RelativePath: relativePath,
+		Destination:  name,
+		Duration:     time.Since(start),
+		Err:          err,
+	})
+
+	return err
+}
+
+// blobName は相対パスからBLOB名を構築する
+func (s *AzureBlobBackupSession) blobName(relativePath string) string {
+	return joinObjectKey(s.config.Prefix, relativePath)
+}
+
+// List は Prefix 以下で相対パスが prefix で始まるBLOBを相対パス順に返す
+// 一覧にもメタデータを含めるため、アップロード時に記録したSHA-256を Checksum に返す
+func (s *AzureBlobBackupSession) List(ctx context.Context, prefix string) ([]BackupInfo, error) {
+	namePrefix := s3KeyPrefix(s.config.Prefix)
+
+	var infos []BackupInfo
+	err := s.client.ListBlobs(ctx, namePrefix+prefix, func(item *container.BlobItem) {
+		if item.Name == nil || item.Properties == nil {
+			return
+		}
+		properties := item.Properties
+		var tier *string
+		if properties.AccessTier != nil {
+			tier = (*string)(properties.AccessTier)
+		}
+		infos = append(infos, azureBackupInfo(*item.Name, namePrefix, properties.ContentLength, properties.LastModified,
+			properties.ETag, tier, properties.ContentType, item.Metadata))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+	return infos, nil
+}
+
+// Stat はBLOBの情報を返す
+// Checksum はアップロード時にメタデータに記録したSHA-256（記録されていない場合は空）
+func (s *AzureBlobBackupSession) Stat(ctx context.Context, relativePath string) (BackupInfo, error) {
+	name := s.blobName(relativePath)
+	properties, err := s.client.GetProperties(ctx, name)
+	if isAzureNotFound(err) {
+		return BackupInfo{}, fmt.Errorf("%w: %s", ErrNotFound, relativePath)
+	}
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to get blob properties %s: %w", name, err)
+	}
+	return azureBackupInfo(name, s3KeyPrefix(s.config.Prefix), properties.ContentLength, properties.LastModified,
+		properties.ETag, properties.AccessTier, properties.ContentType, properties.Metadata), nil
+}
+
+// azureBackupInfo はBLOBのプロパティとメタデータから BackupInfo を作る
+func azureBackupInfo(name, namePrefix string, size *int64, modTime *time.Time, etag *azcore.ETag, tier, contentType *string, metadata map[string]*string) BackupInfo {
+	info := BackupInfo{
+		RelativePath: strings.TrimPrefix(name, namePrefix),
+		Destination:  name,
+		Size:         -1,
+		Checksum:     objectMetadata(metadata, checksumMetadataKey),
+		Metadata:     map[string]string{},
+	}
+	if size != nil {
+		info.Size = *size
+	}
+	if modTime != nil {
+		info.ModTime = *modTime
+	}
+	if etag != nil {
+		info.Metadata["etag"] = string(*etag)
+	}
+	if tier != nil {
+		info.Metadata["access-tier"] = *tier
+	}
+	if contentType != nil {
+		info.Metadata["content-type"] = *contentType
+	}
+	for key, value := range metadata {
+		if value != nil {
+			info.Metadata["x-ms-meta-"+strings.ToLower(key)] = *value
+		}
+	}
+	return info
+}
+
+// isAzureNotFound はAzureがBLOBの不在を返したかどうかを判定する
+// HEADリクエストは本文を返さないため、ステータスコードでも判定する
+func isAzureNotFound(err error) bool {
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return true
+	}
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound
+}
+
+// beginSave は保存処理の開始を記録する
+// クローズ済みのセッションでは ErrSessionClosed を返す
+func (s *AzureBlobBackupSession) beginSave() error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	s.saves.Add(1)
+	return nil
+}
+
+// WaitForCompletion は他のゴルーチンで実行中の保存の完了を待つ
+func (s *AzureBlobBackupSession) WaitForCompletion(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.saves.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("upload timeout: %w", ctx.Err())
+	case <-done:
+		return nil
+	}
+}
+
+// Results はこれまでにアップロードしたファイルごとの結果を返す
+func (s *AzureBlobBackupSession) Results() []FileResult {
+	return s.results.snapshot()
+}
+
+// Close は実行中のアップロードをキャンセルし、それらが終了するまで待つ
+func (s *AzureBlobBackupSession) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+
+	s.cancel()
+	s.saves.Wait()
+	return nil
+}
+
+// validateAzureBlobConfig はAzure Blob Storageバックアップ設定を検証する
+func validateAzureBlobConfig(config AzureBlobBackupSessionConfig) error {
+	if config.Container == "" {
+		return fmt.Errorf("%w: container name is required", ErrInvalidConfig)
+	}
+
+	// 認証方法はちょうど1つ
+	methods := 0
+	for _, set := range []bool{config.AccountKey != "", config.SASToken != "", config.ConnectionString != ""} {
+		if set {
+			methods++
+		}
+	}
+	if methods != 1 {
+		return fmt.Errorf("%w: exactly one of account key, SAS token and connection string is required", ErrInvalidConfig)
+	}
+
+	if config.ConnectionString != "" && (config.AccountName != "" || config.ServiceURL != "") {
+		return fmt.Errorf("%w: account name and service URL cannot be used with a connection string", ErrInvalidConfig)
+	}
+
+	if config.AccountKey != "" && config.AccountName == "" {
+		return fmt.Errorf("%w: account name is required for shared key authentication", ErrInvalidConfig)
+	}
+
+	if config.SASToken != "" && config.AccountName == "" && config.ServiceURL == "" {
+		return fmt.Errorf("%w: account name or service URL is required", ErrInvalidConfig)
+	}
+
+	if config.AccessTier != "" && !slices.Contains(azureAccessTiers, blob.AccessTier(config.AccessTier)) {
+		return fmt.Errorf("%w: invalid access tier: %s", ErrInvalidConfig, config.AccessTier)
+	}
+
+	// ステージアップロード設定のチェック（0はデフォルト値）
+	if config.StagedUploadThreshold < 0 {
+		return fmt.Errorf("%w: staged upload threshold must not be negative", ErrInvalidConfig)
+	}
+
+	if config.BlockSize < 0 || config.BlockSize > maxAzureBlockSize {
+		return fmt.Errorf("%w: block size must be between 1 and %d bytes", ErrInvalidConfig, maxAzureBlockSize)
+	}
+
+	if config.BlockConcurrency < 0 {
+		return fmt.Errorf("%w: block concurrency must not be negative", ErrInvalidConfig)
+	}
+
+	return nil
+}
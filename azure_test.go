@@ -0,0 +1,437 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/stretchr/testify/require"
+)
+
+// mockAzureBlob はモックのコンテナに保存されたBLOB
+type mockAzureBlob struct {
+	data       []byte
+	metadata   map[string]*string
+	tier       *blob.AccessTier
+	contentMD5 []byte
+	modified   time.Time
+}
+
+// mockAzureBlobClient はメモリ上のコンテナに保存する AzureBlobAPI
+// Azureと同様に送られたMD5を検証し、メタデータのキーは先頭を大文字にして返す
+type mockAzureBlobClient struct {
+	mu        sync.Mutex
+	blobs     map[string]*mockAzureBlob
+	staged    map[string]map[string][]byte // BLOB名ごとのステージ済みブロック
+	uploads   int
+	stages    int
+	failStage int // 0でなければこの回数目のステージを失敗させる
+	missing   bool
+}
+
+func newMockAzureBlobClient() *mockAzureBlobClient {
+	return &mockAzureBlobClient{
+		blobs:  map[string]*mockAzureBlob{},
+		staged: map[string]map[string][]byte{},
+	}
+}
+
+func (c *mockAzureBlobClient) GetContainerProperties(ctx context.Context) error {
+	if c.missing {
+		return &azcore.ResponseError{StatusCode: http.StatusNotFound, ErrorCode: "ContainerNotFound"}
+	}
+	return nil
+}
+
+func (c *mockAzureBlobClient) Upload(ctx context.Context, blobName string, body io.ReadSeekCloser, options *blockblob.UploadOptions) error {
+	data, err := readValidated(ctx, body, options.TransactionalValidation)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uploads++
+	c.blobs[blobName] = &mockAzureBlob{
+		data:       data,
+		metadata:   canonicalMetadata(options.Metadata),
+		tier:       options.Tier,
+		contentMD5: options.HTTPHeaders.BlobContentMD5,
+		modified:   time.Now(),
+	}
+	return nil
+}
+
+func (c *mockAzureBlobClient) StageBlock(ctx context.Context, blobName, blockID string, body io.ReadSeekCloser, options *blockblob.StageBlockOptions) error {
+	data, err := readValidated(ctx, body, options.TransactionalValidation)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stages++
+	if c.stages == c.failStage {
+		return errors.New("injected stage failure")
+	}
+	if c.staged[blobName] == nil {
+		c.staged[blobName] = map[string][]byte{}
+	}
+	c.staged[blobName][blockID] = data
+	return nil
+}
+
+func (c *mockAzureBlobClient) CommitBlockList(ctx context.Context, blobName string, blockIDs []string, options *blockblob.CommitBlockListOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var data []byte
+	for _, id := range blockIDs {
+		if len(id) != len(blockIDs[0]) {
+			return errors.New("block IDs must have the same length")
+		}
+		block, ok := c.staged[blobName][id]
+		if !ok {
+			return fmt.Errorf("block %s is not staged", id)
+		}
+		data = append(data, block...)
+	}
+	delete(c.staged, blobName)
+	c.blobs[blobName] = &mockAzureBlob{
+		data:       data,
+		metadata:   canonicalMetadata(options.Metadata),
+		tier:       options.Tier,
+		contentMD5: options.HTTPHeaders.BlobContentMD5,
+		modified:   time.Now(),
+	}
+	return nil
+}
+
+func (c *mockAzureBlobClient) GetProperties(ctx context.Context, blobName string) (blob.GetPropertiesResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.blobs[blobName]
+	if !ok {
+		// HEADリクエストの404は本文を持たない
+		return blob.GetPropertiesResponse{}, &azcore.ResponseError{StatusCode: http.StatusNotFound}
+	}
+	size := int64(len(b.data))
+	return blob.GetPropertiesResponse{
+		ContentLength: &size,
+		ContentMD5:    b.contentMD5,
+		LastModified:  &b.modified,
+		AccessTier:    (*string)(b.tier),
+		Metadata:      b.metadata,
+	}, nil
+}
+
+func (c *mockAzureBlobClient) ListBlobs(ctx context.Context, prefix string, fn func(item *container.BlobItem)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := c.blobs[name]
+		size := int64(len(b.data))
+		fn(&container.BlobItem{
+			Name: &name,
+			Properties: &container.BlobProperties{
+				ContentLength: &size,
+				LastModified:  &b.modified,
+				AccessTier:    b.tier,
+			},
+			Metadata: b.metadata,
+		})
+	}
+	return nil
+}
+
+// readValidated は body を読み込み、送られたMD5と一致することを確認する
+func readValidated(ctx context.Context, body io.ReadSeekCloser, validation blob.TransferValidationType) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	sum, ok := validation.(blob.TransferValidationTypeMD5)
+	if !ok {
+		return nil, errors.New("missing transactional MD5")
+	}
+	actual := md5.Sum(data)
+	if !bytes.Equal(sum, actual[:]) {
+		return nil, errors.New("MD5 mismatch")
+	}
+	return data, nil
+}
+
+// canonicalMetadata はAzureのようにメタデータのキーの先頭を大文字にする
+func canonicalMetadata(metadata map[string]*string) map[string]*string {
+	result := make(map[string]*string, len(metadata))
+	for key, value := range metadata {
+		result[strings.ToUpper(key[:1])+key[1:]] = value
+	}
+	return result
+}
+
+func TestAzureBlobBackupSession(t *testing.T) {
+	newSession := func(t *testing.T, config AzureBlobBackupSessionConfig) (*AzureBlobBackupSession, *mockAzureBlobClient) {
+		client := newMockAzureBlobClient()
+		session, err := newAzureBlobBackupSession(config, client)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session, client
+	}
+
+	testConfig := func() AzureBlobBackupSessionConfig {
+		return AzureBlobBackupSessionConfig{
+			AccountName: "devstoreaccount1",
+			AccountKey:  "a2V5",
+			Container:   "backups",
+			Prefix:      "host1",
+		}
+	}
+
+	content := compressibleTestData(100) // 1ブロックに収まるサイズ
+	srcPath := filepath.Join(t.TempDir(), "app.log")
+	require.NoError(t, os.WriteFile(srcPath, content, 0644))
+	past := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(srcPath, past, past))
+	sum := sha256.Sum256(content)
+	contentMD5 := md5.Sum(content)
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 4*1024) // 64KB
+	largePath := filepath.Join(t.TempDir(), "large.bin")
+	require.NoError(t, os.WriteFile(largePath, large, 0644))
+	largeSum := sha256.Sum256(large)
+	largeMD5 := md5.Sum(large)
+
+	t.Run("Conformance", func(t *testing.T) {
+		testBackupSessionConformance(t, func(t *testing.T) BackupSession {
+			session, _ := newSession(t, testConfig())
+			return session
+		})
+	})
+
+	t.Run("Metadata", func(t *testing.T) {
+		config := testConfig()
+		config.AccessTier = "Cool"
+		session, client := newSession(t, config)
+
+		// 1ブロックに収まるファイルはContent-MD5とメタデータを付けて1回のリクエストでアップロードする
+		require.NoError(t, session.Save(srcPath, "logs/app.log"))
+
+		b := client.blobs["host1/logs/app.log"]
+		require.NotNil(t, b)
+		require.Equal(t, content, b.data)
+		require.Equal(t, contentMD5[:], b.contentMD5)
+		require.Equal(t, blob.AccessTierCool, *b.tier)
+		require.Equal(t, hex.EncodeToString(sum[:]), *b.metadata["Sha256"])
+		require.Equal(t, past.UTC().Format(time.RFC3339Nano), *b.metadata["Mtime"])
+		require.Equal(t, 1, client.uploads)
+		require.Zero(t, client.stages)
+
+		// 一覧でもメタデータのチェックサムとアクセス層を返す
+		infos, err := session.List(context.Background(), "")
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		require.Equal(t, "host1/logs/app.log", infos[0].Destination)
+		require.Equal(t, hex.EncodeToString(sum[:]), infos[0].Checksum)
+		require.Equal(t, "Cool", infos[0].Metadata["access-tier"])
+
+		info, err := session.Stat(context.Background(), "logs/app.log")
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+		require.Equal(t, hex.EncodeToString(sum[:]), info.Metadata["x-ms-meta-"+checksumMetadataKey])
+	})
+
+	t.Run("Staged", func(t *testing.T) {
+		config := testConfig()
+		config.StagedUploadThreshold = 16 * 1024
+		config.BlockSize = 10 * 1024
+		config.BlockConcurrency = 3
+		session, client := newSession(t, config)
+
+		// しきい値以上のファイルはブロックに分けてステージしてからコミットする
+		require.NoError(t, session.Save(largePath, "large.bin"))
+		require.NoError(t, session.Save(srcPath, "small.log"))
+
+		b := client.blobs["host1/large.bin"]
+		require.NotNil(t, b)
+		require.Equal(t, large, b.data)
+		require.Equal(t, largeMD5[:], b.contentMD5)
+		require.Equal(t, hex.EncodeToString(largeSum[:]), *b.metadata["Sha256"])
+		require.Equal(t, 7, client.stages)
+		require.Equal(t, 1, client.uploads)
+		require.Empty(t, client.staged)
+	})
+
+	t.Run("StageFailure", func(t *testing.T) {
+		config := testConfig()
+		config.StagedUploadThreshold = 16 * 1024
+		config.BlockSize = 10 * 1024
+		session, client := newSession(t, config)
+		client.failStage = 3
+
+		// ブロックのステージに失敗した場合はコミットしない
+		err := session.Save(largePath, "large.bin")
+		require.ErrorIs(t, err, ErrBackupFailed)
+		require.NotContains(t, client.blobs, "host1/large.bin")
+
+		err = session.SaveReader(context.Background(), bytes.NewReader(large), "stream.bin", -1)
+		require.NoError(t, err)
+		require.Equal(t, large, client.blobs["host1/stream.bin"].data)
+	})
+
+	t.Run("StreamBlocks", func(t *testing.T) {
+		config := testConfig()
+		config.BlockSize = 10 * 1024
+		config.BlockConcurrency = 2
+		session, client := newSession(t, config)
+
+		// 1ブロックに収まるストリームは1回のリクエストでアップロードする
+		dump := []byte("CREATE TABLE users;")
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(dump), "db/dump.sql", int64(len(dump))))
+		require.Equal(t, 1, client.uploads)
+
+		// 収まらないストリームはブロックをステージしてからコミットする
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(large), "db/large.bin", -1))
+		require.Equal(t, 7, client.stages)
+
+		b := client.blobs["host1/db/large.bin"]
+		require.Equal(t, large, b.data)
+		require.Equal(t, largeMD5[:], b.contentMD5)
+		require.Equal(t, hex.EncodeToString(largeSum[:]), *b.metadata["Sha256"])
+		require.Empty(t, client.staged)
+	})
+
+	t.Run("StreamBufferSize", func(t *testing.T) {
+		config := testConfig()
+		config.BlockSize = 64 * 1024 * 1024
+		session, client := newSession(t, config)
+
+		// 最初のバッファは sizeHint に合わせて確保し、ブロックサイズ分を確保しない
+		dump := []byte("CREATE TABLE users;")
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(dump), "db/dump.sql", int64(len(dump))))
+		runtime.ReadMemStats(&after)
+		require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(config.BlockSize)/4)
+		require.Equal(t, dump, client.blobs["host1/db/dump.sql"].data)
+
+		// sizeHint より大きいストリームはブロックサイズまで広げてから続きを読む
+		config.BlockSize = 10 * 1024
+		session, client = newSession(t, config)
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(large), "db/large.bin", 100))
+		require.Equal(t, large, client.blobs["host1/db/large.bin"].data)
+		require.Equal(t, 7, client.stages)
+	})
+
+	t.Run("SymlinkPreserve", func(t *testing.T) {
+		tree := createTestTree(t)
+		session, _ := newSession(t, testConfig())
+
+		// リンク先をメタデータに持つ空のBLOBとして保存する
+		err := session.SaveDir(context.Background(), tree, "tree", SaveDirOptions{Symlinks: SymlinkPreserve})
+		require.NoError(t, err)
+
+		info, err := session.Stat(context.Background(), "tree/link-file")
+		require.NoError(t, err)
+		require.Equal(t, int64(0), info.Size)
+		require.Equal(t, "a.txt", info.Metadata["x-ms-meta-"+azureMetadataName(symlinkMetadataKey)])
+	})
+
+	t.Run("CancelledStream", func(t *testing.T) {
+		config := testConfig()
+		config.BlockSize = 10 * 1024
+		session, client := newSession(t, config)
+
+		// キャンセルされたストリームはブロックをステージせず、BLOBも作らない
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := session.SaveReader(ctx, bytes.NewReader(large), "stream.bin", -1)
+		require.ErrorIs(t, err, ErrBackupFailed)
+		require.Empty(t, client.blobs)
+		require.Zero(t, client.stages)
+	})
+
+	t.Run("MissingContainer", func(t *testing.T) {
+		client := newMockAzureBlobClient()
+		client.missing = true
+		_, err := newAzureBlobBackupSession(testConfig(), client)
+		require.Error(t, err)
+	})
+
+	t.Run("BlockSize", func(t *testing.T) {
+		session, _ := newSession(t, testConfig())
+
+		// ブロック数が上限を超えないようにブロックを大きくする
+		blockSize, err := session.blockSizeFor(100 * 1024 * 1024)
+		require.NoError(t, err)
+		require.Equal(t, int64(defaultAzureBlockSize), blockSize)
+
+		size := int64(maxAzureBlocks)*defaultAzureBlockSize + 1
+		blockSize, err = session.blockSizeFor(size)
+		require.NoError(t, err)
+		require.Greater(t, blockSize, int64(defaultAzureBlockSize))
+		require.LessOrEqual(t, (size+blockSize-1)/blockSize, int64(maxAzureBlocks))
+
+		_, err = session.blockSizeFor(int64(maxAzureBlocks)*maxAzureBlockSize + 1)
+		require.Error(t, err)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		valid := testConfig()
+		for name, modify := range map[string]func(*AzureBlobBackupSessionConfig){
+			"NoContainer":       func(c *AzureBlobBackupSessionConfig) { c.Container = "" },
+			"NoCredentials":     func(c *AzureBlobBackupSessionConfig) { c.AccountKey = "" },
+			"TwoCredentials":    func(c *AzureBlobBackupSessionConfig) { c.SASToken = "sv=2023-01-03" },
+			"KeyWithoutAccount": func(c *AzureBlobBackupSessionConfig) { c.AccountName = "" },
+			"SASWithoutURL": func(c *AzureBlobBackupSessionConfig) {
+				c.AccountName, c.AccountKey, c.SASToken = "", "", "sv=2023-01-03"
+			},
+			"ConnectionAndURL": func(c *AzureBlobBackupSessionConfig) {
+				c.AccountKey, c.ConnectionString = "", "UseDevelopmentStorage=true"
+			},
+			"BadAccessTier":     func(c *AzureBlobBackupSessionConfig) { c.AccessTier = "Glacier" },
+			"NegativeThreshold": func(c *AzureBlobBackupSessionConfig) { c.StagedUploadThreshold = -1 },
+			"NegativeBlockSize": func(c *AzureBlobBackupSessionConfig) { c.BlockSize = -1 },
+			"HugeBlockSize":     func(c *AzureBlobBackupSessionConfig) { c.BlockSize = maxAzureBlockSize + 1 },
+			"NegativeWorkers":   func(c *AzureBlobBackupSessionConfig) { c.BlockConcurrency = -1 },
+		} {
+			t.Run(name, func(t *testing.T) {
+				config := valid
+				modify(&config)
+				_, err := NewAzureBlobBackupSession(config)
+				require.ErrorIs(t, err, ErrInvalidConfig)
+			})
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package safebackup
+
+import (
+	"io"
+	"math/bits"
+)
+
+const (
+	// defaultMinChunkSize はチャンクのデフォルトの最小サイズ
+	defaultMinChunkSize = 256 * 1024
+
+	// defaultAvgChunkSize はチャンクのデフォルトの平均サイズ
+	defaultAvgChunkSize = 1024 * 1024
+
+	// defaultMaxChunkSize はチャンクのデフォルトの最大サイズ
+	defaultMaxChunkSize = 4 * 1024 * 1024
+
+	// maxChunkSizeLimit はチャンクの最大サイズの上限（チャンクはメモリ上で扱うため）
+	maxChunkSizeLimit = 64 * 1024 * 1024
+
+	// minChunkSizeLimit はチャンクの最小サイズの下限
+	minChunkSizeLimit = 64
+)
+
+// gearTable は内容定義チャンキングのローリングハッシュ（Gear）に使う乱数表
+// 同じ内容が同じチャンクに分割されるように、固定のシードから生成する（変更してはならない）
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x5afeb4c4a9d1e3f7)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker はReaderの内容を内容定義チャンキングで分割する
+// 境界は直前の数十バイトの内容だけで決まるため、ファイルの途中にデータが挿入されても
+// 挿入箇所以外のチャンクは変わらない
+type chunker struct {
+	r       io.Reader
+	buf     []byte
+	start   int // buf の未処理部分の先頭
+	end     int // buf の有効なデータの末尾
+	eof     bool
+	minSize int
+	maxSize int
+	mask    uint64 // ハッシュの上位ビットがすべて0になった位置を境界とする
+}
+
+// newChunker は設定のチャンクサイズで r を分割する chunker を作成する
+func newChunker(r io.Reader, config DedupConfig) *chunker {
+	maxSize := config.maxChunkSize()
+	return &chunker{
+		r:       r,
+		buf:     make([]byte, maxSize),
+		minSize: config.minChunkSize(),
+		maxSize: maxSize,
+		mask:    ^uint64(0) << (64 - (bits.Len(uint(config.avgChunkSize())) - 1)),
+	}
+}
+
+// next は次のチャンクを返す（すべて読み終えたら io.EOF）
+// 返したスライスは次の呼び出しまでしか有効でない
+func (c *chunker) next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	size := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+size]
+	c.start += size
+	return chunk, nil
+}
+
+// fill は最大サイズのチャンクを切り出せるだけのデータをバッファに読み込む
+func (c *chunker) fill() error {
+	if c.eof || c.end-c.start >= c.maxSize {
+		return nil
+	}
+
+	// 未処理のデータを先頭に寄せる
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut は data の先頭から切り出すチャンクのサイズを返す
+func (c *chunker) cut(data []byte) int {
+	if len(data) <= c.minSize {
+		return len(data)
+	}
+	if len(data) > c.maxSize {
+		data = data[:c.maxSize]
+	}
+
+	var hash uint64
+	for i := c.minSize; i < len(data); i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
@@ -0,0 +1,175 @@
+package safebackup
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// compressionMetadataKey は圧縮形式を記録するS3のユーザーメタデータのキー
+	// Content-Encoding を使うとHTTPクライアントが透過的に展開してしまうことがあるため、メタデータで区別する
+	compressionMetadataKey = "compression"
+
+	// originalSizeMetadataKey は圧縮前のサイズを記録するS3のユーザーメタデータのキー
+	originalSizeMetadataKey = "original-size"
+
+	// entropySampleSize は圧縮済みかどうかを判定するために読むファイル先頭のサイズ
+	entropySampleSize = 64 * 1024
+
+	// minEntropySampleSize はこれより小さいファイルではエントロピーで判定しない
+	minEntropySampleSize = 1024
+
+	// maxCompressibleEntropy はこれを超えるエントロピー（ビット/バイト）のファイルを圧縮済みとみなす
+	maxCompressibleEntropy = 7.5
+)
+
+// compressionAlgorithms はサポートする圧縮形式（保存先を探す順）
+var compressionAlgorithms = []Compression{CompressionGzip, CompressionZstd}
+
+// compressedSuffixes はローカルで圧縮したファイルに付ける接尾辞
+// 利用者のファイル名と区別するため、一般的な拡張子の前に識別子を付ける
+var compressedSuffixes = map[Compression]string{
+	CompressionGzip: ".safebackup.gz",
+	CompressionZstd: ".safebackup.zst",
+}
+
+// compressedExtensions は圧縮済みの形式として圧縮しないファイルの拡張子
+var compressedExtensions = map[string]bool{
+	".gz": true, ".tgz": true, ".zst": true, ".xz": true, ".txz": true, ".bz2": true, ".lz4": true,
+	".lzma": true, ".br": true, ".zip": true, ".7z": true, ".rar": true, ".jar": true, ".apk": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".epub": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp3": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true, ".m4a": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".webm": true, ".avi": true,
+	".pdf": true, ".woff": true, ".woff2": true,
+}
+
+// algorithmFor はファイルに使う圧縮形式を返す
+// 拡張子またはファイル先頭のエントロピーから圧縮済みと判定したファイルは圧縮しない
+func (c CompressionConfig) algorithmFor(path string, file *os.File) Compression {
+	if c.Algorithm == CompressionNone {
+		return CompressionNone
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if compressedExtensions[ext] {
+		return CompressionNone
+	}
+	for _, skip := range c.SkipExtensions {
+		if strings.EqualFold(ext, skip) {
+			return CompressionNone
+		}
+	}
+
+	sample := make([]byte, entropySampleSize)
+	n, err := file.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		// 判定できない場合は圧縮する（圧縮済みでも内容が壊れることはない）
+		return c.Algorithm
+	}
+	if n >= minEntropySampleSize && entropy(sample[:n]) > maxCompressibleEntropy {
+		return CompressionNone
+	}
+	return c.Algorithm
+}
+
+// entropy はバイト列のシャノンエントロピー（ビット/バイト）を返す
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+
+	var result float64
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(len(data))
+		result -= p * math.Log2(p)
+	}
+	return result
+}
+
+// newCompressor は w に圧縮して書き込むWriterを返す
+// 書き込み後に Close して圧縮を完了させること
+func newCompressor(w io.Writer, algorithm Compression, level int) (io.WriteCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+
+	case CompressionZstd:
+		var opts []zstd.EOption
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	return nil, fmt.Errorf("%w: unknown compression: %s", ErrInvalidConfig, algorithm)
+}
+
+// newDecompressor は r を展開して読み出すReaderを返す
+// 圧縮していない場合は r をそのまま読み出す
+func newDecompressor(r io.Reader, algorithm Compression) (io.ReadCloser, error) {
+	switch algorithm {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+
+	case CompressionGzip:
+		return gzip.NewReader(r)
+
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression: %s", algorithm)
+}
+
+// countingWriter は書き込んだバイト数を数えるWriter
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write は w に書き込み、書き込んだバイト数を加算する
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// validateCompressionConfig は圧縮の設定を検証する
+func validateCompressionConfig(config CompressionConfig) error {
+	switch config.Algorithm {
+	case CompressionNone:
+		return nil
+
+	case CompressionGzip:
+		if config.Level < gzip.HuffmanOnly || config.Level > gzip.BestCompression {
+			return fmt.Errorf("%w: gzip level must be between %d and %d", ErrInvalidConfig, gzip.HuffmanOnly, gzip.BestCompression)
+		}
+
+	case CompressionZstd:
+		if config.Level < 0 || config.Level > 22 {
+			return fmt.Errorf("%w: zstd level must be between 1 and 22", ErrInvalidConfig)
+		}
+
+	default:
+		return fmt.Errorf("%w: unknown compression: %s", ErrInvalidConfig, config.Algorithm)
+	}
+
+	return nil
+}
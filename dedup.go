@@ -0,0 +1,351 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// chunkDirName は重複排除モードでチャンクを保存するディレクトリ（S3ではキーの一部）の名前
+	chunkDirName = ".safebackup-chunks"
+
+	// manifestFormat はマニフェストの形式を表す識別子
+	manifestFormat = "safebackup-manifest/1"
+)
+
+// manifestHeader はマニフェストの先頭のバイト列
+// 大きなファイルを読み込まずにマニフェストかどうかを判定するために使う
+var manifestHeader = []byte(`{"format":"` + manifestFormat + `"`)
+
+// errNotManifest は読み込んだファイルがマニフェストでない場合のエラー
+var errNotManifest = errors.New("not a dedup manifest")
+
+// manifest は重複排除モードで relativePath に保存する、ファイルを構成するチャンクの一覧
+// Format は manifestHeader と一致するように最初のフィールドにする
+type manifest struct {
+	Format   string          `json:"format"`
+	Size     int64           `json:"size"`   // ファイル全体のサイズ
+	Checksum string          `json:"sha256"` // ファイル全体のSHA-256
+	ModTime  time.Time       `json:"mtime"`  // 元のファイルの更新日時
+	Mode     fs.FileMode     `json:"mode"`   // 元のファイルの権限
+	Chunks   []manifestChunk `json:"chunks"`
+}
+
+// manifestChunk はマニフェストに記録する1チャンク分の情報
+type manifestChunk struct {
+	Hash string `json:"hash"` // チャンクのSHA-256（チャンクの名前）
+	Size int64  `json:"size"`
+}
+
+// readManifest は r からマニフェストを読み込む
+// マニフェストでない場合は先頭だけを読んで errNotManifest を返す
+func readManifest(r io.Reader) (*manifest, error) {
+	header := make([]byte, len(manifestHeader))
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errNotManifest
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header, manifestHeader) {
+		return nil, errNotManifest
+	}
+
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(append(header, rest...), &m); err != nil {
+		return nil, fmt.Errorf("%w: %w", errNotManifest, err)
+	}
+	return &m, nil
+}
+
+// chunkStore は重複排除モードのチャンクとマニフェストの保存先
+// チャンクはハッシュ名で一度だけ保存し、マニフェストは relativePath に保存する
+type chunkStore interface {
+	// hasChunk は指定したサイズのチャンクが保存済みかどうかを返す
+	hasChunk(ctx context.Context, hash string, size int64) (bool, error)
+	putChunk(ctx context.Context, hash string, data []byte) error
+	getChunk(ctx context.Context, hash string) ([]byte, error)
+	deleteChunk(ctx context.Context, hash string) error
+
+	// listChunks は保存されているチャンクのハッシュとサイズを fn に渡す
+	listChunks(ctx context.Context, fn func(hash string, size int64)) error
+
+	putManifest(ctx context.Context, relativePath string, m *manifest) error
+
+	// getManifest はマニフェストを返す
+	// 存在しない場合は ErrNotFound、マニフェストでない場合は errNotManifest を返す
+	getManifest(ctx context.Context, relativePath string) (*manifest, error)
+
+	// listManifests は保存されているすべてのマニフェストを fn に渡す
+	// マニフェストでないファイル（シンボリックリンク等）は含まない
+	listManifests(ctx context.Context, fn func(relativePath string, m *manifest) error) error
+}
+
+// chunkPath はチャンクの保存先の相対パスを返す
+// 1つのディレクトリにファイルが集中しないように、ハッシュの先頭2文字で分ける
+func chunkPath(hash string) string {
+	return path.Join(chunkDirName, hash[:2], hash)
+}
+
+// isChunkPath は相対パスがチャンクの保存先に含まれるかどうかを判定する
+func isChunkPath(relativePath string) bool {
+	relativePath = filepath.ToSlash(filepath.Clean(relativePath))
+	return relativePath == chunkDirName || strings.HasPrefix(relativePath, chunkDirName+"/")
+}
+
+// saveDeduplicated は r の内容をチャンクに分割して保存し、relativePath にマニフェストを書き込む
+// srcInfo はファイルから保存する場合のファイル情報（Readerの場合はnil）で、
+// 増分バックアップでは既存のマニフェストと比較して同じ内容ならマニフェストを書き込まない
+// 戻り値の written は新たに保存したチャンクの合計サイズ
+func saveDeduplicated(ctx context.Context, store chunkStore, config DedupConfig, incremental IncrementalMode, r io.Reader, srcInfo os.FileInfo, relativePath string) (copyResult, error) {
+	if isChunkPath(relativePath) {
+		return copyResult{}, fmt.Errorf("%w: %s is reserved for dedup chunks", ErrInvalidConfig, chunkDirName)
+	}
+
+	m := &manifest{
+		Format:  manifestFormat,
+		ModTime: time.Now(),
+		Mode:    streamFileMode,
+	}
+
+	var previous *manifest
+	if srcInfo != nil {
+		m.ModTime = srcInfo.ModTime()
+		m.Mode = srcInfo.Mode().Perm()
+
+		if incremental != IncrementalOff {
+			// 既存のマニフェストを読めない場合は変更ありとみなす
+			previous, _ = store.getManifest(ctx, relativePath)
+		}
+		if previous != nil && incremental == IncrementalSizeModTime &&
+			previous.Size == srcInfo.Size() && previous.ModTime.Equal(srcInfo.ModTime()) {
+			return copyResult{checksum: previous.Checksum, skipped: true}, nil
+		}
+	}
+
+	written, err := writeChunks(ctx, store, config, r, m)
+	if err != nil {
+		return copyResult{written: written}, err
+	}
+
+	// 内容が同じならチャンクはすべて保存済みのため、マニフェストも書き換えない
+	if previous != nil && incremental == IncrementalChecksum && previous.Checksum == m.Checksum {
+		return copyResult{written: written, checksum: m.Checksum, skipped: true}, nil
+	}
+
+	if err := store.putManifest(ctx, relativePath, m); err != nil {
+		return copyResult{written: written}, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return copyResult{written: written, checksum: m.Checksum}, nil
+}
+
+// writeChunks は r の内容をチャンクに分割し、保存されていないチャンクを保存してマニフェストに記録する
+// 新たに保存したチャンクの合計サイズを返す
+func writeChunks(ctx context.Context, store chunkStore, config DedupConfig, r io.Reader, m *manifest) (int64, error) {
+	hash := sha256.New()
+	chunks := newChunker(&contextReader{ctx: ctx, r: r}, config)
+
+	var written int64
+	for {
+		data, err := chunks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, fmt.Errorf("failed to read file: %w", err)
+		}
+		hash.Write(data)
+
+		sum := sha256.Sum256(data)
+		chunk := manifestChunk{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+
+		exists, err := store.hasChunk(ctx, chunk.Hash, chunk.Size)
+		if err != nil {
+			return written, fmt.Errorf("failed to check chunk %s: %w", chunk.Hash, err)
+		}
+		if !exists {
+			if err := store.putChunk(ctx, chunk.Hash, data); err != nil {
+				return written, fmt.Errorf("failed to write chunk %s: %w", chunk.Hash, err)
+			}
+			written += chunk.Size
+		}
+
+		m.Chunks = append(m.Chunks, chunk)
+		m.Size += chunk.Size
+	}
+
+	m.Checksum = hex.EncodeToString(hash.Sum(nil))
+	return written, nil
+}
+
+// chunkReader はマニフェストのチャンクを順に読み出すReader
+// 各チャンクはハッシュで検証し、一致しない場合は ErrIntegrityCheckFailed を返す
+type chunkReader struct {
+	ctx     context.Context
+	store   chunkStore
+	chunks  []manifestChunk // 未読のチャンク
+	current []byte          // 読み出し中のチャンクの残り
+}
+
+// openManifest はマニフェストが表すファイルの内容を、全体のサイズとチェックサムで検証しながら読み出すReaderを返す
+func openManifest(ctx context.Context, store chunkStore, m *manifest) io.Reader {
+	return newVerifyingReader(&chunkReader{ctx: ctx, store: store, chunks: m.Chunks}, m.Size, m.Checksum)
+}
+
+// Read は読み出し中のチャンクがなくなったら次のチャンクを取得する
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := r.chunks[0]
+
+		data, err := r.store.getChunk(r.ctx, chunk.Hash)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read chunk %s: %w", chunk.Hash, err)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != chunk.Size || hex.EncodeToString(sum[:]) != chunk.Hash {
+			return 0, fmt.Errorf("%w: chunk %s is corrupted", ErrIntegrityCheckFailed, chunk.Hash)
+		}
+
+		r.current = data
+		r.chunks = r.chunks[1:]
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// applyManifest はバックアップの情報をマニフェストが表すファイルの情報に置き換える
+func applyManifest(info *BackupInfo, m *manifest) {
+	info.Size = m.Size
+	info.ModTime = m.ModTime
+	info.Checksum = m.Checksum
+	if info.Metadata == nil {
+		info.Metadata = map[string]string{}
+	}
+	info.Metadata["mode"] = m.Mode.Perm().String()
+	info.Metadata["chunks"] = fmt.Sprint(len(m.Chunks))
+}
+
+// restoreManifest はマニフェストが表すファイルを localDest に書き出し、権限と更新日時を復元する
+func restoreManifest(ctx context.Context, store chunkStore, m *manifest, localDest string) error {
+	if err := writeRestored(ctx, openManifest(ctx, store, m), localDest, nil); err != nil {
+		return err
+	}
+	if err := os.Chmod(localDest, m.Mode.Perm()); err != nil {
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+	if err := os.Chtimes(localDest, m.ModTime, m.ModTime); err != nil {
+		return fmt.Errorf("failed to set file times: %w", err)
+	}
+	return nil
+}
+
+// collectGarbage はどのマニフェストからも参照されていないチャンクを削除する
+// マニフェストを読めなかった場合は、参照されているチャンクを削除しないように何も削除せずにエラーを返す
+func collectGarbage(ctx context.Context, store chunkStore) (GarbageCollectionReport, error) {
+	var report GarbageCollectionReport
+
+	referenced := make(map[string]bool)
+	err := store.listManifests(ctx, func(relativePath string, m *manifest) error {
+		report.Manifests++
+		for _, chunk := range m.Chunks {
+			referenced[chunk.Hash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to read manifests: %w", err)
+	}
+
+	type unreferencedChunk struct {
+		hash string
+		size int64
+	}
+	var unreferenced []unreferencedChunk
+	err = store.listChunks(ctx, func(hash string, size int64) {
+		report.Chunks++
+		if !referenced[hash] {
+			unreferenced = append(unreferenced, unreferencedChunk{hash: hash, size: size})
+		}
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to list chunks: %w", err)
+	}
+
+	for _, chunk := range unreferenced {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if err := store.deleteChunk(ctx, chunk.hash); err != nil {
+			return report, fmt.Errorf("failed to delete chunk %s: %w", chunk.hash, err)
+		}
+		report.DeletedChunks++
+		report.BytesFreed += chunk.size
+	}
+
+	return report, nil
+}
+
+// validateDedupConfig は重複排除モードの設定を検証する
+func validateDedupConfig(config DedupConfig) error {
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.MinChunkSize < 0 || config.AvgChunkSize < 0 || config.MaxChunkSize < 0 {
+		return fmt.Errorf("%w: chunk sizes must not be negative", ErrInvalidConfig)
+	}
+
+	minSize, avgSize, maxSize := config.minChunkSize(), config.avgChunkSize(), config.maxChunkSize()
+	if minSize < minChunkSizeLimit || minSize > avgSize || avgSize > maxSize || maxSize > maxChunkSizeLimit {
+		return fmt.Errorf("%w: chunk sizes must satisfy %d <= min <= avg <= max <= %d", ErrInvalidConfig, minChunkSizeLimit, maxChunkSizeLimit)
+	}
+
+	return nil
+}
+
+// minChunkSize はチャンクの最小サイズを返す
+func (c DedupConfig) minChunkSize() int {
+	if c.MinChunkSize > 0 {
+		return c.MinChunkSize
+	}
+	return defaultMinChunkSize
+}
+
+// avgChunkSize はチャンクの平均サイズを返す
+func (c DedupConfig) avgChunkSize() int {
+	if c.AvgChunkSize > 0 {
+		return c.AvgChunkSize
+	}
+	return defaultAvgChunkSize
+}
+
+// maxChunkSize はチャンクの最大サイズを返す
+func (c DedupConfig) maxChunkSize() int {
+	if c.MaxChunkSize > 0 {
+		return c.MaxChunkSize
+	}
+	return defaultMaxChunkSize
+}
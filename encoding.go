@@ -0,0 +1,206 @@
+package safebackup
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// storageEncoding は保存先に書き込む前に内容に施す変換（圧縮してから暗号化する）
+type storageEncoding struct {
+	compression Compression
+	level       int
+	keys        KeyProvider // nilの場合は暗号化しない
+}
+
+// suffix はローカルで変換したファイルに付ける接尾辞を返す
+func (e storageEncoding) suffix() string {
+	if e.keys != nil {
+		return encryptedSuffix
+	}
+	return compressedSuffixes[e.compression]
+}
+
+// copyEncoded は r の内容を enc で変換して w に書き込み、書き込んだ（変換後の）バイト数と暗号化に使った鍵のIDを返す
+func copyEncoded(ctx context.Context, w io.Writer, r io.Reader, enc storageEncoding) (int64, string, error) {
+	counter := &countingWriter{w: w}
+	var out io.Writer = counter
+	var closers []io.Closer // 内側（圧縮）から順に閉じる
+	keyID := ""
+
+	if enc.keys != nil {
+		dataKey, err := enc.keys.NewDataKey(ctx)
+		if err != nil {
+			return 0, "", err
+		}
+		encryptor, err := newEncryptingWriter(counter, dataKey, enc.compression)
+		if err != nil {
+			return counter.n, "", err
+		}
+		out, keyID = encryptor, dataKey.KeyID
+		closers = append(closers, encryptor)
+	}
+
+	if enc.compression != CompressionNone {
+		compressor, err := newCompressor(out, enc.compression, enc.level)
+		if err != nil {
+			return counter.n, "", err
+		}
+		out = compressor
+		closers = append([]io.Closer{compressor}, closers...)
+	}
+
+	if _, err := io.Copy(out, r); err != nil {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+		return counter.n, keyID, err
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			return counter.n, keyID, fmt.Errorf("failed to finish encoding: %w", err)
+		}
+	}
+	return counter.n, keyID, nil
+}
+
+// encodeToTempFile は r の内容を enc で変換した一時ファイルと、変換した内容のSHA-256、暗号化に使った鍵のIDを返す
+// ジャーナルで中断したアップロードを再開できるように、一時ファイルの更新日時は modTime にする
+// digest がnilでなければ変換した内容を書き込む（アップロードのチェックサムを同時に計算するため）
+// 一時ファイルは呼び出し側が閉じて削除すること
+func encodeToTempFile(ctx context.Context, r io.Reader, enc storageEncoding, modTime time.Time, digest io.Writer) (*os.File, string, string, error) {
+	tempFile, err := os.CreateTemp("", "safebackup-*"+tempFileSuffix)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	hash := sha256.New()
+	w := io.MultiWriter(tempFile, hash)
+	if digest != nil {
+		w = io.MultiWriter(w, digest)
+	}
+	_, keyID, err := copyEncoded(ctx, w, r, enc)
+	if err == nil {
+		err = os.Chtimes(tempFile.Name(), modTime, modTime)
+	}
+	if err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return nil, "", "", fmt.Errorf("failed to encode file: %w", err)
+	}
+
+	return tempFile, hex.EncodeToString(hash.Sum(nil)), keyID, nil
+}
+
+// encodingReader は r の内容を enc で変換して読み出すReaderを返す
+// 変換はゴルーチンで行うため、読み終えなかった場合も必ず Close すること
+// 暗号化に使う鍵のIDは変換を始める前に返す
+func encodingReader(ctx context.Context, r io.Reader, enc storageEncoding) (io.ReadCloser, string, error) {
+	keyID := ""
+	if enc.keys != nil {
+		dataKey, err := enc.keys.NewDataKey(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		enc.keys = fixedKeyProvider{KeyProvider: enc.keys, dataKey: dataKey}
+		keyID = dataKey.KeyID
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, _, err := copyEncoded(ctx, pw, r, enc)
+		_ = pw.CloseWithError(err)
+	}()
+	return pr, keyID, nil
+}
+
+// fixedKeyProvider は生成済みのデータ鍵を返す KeyProvider
+type fixedKeyProvider struct {
+	KeyProvider
+	dataKey DataKey
+}
+
+// NewDataKey は生成済みのデータ鍵を返す
+func (p fixedKeyProvider) NewDataKey(ctx context.Context) (DataKey, error) {
+	return p.dataKey, nil
+}
+
+// openBackupContent は保存した内容を元に戻して読み出すReaderと、元の内容の圧縮形式と暗号化に使った鍵のIDを返す
+// 暗号化した内容は復号してからヘッダーに記録した圧縮形式で展開するため、algorithm は暗号化していない場合のみ使う
+func openBackupContent(ctx context.Context, r io.Reader, algorithm Compression, encrypted bool, keys KeyProvider) (io.ReadCloser, Compression, string, error) {
+	keyID := ""
+	if encrypted {
+		decrypted, err := newDecryptingReader(ctx, bufio.NewReader(r), keys)
+		if err != nil {
+			return nil, CompressionNone, "", err
+		}
+		r, algorithm, keyID = decrypted, decrypted.header.Compression, decrypted.header.KeyID
+	}
+
+	decompressed, err := newDecompressor(r, algorithm)
+	if err != nil {
+		return nil, CompressionNone, "", err
+	}
+	return decompressed, algorithm, keyID, nil
+}
+
+// splitBackupSuffix は変換したファイルの名前から接尾辞を取り除き、圧縮形式と暗号化したかどうかとともに返す
+// 暗号化したファイルの圧縮形式はヘッダーに記録しているため、CompressionNone を返す
+// 変換したファイルでない場合は名前をそのまま返す
+func splitBackupSuffix(name string) (string, Compression, bool) {
+	if strings.HasSuffix(name, encryptedSuffix) && len(name) > len(encryptedSuffix) {
+		return strings.TrimSuffix(name, encryptedSuffix), CompressionNone, true
+	}
+	for _, algorithm := range compressionAlgorithms {
+		suffix := compressedSuffixes[algorithm]
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return strings.TrimSuffix(name, suffix), algorithm, false
+		}
+	}
+	return name, CompressionNone, false
+}
+
+// backupVariants は path に保存したバックアップが取りうるパスを探す順に返す
+func backupVariants(path string) []string {
+	variants := []string{path}
+	for _, algorithm := range compressionAlgorithms {
+		variants = append(variants, path+compressedSuffixes[algorithm])
+	}
+	return append(variants, path+encryptedSuffix)
+}
+
+// findBackupVariant は path に保存したバックアップの実際のパスと、圧縮形式、暗号化したかどうかを返す
+// 変換せずに保存したファイル、圧縮形式の接尾辞を付けたファイル、暗号化の接尾辞を付けたファイルの順に探し、
+// どれも存在しない場合は path をそのまま返す
+func findBackupVariant(path string) (string, Compression, bool) {
+	if _, err := os.Lstat(path); err == nil {
+		return path, CompressionNone, false
+	}
+	for _, variant := range backupVariants(path)[1:] {
+		if info, err := os.Lstat(variant); err == nil && info.Mode().IsRegular() {
+			_, algorithm, encrypted := splitBackupSuffix(variant)
+			return variant, algorithm, encrypted
+		}
+	}
+	return path, CompressionNone, false
+}
+
+// removeBackupVariants は path に保存したバックアップのうち、keep 以外の形式のファイルを削除する
+// 圧縮や暗号化の設定を変えて保存し直したときに、古い形式のファイルとそのサイドカーが残らないようにする
+func removeBackupVariants(path, keep string) {
+	for _, variant := range backupVariants(path) {
+		if variant == keep {
+			continue
+		}
+		if info, err := os.Lstat(variant); err == nil && !info.IsDir() {
+			_ = os.Remove(variant)
+			removeSidecar(variant)
+		}
+	}
+}
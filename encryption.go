@@ -0,0 +1,468 @@
+package safebackup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+const (
+	// encryptedSuffix はローカルで暗号化したファイルに付ける接尾辞
+	// 圧縮形式はヘッダーに記録するため、圧縮した場合も同じ接尾辞を使う
+	encryptedSuffix = ".safebackup.enc"
+
+	// encryptionMagic は暗号化したファイルの先頭に置く識別子
+	encryptionMagic = "safebackup-encrypted/1\n"
+
+	// encryptionAlgorithm はヘッダーとメタデータに記録する暗号化方式
+	encryptionAlgorithm = "AES-256-GCM"
+
+	// encryptionChunkSize は1つの認証タグで保護する平文のサイズ
+	encryptionChunkSize = 64 * 1024
+
+	// maxEncryptionChunkSize は復号時に受け付けるチャンクのサイズの上限（チャンクはメモリ上で扱うため）
+	maxEncryptionChunkSize = 16 * 1024 * 1024
+
+	// maxEncryptionHeaderSize は読み込むヘッダーのサイズの上限
+	maxEncryptionHeaderSize = 64 * 1024
+
+	// dataKeySize はデータ鍵のサイズ（AES-256）
+	dataKeySize = 32
+
+	// encryptionMetadataKey は暗号化方式を記録するS3のユーザーメタデータのキー
+	encryptionMetadataKey = "encryption"
+
+	// encryptionMetadataValue は暗号化方式としてメタデータに記録する値
+	encryptionMetadataValue = "aes-256-gcm"
+
+	// encryptionKeyIDMetadataKey は暗号化に使った鍵のIDを記録するS3のユーザーメタデータのキー
+	encryptionKeyIDMetadataKey = "encryption-key-id"
+)
+
+// DataKey はファイルごとに生成するデータ鍵
+type DataKey struct {
+	// Key は平文のデータ鍵（32バイト）で、ファイルの内容の暗号化に使う
+	Key []byte
+
+	// KeyID はデータ鍵を暗号化した鍵のID（ヘッダーに記録され、復号時に UnwrapKey に渡される）
+	KeyID string
+
+	// WrappedKey は暗号化したデータ鍵（ヘッダーに記録され、復号時に UnwrapKey に渡される）
+	WrappedKey []byte
+}
+
+// KeyProvider はクライアント側の暗号化に使うデータ鍵を提供する
+// ファイルごとに新しいデータ鍵で暗号化し、暗号化したデータ鍵と鍵のIDをファイルのヘッダーに記録する
+// 鍵をローテーションしても、古い鍵のIDを UnwrapKey で扱える限り古いバックアップを復号できる
+type KeyProvider interface {
+	// NewDataKey は新しいファイルを暗号化するデータ鍵を返す
+	NewDataKey(ctx context.Context) (DataKey, error)
+
+	// UnwrapKey はヘッダーに記録された鍵のIDと暗号化したデータ鍵から、平文のデータ鍵を返す
+	// 鍵のIDが不明な場合は ErrKeyNotFound を返す
+	UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error)
+}
+
+// StaticKeyProvider は手元に保持するマスター鍵でデータ鍵を暗号化する KeyProvider
+// 新しいファイルは現在の鍵で暗号化し、それ以外の鍵は古いバックアップの復号に使う
+type StaticKeyProvider struct {
+	currentKeyID string
+	keys         map[string][]byte
+}
+
+// NewStaticKeyProvider はマスター鍵（鍵のID → 32バイトの鍵）から StaticKeyProvider を作成する
+// currentKeyID は新しいファイルの暗号化に使う鍵のID
+func NewStaticKeyProvider(currentKeyID string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	if _, ok := keys[currentKeyID]; !ok {
+		return nil, fmt.Errorf("%w: current key %q is not in keys", ErrInvalidConfig, currentKeyID)
+	}
+
+	copied := make(map[string][]byte, len(keys))
+	for keyID, key := range keys {
+		if keyID == "" {
+			return nil, fmt.Errorf("%w: empty key ID", ErrInvalidConfig)
+		}
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("%w: key %q must be %d bytes", ErrInvalidConfig, keyID, dataKeySize)
+		}
+		copied[keyID] = append([]byte{}, key...)
+	}
+
+	return &StaticKeyProvider{currentKeyID: currentKeyID, keys: copied}, nil
+}
+
+// NewKeyFileProvider は鍵ファイル（鍵のID → ファイルパス）から StaticKeyProvider を作成する
+// 鍵ファイルには32バイトの鍵をそのまま、または16進数かBase64で記録する
+func NewKeyFileProvider(currentKeyID string, files map[string]string) (*StaticKeyProvider, error) {
+	keys := make(map[string][]byte, len(files))
+	for keyID, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file %s: %w", path, err)
+		}
+		key, err := parseKeyFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key file %s: %w", ErrInvalidConfig, path, err)
+		}
+		keys[keyID] = key
+	}
+	return NewStaticKeyProvider(currentKeyID, keys)
+}
+
+// parseKeyFile は鍵ファイルの内容から鍵を取り出す
+func parseKeyFile(data []byte) ([]byte, error) {
+	if len(data) == dataKeySize {
+		return data, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == dataKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == dataKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key must be %d bytes, raw or encoded in hex or base64", dataKeySize)
+}
+
+// NewDataKey はランダムなデータ鍵を生成し、現在のマスター鍵で暗号化する
+func (p *StaticKeyProvider) NewDataKey(ctx context.Context) (DataKey, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return DataKey{}, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	aead, err := newGCM(p.keys[p.currentKeyID])
+	if err != nil {
+		return DataKey{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return DataKey{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	// 鍵のIDを追加データにして、別の鍵のIDに付け替えられないようにする
+	wrapped := aead.Seal(nonce, nonce, key, []byte(p.currentKeyID))
+	return DataKey{Key: key, KeyID: p.currentKeyID, WrappedKey: wrapped}, nil
+}
+
+// UnwrapKey は鍵のIDのマスター鍵でデータ鍵を復号する
+func (p *StaticKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error) {
+	master, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, keyID)
+	}
+
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: wrapped key is too short", ErrIntegrityCheckFailed)
+	}
+
+	nonce, sealed := wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to unwrap data key: %w", ErrIntegrityCheckFailed, err)
+	}
+	return key, nil
+}
+
+// KMSAPI defines the interface for KMS operations used by KMSKeyProvider
+type KMSAPI interface {
+	GenerateDataKeyWithContext(ctx aws.Context, input *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error)
+	DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error)
+}
+
+// KMSKeyProvider はAWS KMSでファイルごとのデータ鍵を生成・復号するエンベロープ暗号化の KeyProvider
+// マスター鍵はKMSの外に出ないため、バックアップの復号にはKMSの Decrypt 権限が必要になる
+type KMSKeyProvider struct {
+	client            KMSAPI
+	keyID             string
+	encryptionContext map[string]*string
+}
+
+// NewKMSKeyProvider はKMSの鍵（キーID、ARNまたはエイリアス）でデータ鍵を生成する KMSKeyProvider を作成する
+// encryptionContext は GenerateDataKey と Decrypt に渡す暗号化コンテキスト（オプション）
+func NewKMSKeyProvider(client KMSAPI, keyID string, encryptionContext map[string]string) (*KMSKeyProvider, error) {
+	if client == nil || keyID == "" {
+		return nil, fmt.Errorf("%w: KMS client and key ID are required", ErrInvalidConfig)
+	}
+	return &KMSKeyProvider{
+		client:            client,
+		keyID:             keyID,
+		encryptionContext: aws.StringMap(encryptionContext),
+	}, nil
+}
+
+// NewDataKey はKMSでデータ鍵を生成する
+// ヘッダーにはKMSが返した鍵のARNを記録する
+func (p *KMSKeyProvider) NewDataKey(ctx context.Context) (DataKey, error) {
+	output, err := p.client.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             aws.String(p.keyID),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+		EncryptionContext: p.encryptionContext,
+	})
+	if err != nil {
+		return DataKey{}, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	keyID := aws.StringValue(output.KeyId)
+	if keyID == "" {
+		keyID = p.keyID
+	}
+	return DataKey{Key: output.Plaintext, KeyID: keyID, WrappedKey: output.CiphertextBlob}, nil
+}
+
+// UnwrapKey はKMSでデータ鍵を復号する
+func (p *KMSKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error) {
+	output, err := p.client.DecryptWithContext(ctx, &kms.DecryptInput{
+		KeyId:             aws.String(keyID),
+		CiphertextBlob:    wrappedKey,
+		EncryptionContext: p.encryptionContext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	return output.Plaintext, nil
+}
+
+// encryptionHeader は暗号化したファイルのヘッダー
+type encryptionHeader struct {
+	Algorithm  string `json:"alg"`
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+	ChunkSize  int    `json:"chunk_size"`
+
+	// Compression は暗号化する前に圧縮した形式
+	Compression Compression `json:"compression,omitempty"`
+}
+
+// newGCM は鍵からAES-GCMを作成する
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("%w: data key must be %d bytes", ErrInvalidConfig, dataKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce はチャンクの番号と最後のチャンクかどうかからノンスを作る
+// データ鍵はファイルごとに異なるため、番号だけでノンスが重複しない
+// 最後のチャンクを区別することで、末尾を切り詰めた改ざんを検出する
+func chunkNonce(size int, counter uint64, last bool) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if last {
+		nonce[size-1] = 1
+	}
+	return nonce
+}
+
+// encryptingWriter は書き込んだ内容をチャンクごとに暗号化して w に書き込む
+type encryptingWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	aad     []byte // ヘッダー（追加データとしてすべてのチャンクを結びつける）
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// newEncryptingWriter はヘッダーを w に書き込み、dataKey で暗号化するWriterを返す
+// compression は暗号化する前に圧縮した形式で、ヘッダーに記録して展開に使う
+// 書き込み後に Close して最後のチャンクを書き込むこと
+func newEncryptingWriter(w io.Writer, dataKey DataKey, compression Compression) (*encryptingWriter, error) {
+	aead, err := newGCM(dataKey.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := json.Marshal(encryptionHeader{
+		Algorithm:   encryptionAlgorithm,
+		KeyID:       dataKey.KeyID,
+		WrappedKey:  dataKey.WrappedKey,
+		ChunkSize:   encryptionChunkSize,
+		Compression: compression,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var aad bytes.Buffer
+	aad.WriteString(encryptionMagic)
+	_ = binary.Write(&aad, binary.BigEndian, uint32(len(header)))
+	aad.Write(header)
+	if _, err := w.Write(aad.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		w:    w,
+		aead: aead,
+		aad:  aad.Bytes(),
+		buf:  make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+// Write はチャンクのサイズを超えた分を暗号化して書き込む
+// 最後のチャンクは Close で書き込むため、ちょうどチャンクのサイズになっても保留する
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close は最後のチャンクを暗号化して書き込む
+func (e *encryptingWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+// seal はバッファのチャンクを暗号化して書き込む
+func (e *encryptingWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.aead.NonceSize(), e.counter, last), e.buf, e.aad)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptingReader は暗号化したファイルをチャンクごとに検証しながら復号するReader
+type decryptingReader struct {
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	aad       []byte
+	header    encryptionHeader
+	sealed    []byte // 暗号化したチャンクの読み込みバッファ
+	plain     []byte // 復号して読み出し待ちの内容
+	counter   uint64
+	chunkSize int
+	done      bool
+}
+
+// newDecryptingReader はヘッダーを読み込み、データ鍵を復号して、内容を復号するReaderを返す
+func newDecryptingReader(ctx context.Context, r *bufio.Reader, keys KeyProvider) (*decryptingReader, error) {
+	var aad bytes.Buffer
+	if _, err := io.CopyN(&aad, r, int64(len(encryptionMagic))); err != nil || aad.String() != encryptionMagic {
+		return nil, fmt.Errorf("%w: missing encryption header", ErrIntegrityCheckFailed)
+	}
+
+	var length uint32
+	if err := binary.Read(io.TeeReader(r, &aad), binary.BigEndian, &length); err != nil || length > maxEncryptionHeaderSize {
+		return nil, fmt.Errorf("%w: invalid encryption header", ErrIntegrityCheckFailed)
+	}
+	headerData := make([]byte, length)
+	if _, err := io.ReadFull(r, headerData); err != nil {
+		return nil, fmt.Errorf("%w: truncated encryption header", ErrIntegrityCheckFailed)
+	}
+	aad.Write(headerData)
+
+	var header encryptionHeader
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, fmt.Errorf("%w: invalid encryption header: %w", ErrIntegrityCheckFailed, err)
+	}
+	if header.Algorithm != encryptionAlgorithm || header.ChunkSize <= 0 || header.ChunkSize > maxEncryptionChunkSize {
+		return nil, fmt.Errorf("%w: unsupported encryption %s", ErrIntegrityCheckFailed, header.Algorithm)
+	}
+
+	if keys == nil {
+		return nil, fmt.Errorf("%w: backup is encrypted with key %s but no KeyProvider is configured", ErrInvalidConfig, header.KeyID)
+	}
+	key, err := keys.UnwrapKey(ctx, header.KeyID, header.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{
+		r:         r,
+		aead:      aead,
+		aad:       aad.Bytes(),
+		header:    header,
+		sealed:    make([]byte, header.ChunkSize+aead.Overhead()),
+		chunkSize: header.ChunkSize,
+	}, nil
+}
+
+// Read は復号した内容を読み出す
+// 改ざんや切り詰めを検出した場合は ErrIntegrityCheckFailed を返す
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open は次のチャンクを読み込んで復号する
+func (d *decryptingReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err == io.EOF:
+		return fmt.Errorf("%w: encrypted data is truncated", ErrIntegrityCheckFailed)
+	case err != nil:
+		return err
+	default:
+		// ちょうどチャンクのサイズの場合は、続きがなければ最後のチャンク
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := d.aead.Open(d.sealed[:0:0], chunkNonce(d.aead.NonceSize(), d.counter, last), d.sealed[:n], d.aad)
+	if err != nil {
+		return fmt.Errorf("%w: failed to decrypt chunk %d", ErrIntegrityCheckFailed, d.counter)
+	}
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
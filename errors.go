@@ -1,6 +1,10 @@
 package safebackup
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	// ErrInvalidConfig は設定が無効な場合のエラー
@@ -11,4 +15,105 @@ var (
 
 	// ErrCleaningTimeout はクリーニングがタイムアウトした場合のエラー
 	ErrCleaningTimeout = errors.New("cleaning timeout")
+
+	// ErrQueueFull はアップロード待ち行列が満杯の場合のエラー
+	ErrQueueFull = errors.New("upload queue is full")
+
+	// ErrSessionClosed はクローズ済みのセッションを使用した場合のエラー
+	ErrSessionClosed = errors.New("session closed")
+
+	// ErrRestoreFailed はリストアに失敗した場合のエラー
+	ErrRestoreFailed = errors.New("restore failed")
+
+	// ErrNotFound は指定したバックアップが存在しない場合のエラー
+	ErrNotFound = errors.New("backup not found")
+
+	// ErrIntegrityCheckFailed は読み出した内容がバックアップ時のサイズやチェックサムと一致しない場合のエラー
+	ErrIntegrityCheckFailed = errors.New("integrity check failed")
+
+	// ErrKeyNotFound は暗号化したバックアップの鍵のIDが KeyProvider にない場合のエラー
+	ErrKeyNotFound = errors.New("encryption key not found")
+
+	// ErrInjectedFault は MemoryBackupSession が設定に従って保存を失敗させた場合のエラー
+	ErrInjectedFault = errors.New("injected fault")
 )
+
+// FileError は個々のファイルのバックアップまたはリストアの失敗を表すエラー
+type FileError struct {
+	// RelativePath はバックアップ先での相対パス
+	RelativePath string
+
+	// Destination は実際の保存先（S3キーなど、リストアの場合は書き込み先のローカルパス）
+	Destination string
+
+	// Err は失敗の原因となったエラー
+	Err error
+}
+
+// Error はエラーメッセージを返す
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s (%s): %v", e.RelativePath, e.Destination, e.Err)
+}
+
+// Unwrap は原因となったエラーを返す
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// BackupError は複数ファイルのバックアップ失敗をまとめたエラー
+// errors.Is(err, ErrBackupFailed) が真になり、Failures で個々の失敗を参照できる
+type BackupError struct {
+	Failures []*FileError
+}
+
+// Error はエラーメッセージを返す
+func (e *BackupError) Error() string {
+	msgs := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		msgs = append(msgs, f.Error())
+	}
+	return fmt.Sprintf("%v: %d file(s) failed: %s", ErrBackupFailed, len(e.Failures), strings.Join(msgs, "; "))
+}
+
+// Is は ErrBackupFailed との比較を可能にする
+func (e *BackupError) Is(target error) bool {
+	return target == ErrBackupFailed
+}
+
+// Unwrap は個々のファイルエラーを返す
+func (e *BackupError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		errs = append(errs, f)
+	}
+	return errs
+}
+
+// RestoreError は複数ファイルのリストア失敗をまとめたエラー
+// errors.Is(err, ErrRestoreFailed) が真になり、Failures で個々の失敗を参照できる
+type RestoreError struct {
+	Failures []*FileError
+}
+
+// Error はエラーメッセージを返す
+func (e *RestoreError) Error() string {
+	msgs := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		msgs = append(msgs, f.Error())
+	}
+	return fmt.Sprintf("%v: %d file(s) failed: %s", ErrRestoreFailed, len(e.Failures), strings.Join(msgs, "; "))
+}
+
+// Is は ErrRestoreFailed との比較を可能にする
+func (e *RestoreError) Is(target error) bool {
+	return target == ErrRestoreFailed
+}
+
+// Unwrap は個々のファイルエラーを返す
+func (e *RestoreError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		errs = append(errs, f)
+	}
+	return errs
+}
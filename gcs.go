@@ -0,0 +1,613 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const (
+	// defaultGCSResumableThreshold は再開可能アップロードで送るファイルのデフォルトのサイズ
+	defaultGCSResumableThreshold = 16 * 1024 * 1024
+
+	// defaultGCSChunkSize は再開可能アップロードで1回のリクエストで送るデフォルトのサイズ
+	defaultGCSChunkSize = 16 * 1024 * 1024
+
+	// gcsChunkAlignment は再開可能アップロードのチャンクサイズの単位
+	gcsChunkAlignment = 256 * 1024
+)
+
+// gcsStorageClasses はGCSのストレージクラス
+var gcsStorageClasses = []string{
+	"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE",
+	"MULTI_REGIONAL", "REGIONAL", "DURABLE_REDUCED_AVAILABILITY",
+}
+
+// gcsTempStorageClass は SaveReader の一時オブジェクトのストレージクラス
+const gcsTempStorageClass = "STANDARD"
+
+// GCSAPI defines the interface for Google Cloud Storage operations used by the backup session
+type GCSAPI interface {
+	BucketAttrs(ctx context.Context, bucket string) (*storage.BucketAttrs, error)
+	NewWriter(ctx context.Context, bucket string, attrs storage.ObjectAttrs, chunkSize int) GCSObjectWriter
+	ObjectAttrs(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error)
+	CopyObject(ctx context.Context, bucket, src string, attrs storage.ObjectAttrs) (*storage.ObjectAttrs, error)
+	DeleteObject(ctx context.Context, bucket, object string) error
+	Objects(ctx context.Context, bucket string, query *storage.Query) GCSObjectIterator
+	Close() error
+}
+
+// GCSObjectWriter はオブジェクトへの書き込み（*storage.Writer が実装する）
+// 書き込みを中止するには NewWriter に渡したコンテキストをキャンセルする
+type GCSObjectWriter interface {
+	io.Writer
+	Close() error
+	Attrs() *storage.ObjectAttrs
+}
+
+// GCSObjectIterator はオブジェクトの列挙（*storage.ObjectIterator が実装する）
+// 列挙の終わりでは iterator.Done を返す
+type GCSObjectIterator interface {
+	Next() (*storage.ObjectAttrs, error)
+}
+
+// gcsClient は *storage.Client を GCSAPI として使うためのアダプター
+type gcsClient struct {
+	client *storage.Client
+}
+
+// BucketAttrs はバケットの属性を返す
+func (c *gcsClient) BucketAttrs(ctx context.Context, bucket string) (*storage.BucketAttrs, error) {
+	return c.client.Bucket(bucket).Attrs(ctx)
+}
+
+// NewWriter は attrs.Name のオブジェクトへの書き込みを作成する
+// chunkSize が0の場合は1回のリクエストで、それ以外は chunkSize ごとの再開可能アップロードで送る
+// attrs.CRC32C が0でない場合はサーバーに送って内容を検証させる
+func (c *gcsClient) NewWriter(ctx context.Context, bucket string, attrs storage.ObjectAttrs, chunkSize int) GCSObjectWriter {
+	w := c.client.Bucket(bucket).Object(attrs.Name).NewWriter(ctx)
+	w.ObjectAttrs = attrs
+	w.ChunkSize = chunkSize
+	w.SendCRC32C = attrs.CRC32C != 0
+	return w
+}
+
+// ObjectAttrs はオブジェクトの属性を返す
+func (c *gcsClient) ObjectAttrs(ctx context.Context, bucket, object string) (*storage.ObjectAttrs, error) {
+	return c.client.Bucket(bucket).Object(object).Attrs(ctx)
+}
+
+// CopyObject は同じバケットの src を attrs.Name にコピーし、コピー先の属性を attrs のものにする
+func (c *gcsClient) CopyObject(ctx context.Context, bucket, src string, attrs storage.ObjectAttrs) (*storage.ObjectAttrs, error) {
+	b := c.client.Bucket(bucket)
+	copier := b.Object(attrs.Name).CopierFrom(b.Object(src))
+	copier.ObjectAttrs = attrs
+	return copier.Run(ctx)
+}
+
+// DeleteObject はオブジェクトを削除する
+func (c *gcsClient) DeleteObject(ctx context.Context, bucket, object string) error {
+	return c.client.Bucket(bucket).Object(object).Delete(ctx)
+}
+
+// Objects はクエリに一致するオブジェクトを列挙する
+func (c *gcsClient) Objects(ctx context.Context, bucket string, query *storage.Query) GCSObjectIterator {
+	return c.client.Bucket(bucket).Objects(ctx, query)
+}
+
+// Close はクライアントを閉じる
+func (c *gcsClient) Close() error {
+	return c.client.Close()
+}
+
+// GCSBackupSession はGoogle Cloud Storageへのバックアップセッション実装
+// オブジェクトはアップロードが完了した時点で作成されるため、保存先に書き込み途中のオブジェクトが現れることはない
+// 保存は呼び出し元のゴルーチンで行われ、複数のゴルーチンから同時に呼び出せる
+type GCSBackupSession struct {
+	config  GCSBackupSessionConfig
+	client  GCSAPI
+	results resultLog // ファイルごとの結果
+	ctx     context.Context
+	cancel  context.CancelFunc // ctx のキャンセル
+	closeMu sync.RWMutex       // closed の排他制御
+	closed  bool
+	saves   sync.WaitGroup // 実行中の保存処理
+}
+
+// NewGCSBackupSession はGCSバックアップセッションインスタンスを作成
+// 作成時にバケットにアクセスできることを確認する
+func NewGCSBackupSession(config GCSBackupSessionConfig) (*GCSBackupSession, error) {
+	// 設定の検証
+	if err := validateGCSConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	client, err := newGCSClient(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+
+	backupSession, err := newGCSBackupSession(config, client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return backupSession, nil
+}
+
+// newGCSBackupSession は client を使うGCSバックアップセッションを作成する
+func newGCSBackupSession(config GCSBackupSessionConfig, client GCSAPI) (*GCSBackupSession, error) {
+	if err := validateGCSConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	// デフォルト値の設定
+	if config.ResumableThreshold == 0 {
+		config.ResumableThreshold = defaultGCSResumableThreshold
+	}
+	if config.ChunkSize == 0 {
+		config.ChunkSize = defaultGCSChunkSize
+	}
+
+	// バケットの存在確認
+	if _, err := client.BucketAttrs(context.Background(), config.Bucket); err != nil {
+		return nil, fmt.Errorf("failed to access bucket %s: %w", config.Bucket, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &GCSBackupSession{
+		config: config,
+		client: client,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// newGCSClient は認証情報とエンドポイントからGCSクライアントを作成する
+// 認証情報が空の場合はアプリケーションのデフォルト認証情報を使う
+func newGCSClient(ctx context.Context, config GCSBackupSessionConfig) (*gcsClient, error) {
+	var options []option.ClientOption
+	switch {
+	case len(config.CredentialsJSON) > 0:
+		options = append(options, option.WithCredentialsJSON(config.CredentialsJSON))
+	case config.CredentialsFile != "":
+		options = append(options, option.WithCredentialsFile(config.CredentialsFile))
+	case config.Endpoint != "":
+		// エミュレーターは認証を必要としない
+		options = append(options, option.WithoutAuthentication())
+	}
+
+	// カスタムエンドポイントの設定（エミュレーター等）
+	if config.Endpoint != "" {
+		options = append(options, option.WithEndpoint(config.Endpoint))
+	}
+
+	client, err := storage.NewClient(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+	}
+	return &gcsClient{client: client}, nil
+}
+
+// Save はファイルをGCSにアップロードする
+func (s *GCSBackupSession) Save(localFilePath, relativePath string) error {
+	return s.SaveContext(context.Background(), localFilePath, relativePath)
+}
+
+// SaveContext はファイルをGCSにアップロードする
+// ctx またはセッションがキャンセルされるとアップロードを中止し、オブジェクトは作成されない
+func (s *GCSBackupSession) SaveContext(ctx context.Context, localFilePath, relativePath string) error {
+	// 入力検証
+	if localFilePath == "" || relativePath == "" {
+		return fmt.Errorf("%w: empty file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	key := s.objectKey(relativePath)
+	start := time.Now()
+	copied, err := s.uploadFile(ctx, localFilePath, key)
+	s.results.add(FileResult{
+		SourcePath:   localFilePath,
+		RelativePath: relativePath,
+		Destination:  key,
+		BytesWritten: copied.written,
+		Duration:     time.Since(start),
+		Checksum:     copied.checksum,
+		Err:          err,
+	})
+
+	return err
+}
+
+// uploadFile はファイルのチェックサムを計算してからアップロードする
+// 内容のCRC32Cをサーバーに送り、転送中に内容が変わった場合はサーバーにアップロードを拒否させる
+func (s *GCSBackupSession) uploadFile(ctx context.Context, filePath, key string) (copyResult, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return copyResult{}, fmt.Errorf("%w: source is not a regular file", ErrInvalidConfig)
+	}
+
+	// チェックサムを計算してから先頭に戻す
+	hash := sha256.New()
+	crc := crc32.New(crc32cTable)
+	if _, err := io.Copy(io.MultiWriter(hash, crc), &contextReader{ctx: ctx, r: file}); err != nil {
+		return copyResult{}, fmt.Errorf("%w: failed to read file: %w", ErrBackupFailed, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return copyResult{}, fmt.Errorf("failed to seek file: %w", err)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	attrs := s.objectAttrs(key, uploadMetadata(checksum, info.ModTime()))
+	attrs.CRC32C = crc.Sum32()
+
+	written, _, err := s.upload(ctx, &contextReader{ctx: ctx, r: file}, attrs, s.chunkSize(info.Size()))
+	if err != nil {
+		return copyResult{}, fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	return copyResult{written: written, checksum: checksum}, nil
+}
+
+// SaveReader はReaderから読み込んだデータをGCSにアップロードする
+// sizeHint はデータサイズが分かっている場合の値（不明な場合は負の値）で、再開可能アップロードを使うかの判断に使う
+// 一時オブジェクトにアップロードしてサーバーのCRC32Cを照合してから、SHA-256をメタデータに記録して保存先にコピーする
+func (s *GCSBackupSession) SaveReader(ctx context.Context, r io.Reader, relativePath string, sizeHint int64) error {
+	// 入力検証
+	if r == nil || relativePath == "" {
+		return fmt.Errorf("%w: empty reader or file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	key := s.objectKey(relativePath)
+	start := time.Now()
+	written, checksum, err := s.uploadStream(ctx, r, key, sizeHint)
+	result := FileResult{
+		RelativePath: relativePath,
+		Destination:  key,
+		Duration:     time.Since(start),
+		Checksum:     checksum,
+		Err:          err,
+	}
+	if err == nil {
+		result.BytesWritten = written
+	}
+	s.results.add(result)
+
+	return err
+}
+
+// uploadStream は r の内容をアップロードし、書き込んだサイズとSHA-256チェックサムを返す
+// 内容は一時オブジェクトに書き込み、サーバーが計算したCRC32Cが送った内容のものと一致した場合だけ、
+// SHA-256をメタデータに記録しながら保存先にコピーする。一時オブジェクトは最後に削除する
+// 一致しない場合は ErrIntegrityCheckFailed を返し、保存先の既存のオブジェクトには触れない
+func (s *GCSBackupSession) uploadStream(ctx context.Context, r io.Reader, key string, sizeHint int64) (int64, string, error) {
+	chunkSize := s.config.ChunkSize
+	if sizeHint >= 0 {
+		chunkSize = s.chunkSize(sizeHint)
+	}
+
+	tempKey, err := gcsTempObjectName(key)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+
+	hash := sha256.New()
+	crc := crc32.New(crc32cTable)
+	// 一時オブジェクトはすぐに削除するため、最低保存期間のないSTANDARDで書き込む
+	tempAttrs := s.objectAttrs(tempKey, nil)
+	tempAttrs.StorageClass = gcsTempStorageClass
+	written, temp, err := s.upload(ctx, io.TeeReader(&contextReader{ctx: ctx, r: r}, io.MultiWriter(hash, crc)), tempAttrs, chunkSize)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	defer func() {
+		_ = s.client.DeleteObject(context.WithoutCancel(ctx), s.config.Bucket, tempKey)
+	}()
+
+	if temp == nil || temp.CRC32C != crc.Sum32() {
+		return 0, "", fmt.Errorf("%w: %w: CRC32C of object %s does not match", ErrBackupFailed, ErrIntegrityCheckFailed, key)
+	}
+
+	// 内容を読み終わるまでSHA-256が分からないため、コピーするときにメタデータに記録する
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	attrs := s.objectAttrs(key, uploadMetadata(checksum, time.Time{}))
+	object, err := s.client.CopyObject(ctx, s.config.Bucket, tempKey, attrs)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: failed to copy object %s to %s: %w", ErrBackupFailed, tempKey, key, err)
+	}
+	if object.CRC32C != temp.CRC32C {
+		return 0, "", fmt.Errorf("%w: %w: CRC32C of object %s does not match", ErrBackupFailed, ErrIntegrityCheckFailed, key)
+	}
+	return written, checksum, nil
+}
+
+// gcsTempObjectName は key と同じ階層に置く一時オブジェクトの名前を返す
+func gcsTempObjectName(key string) (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate temporary object name: %w", err)
+	}
+	dir, name := path.Split(key)
+	return dir + "." + name + "." + hex.EncodeToString(random) + tempFileSuffix, nil
+}
+
+// upload は r の内容をオブジェクトとして書き込み、書き込んだサイズと作成されたオブジェクトの属性を返す
+// 失敗した場合は書き込みを中止するため、途中までの内容がオブジェクトになることはない
+func (s *GCSBackupSession) upload(ctx context.Context, r io.Reader, attrs storage.ObjectAttrs, chunkSize int) (int64, *storage.ObjectAttrs, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := s.client.NewWriter(ctx, s.config.Bucket, attrs, chunkSize)
+	written, err := io.Copy(w, r)
+	if err != nil {
+		// コンテキストをキャンセルしてからクローズすると書き込みは中止される
+		cancel()
+		_ = w.Close()
+		return written, nil, fmt.Errorf("failed to upload object %s: %w", attrs.Name, err)
+	}
+	if err := w.Close(); err != nil {
+		return written, nil, fmt.Errorf("failed to upload object %s: %w", attrs.Name, err)
+	}
+	return written, w.Attrs(), nil
+}
+
+// objectAttrs はアップロードするオブジェクトの属性を返す
+func (s *GCSBackupSession) objectAttrs(key string, metadata map[string]*string) storage.ObjectAttrs {
+	attrs := storage.ObjectAttrs{
+		Name:         key,
+		StorageClass: s.config.StorageClass,
+	}
+	if len(metadata) > 0 {
+		attrs.Metadata = make(map[string]string, len(metadata))
+		for name, value := range metadata {
+			attrs.Metadata[name] = *value
+		}
+	}
+	return attrs
+}
+
+// chunkSize はサイズが size のデータを送るチャンクサイズを返す（0の場合は1回のリクエストで送る）
+func (s *GCSBackupSession) chunkSize(size int64) int {
+	if size < s.config.ResumableThreshold {
+		return 0
+	}
+	return s.config.ChunkSize
+}
+
+// SaveDir は srcDir 以下のファイルを relativePrefix 以下にアップロードする
+// 失敗したファイルがあっても残りの保存を続け、最後に *BackupError を返す
+func (s *GCSBackupSession) SaveDir(ctx context.Context, srcDir, relativePrefix string, opts SaveDirOptions) error {
+	return walkDir(ctx, srcDir, relativePrefix, opts, func(entry dirEntry) *FileError {
+		var err error
+		if entry.linkTarget != "" {
+			err = s.saveSymlink(ctx, entry.path, entry.linkTarget, entry.relativePath)
+		} else {
+			err = s.SaveContext(ctx, entry.path, entry.relativePath)
+		}
+		if err == nil {
+			return nil
+		}
+		return &FileError{
+			RelativePath: entry.relativePath,
+			Destination:  s.objectKey(entry.relativePath),
+			Err:          err,
+		}
+	})
+}
+
+// saveSymlink はシンボリックリンクを、リンク先をメタデータに持つ空のオブジェクトとしてアップロードする
+func (s *GCSBackupSession) saveSymlink(ctx context.Context, linkPath, target, relativePath string) error {
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	key := s.objectKey(relativePath)
+	attrs := s.objectAttrs(key, nil)
+	attrs.Metadata = map[string]string{symlinkMetadataKey: target}
+
+	start := time.Now()
+	_, _, err := s.upload(ctx, bytes.NewReader(nil), attrs, 0)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	s.results.add(FileResult{
+		SourcePath:   linkPath,
+		RelativePath: relativePath,
+		Destination:  key,
+		Duration:     time.Since(start),
+		Err:          err,
+	})
+
+	return err
+}
+
+// objectKey は相対パスからオブジェクト名を構築する
+func (s *GCSBackupSession) objectKey(relativePath string) string {
+	return joinObjectKey(s.config.Prefix, relativePath)
+}
+
+// List は Prefix 以下で相対パスが prefix で始まるオブジェクトを相対パス順に返す
+// GCSは一覧にもユーザーメタデータを含むため、アップロード時に記録したSHA-256を Checksum に返す
+func (s *GCSBackupSession) List(ctx context.Context, prefix string) ([]BackupInfo, error) {
+	keyPrefix := s3KeyPrefix(s.config.Prefix)
+
+	var infos []BackupInfo
+	objects := s.client.Objects(ctx, s.config.Bucket, &storage.Query{Prefix: keyPrefix + prefix})
+	for {
+		object, err := objects.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		// 書き込み途中の一時オブジェクトは含めない
+		if strings.HasSuffix(object.Name, "/") || strings.HasSuffix(object.Name, tempFileSuffix) {
+			continue
+		}
+		infos = append(infos, gcsBackupInfo(object, keyPrefix))
+	}
+	return infos, nil
+}
+
+// Stat はオブジェクトの情報を返す
+// Checksum はアップロード時にメタデータに記録したSHA-256（記録されていない場合は空）
+func (s *GCSBackupSession) Stat(ctx context.Context, relativePath string) (BackupInfo, error) {
+	key := s.objectKey(relativePath)
+	object, err := s.client.ObjectAttrs(ctx, s.config.Bucket, key)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return BackupInfo{}, fmt.Errorf("%w: %s", ErrNotFound, relativePath)
+	}
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to get object attributes %s: %w", key, err)
+	}
+	return gcsBackupInfo(object, s3KeyPrefix(s.config.Prefix)), nil
+}
+
+// gcsBackupInfo はオブジェクトの属性から BackupInfo を作る
+func gcsBackupInfo(object *storage.ObjectAttrs, keyPrefix string) BackupInfo {
+	metadata := map[string]string{
+		"etag":          object.Etag,
+		"storage-class": object.StorageClass,
+		"generation":    fmt.Sprint(object.Generation),
+	}
+	if object.ContentType != "" {
+		metadata["content-type"] = object.ContentType
+	}
+	for name, value := range object.Metadata {
+		metadata["x-goog-meta-"+strings.ToLower(name)] = value
+	}
+
+	return BackupInfo{
+		RelativePath: strings.TrimPrefix(object.Name, keyPrefix),
+		Destination:  object.Name,
+		Size:         object.Size,
+		ModTime:      object.Updated,
+		Checksum:     object.Metadata[checksumMetadataKey],
+		Metadata:     metadata,
+	}
+}
+
+// beginSave は保存処理の開始を記録する
+// クローズ済みのセッションでは ErrSessionClosed を返す
+func (s *GCSBackupSession) beginSave() error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	s.saves.Add(1)
+	return nil
+}
+
+// WaitForCompletion は他のゴルーチンで実行中の保存の完了を待つ
+func (s *GCSBackupSession) WaitForCompletion(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.saves.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("upload timeout: %w", ctx.Err())
+	case <-done:
+		return nil
+	}
+}
+
+// Results はこれまでにアップロードしたファイルごとの結果を返す
+func (s *GCSBackupSession) Results() []FileResult {
+	return s.results.snapshot()
+}
+
+// Close は実行中のアップロードを中止し、それらが終了するまで待ってからクライアントを閉じる
+func (s *GCSBackupSession) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+
+	s.cancel()
+	s.saves.Wait()
+
+	if err := s.client.Close(); err != nil {
+		return fmt.Errorf("failed to close GCS client: %w", err)
+	}
+	return nil
+}
+
+// validateGCSConfig はGCSバックアップ設定を検証する
+func validateGCSConfig(config GCSBackupSessionConfig) error {
+	if config.Bucket == "" {
+		return fmt.Errorf("%w: bucket name is required", ErrInvalidConfig)
+	}
+
+	if len(config.CredentialsJSON) > 0 && config.CredentialsFile != "" {
+		return fmt.Errorf("%w: credentials JSON and credentials file cannot both be specified", ErrInvalidConfig)
+	}
+
+	if config.StorageClass != "" && !slices.Contains(gcsStorageClasses, config.StorageClass) {
+		return fmt.Errorf("%w: invalid storage class: %s", ErrInvalidConfig, config.StorageClass)
+	}
+
+	// 再開可能アップロード設定のチェック（0はデフォルト値）
+	if config.ResumableThreshold < 0 {
+		return fmt.Errorf("%w: resumable threshold must not be negative", ErrInvalidConfig)
+	}
+
+	if config.ChunkSize < 0 || config.ChunkSize%gcsChunkAlignment != 0 {
+		return fmt.Errorf("%w: chunk size must be a multiple of %d bytes", ErrInvalidConfig, gcsChunkAlignment)
+	}
+
+	return nil
+}
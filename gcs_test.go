@@ -0,0 +1,283 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGCSServer はテスト用にプロセス内で動かすGCSのフェイクサーバーを起動する
+func newTestGCSServer(t *testing.T, buckets ...string) *fakestorage.Server {
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{
+		Scheme: "http",
+		Writer: io.Discard,
+	})
+	require.NoError(t, err)
+	t.Cleanup(server.Stop)
+
+	for _, bucket := range buckets {
+		server.CreateBucket(bucket)
+	}
+	return server
+}
+
+// testGCSConfig はフェイクサーバーに接続する設定を返す
+func testGCSConfig(server *fakestorage.Server, bucket string) GCSBackupSessionConfig {
+	return GCSBackupSessionConfig{
+		Bucket:   bucket,
+		Endpoint: server.URL() + "/storage/v1/",
+	}
+}
+
+// recordingGCSClient は書き込みの属性とチャンクサイズ、コピー先の属性を記録する GCSAPI
+// truncate が真の場合は各書き込みの最後の1バイトを落としてアップロード中の破損を模擬する
+type recordingGCSClient struct {
+	GCSAPI
+	mu         sync.Mutex
+	attrs      []storage.ObjectAttrs
+	chunkSizes []int
+	copies     []storage.ObjectAttrs
+	truncate   bool
+}
+
+func (c *recordingGCSClient) NewWriter(ctx context.Context, bucket string, attrs storage.ObjectAttrs, chunkSize int) GCSObjectWriter {
+	c.mu.Lock()
+	c.attrs = append(c.attrs, attrs)
+	c.chunkSizes = append(c.chunkSizes, chunkSize)
+	c.mu.Unlock()
+
+	w := c.GCSAPI.NewWriter(ctx, bucket, attrs, chunkSize)
+	if c.truncate {
+		return &truncatingGCSWriter{GCSObjectWriter: w}
+	}
+	return w
+}
+
+func (c *recordingGCSClient) CopyObject(ctx context.Context, bucket, src string, attrs storage.ObjectAttrs) (*storage.ObjectAttrs, error) {
+	c.mu.Lock()
+	c.copies = append(c.copies, attrs)
+	c.mu.Unlock()
+
+	return c.GCSAPI.CopyObject(ctx, bucket, src, attrs)
+}
+
+type truncatingGCSWriter struct {
+	GCSObjectWriter
+}
+
+func (w *truncatingGCSWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := w.GCSObjectWriter.Write(p[:len(p)-1]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func TestGCSBackupSession(t *testing.T) {
+	const bucket = "backups"
+	server := newTestGCSServer(t, bucket)
+
+	newSession := func(t *testing.T, config GCSBackupSessionConfig) *GCSBackupSession {
+		session, err := NewGCSBackupSession(config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+
+	// 記録用のクライアントを使うセッションを作成する
+	newRecordingSession := func(t *testing.T, config GCSBackupSessionConfig) (*GCSBackupSession, *recordingGCSClient) {
+		client, err := newGCSClient(context.Background(), config)
+		require.NoError(t, err)
+		recording := &recordingGCSClient{GCSAPI: client}
+		session, err := newGCSBackupSession(config, recording)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session, recording
+	}
+
+	content := compressibleTestData(1000)
+	srcPath := filepath.Join(t.TempDir(), "app.log")
+	require.NoError(t, os.WriteFile(srcPath, content, 0644))
+	past := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(srcPath, past, past))
+	sum := sha256.Sum256(content)
+
+	t.Run("Conformance", func(t *testing.T) {
+		testBackupSessionConformance(t, func(t *testing.T) BackupSession {
+			config := testGCSConfig(server, bucket)
+			config.Prefix = t.Name()
+			return newSession(t, config)
+		})
+	})
+
+	t.Run("Metadata", func(t *testing.T) {
+		config := testGCSConfig(server, bucket)
+		config.Prefix = "save"
+		session := newSession(t, config)
+
+		// チェックサムと更新日時はユーザーメタデータに記録し、一覧でも返す
+		require.NoError(t, session.Save(srcPath, "logs/app.log"))
+
+		object, err := server.GetObject(bucket, "save/logs/app.log")
+		require.NoError(t, err)
+		require.Equal(t, content, object.Content)
+		require.Equal(t, hex.EncodeToString(sum[:]), object.Metadata[checksumMetadataKey])
+		require.Equal(t, past.UTC().Format(time.RFC3339Nano), object.Metadata[modTimeMetadataKey])
+
+		infos, err := session.List(context.Background(), "")
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		require.Equal(t, "save/logs/app.log", infos[0].Destination)
+		require.Equal(t, hex.EncodeToString(sum[:]), infos[0].Checksum)
+
+		info, err := session.Stat(context.Background(), "logs/app.log")
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+		require.Equal(t, hex.EncodeToString(sum[:]), info.Metadata["x-goog-meta-"+checksumMetadataKey])
+	})
+
+	t.Run("Resumable", func(t *testing.T) {
+		config := testGCSConfig(server, bucket)
+		config.Prefix = "resumable"
+		config.ResumableThreshold = 256 * 1024
+		config.ChunkSize = 256 * 1024
+		config.StorageClass = "NEARLINE"
+		session, recording := newRecordingSession(t, config)
+
+		// しきい値以上のファイルは複数のチャンクに分けて送る
+		large := bytes.Repeat([]byte("0123456789abcdef"), 40*1024)
+		largePath := filepath.Join(t.TempDir(), "large.bin")
+		require.NoError(t, os.WriteFile(largePath, large, 0644))
+
+		require.NoError(t, session.Save(largePath, "large.bin"))
+		require.NoError(t, session.Save(srcPath, "small.log"))
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(large), "stream.bin", -1))
+
+		object, err := server.GetObject(bucket, "resumable/large.bin")
+		require.NoError(t, err)
+		require.Equal(t, large, object.Content)
+		object, err = server.GetObject(bucket, "resumable/stream.bin")
+		require.NoError(t, err)
+		require.Equal(t, large, object.Content)
+
+		require.Equal(t, []int{256 * 1024, 0, 256 * 1024}, recording.chunkSizes)
+		require.Equal(t, "NEARLINE", recording.attrs[0].StorageClass)
+		require.Equal(t, "NEARLINE", recording.attrs[1].StorageClass)
+		// ストリームの一時オブジェクトはSTANDARDで書き込み、コピー先だけを指定のクラスにする
+		require.True(t, strings.HasSuffix(recording.attrs[2].Name, tempFileSuffix))
+		require.Equal(t, "STANDARD", recording.attrs[2].StorageClass)
+		require.Len(t, recording.copies, 1)
+		require.Equal(t, "resumable/stream.bin", recording.copies[0].Name)
+		require.Equal(t, "NEARLINE", recording.copies[0].StorageClass)
+		// ファイルはCRC32Cを送ってサーバーに検証させる
+		require.Equal(t, crc32.Checksum(large, crc32cTable), recording.attrs[0].CRC32C)
+	})
+
+	t.Run("StreamTempObject", func(t *testing.T) {
+		config := testGCSConfig(server, bucket)
+		config.Prefix = "stream"
+		session := newSession(t, config)
+
+		dump := []byte("CREATE TABLE users;")
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(dump), "db/dump.sql", int64(len(dump))))
+
+		// SHA-256はアップロード後にメタデータに記録する
+		dumpSum := sha256.Sum256(dump)
+		info, err := session.Stat(context.Background(), "db/dump.sql")
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(dumpSum[:]), info.Checksum)
+
+		// 一時オブジェクトは残さない
+		objects, _, err := server.ListObjectsWithOptions(bucket, fakestorage.ListOptions{Prefix: "stream/"})
+		require.NoError(t, err)
+		require.Len(t, objects, 1)
+		require.Equal(t, "stream/db/dump.sql", objects[0].Name)
+	})
+
+	t.Run("IntegrityCheck", func(t *testing.T) {
+		config := testGCSConfig(server, bucket)
+		config.Prefix = "corrupt"
+		session, recording := newRecordingSession(t, config)
+
+		good := []byte("CREATE TABLE users;")
+		goodSum := sha256.Sum256(good)
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(good), "dump.sql", -1))
+
+		// サーバーのCRC32Cが送った内容と一致しない場合は保存先にコピーしない
+		recording.truncate = true
+		err := session.SaveReader(context.Background(), strings.NewReader("broken stream"), "dump.sql", -1)
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+		require.ErrorIs(t, err, ErrBackupFailed)
+		err = session.SaveReader(context.Background(), strings.NewReader("broken stream"), "new.sql", -1)
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+
+		// 以前のバックアップは残り、一時オブジェクトは削除されている
+		object, err := server.GetObject(bucket, "corrupt/dump.sql")
+		require.NoError(t, err)
+		require.Equal(t, good, object.Content)
+		require.Equal(t, hex.EncodeToString(goodSum[:]), object.Metadata[checksumMetadataKey])
+
+		_, err = session.Stat(context.Background(), "new.sql")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		objects, _, err := server.ListObjectsWithOptions(bucket, fakestorage.ListOptions{Prefix: "corrupt/"})
+		require.NoError(t, err)
+		require.Len(t, objects, 1)
+		require.Equal(t, "corrupt/dump.sql", objects[0].Name)
+	})
+
+	t.Run("SymlinkPreserve", func(t *testing.T) {
+		tree := createTestTree(t)
+		config := testGCSConfig(server, bucket)
+		config.Prefix = "dir"
+		session := newSession(t, config)
+
+		// リンク先をメタデータに持つ空のオブジェクトとして保存する
+		err := session.SaveDir(context.Background(), tree, "tree", SaveDirOptions{Symlinks: SymlinkPreserve})
+		require.NoError(t, err)
+
+		info, err := session.Stat(context.Background(), "tree/link-file")
+		require.NoError(t, err)
+		require.Equal(t, int64(0), info.Size)
+		require.Equal(t, "a.txt", info.Metadata["x-goog-meta-"+symlinkMetadataKey])
+	})
+
+	t.Run("MissingBucket", func(t *testing.T) {
+		_, err := NewGCSBackupSession(testGCSConfig(server, "missing"))
+		require.Error(t, err)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		valid := testGCSConfig(server, bucket)
+		for name, modify := range map[string]func(*GCSBackupSessionConfig){
+			"NoBucket":        func(c *GCSBackupSessionConfig) { c.Bucket = "" },
+			"BothCredentials": func(c *GCSBackupSessionConfig) { c.CredentialsJSON, c.CredentialsFile = []byte("{}"), "key.json" },
+			"BadStorageClass": func(c *GCSBackupSessionConfig) { c.StorageClass = "GLACIER" },
+			"NegativeThresh":  func(c *GCSBackupSessionConfig) { c.ResumableThreshold = -1 },
+			"UnalignedChunk":  func(c *GCSBackupSessionConfig) { c.ChunkSize = 1000 },
+			"NegativeChunk":   func(c *GCSBackupSessionConfig) { c.ChunkSize = -256 * 1024 },
+		} {
+			t.Run(name, func(t *testing.T) {
+				config := valid
+				modify(&config)
+				_, err := NewGCSBackupSession(config)
+				require.ErrorIs(t, err, ErrInvalidConfig)
+			})
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package safebackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// unchangedFile は保存先に同じ内容のファイルがあるかどうかを Incremental の方法で判定する
+// IncrementalChecksum の場合は計算したソースのチェックサムも返す
+// 圧縮・暗号化して保存したファイルは、IncrementalSizeModTime では更新日時のみを、IncrementalChecksum では元に戻した内容を比較する
+// 暗号化するかどうかの設定と保存先のファイルが一致しない場合と、保存先を読めない場合は変更ありとみなす
+func (s *LocalBackupSession) unchangedFile(ctx context.Context, srcPath string, srcInfo os.FileInfo, destPath string) (bool, string, error) {
+	if s.config.Incremental == IncrementalOff {
+		return false, "", nil
+	}
+
+	destPath, algorithm, encrypted := findBackupVariant(destPath)
+	destInfo, err := os.Stat(destPath)
+	if err != nil || !destInfo.Mode().IsRegular() || encrypted != (s.config.KeyProvider != nil) {
+		return false, "", nil
+	}
+	if algorithm == CompressionNone && !encrypted && destInfo.Size() != srcInfo.Size() {
+		return false, "", nil
+	}
+
+	if s.config.Incremental == IncrementalSizeModTime {
+		return destInfo.ModTime().Equal(srcInfo.ModTime()), "", nil
+	}
+
+	srcChecksum, err := fileChecksum(ctx, srcPath, CompressionNone, false, nil)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read source file: %w", err)
+	}
+	destChecksum, err := fileChecksum(ctx, destPath, algorithm, encrypted, s.config.KeyProvider)
+	if err != nil {
+		return false, "", nil
+	}
+	return srcChecksum == destChecksum, srcChecksum, nil
+}
+
+// fileChecksum はファイルの内容のSHA-256（16進数表記）を返す
+// 圧縮・暗号化したファイルは元に戻した内容のチェックサムを返す
+func fileChecksum(ctx context.Context, path string, algorithm Compression, encrypted bool, keys KeyProvider) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	r, _, _, err := openBackupContent(ctx, &contextReader{ctx: ctx, r: file}, algorithm, encrypted, keys)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// unchangedObject はS3に同じ内容のオブジェクトがあるかどうかを Incremental の方法で判定する
+// IncrementalSizeModTime では modTime を、IncrementalChecksum では checksum（SHA-256）と md5Sum を比較する
+// 圧縮・暗号化したオブジェクトはメタデータに記録した元のサイズと比較する
+// 暗号化するかどうかの設定とオブジェクトが一致しない場合は変更ありとみなす
+// SSE-Cで保存したオブジェクトの確認には options の鍵を使う
+// HeadObject に失敗した場合は、アップロードし直せば済むため変更ありとみなす
+func (s *S3BackupSession) unchangedObject(ctx context.Context, key string, options S3ObjectOptions, size int64, modTime time.Time, checksum, md5Sum string) bool {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = options.sse().customerKey()
+	output, err := s.s3Client.HeadObjectWithContext(ctx, input)
+	if err != nil || objectSize(output.Metadata, aws.Int64Value(output.ContentLength)) != size {
+		return false
+	}
+	encrypted := objectMetadata(output.Metadata, encryptionMetadataKey) != ""
+	if encrypted != (s.config.KeyProvider != nil) {
+		return false
+	}
+
+	switch s.config.Incremental {
+	case IncrementalSizeModTime:
+		stored, err := time.Parse(time.RFC3339Nano, objectMetadata(output.Metadata, modTimeMetadataKey))
+		return err == nil && stored.Equal(modTime)
+
+	case IncrementalChecksum:
+		if stored := objectChecksum(output.Metadata); stored != "" {
+			return stored == checksum
+		}
+		// チェックサムが記録されていない場合、変換していないシングルパートのETagは内容のMD5
+		etag := strings.Trim(aws.StringValue(output.ETag), "\"")
+		return !encodedObject(output.Metadata) && etag != "" && !strings.Contains(etag, "-") && etag == md5Sum
+	}
+	return false
+}
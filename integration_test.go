@@ -6,10 +6,12 @@ package safebackup
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -228,6 +230,108 @@ func TestS3BackupIntegrationMultipleFiles(t *testing.T) {
 	}
 }
 
+// azuriteAccountKey はAzuriteの開発用アカウント devstoreaccount1 の既知のキー
+const azuriteAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+func TestAzureBlobBackupIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	// DockerでAzuriteを起動
+	pool, err := dockertest.NewPool("")
+	require.NoError(t, err)
+
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "mcr.microsoft.com/azure-storage/azurite",
+		Tag:        "latest",
+		Cmd:        []string{"azurite-blob", "--blobHost", "0.0.0.0", "--skipApiVersionCheck"},
+	})
+	require.NoError(t, err)
+
+	defer func() {
+		if err := pool.Purge(resource); err != nil {
+			t.Logf("Could not purge resource: %s", err)
+		}
+	}()
+
+	// Azuriteが起動するまで待機し、テスト用コンテナを作成
+	serviceURL := fmt.Sprintf("http://localhost:%s/devstoreaccount1", resource.GetPort("10000/tcp"))
+	containerName := "test-backup-container"
+
+	credential, err := container.NewSharedKeyCredential("devstoreaccount1", azuriteAccountKey)
+	require.NoError(t, err)
+	containerClient, err := container.NewClientWithSharedKeyCredential(serviceURL+"/"+containerName, credential, nil)
+	require.NoError(t, err)
+
+	err = pool.Retry(func() error {
+		_, err := containerClient.Create(context.Background(), nil)
+		return err
+	})
+	require.NoError(t, err)
+
+	// AzureBlobBackupSessionのテスト
+	config := AzureBlobBackupSessionConfig{
+		AccountName:           "devstoreaccount1",
+		AccountKey:            azuriteAccountKey,
+		ServiceURL:            serviceURL,
+		Container:             containerName,
+		Prefix:                "backup/",
+		AccessTier:            "Cool",
+		StagedUploadThreshold: 4 * 1024 * 1024,
+		BlockSize:             1024 * 1024,
+	}
+
+	session, err := NewAzureBlobBackupSession(config)
+	require.NoError(t, err)
+	defer session.Close()
+
+	// しきい値未満のファイルは1回で、以上のファイルはブロックをステージしてアップロード
+	files := map[string]int64{
+		"integration/small.dat": 1 * 1024 * 1024,      // 1MB
+		"integration/large.dat": 10*1024*1024 + 12345, // 10MB強
+	}
+	for relativePath, size := range files {
+		testFile := createLargeTestFile(t, size)
+		err := session.Save(testFile, relativePath)
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err = session.WaitForCompletion(ctx)
+	cancel()
+	require.NoError(t, err)
+
+	// アップロードされたBLOBの確認
+	infos, err := session.List(context.Background(), "integration/")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	for _, info := range infos {
+		expectedSize, ok := files[info.RelativePath]
+		require.True(t, ok, "Unexpected blob: %s", info.RelativePath)
+		require.Equal(t, expectedSize, info.Size, "Size mismatch for %s", info.RelativePath)
+		require.NotEmpty(t, info.Checksum)
+		require.Equal(t, "Cool", info.Metadata["access-tier"])
+	}
+
+	// ストリームのアップロード
+	err = session.SaveReader(context.Background(), io.LimitReader(zeroReader{}, 3*1024*1024), "integration/stream.dat", -1)
+	require.NoError(t, err)
+
+	info, err := session.Stat(context.Background(), "integration/stream.dat")
+	require.NoError(t, err)
+	require.Equal(t, int64(3*1024*1024), info.Size)
+	require.Equal(t, "backup/integration/stream.dat", info.Destination)
+}
+
+// zeroReader は0を無限に返す io.Reader
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
 // createLargeTestFile は指定サイズの大きなテストファイルを作成
 func createLargeTestFile(t *testing.T, size int64) string {
 	file, err := os.CreateTemp("", "large_test_")
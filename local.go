@@ -2,24 +2,49 @@ package safebackup
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	cleaner "github.com/ideamans/go-backup-cleaner"
 )
 
+const (
+	// tempFileSuffix は書き込み途中の一時ファイルに付ける接尾辞
+	tempFileSuffix = ".safebackup-tmp"
+
+	// staleTempFileAge はこの時間以上更新されていない一時ファイルを残骸とみなす
+	staleTempFileAge = 10 * time.Minute
+
+	// streamFileMode はReaderから保存したファイルの権限
+	streamFileMode os.FileMode = 0644
+)
+
 // LocalBackupSession はローカルファイルシステムへのバックアップセッション実装
 type LocalBackupSession struct {
 	config           LocalBackupSessionConfig
 	accumulatedSize  int64          // 累積ファイルサイズ（atomic）
 	cleaningMutex    sync.Mutex     // クリーニング排他制御
 	isCleaningActive atomic.Bool    // クリーニング実行中フラグ
-	cleaningDone     chan struct{}  // クリーニング完了通知
 	wg               sync.WaitGroup // 全処理の完了待機
+	results          resultLog      // ファイルごとの結果
+	cleaningMu       sync.Mutex     // cleaningRecords の排他制御
+	cleaningRecords  []CleaningRecord
+	ctx              context.Context    // Close でキャンセルされるセッションのコンテキスト
+	cancel           context.CancelFunc // ctx のキャンセル
+	closeMu          sync.RWMutex       // closed の排他制御
+	closed           bool
+	saves            sync.WaitGroup // 実行中の保存処理
+	dedupMu          sync.RWMutex   // 重複排除モードの保存（読み取り）とチャンクの削除（書き込み）の排他制御
 }
 
 // NewLocalBackupSession はローカルバックアップセッションインスタンスを作成
@@ -35,19 +60,26 @@ func NewLocalBackupSession(config LocalBackupSessionConfig) (*LocalBackupSession
 		config.CheckInterval = 1024 * 1024 * 1024 // 1GB
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	session := &LocalBackupSession{
-		config:       config,
-		cleaningDone: make(chan struct{}),
+		config: config,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 
 	// ルートディレクトリが存在しない場合は作成
 	if err := os.MkdirAll(config.RootDir, 0755); err != nil {
+		cancel()
 		return nil, fmt.Errorf("failed to create root directory: %w", err)
 	}
 
+	// 前回のクラッシュ等で残った一時ファイルを削除
+	removeStaleTempFiles(config.RootDir, time.Now().Add(-staleTempFileAge))
+
 	// 初期容量チェックとクリーニング
 	diskInfo, err := config.CleaningConfig.DiskInfo.GetDiskUsage(config.RootDir)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("failed to get disk usage: %w", err)
 	}
 
@@ -58,7 +90,7 @@ func NewLocalBackupSession(config LocalBackupSessionConfig) (*LocalBackupSession
 
 		go func() {
 			defer session.wg.Done()
-			session.performCleaning()
+			session.performCleaning(CleaningTriggerSessionStart)
 		}()
 	}
 
@@ -67,45 +99,244 @@ func NewLocalBackupSession(config LocalBackupSessionConfig) (*LocalBackupSession
 
 // Save はファイルをバックアップディレクトリに保存する
 func (s *LocalBackupSession) Save(localFilePath, relativePath string) error {
+	return s.SaveContext(context.Background(), localFilePath, relativePath)
+}
+
+// SaveContext はファイルをバックアップディレクトリに保存する
+// ctx またはセッションがキャンセルされるとコピーを中断し、書き込み途中のファイルは残さない
+func (s *LocalBackupSession) SaveContext(ctx context.Context, localFilePath, relativePath string) error {
 	// 入力検証
 	if localFilePath == "" || relativePath == "" {
 		return fmt.Errorf("%w: empty file path", ErrInvalidConfig)
 	}
 
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	// 宛先パスの構築
+	destPath := filepath.Join(s.config.RootDir, relativePath)
+
+	start := time.Now()
+	var copied copyResult
+	var err error
+	if s.config.Dedup.Enabled {
+		copied, err = s.saveDeduplicatedFile(ctx, localFilePath, relativePath)
+	} else {
+		copied, err = s.saveFile(ctx, localFilePath, destPath)
+	}
+	if copied.destination != "" {
+		destPath = copied.destination
+	}
+	s.results.add(FileResult{
+		SourcePath:          localFilePath,
+		RelativePath:        relativePath,
+		Destination:         destPath,
+		BytesWritten:        copied.written,
+		Duration:            time.Since(start),
+		Checksum:            copied.checksum,
+		Skipped:             copied.skipped,
+		UnpreservedMetadata: copied.unpreserved,
+		Err:                 err,
+	})
+
+	return err
+}
+
+// saveFile はファイルを宛先パスにコピーする
+// 増分バックアップで宛先に同じ内容のファイルがある場合はコピーしない
+func (s *LocalBackupSession) saveFile(ctx context.Context, localFilePath, destPath string) (copyResult, error) {
 	// ソースファイルの情報を取得
 	srcInfo, err := os.Stat(localFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to stat source file: %w", err)
+		return copyResult{}, fmt.Errorf("failed to stat source file: %w", err)
 	}
 
 	if !srcInfo.Mode().IsRegular() {
-		return fmt.Errorf("%w: source is not a regular file", ErrInvalidConfig)
+		return copyResult{}, fmt.Errorf("%w: source is not a regular file", ErrInvalidConfig)
+	}
+
+	if err := checkReservedSuffix(destPath); err != nil {
+		return copyResult{}, err
+	}
+
+	unchanged, checksum, err := s.unchangedFile(ctx, localFilePath, srcInfo, destPath)
+	if err != nil {
+		return copyResult{}, fmt.Errorf("%w: %w", ErrBackupFailed, err)
 	}
+	// サイドカーを書く設定で、まだサイドカーがない場合は書き直してサイドカーを作る
+	if unchanged && (!s.config.ChecksumSidecars || hasSidecar(destPath)) {
+		return copyResult{checksum: checksum, skipped: true}, nil
+	}
+
+	// 宛先ディレクトリの作成
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return copyResult{}, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	// ファイルのコピー
+	copied, err := s.copyFile(ctx, localFilePath, destPath)
+	if err != nil {
+		return copied, fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+
+	s.addWrittenSize(copied.written)
+
+	return copied, nil
+}
+
+// SaveReader はReaderから読み込んだデータをバックアップディレクトリに保存する
+// sizeHint はデータサイズが分かっている場合の値（不明な場合は負の値）で、ローカルでは使用しない
+func (s *LocalBackupSession) SaveReader(ctx context.Context, r io.Reader, relativePath string, sizeHint int64) error {
+	// 入力検証
+	if r == nil || relativePath == "" {
+		return fmt.Errorf("%w: empty reader or file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
 
 	// 宛先パスの構築
 	destPath := filepath.Join(s.config.RootDir, relativePath)
-	destDir := filepath.Dir(destPath)
+
+	start := time.Now()
+	var copied copyResult
+	var err error
+	if s.config.Dedup.Enabled {
+		copied, err = s.saveDeduplicated(ctx, r, nil, relativePath)
+	} else {
+		copied, err = s.saveStream(ctx, r, destPath)
+	}
+	s.results.add(FileResult{
+		RelativePath: relativePath,
+		Destination:  destPath,
+		BytesWritten: copied.written,
+		Duration:     time.Since(start),
+		Checksum:     copied.checksum,
+		Err:          err,
+	})
+
+	return err
+}
+
+// saveStream はReaderの内容を宛先パスに書き込む
+func (s *LocalBackupSession) saveStream(ctx context.Context, r io.Reader, destPath string) (copyResult, error) {
+	if err := checkReservedSuffix(destPath); err != nil {
+		return copyResult{}, err
+	}
 
 	// 宛先ディレクトリの作成
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return fmt.Errorf("failed to create destination directory: %w", err)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return copyResult{}, fmt.Errorf("failed to create destination directory: %w", err)
 	}
 
-	// ファイルのコピー
-	if err := s.copyFile(localFilePath, destPath); err != nil {
-		return fmt.Errorf("%w: %v", ErrBackupFailed, err)
+	// 圧縮するかどうかはファイル名と内容から判定するため、ストリームは圧縮せずに暗号化のみ行う
+	enc := storageEncoding{keys: s.config.KeyProvider}
+	path := destPath + enc.suffix()
+	copied, err := writeAtomicEncoded(ctx, &contextReader{ctx: ctx, r: r}, path, nil, s.config.PreserveMetadata, enc)
+	if err != nil {
+		return copied, fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	if path != destPath {
+		copied.destination = path
+	}
+	removeBackupVariants(destPath, path)
+	if err := s.updateSidecar(path, copied.storedChecksum); err != nil {
+		removeSidecar(path)
+		return copied, fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+
+	s.addWrittenSize(copied.written)
+
+	return copied, nil
+}
+
+// SaveDir は srcDir 以下のファイルを relativePrefix 以下に保存する
+// 各ファイルは SaveContext と同様に保存されるため、たどっている途中でも容量チェックが行われる
+// 失敗したファイルがあっても残りの保存を続け、最後に *BackupError を返す
+func (s *LocalBackupSession) SaveDir(ctx context.Context, srcDir, relativePrefix string, opts SaveDirOptions) error {
+	return walkDir(ctx, srcDir, relativePrefix, opts, func(entry dirEntry) *FileError {
+		var err error
+		if entry.linkTarget != "" {
+			err = s.saveSymlink(ctx, entry.path, entry.linkTarget, entry.relativePath)
+		} else {
+			err = s.SaveContext(ctx, entry.path, entry.relativePath)
+		}
+		if err == nil {
+			return nil
+		}
+		return &FileError{
+			RelativePath: entry.relativePath,
+			Destination:  filepath.Join(s.config.RootDir, entry.relativePath),
+			Err:          err,
+		}
+	})
+}
+
+// saveSymlink はシンボリックリンクをリンクのまま保存する
+func (s *LocalBackupSession) saveSymlink(ctx context.Context, linkPath, target, relativePath string) error {
+	if err := s.beginSave(); err != nil {
+		return err
 	}
+	defer s.saves.Done()
 
-	// ファイルサイズを累積
-	fileSize := srcInfo.Size()
-	newAccumulatedSize := atomic.AddInt64(&s.accumulatedSize, fileSize)
+	destPath := filepath.Join(s.config.RootDir, relativePath)
+
+	start := time.Now()
+	err := ctx.Err()
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(destPath), 0755)
+	}
+	if err == nil {
+		err = symlinkAtomic(target, destPath)
+	}
+	if err == nil {
+		removeSidecar(destPath)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	s.results.add(FileResult{
+		SourcePath:   linkPath,
+		RelativePath: relativePath,
+		Destination:  destPath,
+		Duration:     time.Since(start),
+		Err:          err,
+	})
+
+	return err
+}
+
+// beginSave は保存処理の開始を記録する
+// クローズ済みのセッションでは ErrSessionClosed を返す
+func (s *LocalBackupSession) beginSave() error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	s.saves.Add(1)
+	return nil
+}
+
+// addWrittenSize は書き込んだサイズを累積し、チェック間隔を超えたら容量チェックを行う
+func (s *LocalBackupSession) addWrittenSize(written int64) {
+	newAccumulatedSize := atomic.AddInt64(&s.accumulatedSize, written)
 
 	// 累積サイズがチェック間隔を超えたら容量チェック
 	if newAccumulatedSize >= int64(s.config.CheckInterval) {
 		s.checkAndCleanIfNeeded()
 	}
-
-	return nil
 }
 
 // WaitForCompletion はすべての処理の完了を待つ
@@ -118,59 +349,258 @@ func (s *LocalBackupSession) WaitForCompletion(ctx context.Context) error {
 
 	select {
 	case <-ctx.Done():
-		return fmt.Errorf("%w: %v", ErrCleaningTimeout, ctx.Err())
+		return fmt.Errorf("%w: %w", ErrCleaningTimeout, ctx.Err())
 	case <-done:
 		return nil
 	}
 }
 
-// Close はリソースをクリーンアップする
+// Results はこれまでに保存したファイルごとの結果を返す
+func (s *LocalBackupSession) Results() []FileResult {
+	return s.results.snapshot()
+}
+
+// SkippedCount は増分バックアップでスキップしたファイルの数を返す
+func (s *LocalBackupSession) SkippedCount() int {
+	return s.results.skippedCount()
+}
+
+// CleaningRecords はこのセッションで実行したクリーニングの記録を返す
+// 実行中のクリーニングは含まれないため、WaitForCompletion の後に呼び出すこと
+func (s *LocalBackupSession) CleaningRecords() []CleaningRecord {
+	s.cleaningMu.Lock()
+	defer s.cleaningMu.Unlock()
+
+	records := make([]CleaningRecord, len(s.cleaningRecords))
+	copy(records, s.cleaningRecords)
+	return records
+}
+
+// Close は実行中の保存とクリーニングをキャンセルし、それらが終了するまで待つ
+// go-backup-cleanerは実行中に中止できないため、削除を始める前のクリーニングは打ち切るが、
+// 既に始まった削除は最後まで行われ、その完了を待つ（クローズ後は CleaningConfig.Callbacks を呼ばない）
+// すべての処理を完了させたい場合は、先に WaitForCompletion を呼び出すこと
 func (s *LocalBackupSession) Close() error {
-	// クリーニング完了通知チャネルをクローズ
-	close(s.cleaningDone)
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+
+	s.cancel()
+	s.saves.Wait()
+	s.wg.Wait()
 	return nil
 }
 
+// copyResult はコピー処理の結果
+type copyResult struct {
+	written        int64    // コピーしたバイト数（圧縮・暗号化した場合は変換後のサイズ）
+	checksum       string   // SHA-256チェックサム（16進数表記、圧縮・暗号化した場合も元の内容のもの）
+	storedChecksum string   // 書き込んだ内容のSHA-256チェックサム（圧縮・暗号化した場合は変換後のもの）
+	unpreserved    []string // 保持できなかったメタデータ
+	skipped        bool     // 増分バックアップでコピーしなかった
+	destination    string   // 実際に書き込んだパス（圧縮や暗号化の接尾辞を付けた場合のみ）
+}
+
 // copyFile はファイルをコピーする
-func (s *LocalBackupSession) copyFile(src, dst string) error {
+// 圧縮や暗号化する場合は接尾辞を付けたパスに書き込み、その後で他の形式の古いファイルを削除する
+func (s *LocalBackupSession) copyFile(ctx context.Context, src, dst string) (copyResult, error) {
 	sourceFile, err := os.Open(src)
 	if err != nil {
-		return fmt.Errorf("failed to open source file: %w", err)
+		return copyResult{}, fmt.Errorf("failed to open source file: %w", err)
 	}
 	defer func() {
 		_ = sourceFile.Close()
 	}()
 
-	destFile, err := os.Create(dst)
+	enc := storageEncoding{
+		compression: s.config.Compression.algorithmFor(src, sourceFile),
+		level:       s.config.Compression.Level,
+		keys:        s.config.KeyProvider,
+	}
+	path := dst + enc.suffix()
+
+	copied, err := writeAtomicEncoded(ctx, &contextReader{ctx: ctx, r: sourceFile}, path, sourceFile, s.config.PreserveMetadata, enc)
 	if err != nil {
-		return fmt.Errorf("failed to create destination file: %w", err)
+		return copied, err
+	}
+	if path != dst {
+		copied.destination = path
+	}
+	removeBackupVariants(dst, path)
+	if err := s.updateSidecar(path, copied.storedChecksum); err != nil {
+		// 古い内容のサイドカーが残ると、検証で壊れたファイルとして報告されてしまう
+		removeSidecar(path)
+		return copied, err
 	}
+
+	return copied, nil
+}
+
+// checkReservedSuffix は保存先のパスが圧縮形式や暗号化の接尾辞で終わっていないことを確認する
+// リストア時に接尾辞で変換したファイルを判別するため、接尾辞は予約されている
+func checkReservedSuffix(destPath string) error {
+	_, algorithm, encrypted := splitBackupSuffix(destPath)
+	if encrypted {
+		return fmt.Errorf("%w: suffix %s is reserved for encrypted backups", ErrInvalidConfig, encryptedSuffix)
+	}
+	if algorithm != CompressionNone {
+		return fmt.Errorf("%w: suffix %s is reserved for compressed backups", ErrInvalidConfig, compressedSuffixes[algorithm])
+	}
+	if isSidecar(destPath) {
+		return fmt.Errorf("%w: suffix %s is reserved for checksum sidecars", ErrInvalidConfig, sidecarSuffix)
+	}
+	return nil
+}
+
+// writeAtomic はReaderの内容を宛先パスに書き込む
+// 宛先ディレクトリ内の一時ファイルに書き込んでfsyncした後にリネームするため、
+// 宛先パスに書き込み途中のファイルが現れることはない
+// sourceFile がnilでない場合は、その権限と preserve で指定されたメタデータを引き継ぐ
+func writeAtomic(r io.Reader, dst string, sourceFile *os.File, preserve MetadataPreservation) (copyResult, error) {
+	return writeAtomicEncoded(context.Background(), r, dst, sourceFile, preserve, storageEncoding{})
+}
+
+// writeAtomicEncoded は writeAtomic と同様に、Readerの内容を enc で圧縮・暗号化して宛先パスに書き込む
+func writeAtomicEncoded(ctx context.Context, r io.Reader, dst string, sourceFile *os.File, preserve MetadataPreservation, enc storageEncoding) (copyResult, error) {
+	var result copyResult
+
+	destDir := filepath.Dir(dst)
+	tempFile, err := os.CreateTemp(destDir, "."+filepath.Base(dst)+".*"+tempFileSuffix)
+	if err != nil {
+		return result, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tempPath := tempFile.Name()
+
+	// リネームまで完了しなかった場合は一時ファイルを削除
+	committed := false
 	defer func() {
-		_ = destFile.Close()
+		if !committed {
+			_ = tempFile.Close()
+			_ = os.Remove(tempPath)
+		}
 	}()
 
-	if _, err := io.Copy(destFile, sourceFile); err != nil {
-		_ = os.Remove(dst)
-		return fmt.Errorf("failed to copy file: %w", err)
+	// コピーと同時に元の内容と書き込んだ内容のチェックサムを計算
+	hash := sha256.New()
+	stored := hash
+	if enc.compression == CompressionNone && enc.keys == nil {
+		result.written, err = io.Copy(io.MultiWriter(tempFile, hash), r)
+	} else {
+		stored = sha256.New()
+		result.written, _, err = copyEncoded(ctx, io.MultiWriter(tempFile, stored), io.TeeReader(r, hash), enc)
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to copy file: %w", err)
 	}
 
-	// ファイルの権限をコピー
-	srcInfo, err := os.Stat(src)
+	var srcInfo os.FileInfo
+	if sourceFile != nil {
+		srcInfo, err = sourceFile.Stat()
+		if err != nil {
+			return result, fmt.Errorf("failed to stat source file: %w", err)
+		}
+
+		// 所有者と拡張属性のコピー
+		result.unpreserved = preserveFileMetadata(tempFile, sourceFile, srcInfo, preserve)
+	}
+
+	// ファイルの権限をコピー（ストリームの場合は通常のファイルと同じ権限）
+	mode := streamFileMode
+	if srcInfo != nil {
+		mode = srcInfo.Mode()
+	}
+	if err := tempFile.Chmod(mode); err != nil {
+		return result, fmt.Errorf("failed to set file permissions: %w", err)
+	}
+
+	if err := tempFile.Sync(); err != nil {
+		return result, fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return result, fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	// 日時は書き込みが終わってから設定する
+	if srcInfo != nil && preserve.Times {
+		result.unpreserved = append(result.unpreserved, preserveTimes(tempPath, srcInfo)...)
+	}
+
+	if err := os.Rename(tempPath, dst); err != nil {
+		return result, fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+	committed = true
+
+	// リネームを永続化するため親ディレクトリをfsync
+	if err := syncDir(destDir); err != nil {
+		return result, fmt.Errorf("failed to sync destination directory: %w", err)
+	}
+
+	result.checksum = hex.EncodeToString(hash.Sum(nil))
+	result.storedChecksum = hex.EncodeToString(stored.Sum(nil))
+	return result, nil
+}
+
+// symlinkAtomic は target を指すシンボリックリンクを dst に作成する
+// 一時的な名前で作成してからリネームするため、既存の dst はリンクに置き換わる
+func symlinkAtomic(target, dst string) error {
+	destDir := filepath.Dir(dst)
+
+	// 一意な名前を得るために一時ファイルを作成してから置き換える
+	tempFile, err := os.CreateTemp(destDir, "."+filepath.Base(dst)+".*"+tempFileSuffix)
 	if err != nil {
-		return fmt.Errorf("failed to stat source file: %w", err)
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tempPath := tempFile.Name()
+	_ = tempFile.Close()
+	if err := os.Remove(tempPath); err != nil {
+		return fmt.Errorf("failed to remove temporary file: %w", err)
 	}
 
-	if err := destFile.Chmod(srcInfo.Mode()); err != nil {
-		return fmt.Errorf("failed to set file permissions: %w", err)
+	if err := os.Symlink(target, tempPath); err != nil {
+		return fmt.Errorf("failed to create symlink: %w", err)
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("failed to rename temporary symlink: %w", err)
 	}
 
-	return destFile.Sync()
+	if err := syncDir(destDir); err != nil {
+		return fmt.Errorf("failed to sync destination directory: %w", err)
+	}
+	return nil
+}
+
+// removeStaleTempFiles はルートディレクトリ以下に残った古い一時ファイルを削除する
+// 削除に失敗したファイルは次回のセッションに任せて処理を継続する
+func removeStaleTempFiles(rootDir string, olderThan time.Time) {
+	_ = filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// 読めないディレクトリはスキップ
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), tempFileSuffix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(olderThan) {
+			return nil
+		}
+
+		_ = os.Remove(path)
+		return nil
+	})
 }
 
 // checkAndCleanIfNeeded は容量チェックを行い、必要に応じてクリーニングを開始する
 func (s *LocalBackupSession) checkAndCleanIfNeeded() {
-	// 既にクリーニング中なら何もしない
-	if s.isCleaningActive.Load() {
+	// 既にクリーニング中、またはセッションがクローズされた場合は何もしない
+	if s.isCleaningActive.Load() || s.ctx.Err() != nil {
 		return
 	}
 
@@ -197,26 +627,64 @@ func (s *LocalBackupSession) checkAndCleanIfNeeded() {
 
 		go func() {
 			defer s.wg.Done()
-			s.performCleaning()
+			s.performCleaning(CleaningTriggerCheckInterval)
 		}()
 	}
 }
 
-// performCleaning は実際のクリーニング処理を実行する
-func (s *LocalBackupSession) performCleaning() {
+// performCleaning は実際のクリーニング処理を実行し、その結果を記録する
+func (s *LocalBackupSession) performCleaning(trigger CleaningTrigger) {
+	record := CleaningRecord{
+		StartTime: time.Now(),
+		Trigger:   trigger,
+	}
+
 	defer func() {
 		s.isCleaningActive.Store(false)
 		// 累積サイズをリセット
 		atomic.StoreInt64(&s.accumulatedSize, 0)
 	}()
 
+	if err := s.ctx.Err(); err != nil {
+		// セッションがクローズされた場合はクリーニングを開始しない
+		record.Err = fmt.Errorf("cleaning skipped: %w", err)
+	} else {
+		record.Report, record.Err = s.runCleaner()
+		record.BytesFreed = record.Report.DeletedSize
+		record.FilesDeleted = record.Report.DeletedFiles
+	}
+
+	// クリーニング後の空き容量
+	if diskInfo, err := s.config.CleaningConfig.DiskInfo.GetDiskUsage(s.config.RootDir); err == nil {
+		record.FreeSpaceAfter = diskInfo.Free
+	} else if record.Err == nil {
+		record.Err = fmt.Errorf("failed to get disk usage after cleaning: %w", err)
+	}
+	record.EndTime = time.Now()
+
+	s.cleaningMu.Lock()
+	s.cleaningRecords = append(s.cleaningRecords, record)
+	s.cleaningMu.Unlock()
+
+	if s.config.OnCleaningComplete != nil {
+		s.config.OnCleaningComplete(record)
+	}
+}
+
+// runCleaner は目標空き容量から設定を組み立ててgo-backup-cleanerを実行する
+// 重複排除モードではチャンクの参照を考慮する cleanDeduplicated を使う
+func (s *LocalBackupSession) runCleaner() (cleaner.CleaningReport, error) {
+	if s.config.Dedup.Enabled {
+		return s.cleanDeduplicated()
+	}
+
 	// クリーニング設定の準備
 	config := s.config.CleaningConfig
 
 	// 目標使用率の計算（目標空き容量から逆算）
 	diskInfo, err := config.DiskInfo.GetDiskUsage(s.config.RootDir)
 	if err != nil {
-		return
+		return cleaner.CleaningReport{}, fmt.Errorf("failed to get disk usage: %w", err)
 	}
 
 	var targetUsedSpace uint64
@@ -232,13 +700,76 @@ func (s *LocalBackupSession) performCleaning() {
 		config.MaxUsagePercent = &targetUsagePercent
 	}
 
+	// セッションがクローズされたら以降の段階に進まず、データファイルとサイドカーは組で削除する
+	var sidecars sidecarCleaning
+	config.Callbacks = sidecars.callbacks(s.cancelableCallbacks(config.Callbacks))
+
 	// クリーニング実行
-	report, err := cleaner.CleanBackup(s.config.RootDir, config)
+	report, err := s.cleanBackup(config)
 	if err != nil {
-		// エラーはログに記録するが処理は継続
-		return
+		return report, fmt.Errorf("failed to clean backup: %w", err)
+	}
+
+	sidecars.addTo(&report)
+	return report, nil
+}
+
+// errCleaningAborted はセッションのクローズでgo-backup-cleanerの実行を打ち切ったことを表す
+var errCleaningAborted = errors.New("cleaning aborted")
+
+// cleanBackup はgo-backup-cleanerを実行する
+// cancelableCallbacks のコールバックが実行を打ち切った場合はセッションのキャンセル理由をエラーとして返す
+func (s *LocalBackupSession) cleanBackup(config cleaner.CleaningConfig) (report cleaner.CleaningReport, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errCleaningAborted {
+				panic(r)
+			}
+			report, err = cleaner.CleaningReport{}, fmt.Errorf("%w: %w", errCleaningAborted, s.ctx.Err())
+		}
+	}()
+	return cleaner.CleanBackup(s.config.RootDir, config)
+}
+
+// cancelableCallbacks はセッションがクローズされるとgo-backup-cleanerを止めるコールバックを返す
+// go-backup-cleanerには実行を中止する手段がないため、CleanBackup を呼び出したゴルーチンで呼ばれる
+// 開始・走査完了・削除開始のコールバックで panic して打ち切る（cleanBackup で recover する）
+// 削除中のコールバックは削除を行うゴルーチンで呼ばれるため打ち切れず、クローズ後は元のコールバックを呼ばずに戻る
+func (s *LocalBackupSession) cancelableCallbacks(callbacks cleaner.Callbacks) cleaner.Callbacks {
+	return cleaner.Callbacks{
+		OnStart:        abortOnCancel(s.ctx, callbacks.OnStart),
+		OnScanComplete: abortOnCancel(s.ctx, callbacks.OnScanComplete),
+		OnDeleteStart:  abortOnCancel(s.ctx, callbacks.OnDeleteStart),
+		OnFileDeleted:  skipOnCancel(s.ctx, callbacks.OnFileDeleted),
+		OnDirDeleted:   skipOnCancel(s.ctx, callbacks.OnDirDeleted),
+		OnComplete:     skipOnCancel(s.ctx, callbacks.OnComplete),
+		OnError:        skipOnCancel(s.ctx, callbacks.OnError),
+	}
+}
+
+// abortOnCancel は ctx がキャンセルされていれば errCleaningAborted で panic するコールバックを返す
+// fn はキャンセルされていない場合だけ呼び出し、その間にキャンセルされた場合も打ち切る
+func abortOnCancel[T any](ctx context.Context, fn func(T)) func(T) {
+	return func(info T) {
+		if ctx.Err() == nil && fn != nil {
+			fn(info)
+		}
+		if ctx.Err() != nil {
+			panic(errCleaningAborted)
+		}
+	}
+}
+
+// skipOnCancel は ctx がキャンセルされていない場合だけ fn を呼び出すコールバックを返す
+func skipOnCancel[T any](ctx context.Context, fn func(T)) func(T) {
+	if fn == nil {
+		return nil
+	}
+	return func(info T) {
+		if ctx.Err() == nil {
+			fn(info)
+		}
 	}
-	_ = report // レポートは今回は使用しない
 }
 
 // validateLocalConfig はローカルバックアップ設定を検証する
@@ -259,5 +790,37 @@ func validateLocalConfig(config LocalBackupSessionConfig) error {
 		return fmt.Errorf("%w: target free space must be greater than threshold", ErrInvalidConfig)
 	}
 
+	if config.Incremental < IncrementalOff || config.Incremental > IncrementalChecksum {
+		return fmt.Errorf("%w: invalid incremental mode: %d", ErrInvalidConfig, config.Incremental)
+	}
+
+	// 更新日時を保持しないとコピーの更新日時が元のファイルと一致しない
+	// 重複排除モードではマニフェストに更新日時を記録するため不要
+	if config.Incremental == IncrementalSizeModTime && !config.PreserveMetadata.Times && !config.Dedup.Enabled {
+		return fmt.Errorf("%w: incremental size/mtime comparison requires PreserveMetadata.Times", ErrInvalidConfig)
+	}
+
+	if err := validateDedupConfig(config.Dedup); err != nil {
+		return err
+	}
+
+	if err := validateCompressionConfig(config.Compression); err != nil {
+		return err
+	}
+
+	if config.Dedup.Enabled && config.Compression.Algorithm != CompressionNone {
+		return fmt.Errorf("%w: compression cannot be used in dedup mode", ErrInvalidConfig)
+	}
+
+	// チャンクの名前は内容のハッシュのため、暗号化しても内容の一致がわかってしまう
+	if config.Dedup.Enabled && config.KeyProvider != nil {
+		return fmt.Errorf("%w: encryption cannot be used in dedup mode", ErrInvalidConfig)
+	}
+
+	// マニフェストには権限と更新日時のみを記録する
+	if config.Dedup.Enabled && (config.PreserveMetadata.Ownership || config.PreserveMetadata.Xattrs) {
+		return fmt.Errorf("%w: ownership and xattrs cannot be preserved in dedup mode", ErrInvalidConfig)
+	}
+
 	return nil
 }
@@ -0,0 +1,364 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	cleaner "github.com/ideamans/go-backup-cleaner"
+)
+
+// localChunkStore はルートディレクトリに重複排除モードのチャンクとマニフェストを保存する
+type localChunkStore struct {
+	rootDir string
+}
+
+// chunkFile はチャンクのファイルパスを返す
+func (s *localChunkStore) chunkFile(hash string) string {
+	return filepath.Join(s.rootDir, filepath.FromSlash(chunkPath(hash)))
+}
+
+// hasChunk はチャンクのファイルが指定したサイズで存在するかどうかを返す
+func (s *localChunkStore) hasChunk(ctx context.Context, hash string, size int64) (bool, error) {
+	info, err := os.Stat(s.chunkFile(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.Mode().IsRegular() && info.Size() == size, nil
+}
+
+// putChunk はチャンクをアトミックに書き込む
+func (s *localChunkStore) putChunk(ctx context.Context, hash string, data []byte) error {
+	path := s.chunkFile(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+	_, err := writeAtomic(bytes.NewReader(data), path, nil, MetadataPreservation{})
+	return err
+}
+
+// getChunk はチャンクの内容を読み込む
+func (s *localChunkStore) getChunk(ctx context.Context, hash string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(s.chunkFile(hash))
+}
+
+// deleteChunk はチャンクを削除する（既に存在しない場合は何もしない）
+func (s *localChunkStore) deleteChunk(ctx context.Context, hash string) error {
+	err := os.Remove(s.chunkFile(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// listChunks はチャンクのディレクトリ以下のファイルを列挙する
+func (s *localChunkStore) listChunks(ctx context.Context, fn func(hash string, size int64)) error {
+	err := filepath.WalkDir(filepath.Join(s.rootDir, chunkDirName), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), tempFileSuffix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fn(d.Name(), info.Size())
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		// まだチャンクを1つも保存していない
+		return nil
+	}
+	return err
+}
+
+// putManifest はマニフェストを relativePath にアトミックに書き込む
+func (s *localChunkStore) putManifest(ctx context.Context, relativePath string, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.rootDir, relativePath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	_, err = writeAtomic(bytes.NewReader(data), path, nil, MetadataPreservation{})
+	return err
+}
+
+// getManifest は relativePath のマニフェストを読み込む
+func (s *localChunkStore) getManifest(ctx context.Context, relativePath string) (*manifest, error) {
+	path, err := restorePath(s.rootDir, relativePath)
+	if err != nil {
+		return nil, err
+	}
+	return readManifestFile(path, relativePath)
+}
+
+// readManifestFile はファイルからマニフェストを読み込む
+// シンボリックリンクはリンク先を読まずにマニフェストでないとみなす
+func readManifestFile(path, relativePath string) (*manifest, error) {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, relativePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errNotManifest
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	return readManifest(file)
+}
+
+// listManifests はチャンクのディレクトリを除くルートディレクトリ以下のマニフェストを列挙する
+func (s *localChunkStore) listManifests(ctx context.Context, fn func(relativePath string, m *manifest) error) error {
+	return filepath.WalkDir(s.rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() && path == filepath.Join(s.rootDir, chunkDirName) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), tempFileSuffix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.rootDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		m, err := readManifestFile(path, rel)
+		if errors.Is(err, errNotManifest) || errors.Is(err, ErrNotFound) {
+			// マニフェストでないファイルと、列挙中に削除されたファイルは無視する
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read manifest %s: %w", rel, err)
+		}
+		return fn(rel, m)
+	})
+}
+
+// dedupStore は重複排除モードの保存先を返す
+func (s *LocalBackupSession) dedupStore() chunkStore {
+	return &localChunkStore{rootDir: s.config.RootDir}
+}
+
+// saveDeduplicatedFile はファイルを重複排除モードで保存する
+func (s *LocalBackupSession) saveDeduplicatedFile(ctx context.Context, localFilePath, relativePath string) (copyResult, error) {
+	file, err := os.Open(localFilePath)
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	srcInfo, err := file.Stat()
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to stat source file: %w", err)
+	}
+	if !srcInfo.Mode().IsRegular() {
+		return copyResult{}, fmt.Errorf("%w: source is not a regular file", ErrInvalidConfig)
+	}
+
+	return s.saveDeduplicated(ctx, file, srcInfo, relativePath)
+}
+
+// saveDeduplicated は r の内容を重複排除モードで保存する
+// ガベージコレクションとクリーニングが保存中のチャンクを削除しないように、それらとは排他的に実行する
+func (s *LocalBackupSession) saveDeduplicated(ctx context.Context, r io.Reader, srcInfo os.FileInfo, relativePath string) (copyResult, error) {
+	if err := checkReservedSuffix(relativePath); err != nil {
+		return copyResult{}, err
+	}
+
+	s.dedupMu.RLock()
+	copied, err := saveDeduplicated(ctx, s.dedupStore(), s.config.Dedup, s.config.Incremental, r, srcInfo, relativePath)
+	s.dedupMu.RUnlock()
+	if err != nil {
+		if errors.Is(err, ErrInvalidConfig) {
+			return copied, err
+		}
+		return copied, fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+
+	s.addWrittenSize(copied.written)
+
+	return copied, nil
+}
+
+// GarbageCollect は重複排除モードで、どのマニフェストからも参照されていないチャンクを削除する
+// 実行中はこのセッションの保存を待たせるが、同じルートディレクトリに書き込む他のセッションとは同時に実行しないこと
+func (s *LocalBackupSession) GarbageCollect(ctx context.Context) (GarbageCollectionReport, error) {
+	if !s.config.Dedup.Enabled {
+		return GarbageCollectionReport{}, fmt.Errorf("%w: dedup mode is not enabled", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return GarbageCollectionReport{}, err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+
+	return collectGarbage(ctx, s.dedupStore())
+}
+
+// dedupManifestFile はクリーニングで削除する候補のマニフェスト
+type dedupManifestFile struct {
+	path    string
+	modTime time.Time // 保存した日時
+	size    int64
+	chunks  []manifestChunk
+}
+
+// cleanDeduplicated は重複排除モードのクリーニングを行う
+// go-backup-cleanerは新しいマニフェストから参照されている古いチャンクも削除してしまうため使わずに、
+// 参照されていないチャンクを削除した後、古いマニフェストから順に、参照されなくなったチャンクと共に
+// 目標空き容量に達するまで削除する
+func (s *LocalBackupSession) cleanDeduplicated() (cleaner.CleaningReport, error) {
+	start := time.Now()
+	var report cleaner.CleaningReport
+
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+
+	diskInfo, err := s.config.CleaningConfig.DiskInfo.GetDiskUsage(s.config.RootDir)
+	if err != nil {
+		return report, fmt.Errorf("failed to get disk usage: %w", err)
+	}
+	if diskInfo.Free >= s.config.TargetFreeSpace {
+		return report, nil
+	}
+	needed := int64(s.config.TargetFreeSpace - diskInfo.Free)
+
+	store := s.dedupStore()
+
+	var manifests []dedupManifestFile
+	references := make(map[string]int)
+	err = store.listManifests(s.ctx, func(relativePath string, m *manifest) error {
+		path := filepath.Join(s.config.RootDir, filepath.FromSlash(relativePath))
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		manifests = append(manifests, dedupManifestFile{
+			path:    path,
+			modTime: info.ModTime(),
+			size:    info.Size(),
+			chunks:  m.Chunks,
+		})
+		for _, chunk := range m.Chunks {
+			references[chunk.Hash]++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to read manifests: %w", err)
+	}
+
+	chunkSizes := make(map[string]int64)
+	if err := store.listChunks(s.ctx, func(hash string, size int64) {
+		chunkSizes[hash] = size
+	}); err != nil {
+		return report, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	report.ScannedFiles = len(manifests) + len(chunkSizes)
+
+	var freed int64
+	deleteChunk := func(hash string) error {
+		size, ok := chunkSizes[hash]
+		if !ok {
+			return nil
+		}
+		if err := store.deleteChunk(s.ctx, hash); err != nil {
+			return fmt.Errorf("failed to delete chunk %s: %w", hash, err)
+		}
+		delete(chunkSizes, hash)
+		report.DeletedFiles++
+		report.DeletedSize += size
+		freed += size
+		return nil
+	}
+
+	// 参照されていないチャンクは空き容量に関係なく削除する
+	for hash := range chunkSizes {
+		if references[hash] == 0 {
+			if err := deleteChunk(hash); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].modTime.Before(manifests[j].modTime)
+	})
+	for _, m := range manifests {
+		if freed >= needed {
+			break
+		}
+		if err := s.ctx.Err(); err != nil {
+			return report, err
+		}
+
+		if err := os.Remove(m.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return report, fmt.Errorf("failed to delete manifest: %w", err)
+		}
+		report.DeletedFiles++
+		report.DeletedSize += m.size
+		freed += m.size
+
+		for _, chunk := range m.chunks {
+			references[chunk.Hash]--
+			if references[chunk.Hash] == 0 {
+				if err := deleteChunk(chunk.Hash); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+
+	report.TotalDuration = time.Since(start)
+	return report, nil
+}
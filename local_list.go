@@ -0,0 +1,196 @@
+package safebackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// List はルートディレクトリ以下で相対パスが prefix で始まるバックアップを返す
+// 重複排除モードではマニフェストを読み、元のファイルのサイズ、更新日時とチェックサムを返す
+func (s *LocalBackupSession) List(ctx context.Context, prefix string) ([]BackupInfo, error) {
+	infos, err := listLocalBackups(ctx, s.config.RootDir, prefix)
+	if err != nil || !s.config.Dedup.Enabled {
+		return infos, err
+	}
+
+	store := s.dedupStore()
+	for i := range infos {
+		m, err := store.getManifest(ctx, infos[i].RelativePath)
+		if errors.Is(err, errNotManifest) || errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest %s: %w", infos[i].RelativePath, err)
+		}
+		applyManifest(&infos[i], m)
+	}
+	return infos, nil
+}
+
+// listLocalBackups は rootDir 以下で相対パスが prefix で始まるファイルとシンボリックリンクを相対パス順に返す
+// 書き込み途中の一時ファイル、チェックサムのサイドカーと重複排除モードのチャンクは含まない
+// 圧縮・暗号化したファイルは接尾辞を除いた相対パスで返し、Size は変換後のサイズになる
+func listLocalBackups(ctx context.Context, rootDir, prefix string) ([]BackupInfo, error) {
+	var infos []BackupInfo
+	err := filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() && path == filepath.Join(rootDir, chunkDirName) {
+			return filepath.SkipDir
+		}
+		if !(d.Type().IsRegular() || d.Type()&fs.ModeSymlink != 0) || strings.HasSuffix(d.Name(), tempFileSuffix) || isSidecar(d.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(rootDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		algorithm, encrypted := CompressionNone, false
+		if d.Type().IsRegular() {
+			rel, algorithm, encrypted = splitBackupSuffix(rel)
+		}
+		if !strings.HasPrefix(rel, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// 列挙中にクリーニングで削除された
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		backup := localBackupInfo(rel, path, info)
+		if algorithm != CompressionNone {
+			backup.Metadata[compressionMetadataKey] = string(algorithm)
+		}
+		if encrypted {
+			backup.Metadata[encryptionMetadataKey] = encryptionMetadataValue
+		}
+		infos = append(infos, backup)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].RelativePath < infos[j].RelativePath
+	})
+	return infos, nil
+}
+
+// Stat はバックアップの情報を返す
+// ローカルにはチェックサムを保存していないため、ファイルを読んで計算する
+// 圧縮したファイルは展開、暗号化したファイルは復号して、元の内容のサイズとチェックサムを返す
+// 重複排除モードではマニフェストに記録したチェックサムを返す
+func (s *LocalBackupSession) Stat(ctx context.Context, relativePath string) (BackupInfo, error) {
+	path, err := restorePath(s.config.RootDir, relativePath)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	relativePath = filepath.ToSlash(filepath.Clean(relativePath))
+
+	if s.config.Dedup.Enabled {
+		m, err := readManifestFile(path, relativePath)
+		if err == nil {
+			info, err := os.Stat(path)
+			if err != nil {
+				return BackupInfo{}, fmt.Errorf("failed to stat backup file: %w", err)
+			}
+			result := localBackupInfo(relativePath, path, info)
+			applyManifest(&result, m)
+			return result, nil
+		}
+		if !errors.Is(err, errNotManifest) {
+			return BackupInfo{}, err
+		}
+	}
+
+	// シンボリックリンクはリンク先を読まずにリンクの情報を返す
+	if linkInfo, err := os.Lstat(path); err == nil && linkInfo.Mode()&fs.ModeSymlink != 0 {
+		return localBackupInfo(relativePath, path, linkInfo), nil
+	}
+
+	path, algorithm, encrypted := findBackupVariant(path)
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return BackupInfo{}, fmt.Errorf("%w: %s", ErrNotFound, relativePath)
+	}
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to stat backup file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return BackupInfo{}, fmt.Errorf("%w: %s", ErrNotFound, relativePath)
+	}
+
+	r, algorithm, keyID, err := openBackupContent(ctx, &contextReader{ctx: ctx, r: file}, algorithm, encrypted, s.config.KeyProvider)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to decode backup file: %w", err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to read backup file: %w", err)
+	}
+
+	result := localBackupInfo(relativePath, path, info)
+	result.Size = size
+	result.Checksum = hex.EncodeToString(hash.Sum(nil))
+	if algorithm != CompressionNone {
+		result.Metadata[compressionMetadataKey] = string(algorithm)
+	}
+	if encrypted {
+		result.Metadata[encryptionMetadataKey] = encryptionMetadataValue
+		result.Metadata[encryptionKeyIDMetadataKey] = keyID
+	}
+	return result, nil
+}
+
+// localBackupInfo はファイル情報から BackupInfo を作成する
+// シンボリックリンクの場合はリンク先をメタデータに含める
+func localBackupInfo(relativePath, path string, info os.FileInfo) BackupInfo {
+	result := BackupInfo{
+		RelativePath: relativePath,
+		Destination:  path,
+		Size:         info.Size(),
+		ModTime:      info.ModTime(),
+		Metadata: map[string]string{
+			"mode": info.Mode().Perm().String(),
+		},
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if target, err := os.Readlink(path); err == nil {
+			result.Metadata[symlinkMetadataKey] = target
+		}
+	}
+	return result
+}
@@ -0,0 +1,267 @@
+package safebackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// LocalRestoreSession はローカルのバックアップからリストアするセッション実装
+type LocalRestoreSession struct {
+	config   LocalRestoreSessionConfig
+	ctx      context.Context    // Close でキャンセルされるセッションのコンテキスト
+	cancel   context.CancelFunc // ctx のキャンセル
+	closeMu  sync.RWMutex       // closed の排他制御
+	closed   bool
+	restores sync.WaitGroup // 実行中のリストア
+}
+
+// NewLocalRestoreSession はローカルリストアセッションインスタンスを作成
+func NewLocalRestoreSession(config LocalRestoreSessionConfig) (*LocalRestoreSession, error) {
+	if config.RootDir == "" {
+		return nil, fmt.Errorf("invalid config: %w: root directory is required", ErrInvalidConfig)
+	}
+
+	info, err := os.Stat(config.RootDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access root directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("invalid config: %w: root directory is not a directory", ErrInvalidConfig)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LocalRestoreSession{
+		config: config,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// Restore はバックアップしたファイルを localDest に書き出す
+func (s *LocalRestoreSession) Restore(relativePath, localDest string) error {
+	return s.RestoreContext(context.Background(), relativePath, localDest)
+}
+
+// RestoreContext はバックアップしたファイルを localDest に書き出す
+// 権限と更新日時はバックアップしたファイルから引き継ぐ
+func (s *LocalRestoreSession) RestoreContext(ctx context.Context, relativePath, localDest string) error {
+	if relativePath == "" || localDest == "" {
+		return fmt.Errorf("%w: empty file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginRestore(); err != nil {
+		return err
+	}
+	defer s.restores.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	if err := s.restoreFile(ctx, relativePath, localDest); err != nil {
+		return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+	return nil
+}
+
+// restoreFile はバックアップしたファイルを検証しながら localDest に書き出す
+// 圧縮したファイルは展開し、暗号化したファイルは復号して書き出す
+// 重複排除モードのマニフェストは、チャンクから組み立てたファイルとして書き出す
+// リンクのまま保存したシンボリックリンクは、同じリンク先を指すリンクとして書き出す
+func (s *LocalRestoreSession) restoreFile(ctx context.Context, relativePath, localDest string) error {
+	if path, err := restorePath(s.config.RootDir, relativePath); err == nil {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink: %w", err)
+			}
+			return restoreSymlink(target, localDest)
+		}
+	}
+
+	if m, err := s.readManifest(relativePath); err != nil {
+		return err
+	} else if m != nil {
+		return restoreManifest(ctx, s.dedupStore(), m, localDest)
+	}
+
+	file, r, err := s.openBackup(ctx, relativePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+		_ = file.Close()
+	}()
+
+	return writeRestored(ctx, r, localDest, file)
+}
+
+// RestorePrefix は相対パスが prefix で始まるすべてのファイルを localDir 以下に書き出す
+func (s *LocalRestoreSession) RestorePrefix(ctx context.Context, prefix, localDir string) error {
+	if localDir == "" {
+		return fmt.Errorf("%w: empty destination directory", ErrInvalidConfig)
+	}
+
+	if err := s.beginRestore(); err != nil {
+		return err
+	}
+	defer s.restores.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	backups, err := listLocalBackups(ctx, s.config.RootDir, prefix)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+
+	var failures []*FileError
+	for _, backup := range backups {
+		relativePath := backup.RelativePath
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+		}
+
+		dest, err := restorePath(localDir, relativePath)
+		if err == nil {
+			err = s.restoreFile(ctx, relativePath, dest)
+		}
+		if err != nil {
+			failures = append(failures, &FileError{
+				RelativePath: relativePath,
+				Destination:  dest,
+				Err:          err,
+			})
+		}
+	}
+
+	if len(failures) > 0 {
+		return &RestoreError{Failures: failures}
+	}
+	return nil
+}
+
+// Open はバックアップしたファイルを読み出すReaderを返す
+// Readerはセッションのクローズ後に読み込むとエラーを返す
+func (s *LocalRestoreSession) Open(ctx context.Context, relativePath string) (io.ReadCloser, error) {
+	if relativePath == "" {
+		return nil, fmt.Errorf("%w: empty file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginRestore(); err != nil {
+		return nil, err
+	}
+	defer s.restores.Done()
+
+	m, err := s.readManifest(relativePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+	if m != nil {
+		ctx, cancel := mergeContext(ctx, s.ctx)
+		return &restoreReadCloser{
+			Reader: openManifest(ctx, s.dedupStore(), m),
+			close: func() error {
+				cancel()
+				return nil
+			},
+		}, nil
+	}
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	file, r, err := s.openBackup(ctx, relativePath)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+	return &restoreReadCloser{
+		Reader: r,
+		close: func() error {
+			cancel()
+			_ = r.Close()
+			return file.Close()
+		},
+	}, nil
+}
+
+// readManifest は重複排除モードの場合に relativePath のマニフェストを返す
+// 重複排除モードでない場合と、マニフェストでないファイルの場合はnilを返す
+func (s *LocalRestoreSession) readManifest(relativePath string) (*manifest, error) {
+	if !s.config.Dedup {
+		return nil, nil
+	}
+
+	m, err := s.dedupStore().getManifest(s.ctx, relativePath)
+	if errors.Is(err, errNotManifest) {
+		return nil, nil
+	}
+	return m, err
+}
+
+// dedupStore は重複排除モードの保存先を返す
+func (s *LocalRestoreSession) dedupStore() chunkStore {
+	return &localChunkStore{rootDir: s.config.RootDir}
+}
+
+// openBackup はバックアップしたファイルを開き、そのファイルと、保存したサイズで検証しながら元の内容を読み出すReaderを返す
+// 圧縮したファイルは展開し、暗号化したファイルは復号する
+func (s *LocalRestoreSession) openBackup(ctx context.Context, relativePath string) (*os.File, io.ReadCloser, error) {
+	path, err := restorePath(s.config.RootDir, relativePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path, algorithm, encrypted := findBackupVariant(path)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open backup file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("%w: backup is not a regular file", ErrInvalidConfig)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+
+	r, _, _, err := openBackupContent(ctx, newVerifyingReader(&contextReader{ctx: ctx, r: file}, info.Size(), ""), algorithm, encrypted, s.config.KeyProvider)
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, fmt.Errorf("failed to decode backup file: %w", err)
+	}
+	return file, r, nil
+}
+
+// beginRestore はリストアの開始を記録する
+// クローズ済みのセッションでは ErrSessionClosed を返す
+func (s *LocalRestoreSession) beginRestore() error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	s.restores.Add(1)
+	return nil
+}
+
+// Close は実行中のリストアをキャンセルし、それらが終了するまで待つ
+func (s *LocalRestoreSession) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+
+	s.cancel()
+	s.restores.Wait()
+	return nil
+}
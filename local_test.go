@@ -1,11 +1,19 @@
 package safebackup
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -211,6 +219,525 @@ func TestLocalBackupSession_Save(t *testing.T) {
 	})
 }
 
+func TestLocalBackupSession_AtomicWrite(t *testing.T) {
+	newSession := func(t *testing.T, rootDir string) *LocalBackupSession {
+		mockProvider := &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+			freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+		}
+
+		session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            rootDir,
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo: mockProvider,
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+
+	t.Run("NoTempFilesLeft", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir)
+
+		destPath := filepath.Join(rootDir, "atomic/backup.dat")
+		require.NoError(t, os.MkdirAll(filepath.Dir(destPath), 0755))
+		require.NoError(t, os.WriteFile(destPath, []byte("old"), 0644))
+
+		// 既存ファイルを置き換える
+		err := session.Save(createTestFile(t, 128*1024), "atomic/backup.dat")
+		require.NoError(t, err)
+
+		info, err := os.Stat(destPath)
+		require.NoError(t, err)
+		require.Equal(t, int64(128*1024), info.Size())
+
+		entries, err := os.ReadDir(filepath.Dir(destPath))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "backup.dat", entries[0].Name())
+	})
+
+	t.Run("FailedCopyKeepsExistingFile", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir)
+
+		destPath := filepath.Join(rootDir, "existing.dat")
+		require.NoError(t, os.WriteFile(destPath, []byte("previous backup"), 0644))
+
+		// ディレクトリを読み込もうとしてコピーが失敗する
+		_, err := session.copyFile(context.Background(), t.TempDir(), destPath)
+		require.Error(t, err)
+
+		data, err := os.ReadFile(destPath)
+		require.NoError(t, err)
+		require.Equal(t, "previous backup", string(data))
+
+		entries, err := os.ReadDir(rootDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("StaleTempFilesRemoved", func(t *testing.T) {
+		rootDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "sub"), 0755))
+
+		stalePath := filepath.Join(rootDir, "sub", ".data.dat.123"+tempFileSuffix)
+		require.NoError(t, os.WriteFile(stalePath, []byte("partial"), 0644))
+		oldTime := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(stalePath, oldTime, oldTime))
+
+		// 更新されたばかりの一時ファイルは別プロセスが書き込み中の可能性があるため残す
+		freshPath := filepath.Join(rootDir, ".other.dat.456"+tempFileSuffix)
+		require.NoError(t, os.WriteFile(freshPath, []byte("in progress"), 0644))
+
+		newSession(t, rootDir)
+
+		require.NoFileExists(t, stalePath)
+		require.FileExists(t, freshPath)
+	})
+}
+
+func TestLocalBackupSession_PreserveMetadata(t *testing.T) {
+	newSession := func(t *testing.T, preserve MetadataPreservation) *LocalBackupSession {
+		mockProvider := &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+			freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+		}
+
+		session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            t.TempDir(),
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo: mockProvider,
+			},
+			PreserveMetadata: preserve,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+
+	oldTime := time.Now().Add(-30 * 24 * time.Hour).Truncate(time.Second)
+
+	t.Run("Times", func(t *testing.T) {
+		session := newSession(t, MetadataPreservation{Times: true})
+
+		srcPath := createTestFile(t, 1024)
+		require.NoError(t, os.Chtimes(srcPath, oldTime, oldTime))
+
+		require.NoError(t, session.Save(srcPath, "times/old.dat"))
+
+		info, err := os.Stat(filepath.Join(session.config.RootDir, "times/old.dat"))
+		require.NoError(t, err)
+		require.True(t, info.ModTime().Equal(oldTime))
+
+		results := session.Results()
+		require.Len(t, results, 1)
+		require.NotContains(t, results[0].UnpreservedMetadata, "mtime")
+	})
+
+	t.Run("DefaultKeepsCopyTime", func(t *testing.T) {
+		session := newSession(t, MetadataPreservation{})
+
+		srcPath := createTestFile(t, 1024)
+		require.NoError(t, os.Chtimes(srcPath, oldTime, oldTime))
+
+		require.NoError(t, session.Save(srcPath, "default/new.dat"))
+
+		info, err := os.Stat(filepath.Join(session.config.RootDir, "default/new.dat"))
+		require.NoError(t, err)
+		require.True(t, info.ModTime().After(oldTime))
+		require.Empty(t, session.Results()[0].UnpreservedMetadata)
+	})
+
+	t.Run("Ownership", func(t *testing.T) {
+		session := newSession(t, MetadataPreservation{Ownership: true})
+
+		// 自分が所有するファイルなので、root権限がなくても所有者を設定できる
+		require.NoError(t, session.Save(createTestFile(t, 1024), "owner.dat"))
+		require.Empty(t, session.Results()[0].UnpreservedMetadata)
+	})
+}
+
+func TestLocalBackupSession_SaveReader(t *testing.T) {
+	mockProvider := &MockDiskInfoProvider{
+		totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+		freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+	}
+
+	session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+		RootDir:            t.TempDir(),
+		FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+		TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+		CleaningConfig: cleaner.CleaningConfig{
+			DiskInfo: mockProvider,
+		},
+	})
+	require.NoError(t, err)
+	defer func() { _ = session.Close() }()
+
+	t.Run("Stream", func(t *testing.T) {
+		data := []byte(strings.Repeat("INSERT INTO t VALUES (1);\n", 1000))
+
+		err := session.SaveReader(context.Background(), bytes.NewReader(data), "dump/db.sql", -1)
+		require.NoError(t, err)
+
+		destPath := filepath.Join(session.config.RootDir, "dump/db.sql")
+		saved, err := os.ReadFile(destPath)
+		require.NoError(t, err)
+		require.Equal(t, data, saved)
+
+		info, err := os.Stat(destPath)
+		require.NoError(t, err)
+		require.Equal(t, streamFileMode, info.Mode().Perm())
+
+		results := session.Results()
+		require.Len(t, results, 1)
+		sum := sha256.Sum256(data)
+		require.Empty(t, results[0].SourcePath)
+		require.Equal(t, int64(len(data)), results[0].BytesWritten)
+		require.Equal(t, hex.EncodeToString(sum[:]), results[0].Checksum)
+	})
+
+	t.Run("CanceledContext", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := session.SaveReader(ctx, bytes.NewReader([]byte("data")), "canceled.dat", 4)
+		require.ErrorIs(t, err, ErrBackupFailed)
+		require.NoFileExists(t, filepath.Join(session.config.RootDir, "canceled.dat"))
+	})
+
+	t.Run("NilReader", func(t *testing.T) {
+		err := session.SaveReader(context.Background(), nil, "nil.dat", -1)
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+}
+
+// slowReader は少しずつ終わりなくデータを返すReader
+type slowReader struct{}
+
+func (slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestLocalBackupSession_Close(t *testing.T) {
+	mockProvider := &MockDiskInfoProvider{
+		totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+		freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+	}
+
+	session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+		RootDir:            t.TempDir(),
+		FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+		TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+		CleaningConfig: cleaner.CleaningConfig{
+			DiskInfo: mockProvider,
+		},
+	})
+	require.NoError(t, err)
+
+	// 終わらないストリームの保存を Close で中断する
+	saveErr := make(chan error, 1)
+	go func() {
+		saveErr <- session.SaveReader(context.Background(), slowReader{}, "endless.dat", -1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, session.Close())
+	require.ErrorIs(t, <-saveErr, ErrBackupFailed)
+	require.NoFileExists(t, filepath.Join(session.config.RootDir, "endless.dat"))
+
+	entries, err := os.ReadDir(session.config.RootDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// クローズ後の保存はエラー
+	err = session.Save(createTestFile(t, 1024), "after-close.dat")
+	require.ErrorIs(t, err, ErrSessionClosed)
+	require.NoError(t, session.Close())
+}
+
+func TestLocalBackupSession_Results(t *testing.T) {
+	mockProvider := &MockDiskInfoProvider{
+		totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+		freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+	}
+
+	config := LocalBackupSessionConfig{
+		RootDir:            t.TempDir(),
+		FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+		TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+		CleaningConfig: cleaner.CleaningConfig{
+			DiskInfo: mockProvider,
+		},
+	}
+
+	session, err := NewLocalBackupSession(config)
+	require.NoError(t, err)
+	defer func() { _ = session.Close() }()
+
+	testFile := createTestFile(t, 64*1024) // 64KB
+	err = session.Save(testFile, "reports/ok.dat")
+	require.NoError(t, err)
+
+	err = session.Save("/non/existent/file.txt", "reports/missing.dat")
+	require.Error(t, err)
+
+	err = session.WaitForCompletion(context.Background())
+	require.NoError(t, err)
+
+	results := session.Results()
+	require.Len(t, results, 2)
+
+	// 成功したファイルの結果
+	data, err := os.ReadFile(testFile)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+
+	ok := results[0]
+	require.Equal(t, testFile, ok.SourcePath)
+	require.Equal(t, "reports/ok.dat", ok.RelativePath)
+	require.Equal(t, filepath.Join(config.RootDir, "reports/ok.dat"), ok.Destination)
+	require.Equal(t, int64(64*1024), ok.BytesWritten)
+	require.Equal(t, hex.EncodeToString(sum[:]), ok.Checksum)
+	require.NoError(t, ok.Err)
+
+	// 失敗したファイルの結果
+	failed := results[1]
+	require.Equal(t, "reports/missing.dat", failed.RelativePath)
+	require.Error(t, failed.Err)
+	require.Zero(t, failed.BytesWritten)
+	require.Empty(t, failed.Checksum)
+}
+
+func TestLocalBackupSession_CleaningRecords(t *testing.T) {
+	t.Run("SessionStart", func(t *testing.T) {
+		mockProvider := &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+			freeSpace:  5 * 1024 * 1024 * 1024,   // 5GB（閾値未満）
+		}
+
+		var mu sync.Mutex
+		var notified []CleaningRecord
+
+		config := LocalBackupSessionConfig{
+			RootDir:            t.TempDir(),
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo: mockProvider,
+			},
+			OnCleaningComplete: func(record CleaningRecord) {
+				mu.Lock()
+				defer mu.Unlock()
+				notified = append(notified, record)
+			},
+		}
+
+		session, err := NewLocalBackupSession(config)
+		require.NoError(t, err)
+		defer func() { _ = session.Close() }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = session.WaitForCompletion(ctx)
+		cancel()
+		require.NoError(t, err)
+
+		records := session.CleaningRecords()
+		require.Len(t, records, 1)
+		require.Equal(t, CleaningTriggerSessionStart, records[0].Trigger)
+		require.NoError(t, records[0].Err)
+		require.Equal(t, uint64(5*1024*1024*1024), records[0].FreeSpaceAfter)
+		require.False(t, records[0].StartTime.IsZero())
+		require.False(t, records[0].EndTime.Before(records[0].StartTime))
+
+		// コールバックにも同じ記録が渡される
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, notified, 1)
+		require.Equal(t, records[0].Trigger, notified[0].Trigger)
+	})
+
+	t.Run("CheckInterval", func(t *testing.T) {
+		mockProvider := &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+			freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+		}
+
+		config := LocalBackupSessionConfig{
+			RootDir:            t.TempDir(),
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CheckInterval:      1024, // 1KB
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo: mockProvider,
+			},
+		}
+
+		session, err := NewLocalBackupSession(config)
+		require.NoError(t, err)
+		defer func() { _ = session.Close() }()
+
+		// 空き容量が十分な間はクリーニングしない
+		require.Empty(t, session.CleaningRecords())
+
+		mockProvider.SetFreeSpace(5 * 1024 * 1024 * 1024)
+		err = session.Save(createTestFile(t, 4096), "interval.dat")
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = session.WaitForCompletion(ctx)
+		cancel()
+		require.NoError(t, err)
+
+		records := session.CleaningRecords()
+		require.Len(t, records, 1)
+		require.Equal(t, CleaningTriggerCheckInterval, records[0].Trigger)
+	})
+
+	t.Run("CloseBeforeDeleting", func(t *testing.T) {
+		mockProvider := &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+			freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+		}
+
+		rootDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(rootDir, "old.dat"), []byte("old"), 0644))
+
+		// 走査の完了を通知し、セッションがクローズされるまで戻らない
+		var session *LocalBackupSession
+		scanned := make(chan struct{})
+		minFreeSpace := int64(20 * 1024 * 1024 * 1024)
+		session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            rootDir,
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo:     mockProvider,
+				MinFreeSpace: &minFreeSpace,
+				Callbacks: cleaner.Callbacks{
+					OnScanComplete: func(info cleaner.ScanCompleteInfo) {
+						close(scanned)
+						<-session.ctx.Done()
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		mockProvider.SetFreeSpace(5 * 1024 * 1024 * 1024)
+		session.checkAndCleanIfNeeded()
+		<-scanned
+
+		// 削除を始める前に打ち切るため、ファイルは残る
+		require.NoError(t, session.Close())
+		require.FileExists(t, filepath.Join(rootDir, "old.dat"))
+
+		records := session.CleaningRecords()
+		require.Len(t, records, 1)
+		require.ErrorIs(t, records[0].Err, errCleaningAborted)
+		require.ErrorIs(t, records[0].Err, context.Canceled)
+		require.Zero(t, records[0].FilesDeleted)
+	})
+
+	t.Run("CloseWhileDeleting", func(t *testing.T) {
+		mockProvider := &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+			freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+		}
+
+		rootDir := t.TempDir()
+		past := time.Now().Add(-time.Hour).Truncate(time.Hour)
+		for i := 0; i < 10; i++ {
+			path := filepath.Join(rootDir, fmt.Sprintf("old%d.dat", i))
+			require.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+			require.NoError(t, os.Chtimes(path, past, past))
+		}
+
+		// 1ファイルごとに時間のかかるコールバックでクリーニングを遅くする
+		var calls atomic.Int32
+		deleting := make(chan struct{}, 1)
+		minFreeSpace := int64(20 * 1024 * 1024 * 1024)
+		session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            rootDir,
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo:       mockProvider,
+				MinFreeSpace:   &minFreeSpace,
+				Concurrency:    1,
+				MaxConcurrency: 1,
+				Callbacks: cleaner.Callbacks{
+					OnFileDeleted: func(info cleaner.FileDeletedInfo) {
+						calls.Add(1)
+						select {
+						case deleting <- struct{}{}:
+						default:
+						}
+						time.Sleep(500 * time.Millisecond)
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		mockProvider.SetFreeSpace(5 * 1024 * 1024 * 1024)
+		session.checkAndCleanIfNeeded()
+		<-deleting
+
+		// 始まった削除は最後まで行うが、クローズ後はコールバックを呼ばないためすぐに戻る
+		start := time.Now()
+		require.NoError(t, session.Close())
+		require.Less(t, time.Since(start), 2*time.Second)
+		require.Equal(t, int32(1), calls.Load())
+
+		records := session.CleaningRecords()
+		require.Len(t, records, 1)
+		require.NoError(t, records[0].Err)
+		require.Equal(t, 10, records[0].FilesDeleted)
+	})
+
+	t.Run("CleanerError", func(t *testing.T) {
+		mockProvider := &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+			freeSpace:  5 * 1024 * 1024 * 1024,   // 5GB（閾値未満）
+		}
+
+		invalidPercent := 150.0
+		config := LocalBackupSessionConfig{
+			RootDir:            t.TempDir(),
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo:        mockProvider,
+				MaxUsagePercent: &invalidPercent,
+			},
+		}
+
+		session, err := NewLocalBackupSession(config)
+		require.NoError(t, err)
+		defer func() { _ = session.Close() }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = session.WaitForCompletion(ctx)
+		cancel()
+		require.NoError(t, err)
+
+		records := session.CleaningRecords()
+		require.Len(t, records, 1)
+		require.Error(t, records[0].Err)
+		require.ErrorIs(t, records[0].Err, cleaner.ErrInvalidConfig)
+	})
+}
+
 func TestLocalBackupSessionTwoBatchScenario(t *testing.T) {
 	t.Skip("Skipping flaky test due to race conditions in cleaning simulation")
 	// モックDiskInfoProviderを使用
@@ -431,9 +958,12 @@ func TestLocalBackupSession_WaitForCompletion(t *testing.T) {
 		// WaitGroupに手動で処理を追加してタイムアウトをシミュレート
 		session.wg.Add(1)
 		go func() {
-			// 長時間の処理をシミュレート（テスト終了後にクリーンアップ）
+			// 長時間の処理をシミュレート（Close でキャンセルされる）
 			defer session.wg.Done()
-			time.Sleep(10 * time.Second) // テストタイムアウトより長い時間
+			select {
+			case <-time.After(10 * time.Second): // テストタイムアウトより長い時間
+			case <-session.ctx.Done():
+			}
 		}()
 
 		// 短いタイムアウトを設定
@@ -445,3 +975,1280 @@ func TestLocalBackupSession_WaitForCompletion(t *testing.T) {
 		require.ErrorIs(t, err, ErrCleaningTimeout)
 	})
 }
+
+func TestLocalRestoreSession(t *testing.T) {
+	rootDir := t.TempDir()
+	content := []byte("backup content")
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	writeBackup := func(relativePath string, data []byte) {
+		path := filepath.Join(rootDir, filepath.FromSlash(relativePath))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, data, 0600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	writeBackup("docs/a.txt", content)
+	writeBackup("docs/sub/b.txt", content)
+	writeBackup("images/c.img", content)
+	// 書き込み途中の一時ファイルはリストアしない
+	writeBackup("docs/.d.txt.123"+tempFileSuffix, content)
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		_, err := NewLocalRestoreSession(LocalRestoreSessionConfig{})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+
+		_, err = NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: filepath.Join(rootDir, "missing")})
+		require.Error(t, err)
+	})
+
+	session, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: rootDir})
+	require.NoError(t, err)
+	defer func() { _ = session.Close() }()
+
+	t.Run("Restore", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "restored", "a.txt")
+		require.NoError(t, session.Restore("docs/a.txt", dest))
+
+		restored, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		require.Equal(t, content, restored)
+
+		// 権限と更新日時はバックアップから引き継ぐ
+		info, err := os.Stat(dest)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		require.True(t, info.ModTime().Equal(modTime))
+
+		err = session.Restore("docs/missing.txt", filepath.Join(t.TempDir(), "missing.txt"))
+		require.ErrorIs(t, err, ErrRestoreFailed)
+
+		// ルートディレクトリの外は読み出さない
+		err = session.Restore("../outside.txt", filepath.Join(t.TempDir(), "outside.txt"))
+		require.ErrorIs(t, err, ErrRestoreFailed)
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		r, err := session.Open(context.Background(), "images/c.img")
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, content, data)
+	})
+
+	t.Run("RestorePrefix", func(t *testing.T) {
+		localDir := t.TempDir()
+		require.NoError(t, session.RestorePrefix(context.Background(), "docs/", localDir))
+
+		require.FileExists(t, filepath.Join(localDir, "docs", "a.txt"))
+		require.FileExists(t, filepath.Join(localDir, "docs", "sub", "b.txt"))
+		require.NoDirExists(t, filepath.Join(localDir, "images"))
+
+		entries, err := os.ReadDir(filepath.Join(localDir, "docs"))
+		require.NoError(t, err)
+		require.Len(t, entries, 2) // a.txt と sub
+	})
+
+	t.Run("IntegrityCheck", func(t *testing.T) {
+		// バックアップ時より短いデータは検証で失敗する
+		r := newVerifyingReader(bytes.NewReader(content[:4]), int64(len(content)), "")
+		_, err := io.ReadAll(r)
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+
+		sum := sha256.Sum256(content)
+		r = newVerifyingReader(bytes.NewReader(content), int64(len(content)), hex.EncodeToString(sum[:]))
+		_, err = io.ReadAll(r)
+		require.NoError(t, err)
+
+		r = newVerifyingReader(bytes.NewReader([]byte("tampered data!")), -1, hex.EncodeToString(sum[:]))
+		_, err = io.ReadAll(r)
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		closed, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: rootDir})
+		require.NoError(t, err)
+		require.NoError(t, closed.Close())
+
+		_, err = closed.Open(context.Background(), "docs/a.txt")
+		require.ErrorIs(t, err, ErrSessionClosed)
+	})
+}
+
+func TestLocalBackupSession_ListAndStat(t *testing.T) {
+	mockProvider := &MockDiskInfoProvider{
+		totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+		freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+	}
+
+	session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+		RootDir:            t.TempDir(),
+		FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+		TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+		CleaningConfig: cleaner.CleaningConfig{
+			DiskInfo: mockProvider,
+		},
+	})
+	require.NoError(t, err)
+	defer func() { _ = session.Close() }()
+
+	content := []byte("listed content")
+	for _, name := range []string{"db/2.dump", "db/1.dump", "logs/app.log"} {
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(content), name, -1))
+	}
+	// 書き込み途中の一時ファイルは含まない
+	tempPath := filepath.Join(session.config.RootDir, "db", ".3.dump.123"+tempFileSuffix)
+	require.NoError(t, os.WriteFile(tempPath, content, 0644))
+
+	t.Run("List", func(t *testing.T) {
+		infos, err := session.List(context.Background(), "db/")
+		require.NoError(t, err)
+		require.Len(t, infos, 2)
+		require.Equal(t, "db/1.dump", infos[0].RelativePath)
+		require.Equal(t, filepath.Join(session.config.RootDir, "db", "1.dump"), infos[0].Destination)
+		require.Equal(t, "db/2.dump", infos[1].RelativePath)
+		require.Equal(t, int64(len(content)), infos[0].Size)
+		require.False(t, infos[0].ModTime.IsZero())
+		require.Equal(t, "-rw-r--r--", infos[0].Metadata["mode"])
+
+		infos, err = session.List(context.Background(), "")
+		require.NoError(t, err)
+		require.Len(t, infos, 3)
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := session.Stat(context.Background(), "logs/app.log")
+		require.NoError(t, err)
+		require.Equal(t, "logs/app.log", info.RelativePath)
+		require.Equal(t, int64(len(content)), info.Size)
+
+		sum := sha256.Sum256(content)
+		require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+
+		_, err = session.Stat(context.Background(), "logs/missing.log")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		_, err = session.Stat(context.Background(), "../outside.log")
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+}
+
+// createTestTree はSaveDirのテスト用のディレクトリツリーを作成する
+func createTestTree(t *testing.T) string {
+	srcDir := t.TempDir()
+
+	write := func(name string, size int, modTime time.Time) {
+		path := filepath.Join(srcDir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte("x"), size), 0644))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	now := time.Now()
+	write("a.txt", 10, now)
+	write("big.bin", 2000, now)
+	write("logs/app.log", 10, now)
+	write("logs/old.log", 10, now.Add(-48*time.Hour))
+	write("node_modules/lib/index.js", 10, now)
+	write("sub/keep.txt", 10, now)
+
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(srcDir, "link-file")))
+	require.NoError(t, os.Symlink("sub", filepath.Join(srcDir, "link-dir")))
+
+	return srcDir
+}
+
+// savedFiles はバックアップ先のファイルとシンボリックリンクの相対パスを返す
+func savedFiles(t *testing.T, session *LocalBackupSession) []string {
+	infos, err := session.List(context.Background(), "")
+	require.NoError(t, err)
+
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.RelativePath)
+	}
+	return names
+}
+
+func TestLocalBackupSession_SaveDir(t *testing.T) {
+	newSession := func(t *testing.T, provider *MockDiskInfoProvider, checkInterval uint64) *LocalBackupSession {
+		session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            t.TempDir(),
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CheckInterval:      checkInterval,
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo: provider,
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+	newProvider := func() *MockDiskInfoProvider {
+		return &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+			freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+		}
+	}
+
+	srcDir := createTestTree(t)
+
+	t.Run("ExcludeAndSize", func(t *testing.T) {
+		session := newSession(t, newProvider(), 0)
+
+		err := session.SaveDir(context.Background(), srcDir, "tree", SaveDirOptions{
+			Exclude: []string{"node_modules/", "*.log", "!app.log"},
+			MaxSize: 1000,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"tree/a.txt", "tree/logs/app.log", "tree/sub/keep.txt"}, savedFiles(t, session))
+	})
+
+	t.Run("IncludeAndAge", func(t *testing.T) {
+		session := newSession(t, newProvider(), 0)
+
+		err := session.SaveDir(context.Background(), srcDir, "", SaveDirOptions{
+			Include: []string{"logs/"},
+			MaxAge:  24 * time.Hour,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"logs/app.log"}, savedFiles(t, session))
+
+		session = newSession(t, newProvider(), 0)
+		err = session.SaveDir(context.Background(), srcDir, "", SaveDirOptions{
+			Include: []string{"/logs/*.log"},
+			MinAge:  24 * time.Hour,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"logs/old.log"}, savedFiles(t, session))
+	})
+
+	t.Run("FollowSymlinks", func(t *testing.T) {
+		loopDir := createTestTree(t)
+		require.NoError(t, os.Symlink(".", filepath.Join(loopDir, "sub", "loop")))
+
+		session := newSession(t, newProvider(), 0)
+		err := session.SaveDir(context.Background(), loopDir, "", SaveDirOptions{
+			Include:  []string{"*.txt", "link-file"},
+			Symlinks: SymlinkFollow,
+		})
+
+		// 循環するリンクは失敗として記録され、残りは保存される
+		var backupErr *BackupError
+		require.ErrorAs(t, err, &backupErr)
+		require.Len(t, backupErr.Failures, 2) // sub/loop と link-dir/loop
+		require.Equal(t, []string{"a.txt", "link-dir/keep.txt", "link-file", "sub/keep.txt"}, savedFiles(t, session))
+
+		info, err := os.Lstat(filepath.Join(session.config.RootDir, "link-file"))
+		require.NoError(t, err)
+		require.True(t, info.Mode().IsRegular())
+	})
+
+	t.Run("PreserveSymlinks", func(t *testing.T) {
+		session := newSession(t, newProvider(), 0)
+		err := session.SaveDir(context.Background(), srcDir, "", SaveDirOptions{
+			Include:  []string{"link-*"},
+			Symlinks: SymlinkPreserve,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"link-dir", "link-file"}, savedFiles(t, session))
+
+		target, err := os.Readlink(filepath.Join(session.config.RootDir, "link-file"))
+		require.NoError(t, err)
+		require.Equal(t, "a.txt", target)
+
+		// リストアでもリンクとして書き出される
+		restore, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: session.config.RootDir})
+		require.NoError(t, err)
+		defer func() { _ = restore.Close() }()
+
+		localDir := t.TempDir()
+		require.NoError(t, restore.RestorePrefix(context.Background(), "", localDir))
+		target, err = os.Readlink(filepath.Join(localDir, "link-dir"))
+		require.NoError(t, err)
+		require.Equal(t, "sub", target)
+	})
+
+	t.Run("CheckIntervalDuringWalk", func(t *testing.T) {
+		provider := newProvider()
+		session := newSession(t, provider, 1024) // 1KB
+
+		provider.SetFreeSpace(5 * 1024 * 1024 * 1024)
+		require.NoError(t, session.SaveDir(context.Background(), srcDir, "", SaveDirOptions{}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		require.NoError(t, session.WaitForCompletion(ctx))
+		cancel()
+
+		records := session.CleaningRecords()
+		require.NotEmpty(t, records)
+		require.Equal(t, CleaningTriggerCheckInterval, records[0].Trigger)
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		session := newSession(t, newProvider(), 0)
+
+		err := session.SaveDir(context.Background(), srcDir, "", SaveDirOptions{Exclude: []string{"[a-"}})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+
+		err = session.SaveDir(context.Background(), filepath.Join(srcDir, "a.txt"), "", SaveDirOptions{})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = session.SaveDir(ctx, srcDir, "", SaveDirOptions{})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Patterns", func(t *testing.T) {
+		patterns, err := compilePatterns([]string{"# comment", "*.log", "!keep.log", "build/", "/root.txt", "docs/**/*.md"})
+		require.NoError(t, err)
+
+		cases := []struct {
+			path  string
+			isDir bool
+			want  bool
+		}{
+			{"app.log", false, true},
+			{"deep/dir/app.log", false, true},
+			{"deep/keep.log", false, false},
+			{"build", true, true},
+			{"build", false, false},
+			{"src/build", true, true},
+			{"root.txt", false, true},
+			{"sub/root.txt", false, false},
+			{"docs/a.md", false, true},
+			{"docs/x/y/a.md", false, true},
+			{"other/docs/a.md", false, false},
+		}
+		for _, c := range cases {
+			require.Equal(t, c.want, patterns.match(c.path, c.isDir), c.path)
+		}
+		require.True(t, patterns.matchPathOrParent("build/out/app.bin"))
+	})
+}
+
+func TestLocalBackupSession_Incremental(t *testing.T) {
+	newSession := func(t *testing.T, rootDir string, mode IncrementalMode) *LocalBackupSession {
+		session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            rootDir,
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo: &MockDiskInfoProvider{
+					totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+					freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+				},
+			},
+			PreserveMetadata: MetadataPreservation{Times: true},
+			Incremental:      mode,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+
+	for _, mode := range []IncrementalMode{IncrementalSizeModTime, IncrementalChecksum} {
+		t.Run(fmt.Sprintf("Mode%d", mode), func(t *testing.T) {
+			rootDir := t.TempDir()
+			srcDir := t.TempDir()
+			unchanged := filepath.Join(srcDir, "unchanged.txt")
+			changed := filepath.Join(srcDir, "changed.txt")
+			require.NoError(t, os.WriteFile(unchanged, []byte("same content"), 0644))
+			require.NoError(t, os.WriteFile(changed, []byte("old content"), 0644))
+
+			first := newSession(t, rootDir, mode)
+			require.NoError(t, first.Save(unchanged, "unchanged.txt"))
+			require.NoError(t, first.Save(changed, "changed.txt"))
+			require.Zero(t, first.SkippedCount())
+
+			// 同じサイズのまま内容と更新日時を変える
+			require.NoError(t, os.WriteFile(changed, []byte("new content"), 0644))
+			later := time.Now().Add(time.Hour)
+			require.NoError(t, os.Chtimes(changed, later, later))
+
+			second := newSession(t, rootDir, mode)
+			require.NoError(t, second.Save(unchanged, "unchanged.txt"))
+			require.NoError(t, second.Save(changed, "changed.txt"))
+			require.Equal(t, 1, second.SkippedCount())
+
+			results := second.Results()
+			require.True(t, results[0].Skipped)
+			require.Zero(t, results[0].BytesWritten)
+			require.False(t, results[1].Skipped)
+
+			data, err := os.ReadFile(filepath.Join(rootDir, "changed.txt"))
+			require.NoError(t, err)
+			require.Equal(t, "new content", string(data))
+		})
+	}
+
+	t.Run("RequiresTimes", func(t *testing.T) {
+		_, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            t.TempDir(),
+			FreeSpaceThreshold: 10,
+			TargetFreeSpace:    20,
+			Incremental:        IncrementalSizeModTime,
+		})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+}
+
+// dedupTestConfig はテスト用の小さなチャンクサイズの重複排除モードの設定
+var dedupTestConfig = DedupConfig{
+	Enabled:      true,
+	MinChunkSize: 1024,
+	AvgChunkSize: 4096,
+	MaxChunkSize: 16 * 1024,
+}
+
+// dedupTestData は再現可能な乱数のテストデータと、その途中にデータを挿入したものを返す
+func dedupTestData(size int) ([]byte, []byte) {
+	original := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(original)
+
+	inserted := append([]byte{}, original[:size/2]...)
+	inserted = append(inserted, []byte("inserted in the middle")...)
+	inserted = append(inserted, original[size/2:]...)
+	return original, inserted
+}
+
+func TestLocalBackupSession_Dedup(t *testing.T) {
+	newSession := func(t *testing.T, rootDir string, diskInfo *MockDiskInfoProvider) *LocalBackupSession {
+		if diskInfo == nil {
+			diskInfo = &MockDiskInfoProvider{
+				totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+				freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+			}
+		}
+		session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            rootDir,
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CleaningConfig:     cleaner.CleaningConfig{DiskInfo: diskInfo},
+			Incremental:        IncrementalChecksum,
+			Dedup:              dedupTestConfig,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+
+	original, inserted := dedupTestData(256 * 1024)
+	srcDir := t.TempDir()
+	originalPath := filepath.Join(srcDir, "dump1.sql")
+	insertedPath := filepath.Join(srcDir, "dump2.sql")
+	require.NoError(t, os.WriteFile(originalPath, original, 0600))
+	require.NoError(t, os.WriteFile(insertedPath, inserted, 0600))
+
+	t.Run("SharedChunks", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir, nil)
+
+		require.NoError(t, session.Save(originalPath, "dumps/dump1.sql"))
+		require.NoError(t, session.Save(insertedPath, "dumps/dump2.sql"))
+
+		results := session.Results()
+		require.Equal(t, int64(len(original)), results[0].BytesWritten)
+		require.Less(t, results[1].BytesWritten, int64(len(inserted)/4), "挿入箇所の前後のチャンクだけが保存される")
+
+		sum := sha256.Sum256(inserted)
+		require.Equal(t, hex.EncodeToString(sum[:]), results[1].Checksum)
+
+		// 相対パスには小さなマニフェストが保存される
+		manifestInfo, err := os.Stat(filepath.Join(rootDir, "dumps", "dump2.sql"))
+		require.NoError(t, err)
+		require.Less(t, manifestInfo.Size(), int64(len(inserted)/10))
+
+		infos, err := session.List(context.Background(), "")
+		require.NoError(t, err)
+		require.Len(t, infos, 2)
+		require.Equal(t, "dumps/dump2.sql", infos[1].RelativePath)
+		require.Equal(t, int64(len(inserted)), infos[1].Size)
+		require.Equal(t, hex.EncodeToString(sum[:]), infos[1].Checksum)
+		require.Equal(t, "-rw-------", infos[1].Metadata["mode"])
+
+		info, err := session.Stat(context.Background(), "dumps/dump2.sql")
+		require.NoError(t, err)
+		require.Equal(t, infos[1].Checksum, info.Checksum)
+
+		// 同じ内容はマニフェストも書き換えずにスキップする
+		require.NoError(t, session.Save(insertedPath, "dumps/dump2.sql"))
+		require.Equal(t, 1, session.SkippedCount())
+
+		restore, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: rootDir, Dedup: true})
+		require.NoError(t, err)
+		defer restore.Close()
+
+		restoreDir := t.TempDir()
+		require.NoError(t, restore.RestorePrefix(context.Background(), "dumps/", restoreDir))
+		for name, want := range map[string][]byte{"dump1.sql": original, "dump2.sql": inserted} {
+			data, err := os.ReadFile(filepath.Join(restoreDir, "dumps", name))
+			require.NoError(t, err)
+			require.Equal(t, want, data)
+		}
+
+		restoredInfo, err := os.Stat(filepath.Join(restoreDir, "dumps", "dump2.sql"))
+		require.NoError(t, err)
+		srcInfo, err := os.Stat(insertedPath)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), restoredInfo.Mode().Perm())
+		require.True(t, restoredInfo.ModTime().Equal(srcInfo.ModTime()))
+	})
+
+	t.Run("SaveReader", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir, nil)
+
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(original), "stream.bin", -1))
+		require.NoError(t, session.Save(originalPath, "file.bin"))
+		require.Zero(t, session.Results()[1].BytesWritten, "同じ内容のチャンクは保存済み")
+
+		restore, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: rootDir, Dedup: true})
+		require.NoError(t, err)
+		defer restore.Close()
+
+		reader, err := restore.Open(context.Background(), "stream.bin")
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, original, data)
+	})
+
+	t.Run("GarbageCollect", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir, nil)
+
+		require.NoError(t, session.Save(originalPath, "dump1.sql"))
+		require.NoError(t, session.Save(insertedPath, "dump2.sql"))
+
+		report, err := session.GarbageCollect(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 2, report.Manifests)
+		require.Zero(t, report.DeletedChunks)
+
+		require.NoError(t, os.Remove(filepath.Join(rootDir, "dump2.sql")))
+		report, err = session.GarbageCollect(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Manifests)
+		require.NotZero(t, report.DeletedChunks)
+		require.Less(t, report.BytesFreed, int64(len(inserted)/4))
+
+		// 残ったマニフェストはリストアできる
+		restore, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: rootDir, Dedup: true})
+		require.NoError(t, err)
+		defer restore.Close()
+
+		dest := filepath.Join(t.TempDir(), "dump1.sql")
+		require.NoError(t, restore.Restore("dump1.sql", dest))
+		data, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		require.Equal(t, original, data)
+	})
+
+	t.Run("Cleaning", func(t *testing.T) {
+		rootDir := t.TempDir()
+		diskInfo := &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024,
+			freeSpace:  50 * 1024 * 1024 * 1024,
+		}
+		session := newSession(t, rootDir, diskInfo)
+
+		require.NoError(t, session.Save(originalPath, "old.sql"))
+		require.NoError(t, session.Save(insertedPath, "new.sql"))
+		past := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(rootDir, "old.sql"), past, past))
+
+		// 少しだけ空き容量が足りない状態にする
+		diskInfo.SetFreeSpace(20*1024*1024*1024 - 1)
+		session.performCleaning(CleaningTriggerCheckInterval)
+
+		records := session.CleaningRecords()
+		require.Len(t, records, 1)
+		require.NoError(t, records[0].Err)
+		require.NotZero(t, records[0].FilesDeleted)
+
+		// 古いマニフェストだけが削除され、新しいマニフェストのチャンクは残る
+		_, err := os.Stat(filepath.Join(rootDir, "old.sql"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		restore, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: rootDir, Dedup: true})
+		require.NoError(t, err)
+		defer restore.Close()
+
+		dest := filepath.Join(t.TempDir(), "new.sql")
+		require.NoError(t, restore.Restore("new.sql", dest))
+		data, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		require.Equal(t, inserted, data)
+	})
+
+	t.Run("CorruptedChunk", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir, nil)
+		require.NoError(t, session.Save(originalPath, "dump1.sql"))
+
+		err := filepath.WalkDir(filepath.Join(rootDir, chunkDirName), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			return os.WriteFile(path, []byte("corrupted"), 0644)
+		})
+		require.NoError(t, err)
+
+		restore, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: rootDir, Dedup: true})
+		require.NoError(t, err)
+		defer restore.Close()
+
+		err = restore.Restore("dump1.sql", filepath.Join(t.TempDir(), "dump1.sql"))
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+	})
+
+	t.Run("ReservedPath", func(t *testing.T) {
+		session := newSession(t, t.TempDir(), nil)
+		err := session.Save(originalPath, chunkDirName+"/ab/file")
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		_, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            t.TempDir(),
+			FreeSpaceThreshold: 10,
+			TargetFreeSpace:    20,
+			Dedup:              DedupConfig{Enabled: true, MinChunkSize: 8 * 1024 * 1024},
+		})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+
+		_, err = NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            t.TempDir(),
+			FreeSpaceThreshold: 10,
+			TargetFreeSpace:    20,
+			PreserveMetadata:   MetadataPreservation{Xattrs: true},
+			Dedup:              DedupConfig{Enabled: true},
+		})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+}
+
+// compressibleTestData は圧縮しやすいログ形式のテストデータを返す
+func compressibleTestData(lines int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&buf, "2024-01-01T00:00:%02dZ INFO request handled path=/api/items/%d status=200\n", i%60, i)
+	}
+	return buf.Bytes()
+}
+
+func TestLocalBackupSession_Compression(t *testing.T) {
+	newSession := func(t *testing.T, rootDir string, compression CompressionConfig) *LocalBackupSession {
+		session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            rootDir,
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo: &MockDiskInfoProvider{
+					totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+					freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+				},
+			},
+			PreserveMetadata: MetadataPreservation{Times: true},
+			Incremental:      IncrementalChecksum,
+			Compression:      compression,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+
+	content := compressibleTestData(2000)
+	random, _ := dedupTestData(64 * 1024)
+	srcDir := t.TempDir()
+	logPath := filepath.Join(srcDir, "app.log")
+	imagePath := filepath.Join(srcDir, "photo.jpg")
+	randomPath := filepath.Join(srcDir, "random.bin")
+	require.NoError(t, os.WriteFile(logPath, content, 0600))
+	require.NoError(t, os.WriteFile(imagePath, content, 0644))
+	require.NoError(t, os.WriteFile(randomPath, random, 0644))
+	sum := sha256.Sum256(content)
+
+	for _, algorithm := range []Compression{CompressionGzip, CompressionZstd} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			rootDir := t.TempDir()
+			session := newSession(t, rootDir, CompressionConfig{Algorithm: algorithm})
+
+			require.NoError(t, session.Save(logPath, "logs/app.log"))
+			result := session.Results()[0]
+			require.Equal(t, filepath.Join(rootDir, "logs", "app.log"+compressedSuffixes[algorithm]), result.Destination)
+			require.Less(t, result.BytesWritten, int64(len(content)/5))
+			require.Equal(t, hex.EncodeToString(sum[:]), result.Checksum)
+
+			infos, err := session.List(context.Background(), "logs/")
+			require.NoError(t, err)
+			require.Len(t, infos, 1)
+			require.Equal(t, "logs/app.log", infos[0].RelativePath)
+			require.Equal(t, string(algorithm), infos[0].Metadata["compression"])
+
+			info, err := session.Stat(context.Background(), "logs/app.log")
+			require.NoError(t, err)
+			require.Equal(t, int64(len(content)), info.Size)
+			require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+
+			// 同じ内容は展開して比較してスキップする
+			require.NoError(t, session.Save(logPath, "logs/app.log"))
+			require.Equal(t, 1, session.SkippedCount())
+
+			restore, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: rootDir})
+			require.NoError(t, err)
+			defer restore.Close()
+
+			restoreDir := t.TempDir()
+			require.NoError(t, restore.RestorePrefix(context.Background(), "logs/", restoreDir))
+			restoredPath := filepath.Join(restoreDir, "logs", "app.log")
+			data, err := os.ReadFile(restoredPath)
+			require.NoError(t, err)
+			require.Equal(t, content, data)
+
+			restoredInfo, err := os.Stat(restoredPath)
+			require.NoError(t, err)
+			srcInfo, err := os.Stat(logPath)
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0600), restoredInfo.Mode().Perm())
+			require.True(t, restoredInfo.ModTime().Equal(srcInfo.ModTime()))
+
+			reader, err := restore.Open(context.Background(), "logs/app.log")
+			require.NoError(t, err)
+			data, err = io.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+			require.Equal(t, content, data)
+		})
+	}
+
+	t.Run("SkipCompressed", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir, CompressionConfig{Algorithm: CompressionGzip, SkipExtensions: []string{".LOG"}})
+
+		require.NoError(t, session.Save(imagePath, "photo.jpg"))
+		require.NoError(t, session.Save(randomPath, "random.bin"))
+		require.NoError(t, session.Save(logPath, "app.log"))
+
+		// 拡張子、エントロピー、追加の拡張子のいずれかで圧縮しない
+		for _, name := range []string{"photo.jpg", "random.bin", "app.log"} {
+			_, err := os.Stat(filepath.Join(rootDir, name))
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("ReplacesOtherFormat", func(t *testing.T) {
+		rootDir := t.TempDir()
+		compressed := newSession(t, rootDir, CompressionConfig{Algorithm: CompressionZstd})
+		require.NoError(t, compressed.Save(logPath, "app.log"))
+
+		// 圧縮をやめて保存し直すと圧縮したファイルは削除される
+		rotatedPath := filepath.Join(t.TempDir(), "app.log")
+		require.NoError(t, os.WriteFile(rotatedPath, []byte("rotated"), 0600))
+		plain := newSession(t, rootDir, CompressionConfig{})
+		require.NoError(t, plain.Save(rotatedPath, "app.log"))
+
+		_, err := os.Stat(filepath.Join(rootDir, "app.log"+compressedSuffixes[CompressionZstd]))
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		infos, err := plain.List(context.Background(), "")
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		require.Empty(t, infos[0].Metadata["compression"])
+	})
+
+	t.Run("CorruptedFile", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir, CompressionConfig{Algorithm: CompressionGzip})
+		require.NoError(t, session.Save(logPath, "app.log"))
+		require.NoError(t, os.WriteFile(filepath.Join(rootDir, "app.log.safebackup.gz"), []byte("not gzip"), 0600))
+
+		restore, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: rootDir})
+		require.NoError(t, err)
+		defer restore.Close()
+
+		err = restore.Restore("app.log", filepath.Join(t.TempDir(), "app.log"))
+		require.ErrorIs(t, err, ErrRestoreFailed)
+	})
+
+	t.Run("ReservedSuffix", func(t *testing.T) {
+		session := newSession(t, t.TempDir(), CompressionConfig{})
+		err := session.Save(logPath, "app.log.safebackup.gz")
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		for _, config := range []LocalBackupSessionConfig{
+			{Compression: CompressionConfig{Algorithm: "lzma"}},
+			{Compression: CompressionConfig{Algorithm: CompressionGzip, Level: 10}},
+			{Compression: CompressionConfig{Algorithm: CompressionZstd, Level: 23}},
+			{Compression: CompressionConfig{Algorithm: CompressionZstd}, Dedup: DedupConfig{Enabled: true}},
+		} {
+			config.RootDir = t.TempDir()
+			config.FreeSpaceThreshold = 10
+			config.TargetFreeSpace = 20
+			_, err := NewLocalBackupSession(config)
+			require.ErrorIs(t, err, ErrInvalidConfig)
+		}
+	})
+}
+
+// testKeyProvider は鍵のIDごとに異なる固定の鍵を持つ StaticKeyProvider を返す
+func testKeyProvider(t *testing.T, currentKeyID string, keyIDs ...string) *StaticKeyProvider {
+	keys := map[string][]byte{}
+	for _, keyID := range append(keyIDs, currentKeyID) {
+		key := sha256.Sum256([]byte(keyID))
+		keys[keyID] = key[:]
+	}
+	provider, err := NewStaticKeyProvider(currentKeyID, keys)
+	require.NoError(t, err)
+	return provider
+}
+
+func TestLocalBackupSession_Encryption(t *testing.T) {
+	newSession := func(t *testing.T, rootDir string, keys KeyProvider) *LocalBackupSession {
+		session, err := NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            rootDir,
+			FreeSpaceThreshold: 10 * 1024 * 1024 * 1024,
+			TargetFreeSpace:    20 * 1024 * 1024 * 1024,
+			CleaningConfig: cleaner.CleaningConfig{
+				DiskInfo: &MockDiskInfoProvider{
+					totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+					freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+				},
+			},
+			PreserveMetadata: MetadataPreservation{Times: true},
+			Incremental:      IncrementalChecksum,
+			Compression:      CompressionConfig{Algorithm: CompressionZstd},
+			KeyProvider:      keys,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+	newRestore := func(t *testing.T, rootDir string, keys KeyProvider) *LocalRestoreSession {
+		restore, err := NewLocalRestoreSession(LocalRestoreSessionConfig{RootDir: rootDir, KeyProvider: keys})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = restore.Close() })
+		return restore
+	}
+
+	content := compressibleTestData(2000)
+	sum := sha256.Sum256(content)
+	srcDir := t.TempDir()
+	logPath := filepath.Join(srcDir, "app.log")
+	require.NoError(t, os.WriteFile(logPath, content, 0600))
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		rootDir := t.TempDir()
+		keys := testKeyProvider(t, "key-1")
+
+		// 暗号化せずに保存したファイルは、暗号化を有効にすると保存し直して置き換える
+		require.NoError(t, newSession(t, rootDir, nil).Save(logPath, "logs/app.log"))
+		session := newSession(t, rootDir, keys)
+		require.NoError(t, session.Save(logPath, "logs/app.log"))
+		require.Equal(t, 0, session.SkippedCount())
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(content), "logs/stream.log", -1))
+
+		encryptedPath := filepath.Join(rootDir, "logs", "app.log"+encryptedSuffix)
+		result := session.Results()[0]
+		require.Equal(t, encryptedPath, result.Destination)
+		require.Equal(t, hex.EncodeToString(sum[:]), result.Checksum)
+		require.Less(t, result.BytesWritten, int64(len(content)/5), "暗号化する前に圧縮する")
+		_, err := os.Stat(filepath.Join(rootDir, "logs", "app.log"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		stored, err := os.ReadFile(filepath.Join(rootDir, "logs", "stream.log"+encryptedSuffix))
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(stored, content[:64]), "平文が含まれてはいけない")
+
+		infos, err := session.List(context.Background(), "logs/")
+		require.NoError(t, err)
+		require.Len(t, infos, 2)
+		require.Equal(t, "logs/app.log", infos[0].RelativePath)
+		require.Equal(t, "aes-256-gcm", infos[0].Metadata["encryption"])
+
+		info, err := session.Stat(context.Background(), "logs/app.log")
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), info.Size)
+		require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+		require.Equal(t, "key-1", info.Metadata["encryption-key-id"])
+		require.Equal(t, "zstd", info.Metadata["compression"])
+
+		// 同じ内容は復号して比較してスキップする
+		require.NoError(t, session.Save(logPath, "logs/app.log"))
+		require.Equal(t, 1, session.SkippedCount())
+
+		restore := newRestore(t, rootDir, keys)
+		restoreDir := t.TempDir()
+		require.NoError(t, restore.RestorePrefix(context.Background(), "logs/", restoreDir))
+		for _, name := range []string{"app.log", "stream.log"} {
+			data, err := os.ReadFile(filepath.Join(restoreDir, "logs", name))
+			require.NoError(t, err)
+			require.Equal(t, content, data)
+		}
+
+		reader, err := restore.Open(context.Background(), "logs/app.log")
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, content, data)
+	})
+
+	t.Run("KeyRotation", func(t *testing.T) {
+		rootDir := t.TempDir()
+		require.NoError(t, newSession(t, rootDir, testKeyProvider(t, "key-1")).Save(logPath, "old.log"))
+
+		// 新しい鍵に切り替えても、古い鍵を残しておけば古いバックアップを復号できる
+		rotated := testKeyProvider(t, "key-2", "key-1")
+		session := newSession(t, rootDir, rotated)
+		require.NoError(t, session.Save(logPath, "new.log"))
+		info, err := session.Stat(context.Background(), "new.log")
+		require.NoError(t, err)
+		require.Equal(t, "key-2", info.Metadata["encryption-key-id"])
+
+		restore := newRestore(t, rootDir, rotated)
+		for _, name := range []string{"old.log", "new.log"} {
+			dest := filepath.Join(t.TempDir(), name)
+			require.NoError(t, restore.Restore(name, dest))
+			data, err := os.ReadFile(dest)
+			require.NoError(t, err)
+			require.Equal(t, content, data)
+		}
+
+		// 古い鍵を持たない場合は鍵が見つからない
+		err = newRestore(t, rootDir, testKeyProvider(t, "key-2")).Restore("old.log", filepath.Join(t.TempDir(), "old.log"))
+		require.ErrorIs(t, err, ErrRestoreFailed)
+		require.ErrorIs(t, err, ErrKeyNotFound)
+
+		// 鍵を指定しない場合はリストアできない
+		err = newRestore(t, rootDir, nil).Restore("new.log", filepath.Join(t.TempDir(), "new.log"))
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		rootDir := t.TempDir()
+		keys := testKeyProvider(t, "key-1")
+		require.NoError(t, newSession(t, rootDir, keys).Save(logPath, "app.log"))
+
+		path := filepath.Join(rootDir, "app.log"+encryptedSuffix)
+		stored, err := os.ReadFile(path)
+		require.NoError(t, err)
+		tampered := append([]byte{}, stored...)
+		tampered[len(tampered)-1] ^= 0xff
+
+		for name, data := range map[string][]byte{"Modified": tampered, "Truncated": stored[:len(stored)-1]} {
+			t.Run(name, func(t *testing.T) {
+				require.NoError(t, os.WriteFile(path, data, 0600))
+				err := newRestore(t, rootDir, keys).Restore("app.log", filepath.Join(t.TempDir(), "app.log"))
+				require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+			})
+		}
+	})
+
+	t.Run("ChunkBoundary", func(t *testing.T) {
+		keys := testKeyProvider(t, "key-1")
+		plain := bytes.Repeat([]byte("x"), 2*encryptionChunkSize)
+
+		for _, size := range []int{0, 1, encryptionChunkSize, len(plain)} {
+			var buf bytes.Buffer
+			_, _, err := copyEncoded(context.Background(), &buf, bytes.NewReader(plain[:size]), storageEncoding{keys: keys})
+			require.NoError(t, err)
+
+			r, _, _, err := openBackupContent(context.Background(), bytes.NewReader(buf.Bytes()), CompressionNone, true, keys)
+			require.NoError(t, err)
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, plain[:size], data)
+
+			// 最後のチャンクを丸ごと取り除いても検出する
+			if size == len(plain) {
+				truncated := buf.Bytes()[:buf.Len()-encryptionChunkSize-16]
+				r, _, _, err := openBackupContent(context.Background(), bytes.NewReader(truncated), CompressionNone, true, keys)
+				require.NoError(t, err)
+				_, err = io.ReadAll(r)
+				require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+			}
+		}
+	})
+
+	t.Run("KeyFile", func(t *testing.T) {
+		keyDir := t.TempDir()
+		key := sha256.Sum256([]byte("key file"))
+		rawPath := filepath.Join(keyDir, "raw.key")
+		hexPath := filepath.Join(keyDir, "hex.key")
+		invalidPath := filepath.Join(keyDir, "invalid.key")
+		require.NoError(t, os.WriteFile(rawPath, key[:], 0600))
+		require.NoError(t, os.WriteFile(hexPath, []byte(hex.EncodeToString(key[:])+"\n"), 0600))
+		require.NoError(t, os.WriteFile(invalidPath, []byte("short"), 0600))
+
+		rootDir := t.TempDir()
+		raw, err := NewKeyFileProvider("raw", map[string]string{"raw": rawPath})
+		require.NoError(t, err)
+		require.NoError(t, newSession(t, rootDir, raw).Save(logPath, "app.log"))
+
+		// 同じ鍵を別の形式で記録したファイルでも復号できる
+		encoded, err := NewKeyFileProvider("raw", map[string]string{"raw": hexPath})
+		require.NoError(t, err)
+		dest := filepath.Join(t.TempDir(), "app.log")
+		require.NoError(t, newRestore(t, rootDir, encoded).Restore("app.log", dest))
+
+		_, err = NewKeyFileProvider("invalid", map[string]string{"invalid": invalidPath})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+
+	t.Run("ReservedSuffix", func(t *testing.T) {
+		err := newSession(t, t.TempDir(), nil).Save(logPath, "app.log"+encryptedSuffix)
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		_, err := NewStaticKeyProvider("missing", map[string][]byte{"key-1": make([]byte, 32)})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+		_, err = NewStaticKeyProvider("key-1", map[string][]byte{"key-1": make([]byte, 16)})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+
+		_, err = NewLocalBackupSession(LocalBackupSessionConfig{
+			RootDir:            t.TempDir(),
+			FreeSpaceThreshold: 10,
+			TargetFreeSpace:    20,
+			Dedup:              DedupConfig{Enabled: true},
+			KeyProvider:        testKeyProvider(t, "key-1"),
+		})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+}
+
+func TestLocalBackupSession_Verify(t *testing.T) {
+	newSession := func(t *testing.T, rootDir string, diskInfo *MockDiskInfoProvider, config LocalBackupSessionConfig) *LocalBackupSession {
+		if diskInfo == nil {
+			diskInfo = &MockDiskInfoProvider{
+				totalSpace: 100 * 1024 * 1024 * 1024, // 100GB
+				freeSpace:  50 * 1024 * 1024 * 1024,  // 50GB
+			}
+		}
+		config.RootDir = rootDir
+		config.FreeSpaceThreshold = 10 * 1024 * 1024 * 1024
+		config.TargetFreeSpace = 20 * 1024 * 1024 * 1024
+		config.CleaningConfig.DiskInfo = diskInfo
+		session, err := NewLocalBackupSession(config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+
+	content := compressibleTestData(500)
+	srcDir := t.TempDir()
+	srcPath := filepath.Join(srcDir, "app.log")
+	require.NoError(t, os.WriteFile(srcPath, content, 0644))
+	sum := sha256.Sum256(content)
+
+	t.Run("Sidecar", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir, nil, LocalBackupSessionConfig{ChecksumSidecars: true})
+		require.NoError(t, session.Save(srcPath, "logs/app.log"))
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(content), "logs/stream.log", -1))
+
+		// sha256sum -c で検証できる形式
+		data, err := os.ReadFile(filepath.Join(rootDir, "logs", "app.log"+sidecarSuffix))
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(sum[:])+"  app.log\n", string(data))
+
+		// サイドカーは一覧に含まれず、保存先として予約されている
+		infos, err := session.List(context.Background(), "")
+		require.NoError(t, err)
+		require.Len(t, infos, 2)
+		require.ErrorIs(t, session.Save(srcPath, "logs/x"+sidecarSuffix), ErrInvalidConfig)
+
+		report, err := session.Verify(context.Background(), "")
+		require.NoError(t, err)
+		require.True(t, report.OK())
+		require.Equal(t, 2, report.Verified)
+	})
+
+	t.Run("Compressed", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir, nil, LocalBackupSessionConfig{
+			ChecksumSidecars: true,
+			Compression:      CompressionConfig{Algorithm: CompressionGzip},
+		})
+		require.NoError(t, session.Save(srcPath, "app.log"))
+
+		// サイドカーには圧縮後の内容のチェックサムを記録する
+		storedPath := filepath.Join(rootDir, "app.log"+compressedSuffixes[CompressionGzip])
+		stored, err := os.ReadFile(storedPath)
+		require.NoError(t, err)
+		storedSum := sha256.Sum256(stored)
+		checksum, err := readSidecar(sidecarPath(storedPath))
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(storedSum[:]), checksum)
+
+		report, err := session.Verify(context.Background(), "")
+		require.NoError(t, err)
+		require.True(t, report.OK())
+		require.Equal(t, 1, report.Verified)
+	})
+
+	t.Run("Problems", func(t *testing.T) {
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir, nil, LocalBackupSessionConfig{ChecksumSidecars: true})
+		for _, name := range []string{"a.log", "b.log", "c.log", "other/d.log"} {
+			require.NoError(t, session.Save(srcPath, name))
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(rootDir, "a.log"), []byte("bit rot"), 0644))
+		require.NoError(t, os.Remove(filepath.Join(rootDir, "b.log")))
+		require.NoError(t, os.Remove(filepath.Join(rootDir, "c.log"+sidecarSuffix)))
+
+		report, err := session.Verify(context.Background(), "")
+		require.NoError(t, err)
+		require.False(t, report.OK())
+		require.Equal(t, 1, report.Verified)
+
+		kinds := map[string]VerifyProblemKind{}
+		for _, problem := range report.Problems {
+			kinds[problem.RelativePath] = problem.Kind
+		}
+		require.Equal(t, map[string]VerifyProblemKind{
+			"a.log": VerifyCorrupted,
+			"b.log": VerifyMissing,
+			"c.log": VerifyNoChecksum,
+		}, kinds)
+
+		// prefix で対象を絞り込む
+		report, err = session.Verify(context.Background(), "other/")
+		require.NoError(t, err)
+		require.True(t, report.OK())
+		require.Equal(t, 1, report.Verified)
+
+		// 保存し直すとサイドカーのないファイルにもサイドカーを作る
+		require.NoError(t, session.Save(srcPath, "a.log"))
+		require.NoError(t, session.Save(srcPath, "c.log"))
+		_, err = os.Stat(filepath.Join(rootDir, "c.log"+sidecarSuffix))
+		require.NoError(t, err)
+	})
+
+	t.Run("Cleaning", func(t *testing.T) {
+		rootDir := t.TempDir()
+		diskInfo := &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024,
+			freeSpace:  50 * 1024 * 1024 * 1024,
+		}
+		// 空き容量の不足分だけ古いファイルから削除させる
+		minFreeSpace := int64(20 * 1024 * 1024 * 1024)
+		session := newSession(t, rootDir, diskInfo, LocalBackupSessionConfig{
+			ChecksumSidecars: true,
+			CleaningConfig:   cleaner.CleaningConfig{MinFreeSpace: &minFreeSpace},
+		})
+		require.NoError(t, session.Save(srcPath, "old.log"))
+		require.NoError(t, session.Save(srcPath, "new.log"))
+
+		// データファイルだけが古くなった場合もサイドカーを一緒に削除する
+		// go-backup-cleanerは時間枠の先頭を基準に削除するため、枠の先頭の時刻にする
+		past := time.Now().Add(-time.Hour).Truncate(time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(rootDir, "old.log"), past, past))
+
+		diskInfo.SetFreeSpace(20*1024*1024*1024 - 1)
+		session.performCleaning(CleaningTriggerCheckInterval)
+		records := session.CleaningRecords()
+		require.Len(t, records, 1)
+		require.NoError(t, records[0].Err)
+
+		_, err := os.Stat(filepath.Join(rootDir, "old.log"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+		_, err = os.Stat(filepath.Join(rootDir, "old.log"+sidecarSuffix))
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		report, err := session.Verify(context.Background(), "")
+		require.NoError(t, err)
+		require.True(t, report.OK(), "%+v", report.Problems)
+	})
+
+	t.Run("CleaningStopsAtSidecar", func(t *testing.T) {
+		rootDir := t.TempDir()
+		diskInfo := &MockDiskInfoProvider{
+			totalSpace: 100 * 1024 * 1024 * 1024,
+			freeSpace:  50 * 1024 * 1024 * 1024,
+		}
+		var mu sync.Mutex
+		var deleted []string
+		minFreeSpace := int64(20 * 1024 * 1024 * 1024)
+		session := newSession(t, rootDir, diskInfo, LocalBackupSessionConfig{
+			ChecksumSidecars: true,
+			CleaningConfig: cleaner.CleaningConfig{
+				MinFreeSpace: &minFreeSpace,
+				Callbacks: cleaner.Callbacks{
+					OnFileDeleted: func(info cleaner.FileDeletedInfo) {
+						mu.Lock()
+						defer mu.Unlock()
+						deleted = append(deleted, filepath.Base(info.Path))
+					},
+				},
+			},
+		})
+		require.NoError(t, session.Save(srcPath, "old.log"))
+		require.NoError(t, session.Save(srcPath, "new.log"))
+
+		// サイドカーだけが最も古い時間枠にあり、その削除で目標に達する
+		past := time.Now().Add(-2 * time.Hour).Truncate(time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(rootDir, "old.log"+sidecarSuffix), past, past))
+
+		diskInfo.SetFreeSpace(20*1024*1024*1024 - 1)
+		session.performCleaning(CleaningTriggerCheckInterval)
+		records := session.CleaningRecords()
+		require.Len(t, records, 1)
+		require.NoError(t, records[0].Err)
+
+		// サイドカーと組のデータファイルも削除し、両方を削除したファイルとして数える
+		_, err := os.Stat(filepath.Join(rootDir, "old.log"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+		_, err = os.Stat(filepath.Join(rootDir, "old.log"+sidecarSuffix))
+		require.ErrorIs(t, err, os.ErrNotExist)
+		require.FileExists(t, filepath.Join(rootDir, "new.log"))
+		require.FileExists(t, filepath.Join(rootDir, "new.log"+sidecarSuffix))
+		require.Equal(t, 2, records[0].FilesDeleted)
+		mu.Lock()
+		require.ElementsMatch(t, []string{"old.log", "old.log" + sidecarSuffix}, deleted)
+		mu.Unlock()
+
+		report, err := session.Verify(context.Background(), "")
+		require.NoError(t, err)
+		require.True(t, report.OK(), "%+v", report.Problems)
+		require.Equal(t, 1, report.Verified)
+	})
+
+	t.Run("Dedup", func(t *testing.T) {
+		original, inserted := dedupTestData(256 * 1024)
+		require.NoError(t, os.WriteFile(filepath.Join(srcDir, "dump1.sql"), original, 0600))
+		require.NoError(t, os.WriteFile(filepath.Join(srcDir, "dump2.sql"), inserted, 0600))
+
+		rootDir := t.TempDir()
+		session := newSession(t, rootDir, nil, LocalBackupSessionConfig{Dedup: dedupTestConfig})
+		require.NoError(t, session.Save(filepath.Join(srcDir, "dump1.sql"), "dump1.sql"))
+		require.NoError(t, session.Save(filepath.Join(srcDir, "dump2.sql"), "dump2.sql"))
+
+		report, err := session.Verify(context.Background(), "")
+		require.NoError(t, err)
+		require.True(t, report.OK())
+		require.Equal(t, 2, report.Verified)
+
+		// 共有するチャンクを1つ壊し、別のチャンクを1つ削除する
+		m, err := readManifestFile(filepath.Join(rootDir, "dump1.sql"), "dump1.sql")
+		require.NoError(t, err)
+		store := &localChunkStore{rootDir: rootDir}
+		require.NoError(t, os.WriteFile(store.chunkFile(m.Chunks[0].Hash), []byte("corrupted"), 0644))
+		require.NoError(t, os.Remove(store.chunkFile(m.Chunks[len(m.Chunks)-1].Hash)))
+
+		report, err = session.Verify(context.Background(), "dump1")
+		require.NoError(t, err)
+		require.Zero(t, report.Verified)
+		require.Len(t, report.Problems, 2)
+		require.Equal(t, VerifyCorrupted, report.Problems[0].Kind)
+		require.Equal(t, m.Chunks[0].Hash, report.Problems[0].Expected)
+		require.Equal(t, VerifyMissing, report.Problems[1].Kind)
+		require.Equal(t, "dump1.sql", report.Problems[1].RelativePath)
+	})
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package safebackup
+
+import "os"
+
+// syncDir はディレクトリをfsyncし、エントリの変更（リネーム等）を永続化する
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+
+	return d.Sync()
+}
@@ -0,0 +1,351 @@
+package safebackup
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cleaner "github.com/ideamans/go-backup-cleaner"
+)
+
+// sidecarSuffix はサイドカーファイルに付ける接尾辞
+// サイドカーにはデータファイルに保存した内容（圧縮・暗号化した場合は変換後）のSHA-256を sha256sum の形式で記録する
+const sidecarSuffix = ".safebackup.sha256"
+
+// sidecarPath はデータファイルのサイドカーのパスを返す
+func sidecarPath(path string) string {
+	return path + sidecarSuffix
+}
+
+// isSidecar はファイル名がサイドカーのものかどうかを返す
+func isSidecar(name string) bool {
+	return strings.HasSuffix(name, sidecarSuffix) && len(name) > len(sidecarSuffix)
+}
+
+// writeSidecar は path に保存した内容のチェックサムをサイドカーにアトミックに書き込む
+// クリーニングでデータファイルと一緒に削除されるように、更新日時はデータファイルに合わせる
+func writeSidecar(path, checksum string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat backup file: %w", err)
+	}
+
+	sidecar := sidecarPath(path)
+	line := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(path))
+	if _, err := writeAtomic(strings.NewReader(line), sidecar, nil, MetadataPreservation{}); err != nil {
+		return fmt.Errorf("failed to write checksum sidecar: %w", err)
+	}
+	if err := os.Chtimes(sidecar, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("failed to set checksum sidecar times: %w", err)
+	}
+	return nil
+}
+
+// readSidecar はサイドカーに記録したチェックサムを返す
+func readSidecar(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	line, err := bufio.NewReader(io.LimitReader(file, 4096)).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	checksum, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if _, err := hex.DecodeString(checksum); err != nil || len(checksum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid checksum sidecar %s", path)
+	}
+	return checksum, nil
+}
+
+// updateSidecar は保存したファイルのサイドカーを書き込む
+// サイドカーを書かない設定でも、古い内容のサイドカーが残らないように削除する
+func (s *LocalBackupSession) updateSidecar(path, checksum string) error {
+	if !s.config.ChecksumSidecars {
+		removeSidecar(path)
+		return nil
+	}
+	return writeSidecar(path, checksum)
+}
+
+// removeSidecar はデータファイルのサイドカーがあれば削除する
+func removeSidecar(path string) {
+	_ = os.Remove(sidecarPath(path))
+}
+
+// hasSidecar は destPath に保存したバックアップのサイドカーがあるかどうかを返す
+func hasSidecar(destPath string) bool {
+	path, _, _ := findBackupVariant(destPath)
+	info, err := os.Stat(sidecarPath(path))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// sidecarCleaning はgo-backup-cleanerにデータファイルとサイドカーを組で削除させる
+// go-backup-cleanerはサイドカーも独立したファイルとして削除するため、どちらかが削除されたらもう一方も削除する
+// サイドカーの更新日時はデータファイルと同じため通常は一緒に削除されるが、更新日時が変えられた場合に片方だけが残らないようにする
+type sidecarCleaning struct {
+	threshold time.Time // go-backup-cleanerが削除する更新日時の上限
+	mu        sync.Mutex
+	files     int   // go-backup-cleanerの代わりに削除したファイル数
+	size      int64 // go-backup-cleanerの代わりに削除したサイズ
+}
+
+// callbacks は callbacks に組の削除を加えたコールバックを返す
+// 代わりに削除したファイルも callbacks.OnFileDeleted に渡す
+func (c *sidecarCleaning) callbacks(callbacks cleaner.Callbacks) cleaner.Callbacks {
+	onScanComplete := callbacks.OnScanComplete
+	callbacks.OnScanComplete = func(info cleaner.ScanCompleteInfo) {
+		c.threshold = info.TimeThreshold
+		if onScanComplete != nil {
+			onScanComplete(info)
+		}
+	}
+
+	onFileDeleted := callbacks.OnFileDeleted
+	callbacks.OnFileDeleted = func(info cleaner.FileDeletedInfo) {
+		pair := sidecarPath(info.Path)
+		if isSidecar(filepath.Base(info.Path)) {
+			pair = strings.TrimSuffix(info.Path, sidecarSuffix)
+		}
+		if onFileDeleted != nil {
+			onFileDeleted(info)
+		}
+		if deleted, ok := c.remove(pair); ok && onFileDeleted != nil {
+			onFileDeleted(deleted)
+		}
+	}
+	return callbacks
+}
+
+// remove はgo-backup-cleanerが削除しない path を削除する
+// 更新日時が threshold より前のファイルはgo-backup-cleanerが削除するため、競合しないように触れない
+func (c *sidecarCleaning) remove(path string) (cleaner.FileDeletedInfo, bool) {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || info.ModTime().Before(c.threshold) {
+		return cleaner.FileDeletedInfo{}, false
+	}
+	if err := os.Remove(path); err != nil {
+		return cleaner.FileDeletedInfo{}, false
+	}
+
+	c.mu.Lock()
+	c.files++
+	c.size += info.Size()
+	c.mu.Unlock()
+	return cleaner.FileDeletedInfo{Path: path, Size: info.Size(), ModTime: info.ModTime()}, true
+}
+
+// addTo は代わりに削除したファイルを report に加える
+func (c *sidecarCleaning) addTo(report *cleaner.CleaningReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report.DeletedFiles += c.files
+	report.DeletedSize += c.size
+}
+
+// Verify は相対パスが prefix で始まるバックアップを読み直し、記録したチェックサムと照合する
+// ChecksumSidecars で書いたサイドカーと内容が一致しないファイル、サイドカーだけが残ったファイル、
+// サイドカーのないファイルを VerifyReport.Problems に報告する
+// 重複排除モードでは、マニフェストが参照するチャンクが存在し、内容がハッシュと一致するかを検証する
+// 問題が見つかってもエラーは返さず、ディレクトリを列挙できない場合等にのみエラーを返す
+func (s *LocalBackupSession) Verify(ctx context.Context, prefix string) (VerifyReport, error) {
+	if err := s.beginSave(); err != nil {
+		return VerifyReport{}, err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	if s.config.Dedup.Enabled {
+		return s.verifyDeduplicated(ctx, prefix)
+	}
+	return verifySidecars(ctx, s.config.RootDir, prefix)
+}
+
+// verifySidecars は rootDir 以下のバックアップをサイドカーと照合する
+func verifySidecars(ctx context.Context, rootDir, prefix string) (VerifyReport, error) {
+	var report VerifyReport
+	sidecars := map[string]bool{} // サイドカーのパス → 対応するデータファイルがあった
+
+	var dataFiles []string
+	err := filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() && path == filepath.Join(rootDir, chunkDirName) {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), tempFileSuffix) {
+			return nil
+		}
+		if isSidecar(d.Name()) {
+			if _, ok := sidecars[path]; !ok {
+				sidecars[path] = false
+			}
+			return nil
+		}
+		dataFiles = append(dataFiles, path)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	relativePath := func(path string) string {
+		rel, _ := filepath.Rel(rootDir, path)
+		rel, _, _ = splitBackupSuffix(filepath.ToSlash(rel))
+		return rel
+	}
+
+	for _, path := range dataFiles {
+		rel := relativePath(path)
+		if !strings.HasPrefix(rel, prefix) {
+			continue
+		}
+		sidecar := sidecarPath(path)
+		if _, ok := sidecars[sidecar]; !ok {
+			report.Problems = append(report.Problems, VerifyProblem{RelativePath: rel, Path: path, Kind: VerifyNoChecksum})
+			continue
+		}
+		sidecars[sidecar] = true
+
+		expected, err := readSidecar(sidecar)
+		if err != nil {
+			report.Problems = append(report.Problems, VerifyProblem{RelativePath: rel, Path: sidecar, Kind: VerifyUnreadable, Err: err})
+			continue
+		}
+		actual, err := fileSHA256(ctx, path)
+		if err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				// 検証中にクリーニングで削除された
+				continue
+			}
+			report.Problems = append(report.Problems, VerifyProblem{RelativePath: rel, Path: path, Kind: VerifyUnreadable, Err: err})
+			continue
+		}
+		if actual != expected {
+			report.Problems = append(report.Problems, VerifyProblem{RelativePath: rel, Path: path, Kind: VerifyCorrupted, Expected: expected, Actual: actual})
+			continue
+		}
+		report.Verified++
+	}
+
+	// データファイルがないサイドカーはファイルが失われたことを示す
+	var orphans []string
+	for sidecar, matched := range sidecars {
+		if !matched {
+			orphans = append(orphans, sidecar)
+		}
+	}
+	sort.Strings(orphans)
+	for _, sidecar := range orphans {
+		path := strings.TrimSuffix(sidecar, sidecarSuffix)
+		rel := relativePath(path)
+		if !strings.HasPrefix(rel, prefix) {
+			continue
+		}
+		if _, err := os.Lstat(path); err == nil {
+			// シンボリックリンク等に置き換えられた場合や、列挙の後に保存された場合
+			continue
+		}
+		report.Problems = append(report.Problems, VerifyProblem{RelativePath: rel, Path: path, Kind: VerifyMissing})
+	}
+	return report, nil
+}
+
+// verifyDeduplicated は prefix 以下のマニフェストが参照するチャンクを検証する
+// 複数のマニフェストが参照するチャンクは一度だけ読む
+func (s *LocalBackupSession) verifyDeduplicated(ctx context.Context, prefix string) (VerifyReport, error) {
+	s.dedupMu.RLock()
+	defer s.dedupMu.RUnlock()
+
+	var report VerifyReport
+	store := &localChunkStore{rootDir: s.config.RootDir}
+	checked := map[string]*VerifyProblem{} // チャンクのハッシュ → 見つかった問題（問題がなければnil）
+
+	err := store.listManifests(ctx, func(relativePath string, m *manifest) error {
+		if !strings.HasPrefix(relativePath, prefix) {
+			return nil
+		}
+
+		ok := true
+		for _, chunk := range m.Chunks {
+			problem, done := checked[chunk.Hash]
+			if !done {
+				problem = verifyChunk(ctx, store, chunk)
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				checked[chunk.Hash] = problem
+			}
+			if problem != nil {
+				p := *problem
+				p.RelativePath = relativePath
+				report.Problems = append(report.Problems, p)
+				ok = false
+			}
+		}
+		if ok {
+			report.Verified++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to verify manifests: %w", err)
+	}
+	return report, nil
+}
+
+// verifyChunk はチャンクが存在し、内容がハッシュと一致するかを検証する（問題がなければnil）
+func verifyChunk(ctx context.Context, store *localChunkStore, chunk manifestChunk) *VerifyProblem {
+	path := store.chunkFile(chunk.Hash)
+	actual, err := fileSHA256(ctx, path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return &VerifyProblem{Path: path, Kind: VerifyMissing}
+	case err != nil:
+		return &VerifyProblem{Path: path, Kind: VerifyUnreadable, Err: err}
+	case actual != chunk.Hash:
+		return &VerifyProblem{Path: path, Kind: VerifyCorrupted, Expected: chunk.Hash, Actual: actual}
+	}
+	return nil
+}
+
+// fileSHA256 はファイルの内容のSHA-256を返す
+func fileSHA256(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, &contextReader{ctx: ctx, r: file}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package safebackup
+
+// syncDir はWindowsではディレクトリのfsyncがサポートされないため何もしない
+func syncDir(dir string) error {
+	return nil
+}
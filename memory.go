@@ -0,0 +1,469 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryReadChunkSize は BytesPerSecond を指定した場合に1回で読み込む最大のサイズ
+const memoryReadChunkSize = 32 * 1024
+
+// MemoryFile はメモリ上のバックアップセッションに保存されたファイル
+type MemoryFile struct {
+	// RelativePath はバックアップ先での相対パス（"/" 区切り）
+	RelativePath string
+
+	// SourcePath は保存元のファイルパス（SaveReader で保存した場合は空）
+	SourcePath string
+
+	// Content は保存した内容
+	Content []byte
+
+	// Checksum は内容のSHA-256（16進数表記）
+	Checksum string
+
+	// SymlinkTarget は SymlinkPreserve で保存したシンボリックリンクのリンク先（ファイルの場合は空）
+	SymlinkTarget string
+
+	// ModTime は保存した日時
+	ModTime time.Time
+}
+
+// MemoryBackupSession は保存した内容をメモリに保持するバックアップセッション実装
+// アプリケーションのテストやドライランで、実際のバックアップ先の代わりに使う
+// 保存は呼び出し元のゴルーチンで行われ、複数のゴルーチンから同時に呼び出せる
+// 失敗した保存は内容を残さず、同じ相対パスに保存済みの内容はそのまま残る
+type MemoryBackupSession struct {
+	config       MemoryBackupSessionConfig
+	failPatterns patternList
+	mu           sync.Mutex // files と attempts の排他制御
+	files        map[string]MemoryFile
+	attempts     int       // これまでに開始した保存の数
+	results      resultLog // ファイルごとの結果
+	ctx          context.Context
+	cancel       context.CancelFunc // ctx のキャンセル
+	closeMu      sync.RWMutex       // closed の排他制御
+	closed       bool
+	saves        sync.WaitGroup // 実行中の保存処理
+}
+
+// NewMemoryBackupSession はメモリ上のバックアップセッションインスタンスを作成
+func NewMemoryBackupSession(config MemoryBackupSessionConfig) (*MemoryBackupSession, error) {
+	// 設定の検証
+	if err := validateMemoryConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	failPatterns, err := compilePatterns(config.FailPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MemoryBackupSession{
+		config:       config,
+		failPatterns: failPatterns,
+		files:        map[string]MemoryFile{},
+		ctx:          ctx,
+		cancel:       cancel,
+	}, nil
+}
+
+// Save はファイルの内容をメモリに保存する
+func (s *MemoryBackupSession) Save(localFilePath, relativePath string) error {
+	return s.SaveContext(context.Background(), localFilePath, relativePath)
+}
+
+// SaveContext はファイルの内容をメモリに保存する
+// ctx またはセッションがキャンセルされると遅延や読み込みを中断する
+func (s *MemoryBackupSession) SaveContext(ctx context.Context, localFilePath, relativePath string) error {
+	// 入力検証
+	if localFilePath == "" || relativePath == "" {
+		return fmt.Errorf("%w: empty file path", ErrInvalidConfig)
+	}
+
+	return s.save(ctx, localFilePath, relativePath, func(ctx context.Context) (MemoryFile, error) {
+		file, err := os.Open(localFilePath)
+		if err != nil {
+			return MemoryFile{}, fmt.Errorf("failed to open source file: %w", err)
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+
+		info, err := file.Stat()
+		if err != nil {
+			return MemoryFile{}, fmt.Errorf("failed to stat source file: %w", err)
+		}
+		if !info.Mode().IsRegular() {
+			return MemoryFile{}, fmt.Errorf("%w: source is not a regular file", ErrInvalidConfig)
+		}
+
+		content, err := s.read(ctx, file)
+		if err != nil {
+			return MemoryFile{}, fmt.Errorf("%w: failed to read file: %w", ErrBackupFailed, err)
+		}
+		return MemoryFile{Content: content}, nil
+	})
+}
+
+// SaveReader はReaderから読み込んだデータをメモリに保存する
+// sizeHint はデータサイズが分かっている場合の値（不明な場合は負の値）で、メモリでは使用しない
+func (s *MemoryBackupSession) SaveReader(ctx context.Context, r io.Reader, relativePath string, sizeHint int64) error {
+	// 入力検証
+	if r == nil || relativePath == "" {
+		return fmt.Errorf("%w: empty reader or file path", ErrInvalidConfig)
+	}
+
+	return s.save(ctx, "", relativePath, func(ctx context.Context) (MemoryFile, error) {
+		content, err := s.read(ctx, r)
+		if err != nil {
+			return MemoryFile{}, fmt.Errorf("%w: failed to read stream: %w", ErrBackupFailed, err)
+		}
+		return MemoryFile{Content: content}, nil
+	})
+}
+
+// SaveDir は srcDir 以下のファイルを relativePrefix 以下に保存する
+// 失敗したファイルがあっても残りの保存を続け、最後に *BackupError を返す
+func (s *MemoryBackupSession) SaveDir(ctx context.Context, srcDir, relativePrefix string, opts SaveDirOptions) error {
+	return walkDir(ctx, srcDir, relativePrefix, opts, func(entry dirEntry) *FileError {
+		var err error
+		if entry.linkTarget != "" {
+			target := entry.linkTarget
+			err = s.save(ctx, entry.path, entry.relativePath, func(ctx context.Context) (MemoryFile, error) {
+				return MemoryFile{SymlinkTarget: target}, nil
+			})
+		} else {
+			err = s.SaveContext(ctx, entry.path, entry.relativePath)
+		}
+		if err == nil {
+			return nil
+		}
+		destination, _ := memoryPath(entry.relativePath)
+		return &FileError{
+			RelativePath: entry.relativePath,
+			Destination:  destination,
+			Err:          err,
+		}
+	})
+}
+
+// save は遅延と失敗を注入してから read が返す内容を保存し、結果を記録する
+func (s *MemoryBackupSession) save(ctx context.Context, sourcePath, relativePath string, read func(ctx context.Context) (MemoryFile, error)) error {
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	s.mu.Lock()
+	s.attempts++
+	attempt := s.attempts
+	s.mu.Unlock()
+
+	start := time.Now()
+	destination, err := memoryPath(relativePath)
+	var file MemoryFile
+	if err == nil {
+		if err = sleepContext(ctx, s.config.Latency); err != nil {
+			err = fmt.Errorf("%w: %w", ErrBackupFailed, err)
+		}
+	}
+	if err == nil {
+		err = s.injectedFault(attempt, destination)
+	}
+	if err == nil {
+		file, err = read(ctx)
+	}
+	if err == nil {
+		sum := sha256.Sum256(file.Content)
+		file.RelativePath = destination
+		file.SourcePath = sourcePath
+		file.Checksum = hex.EncodeToString(sum[:])
+		file.ModTime = time.Now()
+
+		s.mu.Lock()
+		s.files[destination] = file
+		s.mu.Unlock()
+	}
+
+	result := FileResult{
+		SourcePath:   sourcePath,
+		RelativePath: relativePath,
+		Destination:  destination,
+		Duration:     time.Since(start),
+		Err:          err,
+	}
+	if err == nil && file.SymlinkTarget == "" {
+		result.BytesWritten = int64(len(file.Content))
+		result.Checksum = file.Checksum
+	}
+	s.results.add(result)
+
+	return err
+}
+
+// injectedFault は attempt 番目の relativePath への保存を設定に従って失敗させる場合にエラーを返す
+func (s *MemoryBackupSession) injectedFault(attempt int, relativePath string) error {
+	if !slices.Contains(s.config.FailNth, attempt) && !s.failPatterns.matchPathOrParent(relativePath) {
+		return nil
+	}
+	cause := s.config.FailError
+	if cause == nil {
+		cause = ErrInjectedFault
+	}
+	return fmt.Errorf("%w: %w", ErrBackupFailed, cause)
+}
+
+// read は r の内容を読み込む
+// BytesPerSecond を指定した場合は、読み込んだ量に見合う時間が経つまで待ちながら読み込む
+func (s *MemoryBackupSession) read(ctx context.Context, r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	reader := &contextReader{ctx: ctx, r: r}
+	rate := s.config.BytesPerSecond
+	if rate <= 0 {
+		_, err := buf.ReadFrom(reader)
+		return buf.Bytes(), err
+	}
+
+	start := time.Now()
+	chunk := make([]byte, min(memoryReadChunkSize, max(rate/10, 1)))
+	for {
+		n, err := reader.Read(chunk)
+		buf.Write(chunk[:n])
+
+		expected := time.Duration(float64(buf.Len()) / float64(rate) * float64(time.Second))
+		if waitErr := sleepContext(ctx, expected-time.Since(start)); waitErr != nil {
+			return nil, waitErr
+		}
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleepContext は d だけ待つ。ctx が先に終了した場合はそのエラーを返す
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// memoryPath は相対パスを "/" 区切りに正規化する
+// 保存先の外を指す相対パスは ErrInvalidConfig になる
+func memoryPath(relativePath string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(relativePath)) {
+		return "", fmt.Errorf("%w: unsafe path %q", ErrInvalidConfig, relativePath)
+	}
+	return path.Clean(filepath.ToSlash(relativePath)), nil
+}
+
+// List は相対パスが prefix で始まる保存済みのファイルを相対パス順に返す
+// 他のセッションと同じく Checksum は含まれない
+func (s *MemoryBackupSession) List(ctx context.Context, prefix string) ([]BackupInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var infos []BackupInfo
+	for relativePath, file := range s.files {
+		if strings.HasPrefix(relativePath, prefix) {
+			info := memoryBackupInfo(file)
+			info.Checksum = ""
+			infos = append(infos, info)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].RelativePath < infos[j].RelativePath
+	})
+	return infos, nil
+}
+
+// Stat は保存済みのファイルの情報を返す
+func (s *MemoryBackupSession) Stat(ctx context.Context, relativePath string) (BackupInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return BackupInfo{}, err
+	}
+
+	file, ok := s.File(relativePath)
+	if !ok {
+		return BackupInfo{}, fmt.Errorf("%w: %s", ErrNotFound, relativePath)
+	}
+	return memoryBackupInfo(file), nil
+}
+
+// memoryBackupInfo は保存したファイルから BackupInfo を作る
+func memoryBackupInfo(file MemoryFile) BackupInfo {
+	info := BackupInfo{
+		RelativePath: file.RelativePath,
+		Destination:  file.RelativePath,
+		Size:         int64(len(file.Content)),
+		ModTime:      file.ModTime,
+		Checksum:     file.Checksum,
+		Metadata:     map[string]string{},
+	}
+	if file.SymlinkTarget != "" {
+		info.Checksum = ""
+		info.Metadata[symlinkMetadataKey] = file.SymlinkTarget
+	}
+	return info
+}
+
+// File は relativePath に保存されたファイルを返す
+// 内容はコピーを返すため、変更しても保存済みの内容には影響しない
+func (s *MemoryBackupSession) File(relativePath string) (MemoryFile, bool) {
+	name, err := memoryPath(relativePath)
+	if err != nil {
+		return MemoryFile{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[name]
+	if !ok {
+		return MemoryFile{}, false
+	}
+	file.Content = bytes.Clone(file.Content)
+	return file, true
+}
+
+// Content は relativePath に保存された内容を返す（保存されていない場合は false）
+func (s *MemoryBackupSession) Content(relativePath string) ([]byte, bool) {
+	file, ok := s.File(relativePath)
+	return file.Content, ok
+}
+
+// Files は保存されたすべてのファイルを相対パス順に返す
+func (s *MemoryBackupSession) Files() []MemoryFile {
+	s.mu.Lock()
+	files := make([]MemoryFile, 0, len(s.files))
+	for _, file := range s.files {
+		file.Content = bytes.Clone(file.Content)
+		files = append(files, file)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].RelativePath < files[j].RelativePath
+	})
+	return files
+}
+
+// Attempts はこれまでに開始した保存の数を返す（失敗した保存を含む）
+func (s *MemoryBackupSession) Attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.attempts
+}
+
+// Reset は保存したファイル、結果、保存の通し番号を消去する
+// 実行中の保存がある間に呼び出した場合、その保存の内容と結果は残る場合がある
+func (s *MemoryBackupSession) Reset() {
+	s.mu.Lock()
+	s.files = map[string]MemoryFile{}
+	s.attempts = 0
+	s.mu.Unlock()
+
+	s.results.reset()
+}
+
+// beginSave は保存処理の開始を記録する
+// クローズ済みのセッションでは ErrSessionClosed を返す
+func (s *MemoryBackupSession) beginSave() error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	s.saves.Add(1)
+	return nil
+}
+
+// WaitForCompletion は他のゴルーチンで実行中の保存の完了を待つ
+func (s *MemoryBackupSession) WaitForCompletion(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.saves.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("backup timeout: %w", ctx.Err())
+	case <-done:
+		return nil
+	}
+}
+
+// Results はこれまでに保存したファイルごとの結果を返す
+func (s *MemoryBackupSession) Results() []FileResult {
+	return s.results.snapshot()
+}
+
+// Close は実行中の保存をキャンセルし、それらが終了するまで待つ
+// 保存した内容はクローズ後も File や Files で参照できる
+func (s *MemoryBackupSession) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+
+	s.cancel()
+	s.saves.Wait()
+	return nil
+}
+
+// validateMemoryConfig はメモリ上のバックアップセッションの設定を検証する
+func validateMemoryConfig(config MemoryBackupSessionConfig) error {
+	if config.Latency < 0 {
+		return fmt.Errorf("%w: latency must not be negative", ErrInvalidConfig)
+	}
+
+	if config.BytesPerSecond < 0 {
+		return fmt.Errorf("%w: bytes per second must not be negative", ErrInvalidConfig)
+	}
+
+	for _, n := range config.FailNth {
+		if n < 1 {
+			return fmt.Errorf("%w: save numbers to fail start at 1: %d", ErrInvalidConfig, n)
+		}
+	}
+
+	return nil
+}
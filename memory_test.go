@@ -0,0 +1,246 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBackupSession(t *testing.T) {
+	newSession := func(t *testing.T, config MemoryBackupSessionConfig) *MemoryBackupSession {
+		session, err := NewMemoryBackupSession(config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+
+	content := compressibleTestData(100)
+	srcPath := filepath.Join(t.TempDir(), "app.log")
+	require.NoError(t, os.WriteFile(srcPath, content, 0644))
+	sum := sha256.Sum256(content)
+
+	t.Run("Conformance", func(t *testing.T) {
+		testBackupSessionConformance(t, func(t *testing.T) BackupSession {
+			return newSession(t, MemoryBackupSessionConfig{})
+		})
+	})
+
+	t.Run("Inspection", func(t *testing.T) {
+		session := newSession(t, MemoryBackupSessionConfig{})
+		require.NoError(t, session.Save(srcPath, "logs/b.log"))
+		require.NoError(t, session.SaveReader(context.Background(), strings.NewReader("CREATE TABLE users;"), "db/dump.sql", -1))
+		require.NoError(t, session.Save(srcPath, "logs/a.log"))
+
+		file, ok := session.File("logs/b.log")
+		require.True(t, ok)
+		require.Equal(t, content, file.Content)
+		require.Equal(t, srcPath, file.SourcePath)
+		require.Equal(t, hex.EncodeToString(sum[:]), file.Checksum)
+
+		dump, ok := session.Content("db/dump.sql")
+		require.True(t, ok)
+		require.Equal(t, []byte("CREATE TABLE users;"), dump)
+
+		// 返した内容を変更しても保存済みの内容は変わらない
+		dump[0] = 'X'
+		dump, _ = session.Content("db/dump.sql")
+		require.Equal(t, []byte("CREATE TABLE users;"), dump)
+
+		_, ok = session.File("missing.log")
+		require.False(t, ok)
+
+		// Files は相対パス順に返す
+		files := session.Files()
+		require.Len(t, files, 3)
+		require.Equal(t, "db/dump.sql", files[0].RelativePath)
+		require.Equal(t, "logs/a.log", files[1].RelativePath)
+
+		// 一覧はチェックサムを含まず、Stat は含む
+		infos, err := session.List(context.Background(), "logs/")
+		require.NoError(t, err)
+		require.Empty(t, infos[0].Checksum)
+
+		info, err := session.Stat(context.Background(), "logs/a.log")
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+		require.False(t, info.ModTime.IsZero())
+	})
+
+	t.Run("FailNth", func(t *testing.T) {
+		session := newSession(t, MemoryBackupSessionConfig{FailNth: []int{2, 4}})
+
+		var failed []int
+		for i := 1; i <= 5; i++ {
+			err := session.SaveReader(context.Background(), strings.NewReader("data"), fmt.Sprintf("%d.log", i), -1)
+			if err != nil {
+				require.ErrorIs(t, err, ErrInjectedFault)
+				require.ErrorIs(t, err, ErrBackupFailed)
+				failed = append(failed, i)
+			}
+		}
+		require.Equal(t, []int{2, 4}, failed)
+		require.Equal(t, 5, session.Attempts())
+
+		// 失敗した保存の内容は残さない
+		_, ok := session.File("2.log")
+		require.False(t, ok)
+		require.Len(t, session.Files(), 3)
+
+		results := session.Results()
+		require.Len(t, results, 5)
+		require.ErrorIs(t, results[1].Err, ErrInjectedFault)
+		require.Zero(t, results[1].BytesWritten)
+
+		// Reset で通し番号も最初から数え直す
+		session.Reset()
+		require.Empty(t, session.Files())
+		require.Empty(t, session.Results())
+		require.NoError(t, session.Save(srcPath, "1.log"))
+		require.Error(t, session.Save(srcPath, "2.log"))
+	})
+
+	t.Run("FailPatterns", func(t *testing.T) {
+		cause := errors.New("disk full")
+		session := newSession(t, MemoryBackupSessionConfig{
+			FailPatterns: []string{"*.tmp", "cache/"},
+			FailError:    cause,
+		})
+
+		err := session.Save(srcPath, "work/data.tmp")
+		require.ErrorIs(t, err, cause)
+		require.ErrorIs(t, err, ErrBackupFailed)
+		require.NotErrorIs(t, err, ErrInjectedFault)
+		require.ErrorIs(t, session.Save(srcPath, "cache/a/b.log"), cause)
+		require.NoError(t, session.Save(srcPath, "work/data.log"))
+
+		// 不正なパターンは設定の誤り
+		_, err = NewMemoryBackupSession(MemoryBackupSessionConfig{FailPatterns: []string{"[a-"}})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+
+	t.Run("SaveDir", func(t *testing.T) {
+		srcDir := createTestTree(t)
+		session := newSession(t, MemoryBackupSessionConfig{FailPatterns: []string{"old.log"}})
+
+		err := session.SaveDir(context.Background(), srcDir, "backup", SaveDirOptions{
+			Exclude:  []string{"node_modules/"},
+			Symlinks: SymlinkPreserve,
+		})
+		var backupErr *BackupError
+		require.ErrorAs(t, err, &backupErr)
+		require.Len(t, backupErr.Failures, 1)
+		require.Equal(t, "backup/logs/old.log", backupErr.Failures[0].Destination)
+		require.ErrorIs(t, backupErr.Failures[0].Err, ErrInjectedFault)
+
+		var paths []string
+		for _, file := range session.Files() {
+			paths = append(paths, file.RelativePath)
+		}
+		require.Equal(t, []string{
+			"backup/a.txt", "backup/big.bin", "backup/link-dir", "backup/link-file",
+			"backup/logs/app.log", "backup/sub/keep.txt",
+		}, paths)
+
+		link, ok := session.File("backup/link-file")
+		require.True(t, ok)
+		require.Equal(t, "a.txt", link.SymlinkTarget)
+		require.Empty(t, link.Content)
+
+		info, err := session.Stat(context.Background(), "backup/link-file")
+		require.NoError(t, err)
+		require.Equal(t, "a.txt", info.Metadata[symlinkMetadataKey])
+	})
+
+	t.Run("Latency", func(t *testing.T) {
+		session := newSession(t, MemoryBackupSessionConfig{Latency: 50 * time.Millisecond})
+
+		start := time.Now()
+		require.NoError(t, session.Save(srcPath, "app.log"))
+		require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+		// 遅延中のキャンセルでは保存しない
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := session.SaveContext(ctx, srcPath, "canceled.log")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		_, ok := session.File("canceled.log")
+		require.False(t, ok)
+	})
+
+	t.Run("BytesPerSecond", func(t *testing.T) {
+		session := newSession(t, MemoryBackupSessionConfig{BytesPerSecond: 10000})
+
+		data := bytes.Repeat([]byte("x"), 2000)
+		start := time.Now()
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(data), "slow.bin", int64(len(data))))
+		require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+		saved, ok := session.Content("slow.bin")
+		require.True(t, ok)
+		require.Equal(t, data, saved)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		session, err := NewMemoryBackupSession(MemoryBackupSessionConfig{Latency: time.Minute})
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		var saveErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			saveErr = session.Save(srcPath, "app.log")
+		}()
+
+		// 実行中の保存をキャンセルしてから終了する
+		require.Eventually(t, func() bool { return session.Attempts() == 1 }, time.Second, time.Millisecond)
+		require.NoError(t, session.Close())
+		wg.Wait()
+		require.ErrorIs(t, saveErr, context.Canceled)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		session := newSession(t, MemoryBackupSessionConfig{FailNth: []int{3}})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = session.SaveReader(context.Background(), strings.NewReader("data"), fmt.Sprintf("%02d.log", i), -1)
+			}()
+		}
+		require.NoError(t, session.WaitForCompletion(context.Background()))
+		wg.Wait()
+
+		// 通し番号はすべての保存で数えるため、1つだけ失敗する
+		require.Len(t, session.Files(), 19)
+		require.Len(t, session.Results(), 20)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		for _, config := range []MemoryBackupSessionConfig{
+			{Latency: -time.Second},
+			{BytesPerSecond: -1},
+			{FailNth: []int{0}},
+		} {
+			_, err := NewMemoryBackupSession(config)
+			require.ErrorIs(t, err, ErrInvalidConfig)
+		}
+
+		session := newSession(t, MemoryBackupSessionConfig{})
+		require.ErrorIs(t, session.Save(srcPath, "../escape.log"), ErrInvalidConfig)
+		require.ErrorIs(t, session.Save("", "app.log"), ErrInvalidConfig)
+	})
+}
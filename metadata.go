@@ -0,0 +1,52 @@
+package safebackup
+
+import (
+	"errors"
+	"os"
+)
+
+// errMetadataUnsupported は実行環境がメタデータの保持に対応していない場合のエラー
+var errMetadataUnsupported = errors.New("metadata preservation not supported on this platform")
+
+// preserveFileMetadata は所有者と拡張属性を書き込み中のファイルにコピーし、
+// 保持できなかったメタデータの名前を返す
+// 所有者の変更で権限ビットがクリアされることがあるため、Chmodより前に呼び出す
+func preserveFileMetadata(dst, src *os.File, srcInfo os.FileInfo, opts MetadataPreservation) []string {
+	var unpreserved []string
+
+	if opts.Ownership {
+		if err := copyOwnership(dst, srcInfo); err != nil {
+			unpreserved = append(unpreserved, "ownership")
+		}
+	}
+
+	if opts.Xattrs {
+		failed, err := copyXattrs(dst, src)
+		if err != nil {
+			unpreserved = append(unpreserved, "xattrs")
+		}
+		for _, name := range failed {
+			unpreserved = append(unpreserved, "xattr:"+name)
+		}
+	}
+
+	return unpreserved
+}
+
+// preserveTimes は更新日時とアクセス日時をコピーし、保持できなかったメタデータの名前を返す
+// 書き込みで更新日時が変わるため、ファイルを閉じた後に呼び出す
+func preserveTimes(path string, srcInfo os.FileInfo) []string {
+	var unpreserved []string
+
+	atime, ok := accessTime(srcInfo)
+	if !ok {
+		atime = srcInfo.ModTime()
+		unpreserved = append(unpreserved, "atime")
+	}
+
+	if err := os.Chtimes(path, atime, srcInfo.ModTime()); err != nil {
+		return []string{"mtime", "atime"}
+	}
+
+	return unpreserved
+}
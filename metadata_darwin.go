@@ -0,0 +1,32 @@
+//go:build darwin
+
+package safebackup
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime はファイルの最終アクセス日時を返す
+func accessTime(info os.FileInfo) (time.Time, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(stat.Atimespec.Sec, stat.Atimespec.Nsec), true
+}
+
+// copyOwnership は所有者とグループをコピーする
+func copyOwnership(dst *os.File, srcInfo os.FileInfo) error {
+	stat, ok := srcInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errMetadataUnsupported
+	}
+	return dst.Chown(int(stat.Uid), int(stat.Gid))
+}
+
+// copyXattrs はmacOSでは未対応
+func copyXattrs(dst, src *os.File) ([]string, error) {
+	return nil, errMetadataUnsupported
+}
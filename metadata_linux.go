@@ -0,0 +1,104 @@
+//go:build linux
+
+package safebackup
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// accessTime はファイルの最終アクセス日時を返す
+func accessTime(info os.FileInfo) (time.Time, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec)), true
+}
+
+// copyOwnership は所有者とグループをコピーする
+func copyOwnership(dst *os.File, srcInfo os.FileInfo) error {
+	stat, ok := srcInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errMetadataUnsupported
+	}
+	return dst.Chown(int(stat.Uid), int(stat.Gid))
+}
+
+// copyXattrs は拡張属性をコピーし、設定できなかった属性名を返す
+// 拡張属性の一覧を取得できない場合はエラーを返す
+func copyXattrs(dst, src *os.File) ([]string, error) {
+	names, err := listXattrs(int(src.Fd()))
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []string
+	for _, name := range names {
+		value, err := getXattr(int(src.Fd()), name)
+		if err == nil {
+			err = unix.Fsetxattr(int(dst.Fd()), name, value, 0)
+		}
+		if err != nil {
+			failed = append(failed, name)
+		}
+	}
+
+	return failed, nil
+}
+
+// listXattrs は拡張属性の名前一覧を返す
+func listXattrs(fd int) ([]string, error) {
+	for {
+		size, err := unix.Flistxattr(fd, nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		n, err := unix.Flistxattr(fd, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// 取得の間に属性が増えた場合は再試行
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// getXattr は拡張属性の値を返す
+func getXattr(fd int, name string) ([]byte, error) {
+	for {
+		size, err := unix.Fgetxattr(fd, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		n, err := unix.Fgetxattr(fd, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package safebackup
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime はこのプラットフォームでは取得できない
+func accessTime(info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// copyOwnership はこのプラットフォームでは未対応
+func copyOwnership(dst *os.File, srcInfo os.FileInfo) error {
+	return errMetadataUnsupported
+}
+
+// copyXattrs はこのプラットフォームでは未対応
+func copyXattrs(dst, src *os.File) ([]string, error) {
+	return nil, errMetadataUnsupported
+}
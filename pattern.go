@@ -0,0 +1,115 @@
+package safebackup
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pathPattern はgitignore形式のパターン1つ
+type pathPattern struct {
+	negate   bool     // "!" で始まるパターン（直前までの一致を打ち消す）
+	dirOnly  bool     // "/" で終わるパターン（ディレクトリのみに一致）
+	segments []string // "/" で区切ったパターン（"**" は任意の階層に一致）
+}
+
+// patternList はgitignore形式のパターンの並び
+// 後に書かれたパターンほど優先される
+type patternList []pathPattern
+
+// compilePatterns はgitignore形式のパターンを解析する
+// 空行と "#" で始まる行は無視する
+func compilePatterns(patterns []string) (patternList, error) {
+	var list patternList
+	for _, raw := range patterns {
+		p := strings.TrimSpace(raw)
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+
+		var pattern pathPattern
+		if strings.HasPrefix(p, "!") {
+			pattern.negate = true
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			pattern.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+
+		// 途中に "/" を含むパターンはルートからの相対パス、含まないパターンは任意の階層の名前に一致する
+		if strings.Contains(p, "/") {
+			p = strings.TrimPrefix(p, "/")
+		} else {
+			p = "**/" + p
+		}
+		if p == "" || p == "**/" {
+			return nil, fmt.Errorf("%w: invalid pattern %q", ErrInvalidConfig, raw)
+		}
+
+		pattern.segments = strings.Split(p, "/")
+		for _, segment := range pattern.segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("%w: invalid pattern %q: %w", ErrInvalidConfig, raw, err)
+			}
+		}
+		list = append(list, pattern)
+	}
+	return list, nil
+}
+
+// match は "/" 区切りの相対パスがパターンに一致するかどうかを返す
+// 最後に一致したパターンが "!" で始まる場合は一致しない
+func (l patternList) match(relativePath string, isDir bool) bool {
+	parts := strings.Split(relativePath, "/")
+
+	matched := false
+	for _, pattern := range l {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(pattern.segments, parts) {
+			matched = !pattern.negate
+		}
+	}
+	return matched
+}
+
+// matchPathOrParent は相対パスまたはその親ディレクトリのいずれかがパターンに一致するかどうかを返す
+// "logs/" のようなディレクトリのパターンで、その中のファイルを選ぶために使う
+func (l patternList) matchPathOrParent(relativePath string) bool {
+	if l.match(relativePath, false) {
+		return true
+	}
+	for dir := path.Dir(relativePath); dir != "."; dir = path.Dir(dir) {
+		if l.match(dir, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments はパターンの各階層とパスの各階層を順に照合する
+func matchSegments(segments, parts []string) bool {
+	if len(segments) == 0 {
+		return len(parts) == 0
+	}
+
+	if segments[0] == "**" {
+		// 0個以上の階層に一致
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(segments[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(segments[0], parts[0]); !ok {
+		return false
+	}
+	return matchSegments(segments[1:], parts[1:])
+}
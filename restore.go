@@ -0,0 +1,131 @@
+package safebackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RestoreSession はバックアップを読み出すセッションの共通インターフェース
+// 読み出した内容はバックアップ時のサイズと（記録されていれば）チェックサムで検証され、
+// 一致しない場合は ErrIntegrityCheckFailed を返す
+type RestoreSession interface {
+	// Restore はバックアップしたファイルをローカルに書き出す
+	// relativePath: バックアップ先での相対パス
+	// localDest: 書き出し先のファイルパス
+	// 書き出しは一時ファイルを経由するため、検証に失敗した内容が localDest に現れることはない
+	Restore(relativePath, localDest string) error
+
+	// RestoreContext は Restore のコンテキスト付き版
+	RestoreContext(ctx context.Context, relativePath, localDest string) error
+
+	// RestorePrefix は相対パスが prefix で始まるすべてのファイルを localDir 以下に書き出す
+	// 各ファイルは localDir からの相対パスが relativePath となる位置に書き出される
+	// 失敗したファイルがあっても残りのリストアを続け、最後に *RestoreError を返す
+	RestorePrefix(ctx context.Context, prefix, localDir string) error
+
+	// Open はバックアップしたファイルを読み出すReaderを返す
+	// 検証は最後まで読んだ時点で行われ、不一致の場合は io.EOF の代わりに ErrIntegrityCheckFailed を返す
+	Open(ctx context.Context, relativePath string) (io.ReadCloser, error)
+
+	// Close は実行中のリストアをキャンセルし、それらが終了するまで待つ
+	// クローズ後の呼び出しは ErrSessionClosed を返す
+	Close() error
+}
+
+// verifyingReader は読み出した内容のサイズとSHA-256を検証するReader
+type verifyingReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	read     int64
+	size     int64  // 期待するサイズ（不明な場合は負の値）
+	checksum string // 期待するSHA-256（不明な場合は空）
+}
+
+// newVerifyingReader は r を検証付きのReaderで包む
+func newVerifyingReader(r io.Reader, size int64, checksum string) *verifyingReader {
+	return &verifyingReader{
+		r:        r,
+		hash:     sha256.New(),
+		size:     size,
+		checksum: checksum,
+	}
+}
+
+// Read は読み込みながらチェックサムを計算し、終端で検証する
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.read += int64(n)
+	v.hash.Write(p[:n])
+
+	if v.size >= 0 && v.read > v.size {
+		return n, fmt.Errorf("%w: read more than %d bytes", ErrIntegrityCheckFailed, v.size)
+	}
+	if err == io.EOF {
+		if verr := v.verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// verify は読み終えた内容を検証する
+func (v *verifyingReader) verify() error {
+	if v.size >= 0 && v.read != v.size {
+		return fmt.Errorf("%w: read %d bytes, expected %d", ErrIntegrityCheckFailed, v.read, v.size)
+	}
+	if v.checksum != "" {
+		if sum := hex.EncodeToString(v.hash.Sum(nil)); sum != v.checksum {
+			return fmt.Errorf("%w: checksum %s, expected %s", ErrIntegrityCheckFailed, sum, v.checksum)
+		}
+	}
+	return nil
+}
+
+// restoreReadCloser は検証付きのReaderと元のCloserを組み合わせる
+type restoreReadCloser struct {
+	io.Reader
+	close func() error
+}
+
+// Close は元のReaderを閉じる
+func (r *restoreReadCloser) Close() error {
+	return r.close()
+}
+
+// restorePath は relativePath を書き出す localDir 以下のパスを返す
+// バックアップ先の名前で localDir の外に書き出さないように、ローカルでない相対パスは拒否する
+func restorePath(localDir, relativePath string) (string, error) {
+	relativePath = filepath.FromSlash(relativePath)
+	if !filepath.IsLocal(relativePath) {
+		return "", fmt.Errorf("%w: unsafe path %q", ErrInvalidConfig, relativePath)
+	}
+	return filepath.Join(localDir, relativePath), nil
+}
+
+// restoreSymlink は target を指すシンボリックリンクを localDest に書き出す
+func restoreSymlink(target, localDest string) error {
+	if err := os.MkdirAll(filepath.Dir(localDest), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	return symlinkAtomic(target, localDest)
+}
+
+// writeRestored は検証済みの内容を localDest にアトミックに書き出す
+// sourceFile がnilでない場合は、その権限と更新日時を引き継ぐ
+func writeRestored(ctx context.Context, r io.Reader, localDest string, sourceFile *os.File) error {
+	if err := os.MkdirAll(filepath.Dir(localDest), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	preserve := MetadataPreservation{Times: sourceFile != nil}
+	if _, err := writeAtomic(&contextReader{ctx: ctx, r: r}, localDest, sourceFile, preserve); err != nil {
+		return err
+	}
+	return nil
+}
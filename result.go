@@ -0,0 +1,212 @@
+package safebackup
+
+import (
+	"sync"
+	"time"
+
+	cleaner "github.com/ideamans/go-backup-cleaner"
+)
+
+// FileResult は1ファイル分のバックアップ結果
+type FileResult struct {
+	// SourcePath はバックアップ元のファイルパス
+	SourcePath string
+
+	// RelativePath はバックアップ先での相対パス
+	RelativePath string
+
+	// Destination は実際の保存先（ファイルパスまたはS3キー）
+	Destination string
+
+	// BytesWritten は保存先に書き込んだバイト数
+	BytesWritten int64
+
+	// Duration は保存処理に要した時間
+	Duration time.Duration
+
+	// Checksum は保存した内容のSHA-256（16進数表記）
+	Checksum string
+
+	// Skipped は保存先に同じ内容があったため保存しなかった場合に真（増分バックアップ）
+	Skipped bool
+
+	// UnpreservedMetadata は保持を指定したが保持できなかったメタデータ
+	// （"mtime", "atime", "ownership", "xattrs", "xattr:<名前>"）
+	UnpreservedMetadata []string
+
+	// Err は失敗した場合のエラー（成功時はnil）
+	Err error
+}
+
+// BackupInfo は保存済みのバックアップの情報
+type BackupInfo struct {
+	// RelativePath はバックアップ先での相対パス（"/" 区切り）
+	RelativePath string
+
+	// Destination は実際の保存先（ファイルパスまたはS3キー）
+	Destination string
+
+	// Size はバックアップのサイズ（バイト、不明な場合は-1）
+	Size int64
+
+	// ModTime はバックアップの更新日時（S3では最終更新日時）
+	ModTime time.Time
+
+	// Checksum は内容のSHA-256（16進数表記、不明な場合は空）
+	Checksum string
+
+	// Metadata はストレージ固有の情報
+	// ローカル: "mode", "compression"（圧縮したファイルの圧縮形式）、
+	// "encryption", "encryption-key-id"（暗号化したファイルの暗号化方式と鍵のID、鍵のIDは Stat のみ）
+	// 重複排除モード: "mode", "chunks"（マニフェストに記録したファイルの権限とチャンク数）
+	// S3: "etag", "storage-class", "content-type", "x-amz-meta-<名前>"（ユーザーメタデータ）、
+	// "compression", "encryption", "encryption-key-id"（Stat のみ）
+	Metadata map[string]string
+}
+
+// GarbageCollectionReport は重複排除モードのガベージコレクションの結果
+type GarbageCollectionReport struct {
+	// Manifests は参照を調べたマニフェストの数
+	Manifests int
+
+	// Chunks は保存されていたチャンクの数
+	Chunks int
+
+	// DeletedChunks はどのマニフェストからも参照されていなかったため削除したチャンクの数
+	DeletedChunks int
+
+	// BytesFreed は削除したチャンクの合計サイズ（バイト）
+	BytesFreed int64
+}
+
+// VerifyReport はバックアップの検証の結果
+type VerifyReport struct {
+	// Verified は内容がチェックサムと一致したファイル（重複排除モードではマニフェスト）の数
+	Verified int
+
+	// Problems は見つかった問題
+	Problems []VerifyProblem
+}
+
+// OK は問題が見つからなかった場合に真を返す
+func (r VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// VerifyProblemKind は検証で見つかった問題の種類
+type VerifyProblemKind string
+
+const (
+	// VerifyCorrupted は内容が記録したチェックサムと一致しない（ビット腐敗や書き換え）
+	VerifyCorrupted VerifyProblemKind = "corrupted"
+
+	// VerifyMissing はチェックサムを記録したファイル（重複排除モードではチャンク）が存在しない
+	VerifyMissing VerifyProblemKind = "missing"
+
+	// VerifyNoChecksum はファイルのチェックサムが記録されていないため検証できない
+	VerifyNoChecksum VerifyProblemKind = "no-checksum"
+
+	// VerifyUnreadable はファイルまたはチェックサムを読めない
+	VerifyUnreadable VerifyProblemKind = "unreadable"
+)
+
+// VerifyProblem は検証で見つかった1件の問題
+type VerifyProblem struct {
+	// RelativePath はバックアップの相対パス
+	RelativePath string
+
+	// Path は問題のあったファイルのパス（データファイル、サイドカーまたはチャンク）
+	Path string
+
+	// Kind は問題の種類
+	Kind VerifyProblemKind
+
+	// Expected は記録されていたチェックサム、Actual は計算したチェックサム（VerifyCorrupted の場合のみ）
+	Expected string
+	Actual   string
+
+	// Err は VerifyUnreadable の原因
+	Err error
+}
+
+// CleaningTrigger はクリーニングが開始された理由
+type CleaningTrigger string
+
+const (
+	// CleaningTriggerSessionStart はセッション作成時の容量チェックによるクリーニング
+	CleaningTriggerSessionStart CleaningTrigger = "session_start"
+
+	// CleaningTriggerCheckInterval は累積サイズが CheckInterval を超えた時の容量チェックによるクリーニング
+	CleaningTriggerCheckInterval CleaningTrigger = "check_interval"
+)
+
+// CleaningRecord は1回のクリーニング実行の記録
+type CleaningRecord struct {
+	// StartTime と EndTime はクリーニングの開始・終了時刻
+	StartTime time.Time
+	EndTime   time.Time
+
+	// Trigger はクリーニングが開始された理由
+	Trigger CleaningTrigger
+
+	// BytesFreed は削除したファイルの合計サイズ（バイト）
+	BytesFreed int64
+
+	// FilesDeleted は削除したファイル数
+	FilesDeleted int
+
+	// FreeSpaceAfter はクリーニング後の空き容量（バイト、取得できなかった場合は0）
+	FreeSpaceAfter uint64
+
+	// Report はgo-backup-cleanerが返したレポート
+	Report cleaner.CleaningReport
+
+	// Err はクリーニング中に発生したエラー（成功時はnil）
+	Err error
+}
+
+// resultLog はセッション内のファイル結果を蓄積する
+type resultLog struct {
+	mu      sync.Mutex
+	results []FileResult
+}
+
+// add は結果を追加する
+func (l *resultLog) add(result FileResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.results = append(l.results, result)
+}
+
+// snapshot は蓄積された結果のコピーを返す
+func (l *resultLog) snapshot() []FileResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	results := make([]FileResult, len(l.results))
+	copy(results, l.results)
+	return results
+}
+
+// skippedCount はスキップしたファイルの数を返す
+func (l *resultLog) skippedCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := 0
+	for _, result := range l.results {
+		if result.Skipped {
+			count++
+		}
+	}
+	return count
+}
+
+// reset は蓄積された結果を消去する
+func (l *resultLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.results = nil
+}
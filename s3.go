@@ -1,29 +1,78 @@
 package safebackup
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+const (
+	// defaultMaxConcurrentUploads は同時にアップロードするファイル数のデフォルトの上限
+	defaultMaxConcurrentUploads = 8
+
+	// defaultUploadQueueSize はアップロード待ち行列のデフォルトの長さ
+	defaultUploadQueueSize = 64
+)
+
 // S3API defines the interface for S3 operations used by the backup session
 type S3API interface {
 	HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error)
-	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error)
+	CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error)
+	UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error)
+	CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error)
+	UploadPartCopyWithContext(ctx aws.Context, input *s3.UploadPartCopyInput, opts ...request.Option) (*s3.UploadPartCopyOutput, error)
+	CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error)
+	AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error)
+	ListPartsWithContext(ctx aws.Context, input *s3.ListPartsInput, opts ...request.Option) (*s3.ListPartsOutput, error)
+	ListMultipartUploadsWithContext(ctx aws.Context, input *s3.ListMultipartUploadsInput, opts ...request.Option) (*s3.ListMultipartUploadsOutput, error)
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+	ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error)
+	HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error)
+	DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error)
 }
 
 // S3BackupSession はS3へのバックアップセッション実装
 type S3BackupSession struct {
-	config   S3BackupSessionConfig
-	s3Client S3API
-	wg       sync.WaitGroup
+	config    S3BackupSessionConfig
+	s3Client  S3API
+	wg        sync.WaitGroup
+	errMu     sync.Mutex   // failures の排他制御
+	failures  []*FileError // 非同期アップロードで発生したエラー
+	results   resultLog    // ファイルごとの結果
+	startOnce sync.Once    // ワーカーの起動
+	queue     chan uploadJob
+	queueMu   sync.RWMutex // queue への送信とクローズの排他制御
+	closed    bool
+	ctx       context.Context    // Close でキャンセルされるセッションのコンテキスト
+	cancel    context.CancelFunc // ctx のキャンセル
+	workers   sync.WaitGroup     // ワーカーの終了待機
+	saves     sync.WaitGroup     // 実行中の SaveReader
+	dedupMu   sync.RWMutex       // 重複排除モードのアップロード（読み取り）とチャンクの削除（書き込み）の排他制御
+}
+
+// uploadJob はアップロード待ちのファイル
+// ファイルはワーカーが処理を始めるまで開かないため、待ち行列が長くてもファイル記述子を消費しない
+type uploadJob struct {
+	ctx           context.Context // SaveContext に渡されたコンテキスト
+	localFilePath string
+	relativePath  string
+	key           string
+	size          int64
+	options       S3ObjectOptions // Save ごとの上書きを適用したオブジェクトの属性
 }
 
 // NewS3BackupSession はS3バックアップセッションインスタンスを作成
@@ -38,23 +87,55 @@ func NewS3BackupSession(config S3BackupSessionConfig) (*S3BackupSession, error)
 		config.ACL = "private"
 	}
 
+	// S3クライアントの作成
+	s3Client, err := newS3Client(config.Region, config.AccessKeyID, config.SecretAccessKey, config.SessionToken, config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// バケットの存在確認
+	_, err = s3Client.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(config.Bucket),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to access bucket %s: %w", config.Bucket, err)
+	}
+
+	backupSession := &S3BackupSession{
+		config:   config,
+		s3Client: s3Client,
+	}
+
+	// 中断したまま放置されたマルチパートアップロードの掃除
+	if config.OrphanedUploadAge > 0 {
+		if _, err := backupSession.AbortOrphanedUploads(context.Background(), config.OrphanedUploadAge); err != nil {
+			return nil, fmt.Errorf("failed to abort orphaned uploads: %w", err)
+		}
+	}
+
+	return backupSession, nil
+}
+
+// newS3Client は認証情報とエンドポイントからS3クライアントを作成する
+// 認証情報が空の場合はSDKのデフォルト（環境変数、IAMロール等）を使う
+func newS3Client(region, accessKeyID, secretAccessKey, sessionToken, endpoint string) (*s3.S3, error) {
 	// AWS設定の構築
 	awsConfig := &aws.Config{
-		Region: aws.String(config.Region),
+		Region: aws.String(region),
 	}
 
 	// 認証情報の設定
-	if config.AccessKeyID != "" && config.SecretAccessKey != "" {
+	if accessKeyID != "" && secretAccessKey != "" {
 		awsConfig.Credentials = credentials.NewStaticCredentials(
-			config.AccessKeyID,
-			config.SecretAccessKey,
-			config.SessionToken,
+			accessKeyID,
+			secretAccessKey,
+			sessionToken,
 		)
 	}
 
 	// カスタムエンドポイントの設定（MinIO等）
-	if config.Endpoint != "" {
-		awsConfig.Endpoint = aws.String(config.Endpoint)
+	if endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
 		awsConfig.S3ForcePathStyle = aws.Bool(true)
 	}
 
@@ -65,24 +146,17 @@ func NewS3BackupSession(config S3BackupSessionConfig) (*S3BackupSession, error)
 	}
 
 	// S3クライアントの作成
-	s3Client := s3.New(sess)
-
-	// バケットの存在確認
-	_, err = s3Client.HeadBucket(&s3.HeadBucketInput{
-		Bucket: aws.String(config.Bucket),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to access bucket %s: %w", config.Bucket, err)
-	}
-
-	return &S3BackupSession{
-		config:   config,
-		s3Client: s3Client,
-	}, nil
+	return s3.New(sess), nil
 }
 
 // Save はファイルをS3にアップロードする
 func (s *S3BackupSession) Save(localFilePath, relativePath string) error {
+	return s.SaveContext(context.Background(), localFilePath, relativePath)
+}
+
+// SaveContext はファイルをS3にアップロードする
+// アップロードは非同期に行われ、ctx がキャンセルされると待ち行列への追加や実行中のアップロードを中断する
+func (s *S3BackupSession) SaveContext(ctx context.Context, localFilePath, relativePath string) error {
 	// 入力検証
 	if localFilePath == "" || relativePath == "" {
 		return fmt.Errorf("%w: empty file path", ErrInvalidConfig)
@@ -98,52 +172,368 @@ func (s *S3BackupSession) Save(localFilePath, relativePath string) error {
 		return fmt.Errorf("%w: source is not a regular file", ErrInvalidConfig)
 	}
 
-	// S3キーの構築
-	key := filepath.ToSlash(filepath.Join(s.config.Prefix, relativePath))
+	if s.config.Dedup.Enabled && isChunkPath(relativePath) {
+		return fmt.Errorf("%w: %s is reserved for dedup chunks", ErrInvalidConfig, chunkDirName)
+	}
+
+	options, err := s.objectOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	job := uploadJob{
+		ctx:           ctx,
+		localFilePath: localFilePath,
+		relativePath:  relativePath,
+		key:           s.objectKey(relativePath),
+		size:          fileInfo.Size(),
+		options:       options,
+	}
+
+	return s.enqueue(job)
+}
+
+// enqueue はアップロードを待ち行列に追加する
+// 待ち行列が満杯の場合は空くまで待つが、FailWhenQueueFull が有効な場合は ErrQueueFull を返す
+func (s *S3BackupSession) enqueue(job uploadJob) error {
+	s.startOnce.Do(s.start)
+
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
 
-	// S3にアップロード
 	s.wg.Add(1)
-	go func() {
-		defer s.wg.Done()
-		_ = s.uploadFile(localFilePath, key, fileInfo.Size())
-	}()
+	if s.config.FailWhenQueueFull {
+		select {
+		case s.queue <- job:
+		default:
+			s.wg.Done()
+			return fmt.Errorf("%w: %s", ErrQueueFull, job.relativePath)
+		}
+	} else {
+		select {
+		case s.queue <- job:
+		case <-job.ctx.Done():
+			s.wg.Done()
+			return job.ctx.Err()
+		case <-s.ctx.Done():
+			s.wg.Done()
+			return ErrSessionClosed
+		}
+	}
 
 	return nil
 }
 
-// uploadFile は実際のアップロード処理を行う
-func (s *S3BackupSession) uploadFile(filePath, key string, size int64) error {
+// start はセッションのコンテキスト、待ち行列と MaxConcurrentUploads 個のワーカーを準備する
+func (s *S3BackupSession) start() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.queue = make(chan uploadJob, s.uploadQueueSize())
+	for i := 0; i < s.maxConcurrentUploads(); i++ {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			for job := range s.queue {
+				s.runUpload(job)
+				s.wg.Done()
+			}
+		}()
+	}
+}
+
+// maxConcurrentUploads は同時にアップロードするファイル数の上限を返す
+func (s *S3BackupSession) maxConcurrentUploads() int {
+	if s.config.MaxConcurrentUploads > 0 {
+		return s.config.MaxConcurrentUploads
+	}
+	return defaultMaxConcurrentUploads
+}
+
+// uploadQueueSize はアップロード待ち行列の長さを返す
+func (s *S3BackupSession) uploadQueueSize() int {
+	if s.config.UploadQueueSize > 0 {
+		return s.config.UploadQueueSize
+	}
+	return defaultUploadQueueSize
+}
+
+// runUpload はファイルをアップロードし、結果を記録する
+func (s *S3BackupSession) runUpload(job uploadJob) {
+	ctx, cancel := mergeContext(job.ctx, s.ctx)
+	defer cancel()
+
+	start := time.Now()
+	var copied copyResult
+	var err error
+	if s.config.Dedup.Enabled {
+		// 書き込んだサイズは新たにアップロードしたチャンクの合計
+		copied, err = s.saveDeduplicatedFile(ctx, job.localFilePath, job.relativePath, job.options)
+	} else {
+		copied, err = s.uploadFile(ctx, job.localFilePath, job.key, job.size, job.options)
+	}
+	result := FileResult{
+		SourcePath:   job.localFilePath,
+		RelativePath: job.relativePath,
+		Destination:  job.key,
+		Duration:     time.Since(start),
+		Checksum:     copied.checksum,
+		Skipped:      copied.skipped,
+		Err:          err,
+	}
+	if err != nil {
+		s.recordFailure(job.relativePath, job.key, err)
+	} else if !copied.skipped {
+		result.BytesWritten = copied.written
+	}
+	s.results.add(result)
+}
+
+// SaveReader はReaderから読み込んだデータをS3にアップロードする
+// Readerは呼び出し後に再利用できないため、Save と異なりアップロードの完了まで待ってから戻る
+// sizeHint はデータサイズが分かっている場合の値（不明な場合は負の値）で、パートサイズの決定に使う
+func (s *S3BackupSession) SaveReader(ctx context.Context, r io.Reader, relativePath string, sizeHint int64) error {
+	// 入力検証
+	if r == nil || relativePath == "" {
+		return fmt.Errorf("%w: empty reader or file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	key := s.objectKey(relativePath)
+	options, err := s.objectOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var written int64
+	var checksum string
+	if s.config.Dedup.Enabled {
+		var copied copyResult
+		copied, err = s.saveDeduplicated(ctx, r, nil, relativePath, options)
+		written, checksum = copied.written, copied.checksum
+	} else {
+		written, checksum, err = s.uploadStream(ctx, r, key, sizeHint, options)
+	}
+	result := FileResult{
+		RelativePath: relativePath,
+		Destination:  key,
+		Duration:     time.Since(start),
+		Checksum:     checksum,
+		Err:          err,
+	}
+	if err == nil {
+		result.BytesWritten = written
+	}
+	s.results.add(result)
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	return nil
+}
+
+// SaveDir は srcDir 以下のファイルを relativePrefix 以下にアップロードする
+// ファイルは Save と同様に待ち行列に追加されるため、完了は WaitForCompletion で待つ
+// 待ち行列への追加に失敗したファイルがあっても残りを続け、最後に *BackupError を返す
+func (s *S3BackupSession) SaveDir(ctx context.Context, srcDir, relativePrefix string, opts SaveDirOptions) error {
+	return walkDir(ctx, srcDir, relativePrefix, opts, func(entry dirEntry) *FileError {
+		var err error
+		if entry.linkTarget != "" {
+			err = s.saveSymlink(ctx, entry.path, entry.linkTarget, entry.relativePath)
+		} else {
+			err = s.SaveContext(ctx, entry.path, entry.relativePath)
+		}
+		if err == nil {
+			return nil
+		}
+		return &FileError{
+			RelativePath: entry.relativePath,
+			Destination:  s.objectKey(entry.relativePath),
+			Err:          err,
+		}
+	})
+}
+
+// saveSymlink はシンボリックリンクを、リンク先をメタデータに持つ空のオブジェクトとしてアップロードする
+func (s *S3BackupSession) saveSymlink(ctx context.Context, linkPath, target, relativePath string) error {
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	options, err := s.objectOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := s.objectKey(relativePath)
+	metadata := map[string]*string{symlinkMetadataKey: aws.String(target)}
+
+	start := time.Now()
+	err = s.putObject(ctx, key, bytes.NewReader(nil), 0, newObjectAttributes(options, metadata, relativePath, nil))
+	s.results.add(FileResult{
+		SourcePath:   linkPath,
+		RelativePath: relativePath,
+		Destination:  key,
+		Duration:     time.Since(start),
+		Err:          err,
+	})
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	return nil
+}
+
+// beginSave は SaveReader の開始を記録する
+// クローズ済みのセッションでは ErrSessionClosed を返す
+func (s *S3BackupSession) beginSave() error {
+	s.startOnce.Do(s.start)
+
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	s.saves.Add(1)
+	return nil
+}
+
+// objectKey は相対パスからS3キーを構築する
+func (s *S3BackupSession) objectKey(relativePath string) string {
+	return joinObjectKey(s.config.Prefix, relativePath)
+}
+
+// joinObjectKey はプレフィックスと相対パスからS3キーを構築する
+func joinObjectKey(prefix, relativePath string) string {
+	return filepath.ToSlash(filepath.Join(prefix, relativePath))
+}
+
+// uploadFile は実際のアップロード処理を行い、アップロードした内容のSHA-256チェックサムを返す
+// 増分バックアップでS3に同じ内容がある場合はアップロードせずに skipped を真にして返す
+// 圧縮・暗号化する場合は一時ファイルに変換してからアップロードし、メタデータに圧縮形式、暗号化の鍵のIDと元のサイズを記録する
+func (s *S3BackupSession) uploadFile(ctx context.Context, filePath, key string, size int64, options S3ObjectOptions) (copyResult, error) {
 	// ファイルを開く
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return copyResult{}, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer func() {
 		_ = file.Close()
 	}()
 
-	input := &s3.PutObjectInput{
-		Bucket:        aws.String(s.config.Bucket),
-		Key:           aws.String(key),
-		Body:          file,
-		ContentLength: aws.Int64(size),
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	// サイズと更新日時の比較はファイルを読む前に行う
+	if s.config.Incremental == IncrementalSizeModTime && s.unchangedObject(ctx, key, options, size, fileInfo.ModTime(), "", "") {
+		return copyResult{skipped: true}, nil
+	}
+
+	// チェックサムを計算してから先頭に戻す
+	// transfer は変換しない場合にアップロードする内容の Content-MD5 と追加のチェックサムになり、
+	// アップロードの前にファイルをもう一度読まずに済む
+	hash := sha256.New()
+	transfer := newTransferHasher(s.config.ChecksumAlgorithm)
+	if _, err := io.Copy(io.MultiWriter(hash, transfer), &contextReader{ctx: ctx, r: file}); err != nil {
+		return copyResult{}, fmt.Errorf("failed to read file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return copyResult{}, fmt.Errorf("failed to seek file: %w", err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	stored := transfer.sum()
+
+	if s.config.Incremental == IncrementalChecksum && s.unchangedObject(ctx, key, options, size, time.Time{}, checksum, hex.EncodeToString(stored.md5)) {
+		return copyResult{checksum: checksum, skipped: true}, nil
 	}
 
-	// ACLの設定
-	if s.config.ACL != "" {
-		input.ACL = aws.String(s.config.ACL)
+	// body はアップロードする内容で、bodyChecksum はマルチパートの再開時に内容を照合するためのもの
+	body, bodySize, bodyChecksum := file, size, checksum
+	metadata := uploadMetadata(checksum, fileInfo.ModTime())
+	enc := storageEncoding{
+		compression: s.config.Compression.algorithmFor(filePath, file),
+		level:       s.config.Compression.Level,
+		keys:        s.config.KeyProvider,
+	}
+	if enc.compression != CompressionNone || enc.keys != nil {
+		// 変換しながらアップロードする内容のチェックサムも計算する
+		encodedTransfer := newTransferHasher(s.config.ChecksumAlgorithm)
+		encoded, encodedChecksum, keyID, err := encodeToTempFile(ctx, &contextReader{ctx: ctx, r: file}, enc, fileInfo.ModTime(), encodedTransfer)
+		if err != nil {
+			return copyResult{}, err
+		}
+		defer func() {
+			_ = encoded.Close()
+			_ = os.Remove(encoded.Name())
+		}()
+
+		encodedInfo, err := encoded.Stat()
+		if err != nil {
+			return copyResult{}, fmt.Errorf("failed to stat encoded file: %w", err)
+		}
+		if _, err := encoded.Seek(0, io.SeekStart); err != nil {
+			return copyResult{}, fmt.Errorf("failed to seek encoded file: %w", err)
+		}
+
+		body, bodySize, bodyChecksum, stored = encoded, encodedInfo.Size(), encodedChecksum, encodedTransfer.sum()
+		addEncodingMetadata(metadata, enc, keyID, size)
 	}
 
-	// アップロード実行
-	_, err = s.s3Client.PutObject(input)
+	// Content-Type を判定できない場合は内容の先頭から判定する
+	head := make([]byte, 512)
+	n, _ := file.ReadAt(head, 0)
+	attrs := newObjectAttributes(options, metadata, key, head[:n])
+
+	// 大きなファイルはマルチパートでアップロード
+	// マルチパートのオブジェクトのチェックサムはパートのチェックサムから計算されるため、内容全体のものをメタデータに記録する
+	// （シングルパートでは putObject が記録する）
+	if bodySize >= s.multipartThreshold() {
+		if stored.checksum != "" {
+			metadata[s.config.ChecksumAlgorithm.metadataKey()] = aws.String(stored.checksum)
+		}
+		err = s.uploadFileMultipart(ctx, body, key, bodySize, bodyChecksum, attrs)
+	} else {
+		err = s.putObjectChecked(ctx, key, body, bodySize, stored, attrs)
+	}
 	if err != nil {
-		return fmt.Errorf("%w: failed to upload to S3: %v", ErrBackupFailed, err)
+		return copyResult{}, err
 	}
 
-	return nil
+	return copyResult{written: bodySize, checksum: checksum}, nil
+}
+
+// recordFailure はアップロードの失敗を記録する
+func (s *S3BackupSession) recordFailure(relativePath, key string, err error) {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+
+	s.failures = append(s.failures, &FileError{
+		RelativePath: relativePath,
+		Destination:  key,
+		Err:          err,
+	})
 }
 
 // WaitForCompletion はすべてのアップロードの完了を待つ
+// アップロードに失敗したファイルがある場合は *BackupError を返す
 func (s *S3BackupSession) WaitForCompletion(ctx context.Context) error {
 	done := make(chan struct{})
 	go func() {
@@ -155,13 +545,50 @@ func (s *S3BackupSession) WaitForCompletion(ctx context.Context) error {
 	case <-ctx.Done():
 		return fmt.Errorf("upload timeout: %w", ctx.Err())
 	case <-done:
-		return nil
 	}
+
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+
+	if len(s.failures) > 0 {
+		failures := make([]*FileError, len(s.failures))
+		copy(failures, s.failures)
+		return &BackupError{Failures: failures}
+	}
+
+	return nil
+}
+
+// Results はこれまでにアップロードしたファイルごとの結果を返す
+// 実行中のアップロードは含まれないため、WaitForCompletion の後に呼び出すこと
+func (s *S3BackupSession) Results() []FileResult {
+	return s.results.snapshot()
 }
 
-// Close はリソースをクリーンアップする
+// SkippedCount は増分バックアップでスキップしたファイルの数を返す
+// 実行中のアップロードは含まれないため、WaitForCompletion の後に呼び出すこと
+func (s *S3BackupSession) SkippedCount() int {
+	return s.results.skippedCount()
+}
+
+// Close は実行中と待ち行列のアップロードをキャンセルし、すべてのワーカーが終了するまで待つ
+// キャンセルされたアップロードは失敗として記録される
+// すべてのアップロードを完了させたい場合は、先に WaitForCompletion を呼び出すこと
 func (s *S3BackupSession) Close() error {
-	// S3クライアントは特にクリーンアップ不要
+	s.startOnce.Do(s.start)
+
+	// 待ち行列が空くのを待っている Save を先に解放する
+	s.cancel()
+
+	s.queueMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.queueMu.Unlock()
+
+	s.workers.Wait()
+	s.saves.Wait()
 	return nil
 }
 
@@ -179,20 +606,65 @@ func validateS3Config(config S3BackupSessionConfig) error {
 	// IAMロールやEC2インスタンスプロファイルを使用する場合もあるため、チェックのみ
 	_ = config.Endpoint == "" && (config.AccessKeyID == "" || config.SecretAccessKey == "")
 
-	// ACLの妥当性チェック
-	validACLs := map[string]bool{
-		"private":                   true,
-		"public-read":               true,
-		"public-read-write":         true,
-		"authenticated-read":        true,
-		"aws-exec-read":             true,
-		"bucket-owner-read":         true,
-		"bucket-owner-full-control": true,
-		"":                          true, // デフォルト値
+	// ACL、サーバー側の暗号化などオブジェクトの属性の妥当性チェック
+	if err := validateS3ObjectOptions(sessionObjectOptions(config)); err != nil {
+		return err
+	}
+
+	if err := validateS3ChecksumAlgorithm(config.ChecksumAlgorithm); err != nil {
+		return err
+	}
+
+	// マルチパートアップロード設定のチェック（0はデフォルト値）
+	if config.MultipartThreshold < 0 {
+		return fmt.Errorf("%w: multipart threshold must not be negative", ErrInvalidConfig)
+	}
+
+	if config.PartSize != 0 && (config.PartSize < minPartSize || config.PartSize > maxPartSize) {
+		return fmt.Errorf("%w: part size must be between %d and %d bytes", ErrInvalidConfig, minPartSize, maxPartSize)
+	}
+
+	if config.PartConcurrency < 0 {
+		return fmt.Errorf("%w: part concurrency must not be negative", ErrInvalidConfig)
+	}
+
+	if config.MaxConcurrentUploads < 0 || config.UploadQueueSize < 0 {
+		return fmt.Errorf("%w: upload concurrency and queue size must not be negative", ErrInvalidConfig)
+	}
+
+	if config.OrphanedUploadAge < 0 {
+		return fmt.Errorf("%w: orphaned upload age must not be negative", ErrInvalidConfig)
+	}
+
+	if config.Incremental < IncrementalOff || config.Incremental > IncrementalChecksum {
+		return fmt.Errorf("%w: invalid incremental mode: %d", ErrInvalidConfig, config.Incremental)
+	}
+
+	if err := validateDedupConfig(config.Dedup); err != nil {
+		return err
+	}
+
+	if err := validateCompressionConfig(config.Compression); err != nil {
+		return err
+	}
+
+	if config.Dedup.Enabled && config.Compression.Algorithm != CompressionNone {
+		return fmt.Errorf("%w: compression cannot be used in dedup mode", ErrInvalidConfig)
+	}
+
+	// チャンクのキーは内容のハッシュのため、暗号化しても内容の一致がわかってしまう
+	if config.Dedup.Enabled && config.KeyProvider != nil {
+		return fmt.Errorf("%w: encryption cannot be used in dedup mode", ErrInvalidConfig)
+	}
+
+	// 暗号化のたびにデータ鍵とノンスが変わり、中断前のパートと内容が一致しないため再開できない
+	if config.JournalDir != "" && config.KeyProvider != nil {
+		return fmt.Errorf("%w: encryption cannot be used with JournalDir", ErrInvalidConfig)
 	}
 
-	if !validACLs[config.ACL] {
-		return fmt.Errorf("%w: invalid ACL value: %s", ErrInvalidConfig, config.ACL)
+	// チャンクの存在確認や読み込みのたびに鍵が必要になるため、重複排除モードではSSE-Cを使わない
+	if config.Dedup.Enabled && config.ServerSideEncryption.Mode == SSEC {
+		return fmt.Errorf("%w: SSE-C cannot be used in dedup mode", ErrInvalidConfig)
 	}
 
 	return nil
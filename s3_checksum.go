@@ -0,0 +1,211 @@
+package safebackup
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// checksumSHA256MetadataKey は保存した内容（圧縮・暗号化した場合は変換後）のSHA-256をBase64で記録するユーザーメタデータのキー
+	checksumSHA256MetadataKey = "checksum-sha256"
+
+	// checksumCRC32CMetadataKey は保存した内容（圧縮・暗号化した場合は変換後）のCRC32CをBase64で記録するユーザーメタデータのキー
+	checksumCRC32CMetadataKey = "checksum-crc32c"
+)
+
+// crc32cTable はCRC32C（Castagnoli）の計算に使うテーブル
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newHash は方式のハッシュを返す（追加のチェックサムを送らない場合はnil）
+func (a S3ChecksumAlgorithm) newHash() hash.Hash {
+	switch a {
+	case S3ChecksumSHA256:
+		return sha256.New()
+	case S3ChecksumCRC32C:
+		return crc32.New(crc32cTable)
+	}
+	return nil
+}
+
+// metadataKey は保存した内容のチェックサムを記録するユーザーメタデータのキーを返す
+func (a S3ChecksumAlgorithm) metadataKey() string {
+	switch a {
+	case S3ChecksumSHA256:
+		return checksumSHA256MetadataKey
+	case S3ChecksumCRC32C:
+		return checksumCRC32CMetadataKey
+	}
+	return ""
+}
+
+// validateS3ChecksumAlgorithm はチェックサムの方式を検証する
+func validateS3ChecksumAlgorithm(algorithm S3ChecksumAlgorithm) error {
+	switch algorithm {
+	case S3ChecksumNone, S3ChecksumSHA256, S3ChecksumCRC32C:
+		return nil
+	}
+	return fmt.Errorf("%w: invalid checksum algorithm: %s", ErrInvalidConfig, algorithm)
+}
+
+// transferChecksums はリクエストの本文のMD5と追加のチェックサム
+type transferChecksums struct {
+	algorithm S3ChecksumAlgorithm
+	md5       []byte
+	checksum  string // 追加のチェックサムのBase64（送らない場合は空）
+}
+
+// transferHasher は書き込まれた内容の Content-MD5 と追加のチェックサムを計算する
+type transferHasher struct {
+	algorithm S3ChecksumAlgorithm
+	md5       hash.Hash
+	checksum  hash.Hash // 追加のチェックサムを送らない場合はnil
+}
+
+// newTransferHasher は algorithm のチェックサムと Content-MD5 を計算する transferHasher を返す
+func newTransferHasher(algorithm S3ChecksumAlgorithm) *transferHasher {
+	return &transferHasher{algorithm: algorithm, md5: md5.New(), checksum: algorithm.newHash()}
+}
+
+// Write は内容をチェックサムに加える
+func (h *transferHasher) Write(p []byte) (int, error) {
+	h.md5.Write(p)
+	if h.checksum != nil {
+		h.checksum.Write(p)
+	}
+	return len(p), nil
+}
+
+// sum はここまでに書き込んだ内容のチェックサムを返す
+func (h *transferHasher) sum() transferChecksums {
+	sums := transferChecksums{algorithm: h.algorithm, md5: h.md5.Sum(nil)}
+	if h.checksum != nil {
+		sums.checksum = base64.StdEncoding.EncodeToString(h.checksum.Sum(nil))
+	}
+	return sums
+}
+
+// computeTransferChecksums は body を読んでチェックサムを計算し、先頭に戻す
+func computeTransferChecksums(ctx context.Context, body io.ReadSeeker, algorithm S3ChecksumAlgorithm) (transferChecksums, error) {
+	hasher := newTransferHasher(algorithm)
+	if _, err := io.Copy(hasher, &contextReader{ctx: ctx, r: body}); err != nil {
+		return transferChecksums{}, fmt.Errorf("failed to compute checksum: %w", err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return transferChecksums{}, fmt.Errorf("failed to seek body: %w", err)
+	}
+	return hasher.sum(), nil
+}
+
+// contentMD5 は Content-MD5 ヘッダーの値を返す
+func (c transferChecksums) contentMD5() *string {
+	return aws.String(base64.StdEncoding.EncodeToString(c.md5))
+}
+
+// sha256 は x-amz-checksum-sha256 ヘッダーの値を返す（SHA-256を送らない場合はnil）
+func (c transferChecksums) sha256() *string {
+	if c.algorithm != S3ChecksumSHA256 {
+		return nil
+	}
+	return aws.String(c.checksum)
+}
+
+// crc32c は x-amz-checksum-crc32c ヘッダーの値を返す（CRC32Cを送らない場合はnil）
+func (c transferChecksums) crc32c() *string {
+	if c.algorithm != S3ChecksumCRC32C {
+		return nil
+	}
+	return aws.String(c.checksum)
+}
+
+// applyPut はチェックサムを PutObject のリクエストに設定する
+func (c transferChecksums) applyPut(input *s3.PutObjectInput) {
+	input.ContentMD5 = c.contentMD5()
+	input.ChecksumSHA256 = c.sha256()
+	input.ChecksumCRC32C = c.crc32c()
+}
+
+// applyUploadPart はチェックサムを UploadPart のリクエストに設定する
+func (c transferChecksums) applyUploadPart(input *s3.UploadPartInput) {
+	input.ContentMD5 = c.contentMD5()
+	input.ChecksumSHA256 = c.sha256()
+	input.ChecksumCRC32C = c.crc32c()
+}
+
+// verify はS3が応答したETagとチェックサムが送った内容のものと一致するかを検証する
+// 応答に含まれない値（S3互換のサービスが対応していない等）は検証しない
+// SSE-KMSとSSE-CではETagが内容のMD5にならないため、etagIsMD5 が偽の場合はETagを検証しない
+func (c transferChecksums) verify(etag, sha256Sum, crc32cSum *string, etagIsMD5 bool) error {
+	if etagIsMD5 && etag != nil {
+		if got := strings.Trim(aws.StringValue(etag), "\""); got != hex.EncodeToString(c.md5) {
+			return fmt.Errorf("%w: ETag %s does not match MD5 %s", ErrIntegrityCheckFailed, got, hex.EncodeToString(c.md5))
+		}
+	}
+	var got *string
+	switch c.algorithm {
+	case S3ChecksumSHA256:
+		got = sha256Sum
+	case S3ChecksumCRC32C:
+		got = crc32cSum
+	}
+	if got != nil && aws.StringValue(got) != c.checksum {
+		return fmt.Errorf("%w: %s checksum %s does not match %s", ErrIntegrityCheckFailed, c.algorithm, aws.StringValue(got), c.checksum)
+	}
+	return nil
+}
+
+// etagIsMD5 はサーバー側の暗号化の設定でオブジェクトのETagが内容のMD5になる場合に真を返す
+func etagIsMD5(sse SSEConfig) bool {
+	return sse.Mode == SSENone || sse.Mode == SSES3
+}
+
+// completedPart はアップロードしたパートの完了時の情報を返す
+// 追加のチェックサムを送った場合は、完了のリクエストにもパートのチェックサムが必要になる
+func completedPart(number int64, etag, sha256Sum, crc32cSum *string) *s3.CompletedPart {
+	return &s3.CompletedPart{
+		ETag:           etag,
+		PartNumber:     aws.Int64(number),
+		ChecksumSHA256: sha256Sum,
+		ChecksumCRC32C: crc32cSum,
+	}
+}
+
+// storedChecksumReader は保存した内容を読みながらユーザーメタデータに記録したチェックサムと照合する
+type storedChecksumReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+// newStoredChecksumReader はメタデータに保存した内容のチェックサムが記録されていれば、それを検証するReaderを返す
+// 記録されていない場合は r をそのまま返す
+func newStoredChecksumReader(r io.Reader, metadata map[string]*string) io.Reader {
+	for _, algorithm := range []S3ChecksumAlgorithm{S3ChecksumSHA256, S3ChecksumCRC32C} {
+		if expected := objectMetadata(metadata, algorithm.metadataKey()); expected != "" {
+			return &storedChecksumReader{r: r, hash: algorithm.newHash(), expected: expected}
+		}
+	}
+	return r
+}
+
+// Read は読み込みながらチェックサムを計算し、終端で検証する
+func (v *storedChecksumReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		if sum := base64.StdEncoding.EncodeToString(v.hash.Sum(nil)); sum != v.expected {
+			return n, fmt.Errorf("%w: stored checksum %s, expected %s", ErrIntegrityCheckFailed, sum, v.expected)
+		}
+	}
+	return n, err
+}
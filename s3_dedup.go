@@ -0,0 +1,236 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3ChunkStore はS3の Prefix 以下に重複排除モードのチャンクとマニフェストを保存する
+type s3ChunkStore struct {
+	client   S3API
+	bucket   string
+	prefix   string
+	options  S3ObjectOptions     // 書き込むオブジェクトの属性（Content-Type は種類ごとに決める）
+	checksum S3ChecksumAlgorithm // アップロード時に送る追加のチェックサム
+}
+
+// chunkKey はチャンクのS3キーを返す
+func (s *s3ChunkStore) chunkKey(hash string) string {
+	return joinObjectKey(s.prefix, chunkPath(hash))
+}
+
+// hasChunk はチャンクのオブジェクトが指定したサイズで存在するかどうかを返す
+func (s *s3ChunkStore) hasChunk(ctx context.Context, hash string, size int64) (bool, error) {
+	output, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.chunkKey(hash)),
+	})
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return aws.Int64Value(output.ContentLength) == size, nil
+}
+
+// putChunk はチャンクをアップロードする
+func (s *s3ChunkStore) putChunk(ctx context.Context, hash string, data []byte) error {
+	return s.put(ctx, s.chunkKey(hash), data, uploadMetadata(hash, time.Time{}), defaultContentType)
+}
+
+// getChunk はチャンクの内容をダウンロードする
+func (s *s3ChunkStore) getChunk(ctx context.Context, hash string) ([]byte, error) {
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.chunkKey(hash)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = output.Body.Close()
+	}()
+
+	return io.ReadAll(output.Body)
+}
+
+// deleteChunk はチャンクを削除する
+func (s *s3ChunkStore) deleteChunk(ctx context.Context, hash string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.chunkKey(hash)),
+	})
+	return err
+}
+
+// listChunks はチャンクのキー以下のオブジェクトを列挙する
+func (s *s3ChunkStore) listChunks(ctx context.Context, fn func(hash string, size int64)) error {
+	listPrefix := s3KeyPrefix(s.prefix) + chunkDirName + "/"
+	return listObjects(ctx, s.client, s.bucket, listPrefix, func(object *s3.Object) {
+		fn(path.Base(aws.StringValue(object.Key)), aws.Int64Value(object.Size))
+	})
+}
+
+// putManifest はマニフェストを relativePath のオブジェクトとしてアップロードする
+func (s *s3ChunkStore) putManifest(ctx context.Context, relativePath string, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.put(ctx, joinObjectKey(s.prefix, relativePath), data, nil, "application/json")
+}
+
+// getManifest は relativePath のマニフェストをダウンロードする
+func (s *s3ChunkStore) getManifest(ctx context.Context, relativePath string) (*manifest, error) {
+	return s.getManifestKey(ctx, joinObjectKey(s.prefix, relativePath))
+}
+
+// getManifestKey はS3キーを指定してマニフェストをダウンロードする
+func (s *s3ChunkStore) getManifestKey(ctx context.Context, key string) (*manifest, error) {
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = output.Body.Close()
+	}()
+
+	return readManifest(output.Body)
+}
+
+// listManifests はチャンクを除く Prefix 以下のマニフェストを列挙する
+// 空のオブジェクト（シンボリックリンク等）はダウンロードせずに除く
+func (s *s3ChunkStore) listManifests(ctx context.Context, fn func(relativePath string, m *manifest) error) error {
+	keyPrefix := s3KeyPrefix(s.prefix)
+
+	var keys []string
+	err := listObjects(ctx, s.client, s.bucket, keyPrefix, func(object *s3.Object) {
+		key := aws.StringValue(object.Key)
+		if aws.Int64Value(object.Size) > 0 && !isChunkPath(strings.TrimPrefix(key, keyPrefix)) {
+			keys = append(keys, key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		m, err := s.getManifestKey(ctx, key)
+		if errors.Is(err, errNotManifest) || errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read manifest %s: %w", key, err)
+		}
+		if err := fn(strings.TrimPrefix(key, keyPrefix), m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put はデータを1回のリクエストでアップロードする
+func (s *s3ChunkStore) put(ctx context.Context, key string, data []byte, metadata map[string]*string, contentType string) error {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	}
+	options := s.options
+	options.ContentType = contentType
+	objectAttributes{metadata: metadata, options: options}.applyPut(input)
+
+	sums, err := computeTransferChecksums(ctx, bytes.NewReader(data), s.checksum)
+	if err != nil {
+		return err
+	}
+	sums.applyPut(input)
+
+	output, err := s.client.PutObjectWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to upload to S3: %w", err)
+	}
+	if err := sums.verify(output.ETag, output.ChecksumSHA256, output.ChecksumCRC32C, etagIsMD5(options.sse())); err != nil {
+		return fmt.Errorf("failed to verify upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// dedupStore は options の属性で書き込む重複排除モードの保存先を返す
+func (s *S3BackupSession) dedupStore(options S3ObjectOptions) *s3ChunkStore {
+	return &s3ChunkStore{
+		client:   s.s3Client,
+		bucket:   s.config.Bucket,
+		prefix:   s.config.Prefix,
+		options:  options,
+		checksum: s.config.ChecksumAlgorithm,
+	}
+}
+
+// saveDeduplicatedFile はファイルを重複排除モードでアップロードする
+func (s *S3BackupSession) saveDeduplicatedFile(ctx context.Context, localFilePath, relativePath string, options S3ObjectOptions) (copyResult, error) {
+	file, err := os.Open(localFilePath)
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	return s.saveDeduplicated(ctx, file, fileInfo, relativePath, options)
+}
+
+// saveDeduplicated は r の内容を重複排除モードでアップロードする
+// ガベージコレクションがアップロード中のチャンクを削除しないように、それとは排他的に実行する
+func (s *S3BackupSession) saveDeduplicated(ctx context.Context, r io.Reader, srcInfo os.FileInfo, relativePath string, options S3ObjectOptions) (copyResult, error) {
+	s.dedupMu.RLock()
+	defer s.dedupMu.RUnlock()
+
+	return saveDeduplicated(ctx, s.dedupStore(options), s.config.Dedup, s.config.Incremental, r, srcInfo, relativePath)
+}
+
+// GarbageCollect は重複排除モードで、どのマニフェストからも参照されていないチャンクを削除する
+// すべてのマニフェストをダウンロードして参照を調べるため、オブジェクト数に応じてリクエストが発生する
+// 実行中はこのセッションのアップロードを待たせるが、同じ Prefix に書き込む他のセッションとは同時に実行しないこと
+func (s *S3BackupSession) GarbageCollect(ctx context.Context) (GarbageCollectionReport, error) {
+	if !s.config.Dedup.Enabled {
+		return GarbageCollectionReport{}, fmt.Errorf("%w: dedup mode is not enabled", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return GarbageCollectionReport{}, err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+
+	return collectGarbage(ctx, s.dedupStore(sessionObjectOptions(s.config)))
+}
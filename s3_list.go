@@ -0,0 +1,182 @@
+package safebackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// List は Prefix 以下で相対パスが prefix で始まるオブジェクトを返す
+// ListObjectsV2 はユーザーメタデータを返さないため、Checksum や圧縮・暗号化したオブジェクトの元のサイズが必要な場合は Stat を使う
+// 重複排除モードではマニフェストをダウンロードし、元のファイルのサイズ、更新日時とチェックサムを返す
+func (s *S3BackupSession) List(ctx context.Context, prefix string) ([]BackupInfo, error) {
+	keyPrefix := s3KeyPrefix(s.config.Prefix)
+
+	var infos []BackupInfo
+	err := listObjects(ctx, s.s3Client, s.config.Bucket, keyPrefix+prefix, func(object *s3.Object) {
+		key := aws.StringValue(object.Key)
+		if isChunkPath(strings.TrimPrefix(key, keyPrefix)) {
+			return
+		}
+		metadata := map[string]string{}
+		if object.ETag != nil {
+			metadata["etag"] = aws.StringValue(object.ETag)
+		}
+		if object.StorageClass != nil {
+			metadata["storage-class"] = aws.StringValue(object.StorageClass)
+		}
+
+		infos = append(infos, BackupInfo{
+			RelativePath: strings.TrimPrefix(key, keyPrefix),
+			Destination:  key,
+			Size:         aws.Int64Value(object.Size),
+			ModTime:      aws.TimeValue(object.LastModified),
+			Metadata:     metadata,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.Dedup.Enabled {
+		for i := range infos {
+			if err := s.applyManifest(ctx, &infos[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return infos, nil
+}
+
+// applyManifest は重複排除モードで、バックアップの情報をマニフェストが表すファイルの情報に置き換える
+// 空のオブジェクト（シンボリックリンク等）とマニフェストでないオブジェクトはそのままにする
+func (s *S3BackupSession) applyManifest(ctx context.Context, info *BackupInfo) error {
+	if info.Size == 0 {
+		return nil
+	}
+
+	m, err := s.dedupStore(sessionObjectOptions(s.config)).getManifest(ctx, info.RelativePath)
+	if errors.Is(err, errNotManifest) || errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read manifest %s: %w", info.RelativePath, err)
+	}
+	applyManifest(info, m)
+	return nil
+}
+
+// Stat はオブジェクトの情報を返す
+// Checksum はアップロード時にメタデータに記録したSHA-256（記録されていない場合は空）
+// 圧縮・暗号化したオブジェクトの Size はメタデータに記録した元のサイズ
+// （暗号化してマルチパートでアップロードしたストリームは元のサイズが分からないため-1）
+// 重複排除モードではマニフェストに記録したものを返す
+// SSE-Cで保存したオブジェクトはセッションまたは ctx で指定した鍵で確認する
+func (s *S3BackupSession) Stat(ctx context.Context, relativePath string) (BackupInfo, error) {
+	options, err := s.objectOptions(ctx)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	key := s.objectKey(relativePath)
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = options.sse().customerKey()
+	output, err := s.s3Client.HeadObjectWithContext(ctx, input)
+	if isNotFound(err) {
+		return BackupInfo{}, fmt.Errorf("%w: %s", ErrNotFound, relativePath)
+	}
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to head object %s: %w", key, err)
+	}
+
+	metadata := map[string]string{}
+	if output.ETag != nil {
+		metadata["etag"] = aws.StringValue(output.ETag)
+	}
+	if output.StorageClass != nil {
+		metadata["storage-class"] = aws.StringValue(output.StorageClass)
+	}
+	if output.ContentType != nil {
+		metadata["content-type"] = aws.StringValue(output.ContentType)
+	}
+	for name, value := range output.Metadata {
+		metadata["x-amz-meta-"+strings.ToLower(name)] = aws.StringValue(value)
+	}
+
+	if algorithm := objectMetadata(output.Metadata, compressionMetadataKey); algorithm != "" {
+		metadata[compressionMetadataKey] = algorithm
+	}
+	if encryption := objectMetadata(output.Metadata, encryptionMetadataKey); encryption != "" {
+		metadata[encryptionMetadataKey] = encryption
+		metadata[encryptionKeyIDMetadataKey] = objectMetadata(output.Metadata, encryptionKeyIDMetadataKey)
+	}
+
+	info := BackupInfo{
+		RelativePath: strings.TrimPrefix(key, s3KeyPrefix(s.config.Prefix)),
+		Destination:  key,
+		Size:         objectSize(output.Metadata, aws.Int64Value(output.ContentLength)),
+		ModTime:      aws.TimeValue(output.LastModified),
+		Checksum:     objectChecksum(output.Metadata),
+		Metadata:     metadata,
+	}
+	if s.config.Dedup.Enabled {
+		if err := s.applyManifest(ctx, &info); err != nil {
+			return BackupInfo{}, err
+		}
+	}
+	return info, nil
+}
+
+// s3KeyPrefix は相対パスの前に付くS3キーの部分を返す（prefix が空の場合は空）
+func s3KeyPrefix(prefix string) string {
+	prefix = path.Clean(strings.ReplaceAll(prefix, "\\", "/"))
+	if prefix == "." || prefix == "/" {
+		return ""
+	}
+	return strings.TrimPrefix(prefix, "/") + "/"
+}
+
+// listObjects は listPrefix で始まるオブジェクトをページをたどって列挙し、fn に渡す
+// ディレクトリを表す "/" で終わるキーは含まない
+func listObjects(ctx context.Context, client S3API, bucket, listPrefix string, fn func(object *s3.Object)) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(listPrefix),
+	}
+	for {
+		output, err := client.ListObjectsV2WithContext(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		for _, object := range output.Contents {
+			if !strings.HasSuffix(aws.StringValue(object.Key), "/") {
+				fn(object)
+			}
+		}
+
+		if !aws.BoolValue(output.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+// isNotFound はS3がオブジェクトの不在を返したかどうかを判定する
+// HeadObject は本文を返さないため、エラーコードは "NotFound" になる
+func isNotFound(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	return aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey
+}
@@ -0,0 +1,598 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// minPartSize はマルチパートアップロードの最小パートサイズ（最終パートを除く）
+	minPartSize = 5 * 1024 * 1024
+
+	// maxPartSize はマルチパートアップロードの最大パートサイズ
+	maxPartSize = 5 * 1024 * 1024 * 1024
+
+	// maxUploadParts はマルチパートアップロードの最大パート数
+	maxUploadParts = 10000
+
+	// defaultMultipartThreshold はマルチパートアップロードに切り替えるデフォルトのファイルサイズ
+	defaultMultipartThreshold = 64 * 1024 * 1024
+
+	// defaultPartSize はデフォルトのパートサイズ
+	defaultPartSize = 16 * 1024 * 1024
+
+	// defaultPartConcurrency は1ファイルあたりのデフォルトの並列パート数
+	defaultPartConcurrency = 4
+
+	// maxCopyObjectSize は1回の CopyObject でコピーできる最大のサイズ（S3の制限）
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+	// copyPartSize は CopyObject の上限を超えるオブジェクトをマルチパートでコピーする場合のパートサイズ
+	copyPartSize = 512 * 1024 * 1024
+
+	// checksumMetadataKey はオブジェクトの内容のSHA-256を記録するユーザーメタデータのキー
+	// リストア時の整合性検証と増分バックアップの比較に使う
+	checksumMetadataKey = "sha256"
+
+	// modTimeMetadataKey はアップロード元ファイルの更新日時（RFC 3339）を記録するユーザーメタデータのキー
+	// 増分バックアップの比較に使う
+	modTimeMetadataKey = "mtime"
+)
+
+// uploadPart はアップロードする1パート分のデータ
+type uploadPart struct {
+	number int64
+	body   io.ReadSeeker
+	size   int64
+	done   func() // アップロード後に呼ばれる（バッファの返却等、不要ならnil）
+}
+
+// partProducer はパートを順に out へ送る
+// stop がクローズされたら送信をやめて戻る
+type partProducer func(stop <-chan struct{}, out chan<- uploadPart) error
+
+// multipartThreshold はマルチパートアップロードに切り替えるファイルサイズを返す
+func (s *S3BackupSession) multipartThreshold() int64 {
+	if s.config.MultipartThreshold > 0 {
+		return s.config.MultipartThreshold
+	}
+	return defaultMultipartThreshold
+}
+
+// partSizeFor はデータサイズに対するパートサイズを返す
+// サイズが分かっている場合はパート数が上限を超えないように大きくする
+func (s *S3BackupSession) partSizeFor(size int64) int64 {
+	partSize := s.config.PartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	if size > partSize*maxUploadParts {
+		partSize = (size + maxUploadParts - 1) / maxUploadParts
+	}
+	return partSize
+}
+
+// partConcurrency は1ファイルあたりの並列パート数を返す
+func (s *S3BackupSession) partConcurrency() int {
+	if s.config.PartConcurrency > 0 {
+		return s.config.PartConcurrency
+	}
+	return defaultPartConcurrency
+}
+
+// uploadFileMultipart はファイルを並列のマルチパートアップロードでアップロードする
+// ジャーナルが有効な場合は、前回のセッションで中断したアップロードを再開する
+// checksum はファイル全体のSHA-256で、再開時にファイルが変わっていないことの確認に使う
+// attrs はオブジェクトに記録するメタデータと属性
+func (s *S3BackupSession) uploadFileMultipart(ctx context.Context, file *os.File, key string, size int64, checksum string, attrs objectAttributes) error {
+	partSize := s.partSizeFor(size)
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	state, err := s.startFileMultipart(ctx, key, fileInfo, partSize, checksum, attrs)
+	if err != nil {
+		return err
+	}
+
+	uploaded := make(map[int64]bool, len(state.parts))
+	for _, part := range state.parts {
+		uploaded[*part.PartNumber] = true
+	}
+
+	_, err = s.runMultipart(ctx, key, state, func(stop <-chan struct{}, out chan<- uploadPart) error {
+		number := int64(1)
+		for offset := int64(0); offset < size; offset += partSize {
+			n := partSize
+			if size-offset < n {
+				n = size - offset
+			}
+
+			if !uploaded[number] {
+				part := uploadPart{
+					number: number,
+					body:   io.NewSectionReader(file, offset, n),
+					size:   n,
+				}
+				select {
+				case out <- part:
+				case <-stop:
+					return nil
+				}
+			}
+			number++
+		}
+		return nil
+	})
+	return err
+}
+
+// uploadStream はReaderの内容をアップロードし、アップロードしたバイト数とSHA-256チェックサムを返す
+// 1パートに収まる場合は PutObject、収まらない場合はマルチパートアップロードを使う
+// マルチパートでは並列パート数分のバッファを使い、読み終えて分かったチェックサムと元のサイズは
+// 完了後にオブジェクトを自身にコピーしてメタデータに記録する
+// 暗号化する場合は読み込みながら暗号化する（チェックサムは元の内容のもの）
+// Content-Type は options で指定されていなければ、暗号化しない場合に拡張子と内容の先頭から判定する
+func (s *S3BackupSession) uploadStream(ctx context.Context, r io.Reader, key string, sizeHint int64, options S3ObjectOptions) (int64, string, error) {
+	hash := sha256.New()
+	plain := &countingWriter{w: hash}
+	var body io.Reader = io.TeeReader(&contextReader{ctx: ctx, r: r}, plain)
+
+	enc := storageEncoding{keys: s.config.KeyProvider}
+	keyID := ""
+	if enc.keys != nil {
+		encrypted, id, err := encodingReader(ctx, body, enc)
+		if err != nil {
+			return 0, "", err
+		}
+		defer func() {
+			_ = encrypted.Close()
+		}()
+		body, keyID = encrypted, id
+	}
+
+	// transfer はアップロードする内容（暗号化した場合は暗号化後）全体の Content-MD5 と追加のチェックサム
+	transfer := newTransferHasher(s.config.ChecksumAlgorithm)
+	body = io.TeeReader(body, transfer)
+
+	partSize := s.partSizeFor(sizeHint)
+	first, n, err := readFirstPart(body, partSize, sizeHint)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// 1パートに収まる場合はそのままアップロード
+		// 読み終えているのでチェックサムをメタデータに記録できる
+		checksum := hex.EncodeToString(hash.Sum(nil))
+		metadata := uploadMetadata(checksum, time.Time{})
+		if enc.keys != nil {
+			addEncodingMetadata(metadata, enc, keyID, plain.n)
+		}
+		attrs := newObjectAttributes(options, metadata, key, contentHead(first[:n]))
+		if err := s.putObjectChecked(ctx, key, bytes.NewReader(first[:n]), int64(n), transfer.sum(), attrs); err != nil {
+			return 0, "", err
+		}
+		return int64(n), checksum, nil
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	// アップロードが終わったバッファを再利用する
+	buffers := make(chan []byte, s.partConcurrency())
+	for i := 1; i < cap(buffers); i++ {
+		buffers <- make([]byte, partSize)
+	}
+
+	// チェックサムと元のサイズは読み終えるまで分からないため、完了後に記録する
+	var metadata map[string]*string
+	if enc.keys != nil {
+		metadata = map[string]*string{}
+		addEncodingMetadata(metadata, enc, keyID, -1)
+	}
+
+	attrs := newObjectAttributes(options, metadata, key, contentHead(first))
+	written, err := s.uploadMultipart(ctx, key, attrs, func(stop <-chan struct{}, out chan<- uploadPart) error {
+		buf := first
+		for number := int64(1); ; number++ {
+			if number > 1 {
+				select {
+				case buf = <-buffers:
+				case <-stop:
+					return nil
+				}
+
+				n, err = io.ReadFull(body, buf)
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+					return fmt.Errorf("failed to read stream: %w", err)
+				}
+			}
+
+			if number > maxUploadParts {
+				return fmt.Errorf("stream exceeds %d parts", maxUploadParts)
+			}
+
+			partBuf := buf
+			part := uploadPart{
+				number: number,
+				body:   bytes.NewReader(buf[:n]),
+				size:   int64(n),
+				done:   func() { buffers <- partBuf },
+			}
+			select {
+			case out <- part:
+			case <-stop:
+				return nil
+			}
+
+			if n < len(buf) {
+				// 最終パート
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	metadata = uploadMetadata(checksum, time.Time{})
+	if enc.keys != nil {
+		addEncodingMetadata(metadata, enc, keyID, plain.n)
+	}
+	stored := transfer.sum()
+	if stored.checksum != "" {
+		metadata[s.config.ChecksumAlgorithm.metadataKey()] = aws.String(stored.checksum)
+	}
+	attrs.metadata = metadata
+	if err := s.replaceMetadata(ctx, key, written, stored, attrs); err != nil {
+		return 0, "", err
+	}
+	return written, checksum, nil
+}
+
+// replaceMetadata はアップロード済みのオブジェクトを自身にコピーして、メタデータを attrs のものに置き換える
+// 追加のチェックサムを送る場合は、コピーでS3が計算した内容全体のチェックサムを sums と照合する
+// CopyObject の上限を超えるオブジェクトはマルチパートでコピーする
+func (s *S3BackupSession) replaceMetadata(ctx context.Context, key string, size int64, sums transferChecksums, attrs objectAttributes) error {
+	if size > maxCopyObjectSize {
+		return s.copyObjectMultipart(ctx, key, size, copyPartSize, attrs)
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.config.Bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(s.copySource(key)),
+		ChecksumAlgorithm: optionalString(string(s.config.ChecksumAlgorithm)),
+	}
+	attrs.applyCopy(input)
+
+	output, err := s.s3Client.CopyObjectWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to record metadata of %s: %w", key, err)
+	}
+	if result := output.CopyObjectResult; result != nil {
+		if err := sums.verify(nil, result.ChecksumSHA256, result.ChecksumCRC32C, false); err != nil {
+			return fmt.Errorf("failed to verify upload of %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// copyObjectMultipart はオブジェクトを partSize ごとに UploadPartCopy で自身にコピーして、メタデータを attrs のものに置き換える
+// 途中で失敗した場合はコピーを中止し、元のオブジェクトをそのまま残す
+func (s *S3BackupSession) copyObjectMultipart(ctx context.Context, key string, size, partSize int64, attrs objectAttributes) error {
+	uploadID, err := s.createMultipart(ctx, key, attrs)
+	if err != nil {
+		return err
+	}
+
+	sse := attrs.sse()
+	var parts []*s3.CompletedPart
+	for number, offset := int64(1), int64(0); offset < size; number, offset = number+1, offset+partSize {
+		end := min(offset+partSize, size) - 1
+		input := &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.config.Bucket),
+			Key:             aws.String(key),
+			UploadId:        uploadID,
+			PartNumber:      aws.Int64(number),
+			CopySource:      aws.String(s.copySource(key)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		}
+		input.SSECustomerAlgorithm, input.SSECustomerKey = sse.customerKey()
+		input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey = sse.customerKey()
+
+		output, err := s.s3Client.UploadPartCopyWithContext(ctx, input)
+		if err != nil {
+			s.abortMultipart(ctx, key, uploadID)
+			return fmt.Errorf("failed to record metadata of %s: failed to copy part %d: %w", key, number, err)
+		}
+		result := output.CopyPartResult
+		if result == nil {
+			result = &s3.CopyPartResult{}
+		}
+		parts = append(parts, completedPart(number, result.ETag, result.ChecksumSHA256, result.ChecksumCRC32C))
+	}
+
+	_, err = s.s3Client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.config.Bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortMultipart(ctx, key, uploadID)
+		return fmt.Errorf("failed to record metadata of %s: failed to complete multipart copy: %w", key, err)
+	}
+	return nil
+}
+
+// copySource は CopyObject と UploadPartCopy で指定するコピー元（バケット名とURLエンコードしたキー）を返す
+func (s *S3BackupSession) copySource(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return s.config.Bucket + "/" + strings.Join(segments, "/")
+}
+
+// putObject はデータを1回のリクエストでアップロードする
+// 内容の Content-MD5 と追加のチェックサムを送ってS3に検証させ、応答のETagとチェックサムも照合する
+// 追加のチェックサムはリストア時に照合できるようにメタデータにも記録する
+func (s *S3BackupSession) putObject(ctx context.Context, key string, body io.ReadSeeker, size int64, attrs objectAttributes) error {
+	sums, err := computeTransferChecksums(ctx, body, s.config.ChecksumAlgorithm)
+	if err != nil {
+		return err
+	}
+	return s.putObjectChecked(ctx, key, body, size, sums, attrs)
+}
+
+// putObjectChecked は計算済みの body のチェックサム sums を使って putObject と同じようにアップロードする
+// 内容を読んだついでにチェックサムを計算した場合に、アップロードの前にもう一度読まないようにする
+func (s *S3BackupSession) putObjectChecked(ctx context.Context, key string, body io.ReadSeeker, size int64, sums transferChecksums, attrs objectAttributes) error {
+	if sums.checksum != "" {
+		metadata := make(map[string]*string, len(attrs.metadata)+1)
+		for k, v := range attrs.metadata {
+			metadata[k] = v
+		}
+		metadata[s.config.ChecksumAlgorithm.metadataKey()] = aws.String(sums.checksum)
+		attrs.metadata = metadata
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.config.Bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	}
+	attrs.applyPut(input)
+	sums.applyPut(input)
+
+	output, err := s.s3Client.PutObjectWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to upload to S3: %w", err)
+	}
+	if err := sums.verify(output.ETag, output.ChecksumSHA256, output.ChecksumCRC32C, etagIsMD5(attrs.sse())); err != nil {
+		return fmt.Errorf("failed to verify upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// uploadMetadata はチェックサムと更新日時を記録するユーザーメタデータを返す
+// 不明な値（空のチェックサム、ゼロの日時）は記録しない
+func uploadMetadata(checksum string, modTime time.Time) map[string]*string {
+	metadata := map[string]*string{}
+	if checksum != "" {
+		metadata[checksumMetadataKey] = aws.String(checksum)
+	}
+	if !modTime.IsZero() {
+		metadata[modTimeMetadataKey] = aws.String(modTime.UTC().Format(time.RFC3339Nano))
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+// addEncodingMetadata は圧縮形式、暗号化の鍵のIDと元のサイズ（負の場合は記録しない）をメタデータに追加する
+func addEncodingMetadata(metadata map[string]*string, enc storageEncoding, keyID string, originalSize int64) {
+	if enc.compression != CompressionNone {
+		metadata[compressionMetadataKey] = aws.String(string(enc.compression))
+	}
+	if enc.keys != nil {
+		metadata[encryptionMetadataKey] = aws.String(encryptionMetadataValue)
+		metadata[encryptionKeyIDMetadataKey] = aws.String(keyID)
+	}
+	if originalSize >= 0 {
+		metadata[originalSizeMetadataKey] = aws.String(strconv.FormatInt(originalSize, 10))
+	}
+}
+
+// multipartState は実行中のマルチパートアップロードの状態
+type multipartState struct {
+	uploadID *string
+	parts    []*s3.CompletedPart // 再開時にアップロード済みのパート
+	written  int64               // parts の合計サイズ
+	journal  *uploadJournal      // 再開用のジャーナル（無効な場合はnil）
+	sse      SSEConfig           // SSE-Cではパートごとに鍵を送る
+}
+
+// uploadMultipart はマルチパートアップロードを開始し、アップロードしたバイト数を返す
+// 内容を読み終えるまでチェックサムが分からないため、attrs のメタデータにはチェックサムを含まない
+// （呼び出し側が完了後に replaceMetadata で記録する）
+func (s *S3BackupSession) uploadMultipart(ctx context.Context, key string, attrs objectAttributes, produce partProducer) (int64, error) {
+	uploadID, err := s.createMultipart(ctx, key, attrs)
+	if err != nil {
+		return 0, err
+	}
+	return s.runMultipart(ctx, key, &multipartState{uploadID: uploadID, sse: attrs.sse()}, produce)
+}
+
+// createMultipart はマルチパートアップロードを作成し、アップロードIDを返す
+// attrs は完成後のオブジェクトのメタデータと属性
+func (s *S3BackupSession) createMultipart(ctx context.Context, key string, attrs objectAttributes) (*string, error) {
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(s.config.Bucket),
+		Key:               aws.String(key),
+		ChecksumAlgorithm: optionalString(string(s.config.ChecksumAlgorithm)),
+	}
+	attrs.applyCreateMultipart(createInput)
+
+	created, err := s.s3Client.CreateMultipartUploadWithContext(ctx, createInput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	return created.UploadId, nil
+}
+
+// runMultipart は produce が送ったパートを並列にアップロードしてマルチパートアップロードを完了する
+// 途中で失敗した場合はアップロードを中止して不完全なパートが残らないようにする
+// ただしジャーナルが有効な場合は、次のセッションで再開できるようにアップロードを残す
+func (s *S3BackupSession) runMultipart(ctx context.Context, key string, state *multipartState, produce partProducer) (int64, error) {
+	var (
+		mu       sync.Mutex
+		firstErr error
+		written  = state.written
+		parts    = state.parts
+		stop     = make(chan struct{})
+		stopOnce sync.Once
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		stopOnce.Do(func() { close(stop) })
+	}
+
+	out := make(chan uploadPart)
+	var wg sync.WaitGroup
+	for i := 0; i < s.partConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range out {
+				// 失敗した後のパートはアップロードしない
+				select {
+				case <-stop:
+					if part.done != nil {
+						part.done()
+					}
+					continue
+				default:
+				}
+
+				output, sums, err := s.uploadPartChecked(ctx, key, state, part)
+				if part.done != nil {
+					part.done()
+				}
+				if err != nil {
+					fail(fmt.Errorf("failed to upload part %d: %w", part.number, err))
+					continue
+				}
+
+				if state.journal != nil {
+					// 記録に失敗しても、再開時にそのパートを再送するだけなので処理は継続
+					_ = state.journal.recordPart(part.number, aws.StringValue(output.ETag))
+				}
+
+				mu.Lock()
+				parts = append(parts, completedPart(part.number, output.ETag, sums.sha256(), sums.crc32c()))
+				written += part.size
+				mu.Unlock()
+			}
+		}()
+	}
+
+	if err := produce(stop, out); err != nil {
+		fail(err)
+	}
+	close(out)
+	wg.Wait()
+
+	if firstErr == nil {
+		// パートは番号順に並べる必要がある
+		sort.Slice(parts, func(i, j int) bool {
+			return *parts[i].PartNumber < *parts[j].PartNumber
+		})
+
+		_, err := s.s3Client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.config.Bucket),
+			Key:             aws.String(key),
+			UploadId:        state.uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+		if err != nil {
+			firstErr = fmt.Errorf("failed to complete multipart upload: %w", err)
+		}
+	}
+
+	if firstErr != nil {
+		if state.journal == nil {
+			s.abortMultipart(ctx, key, state.uploadID)
+		}
+		return 0, firstErr
+	}
+
+	if state.journal != nil {
+		_ = state.journal.remove()
+	}
+	return written, nil
+}
+
+// uploadPartChecked はパートの Content-MD5 と追加のチェックサムを送ってアップロードし、応答のETagとチェックサムを照合する
+func (s *S3BackupSession) uploadPartChecked(ctx context.Context, key string, state *multipartState, part uploadPart) (*s3.UploadPartOutput, transferChecksums, error) {
+	sums, err := computeTransferChecksums(ctx, part.body, s.config.ChecksumAlgorithm)
+	if err != nil {
+		return nil, transferChecksums{}, err
+	}
+
+	input := &s3.UploadPartInput{
+		Bucket:        aws.String(s.config.Bucket),
+		Key:           aws.String(key),
+		UploadId:      state.uploadID,
+		PartNumber:    aws.Int64(part.number),
+		Body:          part.body,
+		ContentLength: aws.Int64(part.size),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = state.sse.customerKey()
+	sums.applyUploadPart(input)
+
+	output, err := s.s3Client.UploadPartWithContext(ctx, input)
+	if err != nil {
+		return nil, transferChecksums{}, err
+	}
+	if err := sums.verify(output.ETag, output.ChecksumSHA256, output.ChecksumCRC32C, etagIsMD5(state.sse)); err != nil {
+		return nil, transferChecksums{}, err
+	}
+	return output, sums, nil
+}
+
+// abortMultipart はマルチパートアップロードを中止する
+// キャンセルによる失敗でも中止できるように ctx のキャンセルは引き継がない
+// 中止に失敗した場合はバケットのライフサイクルルールに任せる
+func (s *S3BackupSession) abortMultipart(ctx context.Context, key string, uploadID *string) {
+	_, _ = s.s3Client.AbortMultipartUploadWithContext(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.config.Bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+}
@@ -0,0 +1,451 @@
+package safebackup
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// maxUserMetadataSize はユーザーメタデータのキーと値の合計サイズの上限（S3の制限）
+	maxUserMetadataSize = 2 * 1024
+
+	// maxObjectTags はオブジェクトに付けられるタグの数の上限（S3の制限）
+	maxObjectTags = 10
+
+	// defaultContentType は Content-Type を判定できない場合の値
+	defaultContentType = "application/octet-stream"
+
+	// sseCustomerAlgorithm はSSE-Cで指定する暗号化方式
+	sseCustomerAlgorithm = "AES256"
+)
+
+// reservedMetadataKeys はこのライブラリが記録するため、利用者が指定できないユーザーメタデータのキー
+var reservedMetadataKeys = []string{
+	checksumMetadataKey, modTimeMetadataKey, symlinkMetadataKey,
+	compressionMetadataKey, originalSizeMetadataKey,
+	encryptionMetadataKey, encryptionKeyIDMetadataKey,
+	checksumSHA256MetadataKey, checksumCRC32CMetadataKey,
+}
+
+// validACLs はオブジェクトに指定できるACL（空はデフォルト値）
+var validACLs = map[string]bool{
+	"private":                   true,
+	"public-read":               true,
+	"public-read-write":         true,
+	"authenticated-read":        true,
+	"aws-exec-read":             true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+	"":                          true, // デフォルト値
+}
+
+// s3ObjectOptionsKey は S3ObjectOptions を保持するコンテキストのキー
+type s3ObjectOptionsKey struct{}
+
+// WithS3ObjectOptions は Save ごとにオブジェクトの属性を上書きするコンテキストを返す
+// SaveContext、SaveReader、SaveDir に渡すと、そのアップロードにだけ options が適用される
+// S3RestoreSession の RestoreContext、RestorePrefix、Open に渡すと、SSE-Cの鍵を上書きする
+func WithS3ObjectOptions(ctx context.Context, options S3ObjectOptions) context.Context {
+	return context.WithValue(ctx, s3ObjectOptionsKey{}, options)
+}
+
+// s3ObjectOptionsFrom はコンテキストに設定された S3ObjectOptions を返す
+func s3ObjectOptionsFrom(ctx context.Context) (S3ObjectOptions, bool) {
+	options, ok := ctx.Value(s3ObjectOptionsKey{}).(S3ObjectOptions)
+	return options, ok
+}
+
+// sessionObjectOptions はセッションの設定のオブジェクトの属性を返す
+func sessionObjectOptions(config S3BackupSessionConfig) S3ObjectOptions {
+	sse := config.ServerSideEncryption
+	return S3ObjectOptions{
+		ACL:                  config.ACL,
+		ServerSideEncryption: &sse,
+		StorageClass:         config.StorageClass,
+		Metadata:             config.Metadata,
+		ContentType:          config.ContentType,
+		CacheControl:         config.CacheControl,
+		Tags:                 config.Tags,
+	}
+}
+
+// objectOptions はセッションの設定に ctx で指定された上書きを適用したオブジェクトの属性を返す
+// 上書きが無効な場合は ErrInvalidConfig を返す
+func (s *S3BackupSession) objectOptions(ctx context.Context) (S3ObjectOptions, error) {
+	options := sessionObjectOptions(s.config)
+	override, ok := s3ObjectOptionsFrom(ctx)
+	if !ok {
+		return options, nil
+	}
+
+	if err := validateS3ObjectOptions(override); err != nil {
+		return S3ObjectOptions{}, err
+	}
+	if s.config.Dedup.Enabled && override.ServerSideEncryption != nil && override.ServerSideEncryption.Mode == SSEC {
+		return S3ObjectOptions{}, fmt.Errorf("%w: SSE-C cannot be used in dedup mode", ErrInvalidConfig)
+	}
+
+	if override.ACL != "" {
+		options.ACL = override.ACL
+	}
+	if override.ServerSideEncryption != nil {
+		options.ServerSideEncryption = override.ServerSideEncryption
+	}
+	if override.StorageClass != "" {
+		options.StorageClass = override.StorageClass
+	}
+	if override.ContentType != "" {
+		options.ContentType = override.ContentType
+	}
+	if override.CacheControl != "" {
+		options.CacheControl = override.CacheControl
+	}
+	options.Metadata = mergeStringMaps(options.Metadata, override.Metadata)
+	options.Tags = mergeStringMaps(options.Tags, override.Tags)
+
+	// 合わせた結果もS3の制限を超えないことを確認する
+	if err := validateS3ObjectOptions(options); err != nil {
+		return S3ObjectOptions{}, err
+	}
+	return options, nil
+}
+
+// mergeStringMaps は base に override を追加した新しいマップを返す（同じキーは override の値）
+func mergeStringMaps(base, override map[string]string) map[string]string {
+	if len(override) == 0 {
+		return base
+	}
+	merged := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
+
+// objectAttributes はアップロードするオブジェクトのメタデータと属性
+type objectAttributes struct {
+	metadata map[string]*string // このライブラリが記録するユーザーメタデータ
+	options  S3ObjectOptions    // Content-Type を判定済みの属性
+}
+
+// newObjectAttributes は options の Content-Type が空の場合に判定して objectAttributes を作成する
+// 圧縮・暗号化したオブジェクトは元の形式で読めないため、判定せずに application/octet-stream にする
+// head は内容の先頭で、拡張子から判定できない場合に使う（不明な場合はnil）
+func newObjectAttributes(options S3ObjectOptions, metadata map[string]*string, relativePath string, head []byte) objectAttributes {
+	if options.ContentType == "" {
+		if encodedObject(metadata) {
+			options.ContentType = defaultContentType
+		} else {
+			options.ContentType = detectContentType(relativePath, head)
+		}
+	}
+	return objectAttributes{metadata: metadata, options: options}
+}
+
+// detectContentType は相対パスの拡張子、分からない場合は内容の先頭から Content-Type を判定する
+func detectContentType(relativePath string, head []byte) string {
+	if contentType := mime.TypeByExtension(path.Ext(relativePath)); contentType != "" {
+		return contentType
+	}
+	if len(head) > 0 {
+		return http.DetectContentType(head)
+	}
+	return defaultContentType
+}
+
+// contentHead は Content-Type の判定に使う内容の先頭を返す
+func contentHead(data []byte) []byte {
+	if len(data) > 512 {
+		return data[:512]
+	}
+	return data
+}
+
+// userMetadata は利用者のメタデータとこのライブラリのメタデータを合わせたユーザーメタデータを返す
+func (a objectAttributes) userMetadata() map[string]*string {
+	if len(a.options.Metadata) == 0 {
+		return a.metadata
+	}
+	metadata := make(map[string]*string, len(a.options.Metadata)+len(a.metadata))
+	for k, v := range a.options.Metadata {
+		metadata[k] = aws.String(v)
+	}
+	for k, v := range a.metadata {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+// tagging はタグを x-amz-tagging ヘッダーの形式で返す（タグがない場合はnil）
+func (a objectAttributes) tagging() *string {
+	if len(a.options.Tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for k, v := range a.options.Tags {
+		values.Set(k, v)
+	}
+	// url.Values は空白を "+" にするため、S3が解釈できる "%20" に置き換える
+	return aws.String(strings.ReplaceAll(values.Encode(), "+", "%20"))
+}
+
+// applyPut はオブジェクトの属性を PutObject のリクエストに設定する
+func (a objectAttributes) applyPut(input *s3.PutObjectInput) {
+	sse := a.sse()
+	input.Metadata = a.userMetadata()
+	input.ACL = optionalString(a.options.ACL)
+	input.StorageClass = optionalString(a.options.StorageClass)
+	input.ContentType = optionalString(a.options.ContentType)
+	input.CacheControl = optionalString(a.options.CacheControl)
+	input.Tagging = a.tagging()
+	input.ServerSideEncryption = sse.serverSideEncryption()
+	input.SSEKMSKeyId = sse.kmsKeyID()
+	input.SSEKMSEncryptionContext = sse.kmsEncryptionContext()
+	input.BucketKeyEnabled = sse.bucketKeyEnabled()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sse.customerKey()
+}
+
+// applyCreateMultipart はオブジェクトの属性を CreateMultipartUpload のリクエストに設定する
+func (a objectAttributes) applyCreateMultipart(input *s3.CreateMultipartUploadInput) {
+	sse := a.sse()
+	input.Metadata = a.userMetadata()
+	input.ACL = optionalString(a.options.ACL)
+	input.StorageClass = optionalString(a.options.StorageClass)
+	input.ContentType = optionalString(a.options.ContentType)
+	input.CacheControl = optionalString(a.options.CacheControl)
+	input.Tagging = a.tagging()
+	input.ServerSideEncryption = sse.serverSideEncryption()
+	input.SSEKMSKeyId = sse.kmsKeyID()
+	input.SSEKMSEncryptionContext = sse.kmsEncryptionContext()
+	input.BucketKeyEnabled = sse.bucketKeyEnabled()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sse.customerKey()
+}
+
+// applyCopy はオブジェクトの属性をメタデータを置き換える CopyObject のリクエストに設定する
+// 置き換える場合はコピー元の属性が引き継がれないため、すべて指定し直す（タグはコピー元のものを引き継ぐ）
+func (a objectAttributes) applyCopy(input *s3.CopyObjectInput) {
+	sse := a.sse()
+	input.Metadata = a.userMetadata()
+	input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+	input.ACL = optionalString(a.options.ACL)
+	input.StorageClass = optionalString(a.options.StorageClass)
+	input.ContentType = optionalString(a.options.ContentType)
+	input.CacheControl = optionalString(a.options.CacheControl)
+	input.ServerSideEncryption = sse.serverSideEncryption()
+	input.SSEKMSKeyId = sse.kmsKeyID()
+	input.SSEKMSEncryptionContext = sse.kmsEncryptionContext()
+	input.BucketKeyEnabled = sse.bucketKeyEnabled()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sse.customerKey()
+	input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey = sse.customerKey()
+}
+
+// sse はサーバー側の暗号化の設定を返す
+func (a objectAttributes) sse() SSEConfig {
+	return a.options.sse()
+}
+
+// sse はサーバー側の暗号化の設定を返す（指定されていない場合はゼロ値）
+func (o S3ObjectOptions) sse() SSEConfig {
+	if o.ServerSideEncryption == nil {
+		return SSEConfig{}
+	}
+	return *o.ServerSideEncryption
+}
+
+// optionalString は空でない場合のみ文字列のポインタを返す
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
+// serverSideEncryption は x-amz-server-side-encryption ヘッダーの値を返す（SSE-Cでは指定しない）
+func (c SSEConfig) serverSideEncryption() *string {
+	if c.Mode == SSES3 || c.Mode == SSEKMS {
+		return aws.String(string(c.Mode))
+	}
+	return nil
+}
+
+// kmsKeyID はSSE-KMSの鍵のIDを返す
+func (c SSEConfig) kmsKeyID() *string {
+	if c.Mode != SSEKMS {
+		return nil
+	}
+	return optionalString(c.KMSKeyID)
+}
+
+// kmsEncryptionContext はSSE-KMSの暗号化コンテキストをBase64でエンコードしたJSONで返す
+func (c SSEConfig) kmsEncryptionContext() *string {
+	if c.Mode != SSEKMS || len(c.KMSEncryptionContext) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(c.KMSEncryptionContext)
+	if err != nil {
+		return nil
+	}
+	return aws.String(base64.StdEncoding.EncodeToString(data))
+}
+
+// bucketKeyEnabled はSSE-KMSでS3バケットキーを使う場合に真を返す
+func (c SSEConfig) bucketKeyEnabled() *bool {
+	if c.Mode != SSEKMS || !c.BucketKeyEnabled {
+		return nil
+	}
+	return aws.Bool(true)
+}
+
+// customerKey はSSE-Cの暗号化方式と鍵を返す（SSE-Cでない場合はnil）
+// SDKが鍵をBase64でエンコードし、MD5を計算する
+func (c SSEConfig) customerKey() (*string, *string) {
+	if c.Mode != SSEC {
+		return nil, nil
+	}
+	return aws.String(sseCustomerAlgorithm), aws.String(string(c.CustomerKey))
+}
+
+// validateS3ObjectOptions はオブジェクトの属性を検証する
+func validateS3ObjectOptions(options S3ObjectOptions) error {
+	if !validACLs[options.ACL] {
+		return fmt.Errorf("%w: invalid ACL value: %s", ErrInvalidConfig, options.ACL)
+	}
+
+	if options.ServerSideEncryption != nil {
+		if err := validateSSEConfig(*options.ServerSideEncryption); err != nil {
+			return err
+		}
+	}
+
+	if options.StorageClass != "" && !slices.Contains(s3.StorageClass_Values(), options.StorageClass) {
+		return fmt.Errorf("%w: invalid storage class: %s", ErrInvalidConfig, options.StorageClass)
+	}
+
+	if options.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(options.ContentType); err != nil {
+			return fmt.Errorf("%w: invalid content type %q: %w", ErrInvalidConfig, options.ContentType, err)
+		}
+	}
+
+	if !isPrintableASCII(options.CacheControl) {
+		return fmt.Errorf("%w: invalid cache control: %q", ErrInvalidConfig, options.CacheControl)
+	}
+
+	if err := validateUserMetadata(options.Metadata); err != nil {
+		return err
+	}
+
+	return validateObjectTags(options.Tags)
+}
+
+// validateSSEConfig はサーバー側の暗号化の設定を検証する
+func validateSSEConfig(config SSEConfig) error {
+	kms := config.KMSKeyID != "" || len(config.KMSEncryptionContext) > 0 || config.BucketKeyEnabled
+
+	switch config.Mode {
+	case SSENone, SSES3:
+		if kms || len(config.CustomerKey) > 0 {
+			return fmt.Errorf("%w: KMS and customer key settings require SSE-KMS or SSE-C", ErrInvalidConfig)
+		}
+
+	case SSEKMS:
+		if len(config.CustomerKey) > 0 {
+			return fmt.Errorf("%w: customer key cannot be used with SSE-KMS", ErrInvalidConfig)
+		}
+		for k := range config.KMSEncryptionContext {
+			if k == "" {
+				return fmt.Errorf("%w: empty KMS encryption context key", ErrInvalidConfig)
+			}
+		}
+
+	case SSEC:
+		if kms {
+			return fmt.Errorf("%w: KMS settings cannot be used with SSE-C", ErrInvalidConfig)
+		}
+		if len(config.CustomerKey) != 32 {
+			return fmt.Errorf("%w: SSE-C customer key must be 32 bytes", ErrInvalidConfig)
+		}
+
+	default:
+		return fmt.Errorf("%w: invalid server-side encryption: %s", ErrInvalidConfig, config.Mode)
+	}
+
+	return nil
+}
+
+// validateUserMetadata はユーザーメタデータを検証する
+// キーは英数字、"-" と "_"、値は表示可能なASCII文字のみとし、このライブラリが記録するキーは使えない
+func validateUserMetadata(metadata map[string]string) error {
+	size := 0
+	for k, v := range metadata {
+		if k == "" || strings.IndexFunc(k, func(r rune) bool {
+			return !(r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_'))
+		}) >= 0 {
+			return fmt.Errorf("%w: invalid metadata key: %q", ErrInvalidConfig, k)
+		}
+		for _, reserved := range reservedMetadataKeys {
+			if strings.EqualFold(k, reserved) {
+				return fmt.Errorf("%w: metadata key %s is reserved", ErrInvalidConfig, k)
+			}
+		}
+		if !isPrintableASCII(v) {
+			return fmt.Errorf("%w: metadata %s must be printable ASCII", ErrInvalidConfig, k)
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxUserMetadataSize {
+		return fmt.Errorf("%w: metadata exceeds %d bytes", ErrInvalidConfig, maxUserMetadataSize)
+	}
+	return nil
+}
+
+// validateObjectTags はオブジェクトのタグを検証する
+func validateObjectTags(tags map[string]string) error {
+	if len(tags) > maxObjectTags {
+		return fmt.Errorf("%w: at most %d tags are allowed", ErrInvalidConfig, maxObjectTags)
+	}
+	for k, v := range tags {
+		if k == "" || len([]rune(k)) > 128 || len([]rune(v)) > 256 {
+			return fmt.Errorf("%w: tag keys must be 1 to 128 characters and values at most 256 characters", ErrInvalidConfig)
+		}
+		if strings.HasPrefix(strings.ToLower(k), "aws:") {
+			return fmt.Errorf("%w: tag key %s uses the reserved prefix aws:", ErrInvalidConfig, k)
+		}
+		if !isValidTagText(k) || !isValidTagText(v) {
+			return fmt.Errorf("%w: invalid characters in tag %q", ErrInvalidConfig, k)
+		}
+	}
+	return nil
+}
+
+// isValidTagText はタグに使える文字（文字、数字、空白と + - = . _ : / @）のみかどうかを返す
+func isValidTagText(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' || strings.ContainsRune("+-=._:/@", r))
+	}) < 0
+}
+
+// isPrintableASCII は表示可能なASCII文字のみかどうかを返す
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,363 @@
+package safebackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3RestoreSession はS3のバックアップからリストアするセッション実装
+type S3RestoreSession struct {
+	config   S3RestoreSessionConfig
+	s3Client S3API
+	ctx      context.Context    // Close でキャンセルされるセッションのコンテキスト
+	cancel   context.CancelFunc // ctx のキャンセル
+	closeMu  sync.RWMutex       // closed の排他制御
+	closed   bool
+	restores sync.WaitGroup // 実行中のリストア
+}
+
+// NewS3RestoreSession はS3リストアセッションインスタンスを作成
+func NewS3RestoreSession(config S3RestoreSessionConfig) (*S3RestoreSession, error) {
+	if config.Region == "" {
+		return nil, fmt.Errorf("invalid config: %w: region is required", ErrInvalidConfig)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("invalid config: %w: bucket name is required", ErrInvalidConfig)
+	}
+	if len(config.SSECustomerKey) != 0 && len(config.SSECustomerKey) != 32 {
+		return nil, fmt.Errorf("invalid config: %w: SSE-C customer key must be 32 bytes", ErrInvalidConfig)
+	}
+
+	s3Client, err := newS3Client(config.Region, config.AccessKeyID, config.SecretAccessKey, config.SessionToken, config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// バケットの存在確認
+	_, err = s3Client.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(config.Bucket),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to access bucket %s: %w", config.Bucket, err)
+	}
+
+	return newS3RestoreSession(config, s3Client), nil
+}
+
+// newS3RestoreSession はS3クライアントを指定してリストアセッションを作成する
+func newS3RestoreSession(config S3RestoreSessionConfig, s3Client S3API) *S3RestoreSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &S3RestoreSession{
+		config:   config,
+		s3Client: s3Client,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Restore はバックアップしたオブジェクトを localDest に書き出す
+func (s *S3RestoreSession) Restore(relativePath, localDest string) error {
+	return s.RestoreContext(context.Background(), relativePath, localDest)
+}
+
+// RestoreContext はバックアップしたオブジェクトを localDest に書き出す
+func (s *S3RestoreSession) RestoreContext(ctx context.Context, relativePath, localDest string) error {
+	if relativePath == "" || localDest == "" {
+		return fmt.Errorf("%w: empty file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginRestore(); err != nil {
+		return err
+	}
+	defer s.restores.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	if err := s.restoreObject(ctx, joinObjectKey(s.config.Prefix, relativePath), localDest); err != nil {
+		return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+	return nil
+}
+
+// restoreObject はオブジェクトを検証しながら localDest に書き出す
+// 重複排除モードのマニフェストは、チャンクから組み立てたファイルとして書き出す
+// シンボリックリンクとして保存したオブジェクトは、同じリンク先を指すリンクとして書き出す
+func (s *S3RestoreSession) restoreObject(ctx context.Context, key, localDest string) error {
+	if m, err := s.readManifest(ctx, key); err != nil {
+		return err
+	} else if m != nil {
+		return restoreManifest(ctx, s.dedupStore(), m, localDest)
+	}
+
+	body, linkTarget, err := s.getObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+
+	if linkTarget != "" {
+		return restoreSymlink(linkTarget, localDest)
+	}
+	return writeRestored(ctx, body, localDest, nil)
+}
+
+// RestorePrefix は相対パスが prefix で始まるすべてのオブジェクトを localDir 以下に書き出す
+func (s *S3RestoreSession) RestorePrefix(ctx context.Context, prefix, localDir string) error {
+	if localDir == "" {
+		return fmt.Errorf("%w: empty destination directory", ErrInvalidConfig)
+	}
+
+	if err := s.beginRestore(); err != nil {
+		return err
+	}
+	defer s.restores.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	keys, err := s.listKeys(ctx, s.keyPrefix()+prefix)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+
+	var failures []*FileError
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+		}
+
+		relativePath := strings.TrimPrefix(key, s.keyPrefix())
+		if s.config.Dedup && isChunkPath(relativePath) {
+			continue
+		}
+		dest, err := restorePath(localDir, relativePath)
+		if err == nil {
+			err = s.restoreObject(ctx, key, dest)
+		}
+		if err != nil {
+			failures = append(failures, &FileError{
+				RelativePath: relativePath,
+				Destination:  dest,
+				Err:          err,
+			})
+		}
+	}
+
+	if len(failures) > 0 {
+		return &RestoreError{Failures: failures}
+	}
+	return nil
+}
+
+// keyPrefix は相対パスの前に付くS3キーの部分を返す
+func (s *S3RestoreSession) keyPrefix() string {
+	return s3KeyPrefix(s.config.Prefix)
+}
+
+// listKeys は listPrefix で始まるオブジェクトのキーを列挙する
+func (s *S3RestoreSession) listKeys(ctx context.Context, listPrefix string) ([]string, error) {
+	var keys []string
+	err := listObjects(ctx, s.s3Client, s.config.Bucket, listPrefix, func(object *s3.Object) {
+		keys = append(keys, aws.StringValue(object.Key))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Open はバックアップしたオブジェクトを読み出すReaderを返す
+// Readerはセッションのクローズ後に読み込むとエラーを返す
+func (s *S3RestoreSession) Open(ctx context.Context, relativePath string) (io.ReadCloser, error) {
+	if relativePath == "" {
+		return nil, fmt.Errorf("%w: empty file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginRestore(); err != nil {
+		return nil, err
+	}
+	defer s.restores.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	key := joinObjectKey(s.config.Prefix, relativePath)
+	m, err := s.readManifest(ctx, key)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+	if m != nil {
+		return &restoreReadCloser{
+			Reader: openManifest(ctx, s.dedupStore(), m),
+			close: func() error {
+				cancel()
+				return nil
+			},
+		}, nil
+	}
+
+	body, _, err := s.getObject(ctx, key)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+
+	return &restoreReadCloser{
+		Reader: body,
+		close: func() error {
+			defer cancel()
+			return body.Close()
+		},
+	}, nil
+}
+
+// getObject はオブジェクトを取得し、サイズとメタデータのチェックサムで検証するReaderと、
+// シンボリックリンクとして保存したオブジェクトの場合はそのリンク先を返す
+// 圧縮・暗号化したオブジェクトは、保存したサイズを検証しながら元に戻し、元のサイズとチェックサムで検証する
+func (s *S3RestoreSession) getObject(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = s.customerKey(ctx).customerKey()
+	output, err := s.s3Client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get object %s: %w", key, err)
+	}
+
+	size := int64(-1)
+	if output.ContentLength != nil {
+		size = *output.ContentLength
+	}
+	linkTarget := objectMetadata(output.Metadata, symlinkMetadataKey)
+
+	if !encodedObject(output.Metadata) {
+		return &restoreReadCloser{
+			Reader: newVerifyingReader(newStoredChecksumReader(output.Body, output.Metadata), size, objectChecksum(output.Metadata)),
+			close:  output.Body.Close,
+		}, linkTarget, nil
+	}
+
+	algorithm := Compression(objectMetadata(output.Metadata, compressionMetadataKey))
+	encrypted := objectMetadata(output.Metadata, encryptionMetadataKey) != ""
+	r, _, _, err := openBackupContent(ctx, newVerifyingReader(newStoredChecksumReader(output.Body, output.Metadata), size, ""), algorithm, encrypted, s.config.KeyProvider)
+	if err != nil {
+		_ = output.Body.Close()
+		return nil, "", fmt.Errorf("failed to decode object %s: %w", key, err)
+	}
+	return &restoreReadCloser{
+		Reader: newVerifyingReader(r, objectSize(output.Metadata, -1), objectChecksum(output.Metadata)),
+		close: func() error {
+			_ = r.Close()
+			return output.Body.Close()
+		},
+	}, linkTarget, nil
+}
+
+// customerKey はSSE-Cで保存したオブジェクトの取得に使う設定を返す
+// ctx で WithS3ObjectOptions にSSE-Cの鍵が指定されていれば、セッションの鍵より優先する
+func (s *S3RestoreSession) customerKey(ctx context.Context) SSEConfig {
+	if options, ok := s3ObjectOptionsFrom(ctx); ok && options.sse().Mode == SSEC {
+		return options.sse()
+	}
+	if len(s.config.SSECustomerKey) == 0 {
+		return SSEConfig{}
+	}
+	return SSEConfig{Mode: SSEC, CustomerKey: s.config.SSECustomerKey}
+}
+
+// readManifest は重複排除モードの場合に key のマニフェストを返す
+// 重複排除モードでない場合と、マニフェストでないオブジェクトの場合はnilを返す
+func (s *S3RestoreSession) readManifest(ctx context.Context, key string) (*manifest, error) {
+	if !s.config.Dedup {
+		return nil, nil
+	}
+
+	m, err := s.dedupStore().getManifestKey(ctx, key)
+	if errors.Is(err, errNotManifest) {
+		return nil, nil
+	}
+	return m, err
+}
+
+// dedupStore は重複排除モードの保存先を返す
+func (s *S3RestoreSession) dedupStore() *s3ChunkStore {
+	return &s3ChunkStore{
+		client: s.s3Client,
+		bucket: s.config.Bucket,
+		prefix: s.config.Prefix,
+	}
+}
+
+// objectChecksum はユーザーメタデータに記録されたSHA-256を返す（記録されていない場合は空）
+func objectChecksum(metadata map[string]*string) string {
+	return objectMetadata(metadata, checksumMetadataKey)
+}
+
+// objectSize は元の内容のサイズを返す
+// 圧縮・暗号化したオブジェクトはメタデータに記録した元のサイズ（記録がない場合や不正な場合は-1）、
+// それ以外は storedSize を返す
+func objectSize(metadata map[string]*string, storedSize int64) int64 {
+	if !encodedObject(metadata) {
+		return storedSize
+	}
+	size, err := strconv.ParseInt(objectMetadata(metadata, originalSizeMetadataKey), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// encodedObject はオブジェクトを圧縮または暗号化して保存したかどうかを返す
+func encodedObject(metadata map[string]*string) bool {
+	return objectMetadata(metadata, compressionMetadataKey) != "" || objectMetadata(metadata, encryptionMetadataKey) != ""
+}
+
+// objectMetadata はユーザーメタデータの値を返す（存在しない場合は空）
+// SDKはメタデータのキーを正規化するため、大文字小文字を区別せずに探す
+func objectMetadata(metadata map[string]*string, name string) string {
+	for key, value := range metadata {
+		if strings.EqualFold(key, name) {
+			return aws.StringValue(value)
+		}
+	}
+	return ""
+}
+
+// beginRestore はリストアの開始を記録する
+// クローズ済みのセッションでは ErrSessionClosed を返す
+func (s *S3RestoreSession) beginRestore() error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	s.restores.Add(1)
+	return nil
+}
+
+// Close は実行中のリストアをキャンセルし、それらが終了するまで待つ
+func (s *S3RestoreSession) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+
+	s.cancel()
+	s.restores.Wait()
+	return nil
+}
@@ -0,0 +1,274 @@
+package safebackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// journalEntry はジャーナルファイルに保存するマルチパートアップロードの情報
+type journalEntry struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	UploadID string    `json:"upload_id"`
+	Size     int64     `json:"size"`      // アップロード元ファイルのサイズ
+	ModTime  time.Time `json:"mod_time"`  // アップロード元ファイルの更新日時
+	PartSize int64     `json:"part_size"` // パートサイズ
+	Checksum string    `json:"checksum"`  // アップロードする内容のSHA-256（圧縮した場合は圧縮後）
+
+	// ChecksumAlgorithm はパートに付けた追加のチェックサムの方式（完了時に同じ方式のチェックサムが必要）
+	ChecksumAlgorithm S3ChecksumAlgorithm `json:"checksum_algorithm,omitempty"`
+	Parts             map[int64]string    `json:"parts"` // パート番号 → ETag
+}
+
+// uploadJournal はマルチパートアップロードの進捗を記録するジャーナル
+// プロセスが再起動しても、次のセッションがアップロードを再開できるようにする
+type uploadJournal struct {
+	path  string
+	mu    sync.Mutex
+	entry journalEntry
+}
+
+// journalPath はS3キーに対応するジャーナルファイルのパスを返す
+func (s *S3BackupSession) journalPath(key string) string {
+	sum := sha256.Sum256([]byte(s.config.Bucket + "\x00" + key))
+	return filepath.Join(s.config.JournalDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// loadJournal はジャーナルファイルを読み込む
+func loadJournal(path string) (*uploadJournal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &uploadJournal{path: path}
+	if err := json.Unmarshal(data, &journal.entry); err != nil {
+		return nil, fmt.Errorf("failed to parse upload journal: %w", err)
+	}
+	if journal.entry.Parts == nil {
+		journal.entry.Parts = make(map[int64]string)
+	}
+	return journal, nil
+}
+
+// recordPart はアップロードが完了したパートを記録する
+func (j *uploadJournal) recordPart(number int64, etag string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entry.Parts[number] = etag
+	return j.save()
+}
+
+// save はジャーナルをファイルに書き込む
+// 書き込み途中で中断しても壊れたジャーナルが残らないように一時ファイルからリネームする
+func (j *uploadJournal) save() error {
+	data, err := json.Marshal(j.entry)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(j.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(dir, "."+filepath.Base(j.path)+".*"+tempFileSuffix)
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, j.path)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+	}
+	return err
+}
+
+// remove はジャーナルファイルを削除する
+func (j *uploadJournal) remove() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := os.Remove(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// startFileMultipart はファイルのマルチパートアップロードを開始する
+// ジャーナルに同じファイルの中断したアップロードが記録されていれば、それを再開する
+func (s *S3BackupSession) startFileMultipart(ctx context.Context, key string, fileInfo os.FileInfo, partSize int64, checksum string, attrs objectAttributes) (*multipartState, error) {
+	if s.config.JournalDir == "" {
+		uploadID, err := s.createMultipart(ctx, key, attrs)
+		if err != nil {
+			return nil, err
+		}
+		return &multipartState{uploadID: uploadID, sse: attrs.sse()}, nil
+	}
+
+	path := s.journalPath(key)
+	if journal, err := loadJournal(path); err == nil {
+		entry := journal.entry
+		if entry.Bucket == s.config.Bucket && entry.Key == key && entry.Size == fileInfo.Size() &&
+			entry.ModTime.Equal(fileInfo.ModTime()) && entry.PartSize == partSize && entry.Checksum == checksum &&
+			entry.ChecksumAlgorithm == s.config.ChecksumAlgorithm {
+			state, err := s.resumeMultipart(ctx, key, journal, attrs.sse())
+			if err == nil {
+				return state, nil
+			}
+			if ctx.Err() != nil {
+				// キャンセルされた場合は次の機会に再開できるように残す
+				return nil, err
+			}
+		}
+
+		// ファイルが変更された等で再開できない場合は、古いアップロードを中止してやり直す
+		s.abortMultipart(ctx, key, aws.String(entry.UploadID))
+		_ = journal.remove()
+	}
+
+	uploadID, err := s.createMultipart(ctx, key, attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &uploadJournal{
+		path: path,
+		entry: journalEntry{
+			Bucket:   s.config.Bucket,
+			Key:      key,
+			UploadID: aws.StringValue(uploadID),
+			Size:     fileInfo.Size(),
+			ModTime:  fileInfo.ModTime(),
+			PartSize: partSize,
+			Checksum: checksum,
+			Parts:    make(map[int64]string),
+
+			ChecksumAlgorithm: s.config.ChecksumAlgorithm,
+		},
+	}
+	if err := journal.save(); err != nil {
+		s.abortMultipart(ctx, key, uploadID)
+		return nil, fmt.Errorf("failed to write upload journal: %w", err)
+	}
+
+	return &multipartState{uploadID: uploadID, journal: journal, sse: attrs.sse()}, nil
+}
+
+// resumeMultipart はS3上に残っているパートを確認し、中断したアップロードの状態を復元する
+// ジャーナルとETag・サイズが一致するパートのみをアップロード済みとみなす
+func (s *S3BackupSession) resumeMultipart(ctx context.Context, key string, journal *uploadJournal, sse SSEConfig) (*multipartState, error) {
+	entry := journal.entry
+	state := &multipartState{
+		uploadID: aws.String(entry.UploadID),
+		journal:  journal,
+		sse:      sse,
+	}
+
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(s.config.Bucket),
+		Key:      aws.String(key),
+		UploadId: state.uploadID,
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = sse.customerKey()
+	for {
+		output, err := s.s3Client.ListPartsWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list parts: %w", err)
+		}
+
+		for _, part := range output.Parts {
+			number := aws.Int64Value(part.PartNumber)
+
+			expectedSize := entry.PartSize
+			if remaining := entry.Size - (number-1)*entry.PartSize; remaining < expectedSize {
+				expectedSize = remaining
+			}
+
+			if entry.Parts[number] != aws.StringValue(part.ETag) || aws.Int64Value(part.Size) != expectedSize {
+				continue
+			}
+
+			state.parts = append(state.parts, completedPart(number, part.ETag, part.ChecksumSHA256, part.ChecksumCRC32C))
+			state.written += expectedSize
+		}
+
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		input.PartNumberMarker = output.NextPartNumberMarker
+	}
+
+	return state, nil
+}
+
+// AbortOrphanedUploads は Prefix 以下で olderThan より前に開始された未完了のマルチパートアップロードを中止し、
+// 中止したアップロードのS3キーを返す
+// 中断したまま再開されなかったアップロードのパートは課金対象として残り続けるため、定期的に掃除する
+func (s *S3BackupSession) AbortOrphanedUploads(ctx context.Context, olderThan time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-olderThan)
+
+	var aborted []string
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(s.config.Prefix),
+	}
+	for {
+		output, err := s.s3Client.ListMultipartUploadsWithContext(ctx, input)
+		if err != nil {
+			return aborted, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+
+		for _, upload := range output.Uploads {
+			if upload.Initiated == nil || !upload.Initiated.Before(cutoff) {
+				continue
+			}
+
+			key := aws.StringValue(upload.Key)
+			_, err := s.s3Client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.config.Bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return aborted, fmt.Errorf("failed to abort multipart upload of %s: %w", key, err)
+			}
+			aborted = append(aborted, key)
+
+			// 中止したアップロードのジャーナルも削除
+			if s.config.JournalDir != "" {
+				if journal, err := loadJournal(s.journalPath(key)); err == nil && journal.entry.UploadID == aws.StringValue(upload.UploadId) {
+					_ = journal.remove()
+				}
+			}
+		}
+
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.UploadIdMarker = output.NextUploadIdMarker
+	}
+
+	return aborted, nil
+}
@@ -1,13 +1,29 @@
 package safebackup
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/stretchr/testify/require"
 )
@@ -15,16 +31,83 @@ import (
 // MockS3Clientの実装
 type MockS3Client struct {
 	uploadedFiles map[string][]byte
+	metadata      map[string]map[string]*string   // キー → ユーザーメタデータ
+	modTimes      map[string]time.Time            // キー → 最終更新日時
+	attributes    map[string]mockObjectAttributes // キー → オブジェクトの属性
 	lastACL       string
 	mu            sync.Mutex
 	shouldFail    bool
 	failError     error
+
+	// マルチパートアップロード
+	multipartUploads map[string]*mockMultipartUpload
+	abortedUploads   []string
+	failPartNumber   int64 // このパート番号のアップロードを失敗させる（0は無効）
+	uploadCounter    int
+	uploadedParts    int
+	partDelay        time.Duration // パートのアップロードにかかる時間
+	inFlightParts    int
+	maxInFlightParts int // 同時にアップロードされたパート数の最大値
+
+	// 応答のETagとチェックサムを誤った値にする（転送中の破損を再現する）
+	wrongChecksums bool
+
+	// コピー
+	copiedObjects int // メタデータを置き換えた CopyObject の回数
+	copiedParts   int // UploadPartCopy の回数
+
+	// 並列アップロード
+	putDelay        time.Duration // PutObjectにかかる時間
+	inFlightPuts    int
+	maxInFlightPuts int // 同時に実行されたPutObjectの最大数
+}
+
+// mockObjectAttributes はアップロード時に指定されたオブジェクトの属性
+type mockObjectAttributes struct {
+	contentType  string
+	cacheControl string
+	storageClass string
+	tagging      string
+	sse          string
+	kmsKeyID     string
+	kmsContext   string
+	bucketKey    bool
+	customerKey  string // SSE-Cの鍵（取得時に同じ鍵が必要）
+	contentMD5   string
+}
+
+type mockMultipartUpload struct {
+	key        string
+	metadata   map[string]*string
+	attributes mockObjectAttributes
+	checksum   string           // 追加のチェックサムの方式（空は指定なし）
+	checksums  map[int64]string // パート番号 → 追加のチェックサム
+	parts      map[int64][]byte
+	etags      map[int64]string
+	initiated  time.Time
 }
 
-func (m *MockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+func (m *MockS3Client) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	m.mu.Lock()
+	m.inFlightPuts++
+	if m.inFlightPuts > m.maxInFlightPuts {
+		m.maxInFlightPuts = m.inFlightPuts
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-time.After(m.putDelay):
+	case <-ctx.Done():
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	m.inFlightPuts--
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if m.shouldFail {
 		return nil, m.failError
 	}
@@ -34,17 +117,500 @@ func (m *MockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput,
 	if err != nil {
 		return nil, err
 	}
+	if err := checkMockDigests(body, input.ContentMD5, input.ChecksumSHA256, input.ChecksumCRC32C); err != nil {
+		return nil, err
+	}
+
+	if m.uploadedFiles == nil {
+		m.uploadedFiles = make(map[string][]byte)
+	}
+
+	m.uploadedFiles[*input.Key] = body
+	m.setMetadata(*input.Key, input.Metadata)
+	m.setAttributes(*input.Key, mockObjectAttributes{
+		contentType:  aws.StringValue(input.ContentType),
+		cacheControl: aws.StringValue(input.CacheControl),
+		storageClass: aws.StringValue(input.StorageClass),
+		tagging:      aws.StringValue(input.Tagging),
+		sse:          aws.StringValue(input.ServerSideEncryption),
+		kmsKeyID:     aws.StringValue(input.SSEKMSKeyId),
+		kmsContext:   aws.StringValue(input.SSEKMSEncryptionContext),
+		bucketKey:    aws.BoolValue(input.BucketKeyEnabled),
+		customerKey:  aws.StringValue(input.SSECustomerKey),
+		contentMD5:   aws.StringValue(input.ContentMD5),
+	})
+	if input.ACL != nil {
+		m.lastACL = *input.ACL
+	}
+
+	output := &s3.PutObjectOutput{ETag: aws.String(mockETag(body))}
+	if input.ChecksumSHA256 != nil {
+		output.ChecksumSHA256 = aws.String(mockChecksum(s3.ChecksumAlgorithmSha256, body))
+	}
+	if input.ChecksumCRC32C != nil {
+		output.ChecksumCRC32C = aws.String(mockChecksum(s3.ChecksumAlgorithmCrc32c, body))
+	}
+	if m.wrongChecksums {
+		output.ETag = aws.String(mockETag(append(body, 0)))
+	}
+	return output, nil
+}
+
+func (m *MockS3Client) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.shouldFail {
+		return nil, m.failError
+	}
+
+	if m.multipartUploads == nil {
+		m.multipartUploads = make(map[string]*mockMultipartUpload)
+	}
+
+	m.uploadCounter++
+	uploadID := fmt.Sprintf("upload-%d", m.uploadCounter)
+	m.multipartUploads[uploadID] = &mockMultipartUpload{
+		key:      *input.Key,
+		metadata: input.Metadata,
+		attributes: mockObjectAttributes{
+			contentType:  aws.StringValue(input.ContentType),
+			cacheControl: aws.StringValue(input.CacheControl),
+			storageClass: aws.StringValue(input.StorageClass),
+			tagging:      aws.StringValue(input.Tagging),
+			sse:          aws.StringValue(input.ServerSideEncryption),
+			kmsKeyID:     aws.StringValue(input.SSEKMSKeyId),
+			kmsContext:   aws.StringValue(input.SSEKMSEncryptionContext),
+			bucketKey:    aws.BoolValue(input.BucketKeyEnabled),
+			customerKey:  aws.StringValue(input.SSECustomerKey),
+		},
+		checksum:  aws.StringValue(input.ChecksumAlgorithm),
+		checksums: make(map[int64]string),
+		parts:     make(map[int64][]byte),
+		etags:     make(map[int64]string),
+		initiated: time.Now(),
+	}
+	if input.ACL != nil {
+		m.lastACL = *input.ACL
+	}
+
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadID)}, nil
+}
+
+func (m *MockS3Client) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	m.mu.Lock()
+	m.inFlightParts++
+	if m.inFlightParts > m.maxInFlightParts {
+		m.maxInFlightParts = m.inFlightParts
+	}
+	m.mu.Unlock()
+
+	body, err := io.ReadAll(input.Body)
+	select {
+	case <-time.After(m.partDelay):
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlightParts--
+	if err != nil {
+		return nil, err
+	}
+
+	if m.failPartNumber != 0 && *input.PartNumber == m.failPartNumber {
+		return nil, m.failError
+	}
+
+	upload, ok := m.multipartUploads[*input.UploadId]
+	if !ok {
+		return nil, fmt.Errorf("no such upload: %s", *input.UploadId)
+	}
+	if aws.StringValue(input.SSECustomerKey) != upload.attributes.customerKey {
+		return nil, awserr.New("InvalidRequest", "The SSE-C key does not match the upload.", nil)
+	}
+	if err := checkMockDigests(body, input.ContentMD5, input.ChecksumSHA256, input.ChecksumCRC32C); err != nil {
+		return nil, err
+	}
+	etag := mockETag(body)
+	upload.parts[*input.PartNumber] = body
+	upload.etags[*input.PartNumber] = etag
+	m.uploadedParts++
+
+	output := &s3.UploadPartOutput{ETag: aws.String(etag)}
+	if upload.checksum != "" {
+		checksum := mockChecksum(upload.checksum, body)
+		upload.checksums[*input.PartNumber] = checksum
+		if upload.checksum == s3.ChecksumAlgorithmSha256 {
+			output.ChecksumSHA256 = aws.String(checksum)
+		} else {
+			output.ChecksumCRC32C = aws.String(checksum)
+		}
+	}
+	if m.wrongChecksums {
+		output.ETag = aws.String(mockETag(append(body, 0)))
+	}
+	return output, nil
+}
+
+func (m *MockS3Client) ListPartsWithContext(ctx aws.Context, input *s3.ListPartsInput, opts ...request.Option) (*s3.ListPartsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.multipartUploads[*input.UploadId]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchUpload: %s", *input.UploadId)
+	}
+
+	var numbers []int64
+	for number := range upload.parts {
+		if number > aws.Int64Value(input.PartNumberMarker) {
+			numbers = append(numbers, number)
+		}
+	}
+	if len(numbers) == 0 {
+		return &s3.ListPartsOutput{IsTruncated: aws.Bool(false)}, nil
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	// 1ページに1パートずつ返してページングを確認する
+	number := numbers[0]
+	part := &s3.Part{
+		PartNumber: aws.Int64(number),
+		ETag:       aws.String(upload.etags[number]),
+		Size:       aws.Int64(int64(len(upload.parts[number]))),
+	}
+	switch upload.checksum {
+	case s3.ChecksumAlgorithmSha256:
+		part.ChecksumSHA256 = aws.String(upload.checksums[number])
+	case s3.ChecksumAlgorithmCrc32c:
+		part.ChecksumCRC32C = aws.String(upload.checksums[number])
+	}
+	return &s3.ListPartsOutput{
+		Parts:                []*s3.Part{part},
+		IsTruncated:          aws.Bool(len(numbers) > 1),
+		NextPartNumberMarker: aws.Int64(number),
+	}, nil
+}
+
+func (m *MockS3Client) ListMultipartUploadsWithContext(ctx aws.Context, input *s3.ListMultipartUploadsInput, opts ...request.Option) (*s3.ListMultipartUploadsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	output := &s3.ListMultipartUploadsOutput{IsTruncated: aws.Bool(false)}
+	for uploadID, upload := range m.multipartUploads {
+		if !strings.HasPrefix(upload.key, aws.StringValue(input.Prefix)) {
+			continue
+		}
+		output.Uploads = append(output.Uploads, &s3.MultipartUpload{
+			Key:       aws.String(upload.key),
+			UploadId:  aws.String(uploadID),
+			Initiated: aws.Time(upload.initiated),
+		})
+	}
+
+	return output, nil
+}
+
+func (m *MockS3Client) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.multipartUploads[*input.UploadId]
+	if !ok {
+		return nil, fmt.Errorf("no such upload: %s", *input.UploadId)
+	}
+
+	// パート番号順に連結
+	var body []byte
+	for i, part := range input.MultipartUpload.Parts {
+		if *part.PartNumber != int64(i+1) {
+			return nil, fmt.Errorf("parts out of order")
+		}
+		// 追加のチェックサムを指定したアップロードでは、完了時にパートのチェックサムが必要
+		if checksum := aws.StringValue(part.ChecksumSHA256) + aws.StringValue(part.ChecksumCRC32C); checksum != upload.checksums[*part.PartNumber] {
+			return nil, awserr.New("InvalidPart", fmt.Sprintf("checksum of part %d does not match", *part.PartNumber), nil)
+		}
+		body = append(body, upload.parts[*part.PartNumber]...)
+	}
 
 	if m.uploadedFiles == nil {
 		m.uploadedFiles = make(map[string][]byte)
 	}
+	m.uploadedFiles[upload.key] = body
+	m.setMetadata(upload.key, upload.metadata)
+	m.setAttributes(upload.key, upload.attributes)
+	delete(m.multipartUploads, *input.UploadId)
+
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *MockS3Client) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.multipartUploads, *input.UploadId)
+	m.abortedUploads = append(m.abortedUploads, *input.UploadId)
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (m *MockS3Client) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.shouldFail {
+		return nil, m.failError
+	}
+
+	body, err := m.copySource(input.CopySource, input.CopySourceSSECustomerKey)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(input.MetadataDirective) != s3.MetadataDirectiveReplace {
+		return nil, fmt.Errorf("only metadata replacing copies are supported")
+	}
+	m.copiedObjects++
 
 	m.uploadedFiles[*input.Key] = body
+	m.setMetadata(*input.Key, input.Metadata)
+	m.setAttributes(*input.Key, mockObjectAttributes{
+		contentType:  aws.StringValue(input.ContentType),
+		cacheControl: aws.StringValue(input.CacheControl),
+		storageClass: aws.StringValue(input.StorageClass),
+		tagging:      m.attributes[*input.Key].tagging, // タグはコピー元のものを引き継ぐ
+		sse:          aws.StringValue(input.ServerSideEncryption),
+		kmsKeyID:     aws.StringValue(input.SSEKMSKeyId),
+		kmsContext:   aws.StringValue(input.SSEKMSEncryptionContext),
+		bucketKey:    aws.BoolValue(input.BucketKeyEnabled),
+		customerKey:  aws.StringValue(input.SSECustomerKey),
+	})
 	if input.ACL != nil {
 		m.lastACL = *input.ACL
 	}
 
-	return &s3.PutObjectOutput{}, nil
+	result := &s3.CopyObjectResult{ETag: aws.String(mockETag(body))}
+	switch aws.StringValue(input.ChecksumAlgorithm) {
+	case s3.ChecksumAlgorithmSha256:
+		result.ChecksumSHA256 = aws.String(mockChecksum(s3.ChecksumAlgorithmSha256, body))
+	case s3.ChecksumAlgorithmCrc32c:
+		result.ChecksumCRC32C = aws.String(mockChecksum(s3.ChecksumAlgorithmCrc32c, body))
+	}
+	if m.wrongChecksums {
+		result.ChecksumSHA256 = aws.String(mockChecksum(s3.ChecksumAlgorithmSha256, append(body, 0)))
+		result.ChecksumCRC32C = aws.String(mockChecksum(s3.ChecksumAlgorithmCrc32c, append(body, 0)))
+	}
+	return &s3.CopyObjectOutput{CopyObjectResult: result}, nil
+}
+
+func (m *MockS3Client) UploadPartCopyWithContext(ctx aws.Context, input *s3.UploadPartCopyInput, opts ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	body, err := m.copySource(input.CopySource, input.CopySourceSSECustomerKey)
+	if err != nil {
+		return nil, err
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(aws.StringValue(input.CopySourceRange), "bytes=%d-%d", &start, &end); err != nil || end >= len(body) || start > end {
+		return nil, awserr.New("InvalidArgument", "The x-amz-copy-source-range value must be of the form bytes=first-last.", nil)
+	}
+
+	upload, ok := m.multipartUploads[*input.UploadId]
+	if !ok {
+		return nil, fmt.Errorf("no such upload: %s", *input.UploadId)
+	}
+	if aws.StringValue(input.SSECustomerKey) != upload.attributes.customerKey {
+		return nil, awserr.New("InvalidRequest", "The SSE-C key does not match the upload.", nil)
+	}
+	m.copiedParts++
+
+	part := bytes.Clone(body[start : end+1])
+	etag := mockETag(part)
+	upload.parts[*input.PartNumber] = part
+	upload.etags[*input.PartNumber] = etag
+
+	result := &s3.CopyPartResult{ETag: aws.String(etag)}
+	if upload.checksum != "" {
+		checksum := mockChecksum(upload.checksum, part)
+		upload.checksums[*input.PartNumber] = checksum
+		if upload.checksum == s3.ChecksumAlgorithmSha256 {
+			result.ChecksumSHA256 = aws.String(checksum)
+		} else {
+			result.ChecksumCRC32C = aws.String(checksum)
+		}
+	}
+	return &s3.UploadPartCopyOutput{CopyPartResult: result}, nil
+}
+
+// copySource はコピー元（バケット名とURLエンコードしたキー）の内容を返す
+// SSE-Cのオブジェクトはコピー元の鍵が一致する必要がある
+func (m *MockS3Client) copySource(source, customerKey *string) ([]byte, error) {
+	_, escaped, _ := strings.Cut(aws.StringValue(source), "/")
+	key, err := url.PathUnescape(escaped)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := m.uploadedFiles[key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	if aws.StringValue(customerKey) != m.attributes[key].customerKey {
+		return nil, awserr.New("InvalidRequest", "The SSE-C key does not match the object.", nil)
+	}
+	return body, nil
+}
+
+// setAttributes はオブジェクトの属性を記録する
+func (m *MockS3Client) setAttributes(key string, attributes mockObjectAttributes) {
+	if m.attributes == nil {
+		m.attributes = make(map[string]mockObjectAttributes)
+	}
+	m.attributes[key] = attributes
+}
+
+// setMetadata はオブジェクトのユーザーメタデータ（S3と同様にキーを正規化する）と最終更新日時を記録する
+func (m *MockS3Client) setMetadata(key string, metadata map[string]*string) {
+	if m.metadata == nil {
+		m.metadata = make(map[string]map[string]*string)
+		m.modTimes = make(map[string]time.Time)
+	}
+	m.modTimes[key] = time.Now()
+	normalized := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		normalized[strings.ToUpper(k[:1])+k[1:]] = v
+	}
+	m.metadata[key] = normalized
+}
+
+func (m *MockS3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.shouldFail {
+		return nil, m.failError
+	}
+
+	body, ok := m.uploadedFiles[*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	if aws.StringValue(input.SSECustomerKey) != m.attributes[*input.Key].customerKey {
+		return nil, awserr.New("InvalidRequest", "The SSE-C key does not match the object.", nil)
+	}
+
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: aws.Int64(int64(len(body))),
+		Metadata:      m.metadata[*input.Key],
+	}, nil
+}
+
+func (m *MockS3Client) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.shouldFail {
+		return nil, m.failError
+	}
+
+	var keys []string
+	for key := range m.uploadedFiles {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) && key > aws.StringValue(input.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// 1ページに2件ずつ返してページングを確認する
+	output := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(len(keys) > 2)}
+	if len(keys) > 2 {
+		keys = keys[:2]
+		output.NextContinuationToken = aws.String(keys[1])
+	}
+	for _, key := range keys {
+		output.Contents = append(output.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(m.uploadedFiles[key]))),
+			ETag:         aws.String(mockETag(m.uploadedFiles[key])),
+			LastModified: aws.Time(m.modTimes[key]),
+			StorageClass: aws.String(s3.ObjectStorageClassStandard),
+		})
+	}
+
+	return output, nil
+}
+
+func (m *MockS3Client) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.shouldFail {
+		return nil, m.failError
+	}
+
+	body, ok := m.uploadedFiles[*input.Key]
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	if aws.StringValue(input.SSECustomerKey) != m.attributes[*input.Key].customerKey {
+		return nil, awserr.New("BadRequest", "Bad Request", nil)
+	}
+
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(body))),
+		ETag:          aws.String(mockETag(body)),
+		LastModified:  aws.Time(m.modTimes[*input.Key]),
+		Metadata:      m.metadata[*input.Key],
+	}, nil
+}
+
+func (m *MockS3Client) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.shouldFail {
+		return nil, m.failError
+	}
+
+	delete(m.uploadedFiles, *input.Key)
+	delete(m.metadata, *input.Key)
+	delete(m.modTimes, *input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// mockETag はS3と同様に内容のMD5をETagとして返す
+func mockETag(body []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(body))
+}
+
+// mockChecksum は x-amz-checksum-* の形式（Base64）でチェックサムを返す
+func mockChecksum(algorithm string, body []byte) string {
+	if algorithm == s3.ChecksumAlgorithmSha256 {
+		sum := sha256.Sum256(body)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	sum := crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli))
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, sum))
+}
+
+// checkMockDigests はS3と同様にリクエストの Content-MD5 と追加のチェックサムを検証する
+func checkMockDigests(body []byte, contentMD5, sha256Sum, crc32cSum *string) error {
+	if contentMD5 != nil {
+		sum := md5.Sum(body)
+		if *contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			return awserr.New("BadDigest", "The Content-MD5 you specified did not match what we received.", nil)
+		}
+	}
+	if sha256Sum != nil && *sha256Sum != mockChecksum(s3.ChecksumAlgorithmSha256, body) {
+		return awserr.New("BadDigest", "The SHA256 you specified did not match the calculated checksum.", nil)
+	}
+	if crc32cSum != nil && *crc32cSum != mockChecksum(s3.ChecksumAlgorithmCrc32c, body) {
+		return awserr.New("BadDigest", "The CRC32C you specified did not match the calculated checksum.", nil)
+	}
+	return nil
 }
 
 func (m *MockS3Client) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
@@ -111,6 +677,22 @@ func TestNewS3BackupSession(t *testing.T) {
 		require.ErrorIs(t, err, ErrInvalidConfig)
 	})
 
+	t.Run("InvalidPartSize", func(t *testing.T) {
+		config := S3BackupSessionConfig{
+			Region:   "us-east-1",
+			Bucket:   "test-bucket",
+			PartSize: 1024 * 1024, // 5MB未満
+		}
+
+		err := validateS3Config(config)
+		require.ErrorIs(t, err, ErrInvalidConfig)
+
+		config.PartSize = minPartSize
+		config.PartConcurrency = -1
+		err = validateS3Config(config)
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+
 	t.Run("DefaultACL", func(t *testing.T) {
 		config := S3BackupSessionConfig{
 			Region:          "us-east-1",
@@ -229,27 +811,175 @@ func TestS3BackupSession_Save(t *testing.T) {
 	})
 }
 
-func TestS3BackupSession_ConcurrentUpload(t *testing.T) {
-	mockS3 := &MockS3Client{
-		uploadedFiles: make(map[string][]byte),
-	}
+func TestS3BackupSession_Results(t *testing.T) {
+	t.Run("SuccessfulUpload", func(t *testing.T) {
+		mockS3 := &MockS3Client{
+			uploadedFiles: make(map[string][]byte),
+		}
 
-	session := &S3BackupSession{
-		config: S3BackupSessionConfig{
-			Bucket: "test-bucket",
-			Prefix: "concurrent/",
-		},
-		s3Client: mockS3,
-	}
+		session := &S3BackupSession{
+			config: S3BackupSessionConfig{
+				Bucket: "test-bucket",
+				Prefix: "backup/",
+			},
+			s3Client: mockS3,
+		}
 
-	// 複数のgoroutineから同時にアップロード
-	var wg sync.WaitGroup
-	errors := make(chan error, 10)
+		testFile := createTestFile(t, 256*1024) // 256KB
+		err := session.Save(testFile, "result.dat")
+		require.NoError(t, err)
 
-	for i := 0; i < 10; i++ {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = session.WaitForCompletion(ctx)
+		cancel()
+		require.NoError(t, err)
+
+		results := session.Results()
+		require.Len(t, results, 1)
+
+		sum := sha256.Sum256(mockS3.uploadedFiles["backup/result.dat"])
+		require.Equal(t, testFile, results[0].SourcePath)
+		require.Equal(t, "result.dat", results[0].RelativePath)
+		require.Equal(t, "backup/result.dat", results[0].Destination)
+		require.Equal(t, int64(256*1024), results[0].BytesWritten)
+		require.Equal(t, hex.EncodeToString(sum[:]), results[0].Checksum)
+		require.NoError(t, results[0].Err)
+	})
+
+	t.Run("FailedUpload", func(t *testing.T) {
+		mockS3 := &MockS3Client{
+			shouldFail: true,
+			failError:  fmt.Errorf("network timeout"),
+		}
+
+		session := &S3BackupSession{
+			config: S3BackupSessionConfig{
+				Bucket: "test-bucket",
+			},
+			s3Client: mockS3,
+		}
+
+		testFile := createTestFile(t, 1024)
+		err := session.Save(testFile, "failed.dat")
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = session.WaitForCompletion(ctx)
+		cancel()
+		require.Error(t, err)
+
+		results := session.Results()
+		require.Len(t, results, 1)
+		require.Equal(t, "failed.dat", results[0].Destination)
+		require.ErrorIs(t, results[0].Err, mockS3.failError)
+		require.Zero(t, results[0].BytesWritten)
+	})
+}
+
+func TestS3BackupSession_MultipartUpload(t *testing.T) {
+	newSession := func(mockS3 *MockS3Client) *S3BackupSession {
+		return &S3BackupSession{
+			config: S3BackupSessionConfig{
+				Bucket:             "test-bucket",
+				Prefix:             "large/",
+				ACL:                "private",
+				MultipartThreshold: 8 * 1024 * 1024,
+				PartSize:           minPartSize,
+				PartConcurrency:    3,
+			},
+			s3Client: mockS3,
+		}
+	}
+
+	t.Run("ParallelParts", func(t *testing.T) {
+		mockS3 := &MockS3Client{partDelay: 50 * time.Millisecond}
+		session := newSession(mockS3)
+
+		// 5MBパートが4つになるファイル
+		size := int64(3*minPartSize + 1024)
+		testFile := createTestFile(t, size)
+		require.NoError(t, session.Save(testFile, "image.qcow2"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := session.WaitForCompletion(ctx)
+		cancel()
+		require.NoError(t, err)
+
+		require.Len(t, mockS3.uploadedFiles["large/image.qcow2"], int(size))
+		require.Equal(t, 1, mockS3.uploadCounter)
+		require.Equal(t, 4, mockS3.uploadedParts)
+		require.Empty(t, mockS3.multipartUploads)
+		require.Equal(t, "private", mockS3.lastACL)
+
+		// 並列パート数の上限を超えずに並列でアップロードされる
+		require.Greater(t, mockS3.maxInFlightParts, 1)
+		require.LessOrEqual(t, mockS3.maxInFlightParts, 3)
+
+		results := session.Results()
+		require.Len(t, results, 1)
+		require.Equal(t, size, results[0].BytesWritten)
+	})
+
+	t.Run("BelowThreshold", func(t *testing.T) {
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3)
+
+		require.NoError(t, session.Save(createTestFile(t, 1024*1024), "small.dat"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := session.WaitForCompletion(ctx)
+		cancel()
+		require.NoError(t, err)
+
+		require.Contains(t, mockS3.uploadedFiles, "large/small.dat")
+		require.Zero(t, mockS3.uploadCounter)
+	})
+
+	t.Run("PartFailureAbortsUpload", func(t *testing.T) {
+		mockS3 := &MockS3Client{
+			failPartNumber: 3,
+			failError:      fmt.Errorf("connection reset"),
+		}
+		session := newSession(mockS3)
+
+		require.NoError(t, session.Save(createTestFile(t, 4*minPartSize), "broken.img"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := session.WaitForCompletion(ctx)
+		cancel()
+		require.ErrorIs(t, err, ErrBackupFailed)
+		require.ErrorIs(t, err, mockS3.failError)
+
+		require.NotContains(t, mockS3.uploadedFiles, "large/broken.img")
+		require.Equal(t, []string{"upload-1"}, mockS3.abortedUploads)
+		require.Empty(t, mockS3.multipartUploads)
+	})
+}
+
+func TestS3BackupSession_ConcurrentUpload(t *testing.T) {
+	mockS3 := &MockS3Client{
+		uploadedFiles: make(map[string][]byte),
+		putDelay:      10 * time.Millisecond,
+	}
+
+	session := &S3BackupSession{
+		config: S3BackupSessionConfig{
+			Bucket:               "test-bucket",
+			Prefix:               "concurrent/",
+			MaxConcurrentUploads: 3,
+			UploadQueueSize:      4,
+		},
+		s3Client: mockS3,
+	}
+
+	// 複数のgoroutineから同時にアップロード
+	var wg sync.WaitGroup
+	errors := make(chan error, 10)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
 
 			for j := 0; j < 5; j++ {
 				testFile := createTestFile(t, 100*1024) // 100KB
@@ -277,6 +1007,49 @@ func TestS3BackupSession_ConcurrentUpload(t *testing.T) {
 
 	// すべてのファイルがアップロードされたことを確認
 	require.Len(t, mockS3.uploadedFiles, 50)
+
+	// 同時アップロード数が上限を超えていないことを確認
+	require.Greater(t, mockS3.maxInFlightPuts, 1)
+	require.LessOrEqual(t, mockS3.maxInFlightPuts, 3)
+}
+
+func TestS3BackupSession_QueueFull(t *testing.T) {
+	mockS3 := &MockS3Client{
+		uploadedFiles: make(map[string][]byte),
+		putDelay:      200 * time.Millisecond,
+	}
+
+	session := &S3BackupSession{
+		config: S3BackupSessionConfig{
+			Bucket:               "test-bucket",
+			MaxConcurrentUploads: 1,
+			UploadQueueSize:      1,
+			FailWhenQueueFull:    true,
+		},
+		s3Client: mockS3,
+	}
+
+	// 1つ目はワーカーが処理中、2つ目は待ち行列に入り、3つ目以降は拒否される
+	var queueFull int
+	for i := 0; i < 5; i++ {
+		err := session.Save(createTestFile(t, 1024), fmt.Sprintf("file%d.dat", i))
+		if err != nil {
+			require.ErrorIs(t, err, ErrQueueFull)
+			queueFull++
+		}
+	}
+	require.GreaterOrEqual(t, queueFull, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := session.WaitForCompletion(ctx)
+	cancel()
+	require.NoError(t, err)
+	require.Len(t, mockS3.uploadedFiles, 5-queueFull)
+
+	// クローズ後の Save はエラー
+	require.NoError(t, session.Close())
+	err = session.Save(createTestFile(t, 1024), "closed.dat")
+	require.ErrorIs(t, err, ErrSessionClosed)
 }
 
 func TestS3BackupSession_WaitForCompletion(t *testing.T) {
@@ -339,6 +1112,1470 @@ func TestS3BackupSession_ErrorHandling(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		err = session.WaitForCompletion(ctx)
 		cancel()
-		require.NoError(t, err) // 現在の実装ではアップロードエラーは返されない
+		require.Error(t, err)
+		require.ErrorIs(t, err, ErrBackupFailed)
+		require.ErrorIs(t, err, mockS3.failError)
+
+		var backupErr *BackupError
+		require.ErrorAs(t, err, &backupErr)
+		require.Len(t, backupErr.Failures, 1)
+		require.Equal(t, "error.dat", backupErr.Failures[0].RelativePath)
+		require.Equal(t, "error.dat", backupErr.Failures[0].Destination)
+	})
+
+	t.Run("MultipleUploadErrors", func(t *testing.T) {
+		mockS3 := &MockS3Client{
+			shouldFail: true,
+			failError:  fmt.Errorf("access denied"),
+		}
+
+		session := &S3BackupSession{
+			config: S3BackupSessionConfig{
+				Bucket: "test-bucket",
+				Prefix: "backup/",
+			},
+			s3Client: mockS3,
+		}
+
+		for i := 0; i < 3; i++ {
+			testFile := createTestFile(t, 1024)
+			err := session.Save(testFile, fmt.Sprintf("file%d.dat", i))
+			require.NoError(t, err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := session.WaitForCompletion(ctx)
+		cancel()
+		require.ErrorIs(t, err, ErrBackupFailed)
+
+		var backupErr *BackupError
+		require.ErrorAs(t, err, &backupErr)
+		require.Len(t, backupErr.Failures, 3)
+
+		keys := make([]string, 0, len(backupErr.Failures))
+		for _, f := range backupErr.Failures {
+			keys = append(keys, f.Destination)
+			require.ErrorIs(t, f, mockS3.failError)
+		}
+		require.ElementsMatch(t, []string{"backup/file0.dat", "backup/file1.dat", "backup/file2.dat"}, keys)
+	})
+}
+
+func TestS3BackupSession_SaveReader(t *testing.T) {
+	newSession := func(mockS3 *MockS3Client) *S3BackupSession {
+		return &S3BackupSession{
+			config: S3BackupSessionConfig{
+				Bucket:   "test-bucket",
+				Prefix:   "stream/",
+				ACL:      "private",
+				PartSize: minPartSize,
+			},
+			s3Client: mockS3,
+		}
+	}
+
+	t.Run("SmallStream", func(t *testing.T) {
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3)
+
+		data := bytes.Repeat([]byte("dump"), 1024)
+		err := session.SaveReader(context.Background(), bytes.NewReader(data), "db.sql", -1)
+		require.NoError(t, err)
+
+		require.Equal(t, data, mockS3.uploadedFiles["stream/db.sql"])
+		require.Empty(t, mockS3.multipartUploads)
+		require.Equal(t, "private", mockS3.lastACL)
+
+		sum := sha256.Sum256(data)
+		results := session.Results()
+		require.Len(t, results, 1)
+		require.Empty(t, results[0].SourcePath)
+		require.Equal(t, "stream/db.sql", results[0].Destination)
+		require.Equal(t, int64(len(data)), results[0].BytesWritten)
+		require.Equal(t, hex.EncodeToString(sum[:]), results[0].Checksum)
+	})
+
+	t.Run("UnknownLengthUsesMultipart", func(t *testing.T) {
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3)
+
+		// パートサイズの2倍強のデータを長さ不明のストリームとして渡す
+		data := make([]byte, 2*minPartSize+1234)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		r := io.MultiReader(bytes.NewReader(data[:1000]), bytes.NewReader(data[1000:]))
+
+		err := session.SaveReader(context.Background(), r, "archive.tar", -1)
+		require.NoError(t, err)
+
+		require.Equal(t, data, mockS3.uploadedFiles["stream/archive.tar"])
+		require.Empty(t, mockS3.multipartUploads)
+		require.Equal(t, int64(len(data)), session.Results()[0].BytesWritten)
+	})
+
+	t.Run("SizeHint", func(t *testing.T) {
+		// 小さいストリームにはパートサイズのバッファを確保しない
+		data := []byte("CREATE TABLE users;")
+		buf, n, err := readFirstPart(bytes.NewReader(data), minPartSize, int64(len(data)))
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Equal(t, len(data)+1, len(buf))
+		require.Equal(t, data, buf[:n])
+
+		// 申告より大きいストリームはパートサイズまで広げて読み続ける
+		large := make([]byte, minPartSize+10)
+		for i := range large {
+			large[i] = byte(i)
+		}
+		buf, n, err = readFirstPart(bytes.NewReader(large), minPartSize, 100)
+		require.NoError(t, err)
+		require.Equal(t, minPartSize, n)
+		require.Equal(t, large[:minPartSize], buf[:n])
+
+		buf, n, err = readFirstPart(bytes.NewReader(large[:500]), minPartSize, 100)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Equal(t, large[:500], buf[:n])
+
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3)
+		err = session.SaveReader(context.Background(), bytes.NewReader(large), "larger.bin", 100)
+		require.NoError(t, err)
+		require.Equal(t, large, mockS3.uploadedFiles["stream/larger.bin"])
+		require.Equal(t, int64(len(large)), session.Results()[0].BytesWritten)
+
+		err = session.SaveReader(context.Background(), bytes.NewReader(large[:100]), "exact.bin", 100)
+		require.NoError(t, err)
+		require.Equal(t, large[:100], mockS3.uploadedFiles["stream/exact.bin"])
+	})
+
+	t.Run("PartFailureAbortsUpload", func(t *testing.T) {
+		mockS3 := &MockS3Client{
+			failPartNumber: 2,
+			failError:      fmt.Errorf("connection reset"),
+		}
+		session := newSession(mockS3)
+
+		data := make([]byte, 3*minPartSize)
+		err := session.SaveReader(context.Background(), bytes.NewReader(data), "broken.tar", int64(len(data)))
+		require.ErrorIs(t, err, ErrBackupFailed)
+		require.ErrorIs(t, err, mockS3.failError)
+
+		require.NotContains(t, mockS3.uploadedFiles, "stream/broken.tar")
+		require.Len(t, mockS3.abortedUploads, 1)
+		require.Empty(t, mockS3.multipartUploads)
+
+		results := session.Results()
+		require.Len(t, results, 1)
+		require.ErrorIs(t, results[0].Err, mockS3.failError)
+		require.Zero(t, results[0].BytesWritten)
+	})
+
+	t.Run("CanceledContext", func(t *testing.T) {
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := session.SaveReader(ctx, bytes.NewReader([]byte("data")), "canceled.dat", 4)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Empty(t, mockS3.uploadedFiles)
+	})
+
+	t.Run("NilReader", func(t *testing.T) {
+		session := newSession(&MockS3Client{})
+
+		err := session.SaveReader(context.Background(), nil, "nil.dat", -1)
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+}
+
+func TestS3BackupSession_PartSize(t *testing.T) {
+	session := &S3BackupSession{}
+	require.Equal(t, int64(defaultPartSize), session.partSizeFor(-1))
+	require.Equal(t, int64(defaultPartSize), session.partSizeFor(1024))
+	require.Equal(t, int64(defaultMultipartThreshold), session.multipartThreshold())
+	require.Equal(t, defaultPartConcurrency, session.partConcurrency())
+
+	// 上限のパート数に収まるようにパートサイズを大きくする
+	session.config.PartSize = minPartSize
+	size := int64(100 * 1024 * 1024 * 1024) // 100GB
+	partSize := session.partSizeFor(size)
+	require.Greater(t, partSize, int64(minPartSize))
+	require.LessOrEqual(t, (size+partSize-1)/partSize, int64(maxUploadParts))
+}
+
+func TestS3BackupSession_ResumeMultipart(t *testing.T) {
+	newSession := func(mockS3 *MockS3Client, journalDir string) *S3BackupSession {
+		return &S3BackupSession{
+			config: S3BackupSessionConfig{
+				Bucket:             "test-bucket",
+				Prefix:             "vm/",
+				MultipartThreshold: minPartSize,
+				PartSize:           minPartSize,
+				PartConcurrency:    1,
+				JournalDir:         journalDir,
+			},
+			s3Client: mockS3,
+		}
+	}
+
+	upload := func(t *testing.T, session *S3BackupSession, testFile string) error {
+		require.NoError(t, session.Save(testFile, "disk.img"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return session.WaitForCompletion(ctx)
+	}
+
+	t.Run("ResumeAfterFailure", func(t *testing.T) {
+		journalDir := t.TempDir()
+		mockS3 := &MockS3Client{
+			failPartNumber: 3,
+			failError:      fmt.Errorf("connection reset"),
+		}
+		testFile := createTestFile(t, 4*minPartSize+100)
+
+		// 1回目: 3番目のパートで失敗してもアップロードとジャーナルが残る
+		err := upload(t, newSession(mockS3, journalDir), testFile)
+		require.ErrorIs(t, err, mockS3.failError)
+		require.Empty(t, mockS3.abortedUploads)
+		require.Len(t, mockS3.multipartUploads, 1)
+		require.Equal(t, 2, mockS3.uploadedParts)
+
+		entries, err := os.ReadDir(journalDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		// 2回目: 新しいセッションが残りのパートだけをアップロードする
+		mockS3.failPartNumber = 0
+		err = upload(t, newSession(mockS3, journalDir), testFile)
+		require.NoError(t, err)
+
+		require.Equal(t, 1, mockS3.uploadCounter)
+		require.Equal(t, 5, mockS3.uploadedParts)
+		require.Empty(t, mockS3.multipartUploads)
+
+		data, err := os.ReadFile(testFile)
+		require.NoError(t, err)
+		require.Equal(t, data, mockS3.uploadedFiles["vm/disk.img"])
+
+		entries, err = os.ReadDir(journalDir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("ChangedFileRestarts", func(t *testing.T) {
+		journalDir := t.TempDir()
+		mockS3 := &MockS3Client{
+			failPartNumber: 2,
+			failError:      fmt.Errorf("connection reset"),
+		}
+		testFile := createTestFile(t, 3*minPartSize)
+
+		err := upload(t, newSession(mockS3, journalDir), testFile)
+		require.Error(t, err)
+
+		// ファイルを書き換えると前回のアップロードは中止してやり直す
+		newTime := time.Now().Add(time.Hour)
+		require.NoError(t, os.Chtimes(testFile, newTime, newTime))
+
+		mockS3.failPartNumber = 0
+		err = upload(t, newSession(mockS3, journalDir), testFile)
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"upload-1"}, mockS3.abortedUploads)
+		require.Equal(t, 2, mockS3.uploadCounter)
+		require.Len(t, mockS3.uploadedFiles["vm/disk.img"], 3*minPartSize)
+	})
+
+	t.Run("WithoutJournalAborts", func(t *testing.T) {
+		mockS3 := &MockS3Client{
+			failPartNumber: 2,
+			failError:      fmt.Errorf("connection reset"),
+		}
+
+		err := upload(t, newSession(mockS3, ""), createTestFile(t, 3*minPartSize))
+		require.Error(t, err)
+		require.Len(t, mockS3.abortedUploads, 1)
+	})
+}
+
+func TestS3BackupSession_AbortOrphanedUploads(t *testing.T) {
+	journalDir := t.TempDir()
+	mockS3 := &MockS3Client{
+		multipartUploads: map[string]*mockMultipartUpload{
+			"old":    {key: "backup/old.img", initiated: time.Now().Add(-48 * time.Hour)},
+			"recent": {key: "backup/recent.img", initiated: time.Now().Add(-time.Minute)},
+			"other":  {key: "other/old.img", initiated: time.Now().Add(-48 * time.Hour)},
+		},
+	}
+
+	session := &S3BackupSession{
+		config: S3BackupSessionConfig{
+			Bucket:     "test-bucket",
+			Prefix:     "backup/",
+			JournalDir: journalDir,
+		},
+		s3Client: mockS3,
+	}
+
+	// 中止したアップロードのジャーナルは削除される
+	journal := &uploadJournal{
+		path:  session.journalPath("backup/old.img"),
+		entry: journalEntry{Bucket: "test-bucket", Key: "backup/old.img", UploadID: "old"},
+	}
+	require.NoError(t, journal.save())
+
+	aborted, err := session.AbortOrphanedUploads(context.Background(), 24*time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, []string{"backup/old.img"}, aborted)
+
+	require.Equal(t, []string{"old"}, mockS3.abortedUploads)
+	require.Contains(t, mockS3.multipartUploads, "recent")
+	require.Contains(t, mockS3.multipartUploads, "other")
+	require.NoFileExists(t, filepath.Join(journalDir, filepath.Base(journal.path)))
+}
+
+func TestS3BackupSession_Cancellation(t *testing.T) {
+	newSession := func(mockS3 *MockS3Client) *S3BackupSession {
+		return &S3BackupSession{
+			config: S3BackupSessionConfig{
+				Bucket:               "test-bucket",
+				MaxConcurrentUploads: 1,
+				UploadQueueSize:      1,
+			},
+			s3Client: mockS3,
+		}
+	}
+
+	t.Run("SaveContextCanceled", func(t *testing.T) {
+		mockS3 := &MockS3Client{putDelay: 10 * time.Second}
+		session := newSession(mockS3)
+		defer func() { _ = session.Close() }()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		require.NoError(t, session.SaveContext(ctx, createTestFile(t, 1024), "canceled.dat"))
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := session.WaitForCompletion(waitCtx)
+		waitCancel()
+		require.ErrorIs(t, err, ErrBackupFailed)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Empty(t, mockS3.uploadedFiles)
+	})
+
+	t.Run("CloseCancelsAndWaits", func(t *testing.T) {
+		mockS3 := &MockS3Client{putDelay: 10 * time.Second}
+		session := newSession(mockS3)
+
+		// 1つ目は実行中、2つ目は待ち行列、3つ目は待ち行列が空くのを待つ
+		for i := 0; i < 2; i++ {
+			require.NoError(t, session.Save(createTestFile(t, 1024), fmt.Sprintf("file%d.dat", i)))
+		}
+		blocked := make(chan error, 1)
+		go func() {
+			blocked <- session.Save(createTestFile(t, 1024), "blocked.dat")
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		start := time.Now()
+		require.NoError(t, session.Close())
+		require.Less(t, time.Since(start), 5*time.Second)
+		require.ErrorIs(t, <-blocked, ErrSessionClosed)
+
+		// Close の後はすべての結果が記録されている
+		results := session.Results()
+		require.Len(t, results, 2)
+		for _, result := range results {
+			require.ErrorIs(t, result.Err, context.Canceled)
+		}
+
+		err := session.Save(createTestFile(t, 1024), "after-close.dat")
+		require.ErrorIs(t, err, ErrSessionClosed)
+		require.NoError(t, session.Close())
+	})
+}
+
+func TestS3RestoreSession(t *testing.T) {
+	// バックアップセッションで保存したオブジェクトをリストアする
+	mockS3 := &MockS3Client{}
+	backup := &S3BackupSession{
+		config: S3BackupSessionConfig{
+			Bucket:             "test-bucket",
+			Prefix:             "backup/",
+			MultipartThreshold: minPartSize,
+			PartSize:           minPartSize,
+		},
+		s3Client: mockS3,
+	}
+
+	srcDir := t.TempDir()
+	small := []byte("small file content")
+	large := bytes.Repeat([]byte("0123456789abcdef"), (2*minPartSize+1024)/16)
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "small.txt"), small, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "large.img"), large, 0644))
+
+	require.NoError(t, backup.Save(filepath.Join(srcDir, "small.txt"), "docs/small.txt"))
+	require.NoError(t, backup.Save(filepath.Join(srcDir, "large.img"), "images/large.img"))
+	require.NoError(t, backup.SaveReader(context.Background(), bytes.NewReader(small), "docs/stream.txt", -1))
+	require.NoError(t, backup.SaveReader(context.Background(), bytes.NewReader(large), "images/stream.img", -1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	require.NoError(t, backup.WaitForCompletion(ctx))
+	cancel()
+	require.NoError(t, backup.Close())
+
+	// すべてのオブジェクトにチェックサムが記録される
+	// マルチパートでアップロードしたストリームは完了後にメタデータを置き換えて記録する
+	largeSum := sha256.Sum256(large)
+	require.NotEmpty(t, objectChecksum(mockS3.metadata["backup/docs/small.txt"]))
+	require.NotEmpty(t, objectChecksum(mockS3.metadata["backup/images/large.img"]))
+	require.NotEmpty(t, objectChecksum(mockS3.metadata["backup/docs/stream.txt"]))
+	require.Equal(t, hex.EncodeToString(largeSum[:]), objectChecksum(mockS3.metadata["backup/images/stream.img"]))
+	require.Equal(t, 1, mockS3.copiedObjects)
+	require.Equal(t, mockS3.attributes["backup/images/large.img"].contentType, mockS3.attributes["backup/images/stream.img"].contentType)
+
+	newRestore := func() *S3RestoreSession {
+		return newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/"}, mockS3)
+	}
+
+	t.Run("Restore", func(t *testing.T) {
+		session := newRestore()
+		defer func() { _ = session.Close() }()
+
+		dest := filepath.Join(t.TempDir(), "restored", "large.img")
+		require.NoError(t, session.Restore("images/large.img", dest))
+
+		restored, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		require.Equal(t, large, restored)
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		session := newRestore()
+		defer func() { _ = session.Close() }()
+
+		r, err := session.Open(context.Background(), "docs/stream.txt")
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, small, data)
+
+		_, err = session.Open(context.Background(), "docs/missing.txt")
+		require.ErrorIs(t, err, ErrRestoreFailed)
+	})
+
+	t.Run("RestorePrefix", func(t *testing.T) {
+		session := newRestore()
+		defer func() { _ = session.Close() }()
+
+		localDir := t.TempDir()
+		require.NoError(t, session.RestorePrefix(context.Background(), "docs/", localDir))
+
+		for _, name := range []string{"docs/small.txt", "docs/stream.txt"} {
+			restored, err := os.ReadFile(filepath.Join(localDir, name))
+			require.NoError(t, err)
+			require.Equal(t, small, restored)
+		}
+		require.NoDirExists(t, filepath.Join(localDir, "images"))
+
+		// 空のプレフィックスはすべてをリストアする（ページングをまたぐ）
+		allDir := t.TempDir()
+		require.NoError(t, session.RestorePrefix(context.Background(), "", allDir))
+		require.FileExists(t, filepath.Join(allDir, "images", "large.img"))
+		require.FileExists(t, filepath.Join(allDir, "images", "stream.img"))
+	})
+
+	t.Run("IntegrityCheck", func(t *testing.T) {
+		corruptS3 := &MockS3Client{uploadedFiles: map[string][]byte{}, metadata: mockS3.metadata}
+		for key, body := range mockS3.uploadedFiles {
+			corruptS3.uploadedFiles[key] = append([]byte(nil), body...)
+		}
+
+		// 同じサイズのまま内容が壊れたオブジェクト
+		corruptS3.uploadedFiles["backup/docs/small.txt"][0] ^= 0xff
+
+		session := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup"}, corruptS3)
+		defer func() { _ = session.Close() }()
+
+		dest := filepath.Join(t.TempDir(), "small.txt")
+		err := session.Restore("docs/small.txt", dest)
+		require.ErrorIs(t, err, ErrRestoreFailed)
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+		require.NoFileExists(t, dest)
+
+		r, err := session.Open(context.Background(), "docs/small.txt")
+		require.NoError(t, err)
+		_, err = io.ReadAll(r)
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+		require.NoError(t, r.Close())
+
+		// 失敗したファイルがあっても残りはリストアされる
+		localDir := t.TempDir()
+		err = session.RestorePrefix(context.Background(), "docs/", localDir)
+		var restoreErr *RestoreError
+		require.ErrorAs(t, err, &restoreErr)
+		require.ErrorIs(t, err, ErrRestoreFailed)
+		require.Len(t, restoreErr.Failures, 1)
+		require.Equal(t, "docs/small.txt", restoreErr.Failures[0].RelativePath)
+		require.FileExists(t, filepath.Join(localDir, "docs", "stream.txt"))
+	})
+
+	t.Run("UnsafeKey", func(t *testing.T) {
+		evilS3 := &MockS3Client{uploadedFiles: map[string][]byte{"backup/../escape.txt": []byte("evil")}}
+		session := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/"}, evilS3)
+		defer func() { _ = session.Close() }()
+
+		localDir := filepath.Join(t.TempDir(), "restore")
+		err := session.RestorePrefix(context.Background(), "", localDir)
+		require.ErrorIs(t, err, ErrRestoreFailed)
+		require.NoFileExists(t, filepath.Join(filepath.Dir(localDir), "escape.txt"))
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		session := newRestore()
+		require.NoError(t, session.Close())
+
+		err := session.Restore("docs/small.txt", filepath.Join(t.TempDir(), "small.txt"))
+		require.ErrorIs(t, err, ErrSessionClosed)
+	})
+}
+
+func TestS3BackupSession_ListAndStat(t *testing.T) {
+	mockS3 := &MockS3Client{}
+	session := &S3BackupSession{
+		config: S3BackupSessionConfig{
+			Bucket: "test-bucket",
+			Prefix: "backup",
+		},
+		s3Client: mockS3,
+	}
+	defer func() { _ = session.Close() }()
+
+	content := []byte("listed content")
+	for _, name := range []string{"db/2.dump", "db/1.dump", "logs/app.log"} {
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(content), name, -1))
+	}
+	// バックアップの対象外のオブジェクト
+	mockS3.uploadedFiles["other/file.txt"] = []byte("other")
+
+	t.Run("List", func(t *testing.T) {
+		infos, err := session.List(context.Background(), "db/")
+		require.NoError(t, err)
+		require.Len(t, infos, 2)
+		require.Equal(t, "db/1.dump", infos[0].RelativePath)
+		require.Equal(t, "backup/db/1.dump", infos[0].Destination)
+		require.Equal(t, "db/2.dump", infos[1].RelativePath)
+		require.Equal(t, int64(len(content)), infos[0].Size)
+		require.False(t, infos[0].ModTime.IsZero())
+		require.Equal(t, mockETag(content), infos[0].Metadata["etag"])
+		require.Empty(t, infos[0].Checksum)
+
+		// ページングをまたいで Prefix 以下のすべてを返す
+		infos, err = session.List(context.Background(), "")
+		require.NoError(t, err)
+		require.Len(t, infos, 3)
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := session.Stat(context.Background(), "logs/app.log")
+		require.NoError(t, err)
+		require.Equal(t, "logs/app.log", info.RelativePath)
+		require.Equal(t, int64(len(content)), info.Size)
+
+		sum := sha256.Sum256(content)
+		require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+		require.Equal(t, info.Checksum, info.Metadata["x-amz-meta-sha256"])
+
+		_, err = session.Stat(context.Background(), "logs/missing.log")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestS3BackupSession_SaveDir(t *testing.T) {
+	mockS3 := &MockS3Client{}
+	session := &S3BackupSession{
+		config: S3BackupSessionConfig{
+			Bucket: "test-bucket",
+			Prefix: "backup/",
+		},
+		s3Client: mockS3,
+	}
+	defer func() { _ = session.Close() }()
+
+	srcDir := createTestTree(t)
+	err := session.SaveDir(context.Background(), srcDir, "tree", SaveDirOptions{
+		Exclude:  []string{"node_modules/", "big.bin", "link-dir"},
+		MaxAge:   24 * time.Hour,
+		Symlinks: SymlinkPreserve,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	require.NoError(t, session.WaitForCompletion(ctx))
+	cancel()
+
+	var keys []string
+	for key := range mockS3.uploadedFiles {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	require.Equal(t, []string{
+		"backup/tree/a.txt",
+		"backup/tree/link-file",
+		"backup/tree/logs/app.log",
+		"backup/tree/sub/keep.txt",
+	}, keys)
+
+	// リンクはリンク先をメタデータに持つ空のオブジェクトとして保存される
+	require.Empty(t, mockS3.uploadedFiles["backup/tree/link-file"])
+	info, err := session.Stat(context.Background(), "tree/link-file")
+	require.NoError(t, err)
+	require.Equal(t, "a.txt", info.Metadata["x-amz-meta-symlink-target"])
+	require.Len(t, session.Results(), 4)
+
+	// リストアでもリンクとして書き出される
+	restore := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/"}, mockS3)
+	defer func() { _ = restore.Close() }()
+
+	localDir := t.TempDir()
+	require.NoError(t, restore.RestorePrefix(context.Background(), "tree/", localDir))
+	target, err := os.Readlink(filepath.Join(localDir, "tree", "link-file"))
+	require.NoError(t, err)
+	require.Equal(t, "a.txt", target)
+	require.FileExists(t, filepath.Join(localDir, "tree", "sub", "keep.txt"))
+
+	// クローズ後はたどるのを中断する
+	require.NoError(t, session.Close())
+	err = session.SaveDir(context.Background(), srcDir, "tree", SaveDirOptions{})
+	require.ErrorIs(t, err, ErrSessionClosed)
+}
+
+func TestS3BackupSession_Incremental(t *testing.T) {
+	newSession := func(mockS3 *MockS3Client, mode IncrementalMode) *S3BackupSession {
+		return &S3BackupSession{
+			config: S3BackupSessionConfig{
+				Bucket:      "test-bucket",
+				Prefix:      "backup/",
+				Incremental: mode,
+			},
+			s3Client: mockS3,
+		}
+	}
+	saveAll := func(t *testing.T, session *S3BackupSession, files map[string]string) {
+		for relativePath, path := range files {
+			require.NoError(t, session.Save(path, relativePath))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, session.WaitForCompletion(ctx))
+		require.NoError(t, session.Close())
+	}
+
+	for _, mode := range []IncrementalMode{IncrementalSizeModTime, IncrementalChecksum} {
+		t.Run(fmt.Sprintf("Mode%d", mode), func(t *testing.T) {
+			srcDir := t.TempDir()
+			unchanged := filepath.Join(srcDir, "unchanged.txt")
+			changed := filepath.Join(srcDir, "changed.txt")
+			require.NoError(t, os.WriteFile(unchanged, []byte("same content"), 0644))
+			require.NoError(t, os.WriteFile(changed, []byte("old content"), 0644))
+			files := map[string]string{"unchanged.txt": unchanged, "changed.txt": changed}
+
+			mockS3 := &MockS3Client{}
+			saveAll(t, newSession(mockS3, mode), files)
+
+			// 同じサイズのまま内容と更新日時を変える
+			require.NoError(t, os.WriteFile(changed, []byte("new content"), 0644))
+			later := time.Now().Add(time.Hour)
+			require.NoError(t, os.Chtimes(changed, later, later))
+
+			second := newSession(mockS3, mode)
+			saveAll(t, second, files)
+			require.Equal(t, 1, second.SkippedCount())
+			require.Equal(t, "new content", string(mockS3.uploadedFiles["backup/changed.txt"]))
+
+			for _, result := range second.Results() {
+				require.Equal(t, result.RelativePath == "unchanged.txt", result.Skipped)
+			}
+		})
+	}
+
+	t.Run("ETagFallback", func(t *testing.T) {
+		srcPath := filepath.Join(t.TempDir(), "file.txt")
+		require.NoError(t, os.WriteFile(srcPath, []byte("uploaded by another tool"), 0644))
+
+		// チェックサムのメタデータを持たないオブジェクトはETag（MD5）と比較する
+		mockS3 := &MockS3Client{uploadedFiles: map[string][]byte{"backup/file.txt": []byte("uploaded by another tool")}}
+		session := newSession(mockS3, IncrementalChecksum)
+		saveAll(t, session, map[string]string{"file.txt": srcPath})
+		require.Equal(t, 1, session.SkippedCount())
+	})
+}
+
+func TestS3BackupSession_Dedup(t *testing.T) {
+	newSession := func(mockS3 *MockS3Client) *S3BackupSession {
+		return &S3BackupSession{
+			config: S3BackupSessionConfig{
+				Bucket: "test-bucket",
+				Prefix: "backup/",
+				Dedup:  dedupTestConfig,
+			},
+			s3Client: mockS3,
+		}
+	}
+	wait := func(t *testing.T, session *S3BackupSession) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, session.WaitForCompletion(ctx))
+	}
+
+	original, inserted := dedupTestData(256 * 1024)
+	srcDir := t.TempDir()
+	originalPath := filepath.Join(srcDir, "dump1.sql")
+	insertedPath := filepath.Join(srcDir, "dump2.sql")
+	require.NoError(t, os.WriteFile(originalPath, original, 0644))
+	require.NoError(t, os.WriteFile(insertedPath, inserted, 0644))
+
+	mockS3 := &MockS3Client{}
+	session := newSession(mockS3)
+	defer session.Close()
+
+	require.NoError(t, session.Save(originalPath, "dump1.sql"))
+	wait(t, session)
+	require.NoError(t, session.Save(insertedPath, "dump2.sql"))
+	wait(t, session)
+
+	results := session.Results()
+	require.Equal(t, int64(len(original)), results[0].BytesWritten)
+	require.Less(t, results[1].BytesWritten, int64(len(inserted)/4), "挿入箇所の前後のチャンクだけがアップロードされる")
+	require.Less(t, len(mockS3.uploadedFiles["backup/dump2.sql"]), len(inserted)/10)
+
+	t.Run("ListAndStat", func(t *testing.T) {
+		infos, err := session.List(context.Background(), "")
+		require.NoError(t, err)
+		require.Len(t, infos, 2, "チャンクは含まない")
+		require.Equal(t, int64(len(inserted)), infos[1].Size)
+
+		sum := sha256.Sum256(inserted)
+		info, err := session.Stat(context.Background(), "dump2.sql")
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+		require.Equal(t, int64(len(inserted)), info.Size)
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		restore := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/", Dedup: true}, mockS3)
+		defer restore.Close()
+
+		restoreDir := t.TempDir()
+		require.NoError(t, restore.RestorePrefix(context.Background(), "", restoreDir))
+		entries, err := os.ReadDir(restoreDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+
+		data, err := os.ReadFile(filepath.Join(restoreDir, "dump2.sql"))
+		require.NoError(t, err)
+		require.Equal(t, inserted, data)
+
+		reader, err := restore.Open(context.Background(), "dump1.sql")
+		require.NoError(t, err)
+		data, err = io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, original, data)
+	})
+
+	t.Run("GarbageCollect", func(t *testing.T) {
+		report, err := session.GarbageCollect(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 2, report.Manifests)
+		require.Zero(t, report.DeletedChunks)
+
+		delete(mockS3.uploadedFiles, "backup/dump2.sql")
+		report, err = session.GarbageCollect(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Manifests)
+		require.NotZero(t, report.DeletedChunks)
+
+		restore := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/", Dedup: true}, mockS3)
+		defer restore.Close()
+
+		dest := filepath.Join(t.TempDir(), "dump1.sql")
+		require.NoError(t, restore.Restore("dump1.sql", dest))
+		data, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		require.Equal(t, original, data)
+	})
+
+	t.Run("NotEnabled", func(t *testing.T) {
+		plain := &S3BackupSession{config: S3BackupSessionConfig{Bucket: "test-bucket"}, s3Client: &MockS3Client{}}
+		defer plain.Close()
+		_, err := plain.GarbageCollect(context.Background())
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+}
+
+func TestS3BackupSession_Compression(t *testing.T) {
+	newSession := func(mockS3 *MockS3Client, config S3BackupSessionConfig) *S3BackupSession {
+		config.Bucket = "test-bucket"
+		config.Prefix = "backup/"
+		config.Compression = CompressionConfig{Algorithm: CompressionZstd, Level: 3}
+		return &S3BackupSession{config: config, s3Client: mockS3}
+	}
+	saveAll := func(t *testing.T, session *S3BackupSession, files map[string]string) {
+		for relativePath, path := range files {
+			require.NoError(t, session.Save(path, relativePath))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, session.WaitForCompletion(ctx))
+		require.NoError(t, session.Close())
+	}
+
+	content := compressibleTestData(2000)
+	sum := sha256.Sum256(content)
+	srcDir := t.TempDir()
+	logPath := filepath.Join(srcDir, "app.log")
+	imagePath := filepath.Join(srcDir, "photo.jpg")
+	require.NoError(t, os.WriteFile(logPath, content, 0644))
+	require.NoError(t, os.WriteFile(imagePath, content, 0644))
+
+	mockS3 := &MockS3Client{}
+	session := newSession(mockS3, S3BackupSessionConfig{})
+	saveAll(t, session, map[string]string{"app.log": logPath, "photo.jpg": imagePath})
+
+	// 圧縮したオブジェクトにはメタデータで圧縮形式と元のサイズを記録する
+	require.Less(t, len(mockS3.uploadedFiles["backup/app.log"]), len(content)/5)
+	require.Equal(t, "zstd", objectMetadata(mockS3.metadata["backup/app.log"], compressionMetadataKey))
+	require.Equal(t, content, mockS3.uploadedFiles["backup/photo.jpg"], "圧縮済みの形式はそのままアップロードする")
+	for _, result := range session.Results() {
+		require.Equal(t, hex.EncodeToString(sum[:]), result.Checksum)
+		require.Equal(t, int64(len(mockS3.uploadedFiles["backup/"+result.RelativePath])), result.BytesWritten)
+	}
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := session.Stat(context.Background(), "app.log")
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), info.Size)
+		require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+		require.Equal(t, "zstd", info.Metadata["compression"])
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		restore := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/"}, mockS3)
+		defer restore.Close()
+
+		restoreDir := t.TempDir()
+		require.NoError(t, restore.RestorePrefix(context.Background(), "", restoreDir))
+		for _, name := range []string{"app.log", "photo.jpg"} {
+			data, err := os.ReadFile(filepath.Join(restoreDir, name))
+			require.NoError(t, err)
+			require.Equal(t, content, data)
+		}
+	})
+
+	t.Run("Incremental", func(t *testing.T) {
+		for _, mode := range []IncrementalMode{IncrementalSizeModTime, IncrementalChecksum} {
+			second := newSession(mockS3, S3BackupSessionConfig{Incremental: mode})
+			saveAll(t, second, map[string]string{"app.log": logPath})
+			require.Equal(t, 1, second.SkippedCount())
+		}
+	})
+
+	t.Run("Multipart", func(t *testing.T) {
+		large := compressibleTestData(100000)
+		largePath := filepath.Join(t.TempDir(), "large.log")
+		require.NoError(t, os.WriteFile(largePath, large, 0644))
+
+		multipartS3 := &MockS3Client{}
+		multipart := newSession(multipartS3, S3BackupSessionConfig{
+			MultipartThreshold: 1,
+			PartSize:           minPartSize,
+			JournalDir:         t.TempDir(),
+		})
+		saveAll(t, multipart, map[string]string{"large.log": largePath})
+		require.Equal(t, "zstd", objectMetadata(multipartS3.metadata["backup/large.log"], compressionMetadataKey))
+
+		restore := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/"}, multipartS3)
+		defer restore.Close()
+		reader, err := restore.Open(context.Background(), "large.log")
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, large, data)
+	})
+
+	t.Run("IntegrityCheck", func(t *testing.T) {
+		corruptedS3 := &MockS3Client{}
+		saveAll(t, newSession(corruptedS3, S3BackupSessionConfig{}), map[string]string{"app.log": logPath})
+		// モックはS3と同様にメタデータのキーを正規化して記録している
+		corruptedS3.metadata["backup/app.log"]["Original-size"] = aws.String("1")
+
+		restore := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/"}, corruptedS3)
+		defer restore.Close()
+		err := restore.Restore("app.log", filepath.Join(t.TempDir(), "app.log"))
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		err := validateS3Config(S3BackupSessionConfig{
+			Region:      "us-east-1",
+			Bucket:      "test-bucket",
+			Compression: CompressionConfig{Algorithm: CompressionGzip},
+			Dedup:       DedupConfig{Enabled: true},
+		})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+}
+
+// mockKMSClient は鍵ごとのマスター鍵でデータ鍵を暗号化するKMSのモック
+type mockKMSClient struct {
+	keys         map[string]*StaticKeyProvider // キーID → マスター鍵
+	generateKeys int
+	mu           sync.Mutex
+}
+
+func (m *mockKMSClient) GenerateDataKeyWithContext(ctx aws.Context, input *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+	m.mu.Lock()
+	m.generateKeys++
+	m.mu.Unlock()
+
+	provider, ok := m.keys[aws.StringValue(input.KeyId)]
+	if !ok || aws.StringValue(input.KeySpec) != kms.DataKeySpecAes256 {
+		return nil, awserr.New(kms.ErrCodeNotFoundException, "key not found", nil)
+	}
+	dataKey, err := provider.NewDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GenerateDataKeyOutput{
+		KeyId:          aws.String("arn:aws:kms:us-east-1:123456789012:key/" + aws.StringValue(input.KeyId)),
+		Plaintext:      dataKey.Key,
+		CiphertextBlob: dataKey.WrappedKey,
+	}, nil
+}
+
+func (m *mockKMSClient) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	keyID := strings.TrimPrefix(aws.StringValue(input.KeyId), "arn:aws:kms:us-east-1:123456789012:key/")
+	provider, ok := m.keys[keyID]
+	if !ok {
+		return nil, awserr.New(kms.ErrCodeNotFoundException, "key not found", nil)
+	}
+	plaintext, err := provider.UnwrapKey(ctx, keyID, input.CiphertextBlob)
+	if err != nil {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, err.Error(), nil)
+	}
+	return &kms.DecryptOutput{KeyId: input.KeyId, Plaintext: plaintext}, nil
+}
+
+func TestS3BackupSession_Encryption(t *testing.T) {
+	kmsClient := &mockKMSClient{keys: map[string]*StaticKeyProvider{"backup-key": testKeyProvider(t, "backup-key")}}
+	keys, err := NewKMSKeyProvider(kmsClient, "backup-key", map[string]string{"purpose": "backup"})
+	require.NoError(t, err)
+
+	newSession := func(mockS3 *MockS3Client, config S3BackupSessionConfig) *S3BackupSession {
+		config.Bucket = "test-bucket"
+		config.Prefix = "backup/"
+		config.PartSize = minPartSize
+		return &S3BackupSession{config: config, s3Client: mockS3}
+	}
+	wait := func(t *testing.T, session *S3BackupSession) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, session.WaitForCompletion(ctx))
+		require.NoError(t, session.Close())
+	}
+	newRestore := func(mockS3 *MockS3Client, keys KeyProvider) *S3RestoreSession {
+		return newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/", KeyProvider: keys}, mockS3)
+	}
+
+	content := compressibleTestData(2000)
+	large := compressibleTestData(100000)
+	sum := sha256.Sum256(content)
+	logPath := filepath.Join(t.TempDir(), "app.log")
+	require.NoError(t, os.WriteFile(logPath, content, 0644))
+
+	mockS3 := &MockS3Client{}
+	session := newSession(mockS3, S3BackupSessionConfig{KeyProvider: keys})
+	require.NoError(t, session.Save(logPath, "app.log"))
+	require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(content), "stream.log", -1))
+	require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(large), "large.log", -1))
+	wait(t, session)
+	require.Equal(t, 3, kmsClient.generateKeys, "ファイルごとにデータ鍵を生成する")
+
+	// オフサイトのコピーには平文が含まれない
+	for _, key := range []string{"backup/app.log", "backup/stream.log", "backup/large.log"} {
+		require.False(t, bytes.Contains(mockS3.uploadedFiles[key], content[:64]), key)
+		require.Equal(t, "aes-256-gcm", objectMetadata(mockS3.metadata[key], encryptionMetadataKey))
+		require.Equal(t, "arn:aws:kms:us-east-1:123456789012:key/backup-key", objectMetadata(mockS3.metadata[key], encryptionKeyIDMetadataKey))
+	}
+
+	t.Run("Stat", func(t *testing.T) {
+		for _, name := range []string{"app.log", "stream.log"} {
+			info, err := session.Stat(context.Background(), name)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(content)), info.Size)
+			require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+			require.Equal(t, "aes-256-gcm", info.Metadata["encryption"])
+		}
+
+		// マルチパートでアップロードしたストリームも完了後に元のサイズとチェックサムを記録する
+		largeSum := sha256.Sum256(large)
+		info, err := session.Stat(context.Background(), "large.log")
+		require.NoError(t, err)
+		require.Equal(t, int64(len(large)), info.Size)
+		require.Equal(t, hex.EncodeToString(largeSum[:]), info.Checksum)
+		require.Equal(t, "aes-256-gcm", info.Metadata["encryption"])
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		restore := newRestore(mockS3, keys)
+		defer restore.Close()
+
+		restoreDir := t.TempDir()
+		require.NoError(t, restore.RestorePrefix(context.Background(), "", restoreDir))
+		for name, expected := range map[string][]byte{"app.log": content, "stream.log": content, "large.log": large} {
+			data, err := os.ReadFile(filepath.Join(restoreDir, name))
+			require.NoError(t, err)
+			require.Equal(t, expected, data, name)
+		}
+	})
+
+	t.Run("WithoutKeys", func(t *testing.T) {
+		restore := newRestore(mockS3, nil)
+		defer restore.Close()
+		err := restore.Restore("app.log", filepath.Join(t.TempDir(), "app.log"))
+		require.ErrorIs(t, err, ErrInvalidConfig)
+
+		other := newRestore(mockS3, testKeyProvider(t, "other-key"))
+		defer other.Close()
+		err = other.Restore("app.log", filepath.Join(t.TempDir(), "app.log"))
+		require.ErrorIs(t, err, ErrKeyNotFound)
+	})
+
+	t.Run("Incremental", func(t *testing.T) {
+		for _, mode := range []IncrementalMode{IncrementalSizeModTime, IncrementalChecksum} {
+			second := newSession(mockS3, S3BackupSessionConfig{Incremental: mode, KeyProvider: keys})
+			require.NoError(t, second.Save(logPath, "app.log"))
+			wait(t, second)
+			require.Equal(t, 1, second.SkippedCount())
+		}
+
+		// 暗号化をやめた場合は平文でアップロードし直す
+		plain := newSession(mockS3, S3BackupSessionConfig{Incremental: IncrementalSizeModTime})
+		require.NoError(t, plain.Save(logPath, "app.log"))
+		wait(t, plain)
+		require.Equal(t, 0, plain.SkippedCount())
+		require.Equal(t, content, mockS3.uploadedFiles["backup/app.log"])
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		err := validateS3Config(S3BackupSessionConfig{
+			Region:      "us-east-1",
+			Bucket:      "test-bucket",
+			KeyProvider: keys,
+			Dedup:       DedupConfig{Enabled: true},
+		})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+
+		// 暗号化したファイルのアップロードは再開できない
+		err = validateS3Config(S3BackupSessionConfig{
+			Region:      "us-east-1",
+			Bucket:      "test-bucket",
+			KeyProvider: keys,
+			JournalDir:  t.TempDir(),
+		})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+		require.ErrorContains(t, err, "JournalDir")
+
+		_, err = NewKMSKeyProvider(nil, "backup-key", nil)
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+}
+
+func TestS3BackupSession_ObjectOptions(t *testing.T) {
+	newSession := func(mockS3 *MockS3Client, config S3BackupSessionConfig) *S3BackupSession {
+		config.Bucket = "test-bucket"
+		config.Prefix = "backup/"
+		config.PartSize = minPartSize
+		config.MultipartThreshold = minPartSize
+		return &S3BackupSession{config: config, s3Client: mockS3}
+	}
+	wait := func(t *testing.T, session *S3BackupSession) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, session.WaitForCompletion(ctx))
+		require.NoError(t, session.Close())
+	}
+
+	dir := t.TempDir()
+	writeFile := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, data, 0644))
+		return path
+	}
+	jsonPath := writeFile("data.json", []byte(`{"a":1}`))
+	noExtPath := writeFile("README", []byte("plain text\n"))
+	largePath := writeFile("large.bin", bytes.Repeat([]byte("x"), minPartSize+1))
+
+	t.Run("SessionOptions", func(t *testing.T) {
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3, S3BackupSessionConfig{
+			ServerSideEncryption: SSEConfig{
+				Mode:                 SSEKMS,
+				KMSKeyID:             "alias/backup",
+				KMSEncryptionContext: map[string]string{"app": "backup"},
+				BucketKeyEnabled:     true,
+			},
+			StorageClass: s3.StorageClassStandardIa,
+			Metadata:     map[string]string{"owner": "ops"},
+			CacheControl: "no-cache",
+			Tags:         map[string]string{"env": "prod", "team": "data ops"},
+		})
+		require.NoError(t, session.Save(jsonPath, "data.json"))
+		require.NoError(t, session.Save(noExtPath, "README"))
+		require.NoError(t, session.Save(largePath, "large.bin"))
+		require.NoError(t, session.SaveReader(context.Background(), strings.NewReader("<html></html>"), "page.html", -1))
+		wait(t, session)
+
+		for _, key := range []string{"backup/data.json", "backup/README", "backup/large.bin", "backup/page.html"} {
+			attributes := mockS3.attributes[key]
+			require.Equal(t, "aws:kms", attributes.sse, key)
+			require.Equal(t, "alias/backup", attributes.kmsKeyID, key)
+			require.Equal(t, base64.StdEncoding.EncodeToString([]byte(`{"app":"backup"}`)), attributes.kmsContext, key)
+			require.True(t, attributes.bucketKey, key)
+			require.Equal(t, "STANDARD_IA", attributes.storageClass, key)
+			require.Equal(t, "no-cache", attributes.cacheControl, key)
+			require.Equal(t, "env=prod&team=data%20ops", attributes.tagging, key)
+			require.Equal(t, "ops", objectMetadata(mockS3.metadata[key], "owner"), key)
+			require.NotEmpty(t, objectChecksum(mockS3.metadata[key]), key)
+		}
+
+		// Content-Type は拡張子、分からない場合は内容から判定する
+		require.Equal(t, "application/json", mockS3.attributes["backup/data.json"].contentType)
+		require.Equal(t, "text/plain; charset=utf-8", mockS3.attributes["backup/README"].contentType)
+		require.Equal(t, "application/octet-stream", mockS3.attributes["backup/large.bin"].contentType)
+		require.Equal(t, "text/html; charset=utf-8", mockS3.attributes["backup/page.html"].contentType)
+	})
+
+	t.Run("PerSaveOverride", func(t *testing.T) {
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3, S3BackupSessionConfig{
+			ServerSideEncryption: SSEConfig{Mode: SSES3},
+			StorageClass:         s3.StorageClassStandardIa,
+			Tags:                 map[string]string{"env": "prod"},
+		})
+		ctx := WithS3ObjectOptions(context.Background(), S3ObjectOptions{
+			StorageClass: s3.StorageClassGlacier,
+			ContentType:  "application/x-archive",
+			Tags:         map[string]string{"retention": "long"},
+		})
+		require.NoError(t, session.SaveContext(ctx, jsonPath, "archive.json"))
+		require.NoError(t, session.Save(jsonPath, "data.json"))
+		wait(t, session)
+
+		archived := mockS3.attributes["backup/archive.json"]
+		require.Equal(t, "GLACIER", archived.storageClass)
+		require.Equal(t, "application/x-archive", archived.contentType)
+		require.Equal(t, "env=prod&retention=long", archived.tagging)
+		require.Equal(t, "AES256", archived.sse, "上書きしない属性はセッションの設定")
+
+		plain := mockS3.attributes["backup/data.json"]
+		require.Equal(t, "STANDARD_IA", plain.storageClass)
+		require.Equal(t, "env=prod", plain.tagging)
+
+		// 無効な上書きは Save の時点でエラー
+		session = newSession(mockS3, S3BackupSessionConfig{})
+		err := session.SaveContext(WithS3ObjectOptions(context.Background(), S3ObjectOptions{StorageClass: "COLD"}), jsonPath, "data.json")
+		require.ErrorIs(t, err, ErrInvalidConfig)
+		wait(t, session)
+	})
+
+	t.Run("CustomerKey", func(t *testing.T) {
+		key := bytes.Repeat([]byte{0x42}, 32)
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3, S3BackupSessionConfig{
+			ServerSideEncryption: SSEConfig{Mode: SSEC, CustomerKey: key},
+			Incremental:          IncrementalSizeModTime,
+		})
+		require.NoError(t, session.Save(jsonPath, "data.json"))
+		require.NoError(t, session.Save(largePath, "large.bin"))
+		wait(t, session)
+		require.Equal(t, string(key), mockS3.attributes["backup/large.bin"].customerKey)
+		require.Empty(t, mockS3.attributes["backup/large.bin"].sse)
+
+		// 増分バックアップと Stat は同じ鍵で確認する
+		second := newSession(mockS3, S3BackupSessionConfig{
+			ServerSideEncryption: SSEConfig{Mode: SSEC, CustomerKey: key},
+			Incremental:          IncrementalSizeModTime,
+		})
+		require.NoError(t, second.Save(jsonPath, "data.json"))
+		info, err := second.Stat(context.Background(), "data.json")
+		require.NoError(t, err)
+		require.Equal(t, int64(7), info.Size)
+		wait(t, second)
+		require.Equal(t, 1, second.SkippedCount())
+
+		// リストアには同じ鍵が必要
+		restore := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/", SSECustomerKey: key}, mockS3)
+		defer restore.Close()
+		restoredPath := filepath.Join(t.TempDir(), "data.json")
+		require.NoError(t, restore.Restore("data.json", restoredPath))
+		restored, err := os.ReadFile(restoredPath)
+		require.NoError(t, err)
+		require.Equal(t, `{"a":1}`, string(restored))
+
+		withoutKey := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/"}, mockS3)
+		defer withoutKey.Close()
+		require.Error(t, withoutKey.Restore("data.json", restoredPath))
+
+		// ctx で鍵を指定することもできる
+		ctx := WithS3ObjectOptions(context.Background(), S3ObjectOptions{ServerSideEncryption: &SSEConfig{Mode: SSEC, CustomerKey: key}})
+		require.NoError(t, withoutKey.RestoreContext(ctx, "large.bin", filepath.Join(t.TempDir(), "large.bin")))
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		base := S3BackupSessionConfig{Region: "us-east-1", Bucket: "test-bucket"}
+		tooManyTags := map[string]string{}
+		for i := 0; i <= maxObjectTags; i++ {
+			tooManyTags[fmt.Sprintf("tag%d", i)] = "v"
+		}
+
+		for name, modify := range map[string]func(*S3BackupSessionConfig){
+			"StorageClass": func(c *S3BackupSessionConfig) { c.StorageClass = "COLD" },
+			"SSEMode":      func(c *S3BackupSessionConfig) { c.ServerSideEncryption.Mode = "aws:unknown" },
+			"KMSWithoutSSEKMS": func(c *S3BackupSessionConfig) {
+				c.ServerSideEncryption = SSEConfig{Mode: SSES3, KMSKeyID: "alias/backup"}
+			},
+			"CustomerKeySize": func(c *S3BackupSessionConfig) {
+				c.ServerSideEncryption = SSEConfig{Mode: SSEC, CustomerKey: []byte("short")}
+			},
+			"ReservedMetadata": func(c *S3BackupSessionConfig) { c.Metadata = map[string]string{"SHA256": "x"} },
+			"MetadataKey":      func(c *S3BackupSessionConfig) { c.Metadata = map[string]string{"bad key": "x"} },
+			"MetadataSize": func(c *S3BackupSessionConfig) {
+				c.Metadata = map[string]string{"big": strings.Repeat("x", maxUserMetadataSize)}
+			},
+			"ContentType":  func(c *S3BackupSessionConfig) { c.ContentType = "not a type" },
+			"CacheControl": func(c *S3BackupSessionConfig) { c.CacheControl = "max-age=1\r\n" },
+			"TooManyTags":  func(c *S3BackupSessionConfig) { c.Tags = tooManyTags },
+			"ReservedTag":  func(c *S3BackupSessionConfig) { c.Tags = map[string]string{"aws:created": "x"} },
+			"SSECWithDedup": func(c *S3BackupSessionConfig) {
+				c.ServerSideEncryption = SSEConfig{Mode: SSEC, CustomerKey: bytes.Repeat([]byte{1}, 32)}
+				c.Dedup = DedupConfig{Enabled: true}
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				config := base
+				modify(&config)
+				require.ErrorIs(t, validateS3Config(config), ErrInvalidConfig)
+			})
+		}
+
+		_, err := NewS3RestoreSession(S3RestoreSessionConfig{Region: "us-east-1", Bucket: "test-bucket", SSECustomerKey: []byte("short")})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+	})
+}
+
+func TestS3BackupSession_Checksums(t *testing.T) {
+	newSession := func(mockS3 *MockS3Client, config S3BackupSessionConfig) *S3BackupSession {
+		config.Bucket = "test-bucket"
+		config.Prefix = "backup/"
+		config.PartSize = minPartSize
+		config.MultipartThreshold = minPartSize
+		return &S3BackupSession{config: config, s3Client: mockS3}
+	}
+
+	dir := t.TempDir()
+	small := []byte("small file content")
+	large := bytes.Repeat([]byte("0123456789abcdef"), (minPartSize*2+100)/16)
+	smallPath := filepath.Join(dir, "small.txt")
+	largePath := filepath.Join(dir, "large.bin")
+	require.NoError(t, os.WriteFile(smallPath, small, 0644))
+	require.NoError(t, os.WriteFile(largePath, large, 0644))
+
+	for name, algorithm := range map[string]S3ChecksumAlgorithm{"None": S3ChecksumNone, "SHA256": S3ChecksumSHA256, "CRC32C": S3ChecksumCRC32C} {
+		t.Run(name, func(t *testing.T) {
+			mockS3 := &MockS3Client{}
+			session := newSession(mockS3, S3BackupSessionConfig{ChecksumAlgorithm: algorithm})
+			require.NoError(t, session.Save(smallPath, "small.txt"))
+			require.NoError(t, session.Save(largePath, "large.bin"))
+			require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(small), "stream.txt", -1))
+			require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(large), "stream.bin", -1))
+			require.NoError(t, session.WaitForCompletion(context.Background()))
+			require.NoError(t, session.Close())
+
+			// シングルパートでは Content-MD5 を送る（モックが内容と照合する）
+			smallMD5 := md5.Sum(small)
+			require.Equal(t, base64.StdEncoding.EncodeToString(smallMD5[:]), mockS3.attributes["backup/small.txt"].contentMD5)
+
+			// 内容全体が分かるものは保存した内容のチェックサムをメタデータに記録する
+			key := algorithm.metadataKey()
+			if algorithm == S3ChecksumNone {
+				require.Empty(t, objectMetadata(mockS3.metadata["backup/large.bin"], checksumSHA256MetadataKey))
+				require.Empty(t, objectMetadata(mockS3.metadata["backup/large.bin"], checksumCRC32CMetadataKey))
+			} else {
+				require.Equal(t, mockChecksum(string(algorithm), small), objectMetadata(mockS3.metadata["backup/small.txt"], key))
+				require.Equal(t, mockChecksum(string(algorithm), small), objectMetadata(mockS3.metadata["backup/stream.txt"], key))
+				require.Equal(t, mockChecksum(string(algorithm), large), objectMetadata(mockS3.metadata["backup/large.bin"], key))
+				// 長さの分からないストリームも完了後にメタデータを置き換えて記録する
+				require.Equal(t, mockChecksum(string(algorithm), large), objectMetadata(mockS3.metadata["backup/stream.bin"], key))
+			}
+			largeSum := sha256.Sum256(large)
+			require.Equal(t, hex.EncodeToString(largeSum[:]), objectChecksum(mockS3.metadata["backup/stream.bin"]))
+
+			restore := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/"}, mockS3)
+			defer restore.Close()
+			restoreDir := t.TempDir()
+			require.NoError(t, restore.Restore("large.bin", filepath.Join(restoreDir, "large.bin")))
+			require.NoError(t, restore.Restore("small.txt", filepath.Join(restoreDir, "small.txt")))
+			require.NoError(t, restore.Restore("stream.bin", filepath.Join(restoreDir, "stream.bin")))
+		})
+	}
+
+	t.Run("StreamMetadata", func(t *testing.T) {
+		// 置き換えたメタデータでも属性とSSE-Cの鍵は変わらない
+		key := bytes.Repeat([]byte{0x42}, 32)
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3, S3BackupSessionConfig{
+			ChecksumAlgorithm:    S3ChecksumSHA256,
+			ServerSideEncryption: SSEConfig{Mode: SSEC, CustomerKey: key},
+			StorageClass:         "STANDARD_IA",
+			Tags:                 map[string]string{"env": "prod"},
+			Metadata:             map[string]string{"owner": "ops"},
+		})
+		require.NoError(t, session.SaveReader(context.Background(), bytes.NewReader(large), "dump.sql", -1))
+		require.NoError(t, session.WaitForCompletion(context.Background()))
+
+		attributes := mockS3.attributes["backup/dump.sql"]
+		require.Equal(t, string(key), attributes.customerKey)
+		require.Equal(t, "STANDARD_IA", attributes.storageClass)
+		require.Equal(t, "env=prod", attributes.tagging)
+		require.Equal(t, "ops", objectMetadata(mockS3.metadata["backup/dump.sql"], "owner"))
+
+		largeSum := sha256.Sum256(large)
+		info, err := session.Stat(context.Background(), "dump.sql")
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(largeSum[:]), info.Checksum)
+		require.NoError(t, session.Close())
+
+		// リストアは記録したチェックサムで内容を照合する
+		mockS3.uploadedFiles["backup/dump.sql"][0] ^= 0xff
+		restore := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/", SSECustomerKey: key}, mockS3)
+		defer restore.Close()
+		err = restore.Restore("dump.sql", filepath.Join(t.TempDir(), "dump.sql"))
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+	})
+
+	t.Run("StreamMetadataMultipartCopy", func(t *testing.T) {
+		// CopyObject の上限を超えるオブジェクトはパートごとにコピーしてメタデータを置き換える
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3, S3BackupSessionConfig{ChecksumAlgorithm: S3ChecksumCRC32C})
+		defer session.Close()
+
+		data := compressibleTestData(40)
+		require.NoError(t, session.putObject(context.Background(), "backup/data.log", bytes.NewReader(data), int64(len(data)), objectAttributes{}))
+
+		attrs := objectAttributes{metadata: uploadMetadata("0123abcd", time.Time{}), options: S3ObjectOptions{ContentType: "text/plain"}}
+		require.NoError(t, session.copyObjectMultipart(context.Background(), "backup/data.log", int64(len(data)), 1000, attrs))
+
+		require.Equal(t, data, mockS3.uploadedFiles["backup/data.log"])
+		require.Equal(t, "0123abcd", objectChecksum(mockS3.metadata["backup/data.log"]))
+		require.Equal(t, "text/plain", mockS3.attributes["backup/data.log"].contentType)
+		require.Equal(t, (len(data)+999)/1000, mockS3.copiedParts)
+		require.Empty(t, mockS3.multipartUploads)
+	})
+
+	t.Run("Compressed", func(t *testing.T) {
+		// 変換した内容のチェックサムは変換と同時に計算する（モックが Content-MD5 と内容を照合する）
+		logPath := filepath.Join(dir, "app.log")
+		require.NoError(t, os.WriteFile(logPath, compressibleTestData(100), 0644))
+
+		for _, algorithm := range []S3ChecksumAlgorithm{S3ChecksumNone, S3ChecksumSHA256, S3ChecksumCRC32C} {
+			mockS3 := &MockS3Client{}
+			session := newSession(mockS3, S3BackupSessionConfig{
+				ChecksumAlgorithm: algorithm,
+				Compression:       CompressionConfig{Algorithm: CompressionGzip},
+			})
+			require.NoError(t, session.Save(logPath, "app.log"))
+			require.NoError(t, session.WaitForCompletion(context.Background()))
+			require.NoError(t, session.Close())
+
+			stored := mockS3.uploadedFiles["backup/app.log"]
+			require.Equal(t, string(CompressionGzip), objectMetadata(mockS3.metadata["backup/app.log"], compressionMetadataKey))
+			storedMD5 := md5.Sum(stored)
+			require.Equal(t, base64.StdEncoding.EncodeToString(storedMD5[:]), mockS3.attributes["backup/app.log"].contentMD5)
+			if algorithm != S3ChecksumNone {
+				require.Equal(t, mockChecksum(string(algorithm), stored), objectMetadata(mockS3.metadata["backup/app.log"], algorithm.metadataKey()))
+			}
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		journalDir := t.TempDir()
+		mockS3 := &MockS3Client{failPartNumber: 2, failError: fmt.Errorf("connection reset")}
+		upload := func(algorithm S3ChecksumAlgorithm) error {
+			session := newSession(mockS3, S3BackupSessionConfig{ChecksumAlgorithm: algorithm, JournalDir: journalDir})
+			require.NoError(t, session.Save(largePath, "large.bin"))
+			err := session.WaitForCompletion(context.Background())
+			require.NoError(t, session.Close())
+			return err
+		}
+
+		require.Error(t, upload(S3ChecksumCRC32C))
+
+		// 再開したパートのチェックサムは ListParts の結果から完了のリクエストに含める
+		mockS3.failPartNumber = 0
+		require.NoError(t, upload(S3ChecksumCRC32C))
+		require.Equal(t, 1, mockS3.uploadCounter)
+		require.Equal(t, large, mockS3.uploadedFiles["backup/large.bin"])
+
+		// チェックサムの方式を変えた場合は再開せずにやり直す
+		mockS3.failPartNumber = 2
+		require.Error(t, upload(S3ChecksumCRC32C))
+		mockS3.failPartNumber = 0
+		require.NoError(t, upload(S3ChecksumSHA256))
+		require.Equal(t, 3, mockS3.uploadCounter)
+		require.Equal(t, mockChecksum(s3.ChecksumAlgorithmSha256, large), objectMetadata(mockS3.metadata["backup/large.bin"], checksumSHA256MetadataKey))
+	})
+
+	t.Run("ResponseMismatch", func(t *testing.T) {
+		mockS3 := &MockS3Client{wrongChecksums: true}
+		session := newSession(mockS3, S3BackupSessionConfig{ChecksumAlgorithm: S3ChecksumSHA256})
+		require.NoError(t, session.Save(smallPath, "small.txt"))
+		require.NoError(t, session.Save(largePath, "large.bin"))
+		err := session.WaitForCompletion(context.Background())
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+		require.Len(t, err.(*BackupError).Failures, 2)
+		require.NoError(t, session.Close())
+		require.Empty(t, mockS3.multipartUploads, "失敗したマルチパートアップロードは中止する")
+	})
+
+	t.Run("StoredChecksumMismatch", func(t *testing.T) {
+		mockS3 := &MockS3Client{}
+		session := newSession(mockS3, S3BackupSessionConfig{ChecksumAlgorithm: S3ChecksumCRC32C})
+		require.NoError(t, session.Save(smallPath, "small.txt"))
+		require.NoError(t, session.WaitForCompletion(context.Background()))
+		require.NoError(t, session.Close())
+
+		// 記録したチェックサムと保存した内容が一致しなければリストアは失敗する
+		mockS3.metadata["backup/small.txt"]["Checksum-crc32c"] = aws.String(mockChecksum(s3.ChecksumAlgorithmCrc32c, []byte("other")))
+		delete(mockS3.metadata["backup/small.txt"], "Sha256")
+		restore := newS3RestoreSession(S3RestoreSessionConfig{Bucket: "test-bucket", Prefix: "backup/"}, mockS3)
+		defer restore.Close()
+		err := restore.Restore("small.txt", filepath.Join(t.TempDir(), "small.txt"))
+		require.ErrorIs(t, err, ErrIntegrityCheckFailed)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		err := validateS3Config(S3BackupSessionConfig{Region: "us-east-1", Bucket: "test-bucket", ChecksumAlgorithm: "MD5"})
+		require.ErrorIs(t, err, ErrInvalidConfig)
+
+		err = validateS3Config(S3BackupSessionConfig{Region: "us-east-1", Bucket: "test-bucket", Metadata: map[string]string{"checksum-sha256": "x"}})
+		require.ErrorIs(t, err, ErrInvalidConfig)
 	})
 }
@@ -0,0 +1,223 @@
+package safebackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// symlinkMetadataKey はS3に保存したシンボリックリンクのリンク先を記録するユーザーメタデータのキー
+const symlinkMetadataKey = "symlink-target"
+
+// dirEntry は SaveDir が保存するエントリ
+type dirEntry struct {
+	path         string // ソースのパス
+	relativePath string // バックアップ先での相対パス
+	linkTarget   string // SymlinkPreserve で保存するリンク先（ファイルの場合は空）
+}
+
+// dirWalker は SaveDir のためにディレクトリをたどり、フィルタに一致するエントリを選ぶ
+type dirWalker struct {
+	opts           SaveDirOptions
+	include        patternList
+	exclude        patternList
+	relativePrefix string
+	now            time.Time
+	save           func(entry dirEntry) *FileError // エントリの保存（成功時はnil）
+	failures       []*FileError
+}
+
+// walkDir は srcDir 以下をたどって、フィルタに一致するエントリを save に渡す
+// 保存やディレクトリの読み込みに失敗したエントリは記録して処理を続け、最後に *BackupError として返す
+// ctx のキャンセルやセッションのクローズではたどるのを中断してそのエラーを返す
+func walkDir(ctx context.Context, srcDir, relativePrefix string, opts SaveDirOptions, save func(entry dirEntry) *FileError) error {
+	if srcDir == "" {
+		return fmt.Errorf("%w: empty source directory", ErrInvalidConfig)
+	}
+	if opts.MinSize < 0 || opts.MaxSize < 0 || opts.MinAge < 0 || opts.MaxAge < 0 {
+		return fmt.Errorf("%w: size and age filters must not be negative", ErrInvalidConfig)
+	}
+
+	include, err := compilePatterns(opts.Include)
+	if err != nil {
+		return err
+	}
+	exclude, err := compilePatterns(opts.Exclude)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(srcDir)
+	if err != nil {
+		return fmt.Errorf("failed to stat source directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%w: source is not a directory", ErrInvalidConfig)
+	}
+
+	w := &dirWalker{
+		opts:           opts,
+		include:        include,
+		exclude:        exclude,
+		relativePrefix: relativePrefix,
+		now:            time.Now(),
+		save:           save,
+	}
+	if err := w.walk(ctx, srcDir, "", []os.FileInfo{info}); err != nil {
+		return err
+	}
+
+	if len(w.failures) > 0 {
+		return &BackupError{Failures: w.failures}
+	}
+	return nil
+}
+
+// walk は dir 以下をたどる
+// rel は srcDir からの "/" 区切りの相対パス、ancestors はリンクの循環を検出するための祖先ディレクトリ
+func (w *dirWalker) walk(ctx context.Context, dir, rel string, ancestors []os.FileInfo) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		w.fail(rel, fmt.Errorf("failed to read directory: %w", err))
+		return nil
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entryPath := filepath.Join(dir, entry.Name())
+		entryRel := path.Join(rel, entry.Name())
+
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// たどっている間に削除された
+			continue
+		}
+		if err != nil {
+			w.fail(entryRel, err)
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch w.opts.Symlinks {
+			case SymlinkSkip:
+				continue
+			case SymlinkPreserve:
+				if w.excluded(entryRel, false) || !w.selected(entryRel, info, false) {
+					continue
+				}
+				target, err := os.Readlink(entryPath)
+				if err != nil {
+					w.fail(entryRel, fmt.Errorf("failed to read symlink: %w", err))
+					continue
+				}
+				if err := w.saveEntry(dirEntry{path: entryPath, relativePath: w.relativePath(entryRel), linkTarget: target}); err != nil {
+					return err
+				}
+				continue
+			case SymlinkFollow:
+				info, err = os.Stat(entryPath)
+				if err != nil {
+					w.fail(entryRel, fmt.Errorf("failed to follow symlink: %w", err))
+					continue
+				}
+			}
+		}
+
+		if info.IsDir() {
+			if w.excluded(entryRel, true) {
+				continue
+			}
+			if isAncestor(info, ancestors) {
+				w.fail(entryRel, fmt.Errorf("symlink loop detected"))
+				continue
+			}
+			if err := w.walk(ctx, entryPath, entryRel, append(ancestors, info)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !info.Mode().IsRegular() || w.excluded(entryRel, false) || !w.selected(entryRel, info, true) {
+			continue
+		}
+		if err := w.saveEntry(dirEntry{path: entryPath, relativePath: w.relativePath(entryRel)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// excluded はエントリが Exclude に一致するかどうかを返す
+func (w *dirWalker) excluded(rel string, isDir bool) bool {
+	return w.exclude.match(rel, isDir)
+}
+
+// selected はファイルが Include とサイズ・経過時間のフィルタを満たすかどうかを返す
+// checkSize が偽の場合（シンボリックリンク）はサイズを確認しない
+func (w *dirWalker) selected(rel string, info os.FileInfo, checkSize bool) bool {
+	if len(w.include) > 0 && !w.include.matchPathOrParent(rel) {
+		return false
+	}
+
+	if checkSize {
+		if w.opts.MinSize > 0 && info.Size() < w.opts.MinSize {
+			return false
+		}
+		if w.opts.MaxSize > 0 && info.Size() > w.opts.MaxSize {
+			return false
+		}
+	}
+
+	age := w.now.Sub(info.ModTime())
+	if w.opts.MinAge > 0 && age < w.opts.MinAge {
+		return false
+	}
+	if w.opts.MaxAge > 0 && age > w.opts.MaxAge {
+		return false
+	}
+	return true
+}
+
+// saveEntry はエントリを保存する
+// 失敗は記録して処理を続けるが、セッションがクローズされた場合はたどるのを中断する
+func (w *dirWalker) saveEntry(entry dirEntry) error {
+	failure := w.save(entry)
+	if failure == nil {
+		return nil
+	}
+	if errors.Is(failure.Err, ErrSessionClosed) {
+		return ErrSessionClosed
+	}
+	w.failures = append(w.failures, failure)
+	return nil
+}
+
+// fail はエントリの失敗を記録する
+func (w *dirWalker) fail(rel string, err error) {
+	w.failures = append(w.failures, &FileError{
+		RelativePath: w.relativePath(rel),
+		Err:          err,
+	})
+}
+
+// relativePath は srcDir からの相対パスをバックアップ先での相対パスに変換する
+func (w *dirWalker) relativePath(rel string) string {
+	return filepath.Join(w.relativePrefix, filepath.FromSlash(rel))
+}
+
+// isAncestor は info がたどっている途中のディレクトリのいずれかと同じかどうかを返す
+func isAncestor(info os.FileInfo, ancestors []os.FileInfo) bool {
+	for _, ancestor := range ancestors {
+		if os.SameFile(info, ancestor) {
+			return true
+		}
+	}
+	return false
+}
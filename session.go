@@ -2,6 +2,7 @@ package safebackup
 
 import (
 	"context"
+	"io"
 )
 
 // BackupSession はバックアップセッションの共通インターフェース
@@ -11,10 +12,37 @@ type BackupSession interface {
 	// relativePath: バックアップ先での相対パス
 	Save(localFilePath, relativePath string) error
 
+	// SaveContext は Save のコンテキスト付き版
+	// ctx がキャンセルされると保存処理を中断する
+	SaveContext(ctx context.Context, localFilePath, relativePath string) error
+
+	// SaveReader はReaderから読み込んだデータをバックアップ先に保存する
+	// ローカルディスクに一時保存できないストリーム（ダンプ出力等）に使う
+	// sizeHint: データサイズ（不明な場合は負の値）
+	SaveReader(ctx context.Context, r io.Reader, relativePath string, sizeHint int64) error
+
+	// SaveDir は srcDir 以下のファイルを relativePrefix 以下に保存する
+	// opts でパターン、サイズ、経過時間による絞り込みとシンボリックリンクの扱いを指定する
+	// 失敗したファイルがあっても残りの保存を続け、最後に *BackupError を返す
+	SaveDir(ctx context.Context, srcDir, relativePrefix string, opts SaveDirOptions) error
+
 	// WaitForCompletion はバックアップ処理とクリーニング処理の完了を待つ
 	// ctx: タイムアウト制御用のコンテキスト
 	WaitForCompletion(ctx context.Context) error
 
-	// Close はリソースをクリーンアップする
+	// List は相対パスが prefix で始まる保存済みのバックアップを相対パス順に返す
+	// 一覧の取得だけで内容は読まないため、Checksum は含まれない
+	List(ctx context.Context, prefix string) ([]BackupInfo, error)
+
+	// Stat は保存済みのバックアップの情報を返す
+	// 存在しない場合は ErrNotFound を返す
+	Stat(ctx context.Context, relativePath string) (BackupInfo, error)
+
+	// Results はこれまでに処理したファイルごとの結果を返す
+	// 非同期に保存するセッションでは WaitForCompletion の後に呼び出すこと
+	Results() []FileResult
+
+	// Close は実行中の処理をキャンセルし、それらが終了するまで待ってからリソースをクリーンアップする
+	// クローズ後の Save は ErrSessionClosed を返す
 	Close() error
 }
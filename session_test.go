@@ -0,0 +1,154 @@
+package safebackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testBackupSessionConformance は BackupSession の実装に共通する振る舞いを確認する
+// newSession は空の保存先に接続したセッションを返し、テストの終了時に閉じる
+func testBackupSessionConformance(t *testing.T, newSession func(t *testing.T) BackupSession) {
+	content := compressibleTestData(1000)
+	srcPath := filepath.Join(t.TempDir(), "app.log")
+	require.NoError(t, os.WriteFile(srcPath, content, 0644))
+	sum := sha256.Sum256(content)
+
+	t.Run("Save", func(t *testing.T) {
+		session := newSession(t)
+
+		require.NoError(t, session.Save(srcPath, "logs/2024/app.log"))
+		info, err := session.Stat(context.Background(), "logs/2024/app.log")
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), info.Size)
+
+		results := session.Results()
+		require.Len(t, results, 1)
+		require.NoError(t, results[0].Err)
+		require.Equal(t, srcPath, results[0].SourcePath)
+		require.Equal(t, "logs/2024/app.log", results[0].RelativePath)
+		require.Equal(t, info.Destination, results[0].Destination)
+		require.Equal(t, hex.EncodeToString(sum[:]), results[0].Checksum)
+		require.Equal(t, int64(len(content)), results[0].BytesWritten)
+
+		// 既存のバックアップは置き換える
+		require.NoError(t, session.SaveReader(context.Background(), strings.NewReader("replaced"), "logs/2024/app.log", -1))
+		info, err = session.Stat(context.Background(), "logs/2024/app.log")
+		require.NoError(t, err)
+		require.Equal(t, int64(len("replaced")), info.Size)
+	})
+
+	t.Run("SaveReader", func(t *testing.T) {
+		session := newSession(t)
+
+		dump := "CREATE TABLE users;"
+		dumpSum := sha256.Sum256([]byte(dump))
+		require.NoError(t, session.SaveReader(context.Background(), strings.NewReader(dump), "db/known.sql", int64(len(dump))))
+		require.NoError(t, session.SaveReader(context.Background(), strings.NewReader(dump), "db/unknown.sql", -1))
+		// サイズのヒントより長いストリームも最後まで保存する
+		require.NoError(t, session.SaveReader(context.Background(), strings.NewReader(dump), "db/short.sql", 4))
+
+		for i, name := range []string{"db/known.sql", "db/unknown.sql", "db/short.sql"} {
+			info, err := session.Stat(context.Background(), name)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(dump)), info.Size)
+
+			result := session.Results()[i]
+			require.NoError(t, result.Err)
+			require.Empty(t, result.SourcePath)
+			require.Equal(t, hex.EncodeToString(dumpSum[:]), result.Checksum)
+			require.Equal(t, int64(len(dump)), result.BytesWritten)
+		}
+
+		require.ErrorIs(t, session.SaveReader(context.Background(), nil, "db/nil.sql", -1), ErrInvalidConfig)
+	})
+
+	t.Run("ListAndStat", func(t *testing.T) {
+		session := newSession(t)
+
+		require.NoError(t, session.Save(srcPath, "b/app.log"))
+		require.NoError(t, session.SaveReader(context.Background(), strings.NewReader("dump"), "a/dump.sql", 4))
+		require.NoError(t, session.SaveReader(context.Background(), strings.NewReader("x"), "bb/deep/x.txt", 1))
+
+		// 相対パス順に返す
+		infos, err := session.List(context.Background(), "")
+		require.NoError(t, err)
+		var paths []string
+		for _, info := range infos {
+			paths = append(paths, info.RelativePath)
+		}
+		require.Equal(t, []string{"a/dump.sql", "b/app.log", "bb/deep/x.txt"}, paths)
+		require.Equal(t, int64(len(content)), infos[1].Size)
+
+		infos, err = session.List(context.Background(), "b/")
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		require.Equal(t, "b/app.log", infos[0].RelativePath)
+
+		info, err := session.Stat(context.Background(), "a/dump.sql")
+		require.NoError(t, err)
+		require.Equal(t, "a/dump.sql", info.RelativePath)
+		require.Equal(t, int64(4), info.Size)
+
+		_, err = session.Stat(context.Background(), "missing.sql")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("SaveDir", func(t *testing.T) {
+		session := newSession(t)
+
+		err := session.SaveDir(context.Background(), createTestTree(t), "tree", SaveDirOptions{
+			Exclude:  []string{"node_modules/"},
+			Symlinks: SymlinkFollow,
+		})
+		require.NoError(t, err)
+
+		infos, err := session.List(context.Background(), "tree/")
+		require.NoError(t, err)
+		var paths []string
+		for _, info := range infos {
+			paths = append(paths, info.RelativePath)
+		}
+		require.Equal(t, []string{
+			"tree/a.txt", "tree/big.bin", "tree/link-dir/keep.txt", "tree/link-file",
+			"tree/logs/app.log", "tree/logs/old.log", "tree/sub/keep.txt",
+		}, paths)
+
+		info, err := session.Stat(context.Background(), "tree/big.bin")
+		require.NoError(t, err)
+		require.Equal(t, int64(2000), info.Size)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		session := newSession(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.ErrorIs(t, session.SaveContext(ctx, srcPath, "app.log"), ErrBackupFailed)
+		require.ErrorIs(t, session.SaveReader(ctx, strings.NewReader("dump"), "dump.sql", 4), ErrBackupFailed)
+
+		for _, name := range []string{"app.log", "dump.sql"} {
+			_, err := session.Stat(context.Background(), name)
+			require.ErrorIs(t, err, ErrNotFound)
+		}
+		results := session.Results()
+		require.Len(t, results, 2)
+		require.Error(t, results[0].Err)
+		require.Error(t, results[1].Err)
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		session := newSession(t)
+		require.NoError(t, session.Close())
+		require.NoError(t, session.Close())
+
+		require.ErrorIs(t, session.Save(srcPath, "app.log"), ErrSessionClosed)
+		require.ErrorIs(t, session.SaveReader(context.Background(), strings.NewReader("dump"), "dump.sql", 4), ErrSessionClosed)
+	})
+}
@@ -0,0 +1,749 @@
+package safebackup
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// defaultSFTPPort はSSHのデフォルトのポート
+	defaultSFTPPort = 22
+
+	// defaultSFTPDialTimeout は接続とハンドシェイクのデフォルトのタイムアウト
+	defaultSFTPDialTimeout = 30 * time.Second
+
+	// posixRenameExtension は既存のファイルを置き換えるリネームのSFTP拡張
+	posixRenameExtension = "posix-rename@openssh.com"
+)
+
+// SFTPBackupSession はSFTPサーバーへのバックアップセッション実装
+// ファイルはリモートの一時ファイルに書き込んでからリネームするため、保存先に書き込み途中のファイルが現れることはない
+// 保存は呼び出し元のゴルーチンで行われ、複数のゴルーチンから同時に呼び出せる
+type SFTPBackupSession struct {
+	config  SFTPBackupSessionConfig
+	conn    *ssh.Client
+	client  *sftp.Client
+	agent   io.Closer // ssh-agentとの接続（UseAgent の場合のみ）
+	results resultLog // ファイルごとの結果
+	ctx     context.Context
+	cancel  context.CancelFunc // ctx のキャンセル
+	closeMu sync.RWMutex       // closed の排他制御
+	closed  bool
+	saves   sync.WaitGroup // 実行中の保存処理
+}
+
+// NewSFTPBackupSession はSFTPバックアップセッションインスタンスを作成
+// 作成時にサーバーに接続してホスト鍵を検証し、リモートのルートディレクトリを作成する
+func NewSFTPBackupSession(config SFTPBackupSessionConfig) (*SFTPBackupSession, error) {
+	// 設定の検証
+	if err := validateSFTPConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	// デフォルト値の設定
+	if config.Port == 0 {
+		config.Port = defaultSFTPPort
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultSFTPDialTimeout
+	}
+	config.RootDir = path.Clean(config.RootDir)
+
+	auth, agentConn, err := sftpAuthMethods(config)
+	if err != nil {
+		return nil, err
+	}
+	closeAgent := func() {
+		if agentConn != nil {
+			_ = agentConn.Close()
+		}
+	}
+
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	clientConfig := &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            auth,
+		HostKeyCallback: config.HostKeyCallback,
+		Timeout:         config.DialTimeout,
+	}
+	if clientConfig.HostKeyCallback == nil {
+		clientConfig.HostKeyCallback, err = knownHostsCallback(config.KnownHostsFile)
+		if err != nil {
+			closeAgent()
+			return nil, err
+		}
+		clientConfig.HostKeyAlgorithms = knownHostKeyAlgorithms(clientConfig.HostKeyCallback, addr)
+	}
+
+	conn, err := dialSSH(addr, clientConfig)
+	if err != nil {
+		closeAgent()
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		closeAgent()
+		return nil, fmt.Errorf("failed to start sftp session: %w", err)
+	}
+
+	// ルートディレクトリが存在しない場合は作成
+	if err := client.MkdirAll(config.RootDir); err != nil {
+		_ = client.Close()
+		_ = conn.Close()
+		closeAgent()
+		return nil, fmt.Errorf("failed to create remote root directory: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SFTPBackupSession{
+		config: config,
+		conn:   conn,
+		client: client,
+		agent:  agentConn,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// sftpAuthMethods は設定された認証方法を秘密鍵、ssh-agent、パスワードの順に返す
+// ssh-agentを使う場合は、セッションのクローズ時に閉じる接続も返す
+func sftpAuthMethods(config SFTPBackupSessionConfig) ([]ssh.AuthMethod, io.Closer, error) {
+	var methods []ssh.AuthMethod
+
+	key := config.PrivateKey
+	if config.PrivateKeyFile != "" {
+		data, err := os.ReadFile(config.PrivateKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read private key: %w", err)
+		}
+		key = data
+	}
+	if len(key) > 0 {
+		var signer ssh.Signer
+		var err error
+		if config.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(config.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: failed to parse private key: %w", ErrInvalidConfig, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	var agentConn io.Closer
+	if config.UseAgent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, nil, fmt.Errorf("%w: SSH_AUTH_SOCK is not set", ErrInvalidConfig)
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+		}
+		agentConn = conn
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if config.Password != "" {
+		password := config.Password
+		methods = append(methods,
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}),
+		)
+	}
+
+	return methods, agentConn, nil
+}
+
+// knownHostsCallback は known_hosts ファイルでホスト鍵を検証するコールバックを返す
+// file が空の場合は ~/.ssh/known_hosts を使う
+func knownHostsCallback(file string) (ssh.HostKeyCallback, error) {
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("%w: known hosts file is not specified: %w", ErrInvalidConfig, err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to load known hosts file: %w", ErrInvalidConfig, err)
+	}
+	return callback, nil
+}
+
+// knownHostKeyAlgorithms は known_hosts に addr のホスト鍵として記録された鍵の方式を返す
+// 記録されていない方式の鍵をサーバーが提示すると検証に失敗するため、記録された方式で交渉する
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+	// 記録されていない鍵で検証すると、記録された鍵の一覧が KeyError で返る
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(addr, &net.TCPAddr{IP: net.IPv4zero}, probe), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		candidates := []string{known.Key.Type()}
+		if known.Key.Type() == ssh.KeyAlgoRSA {
+			// RSA鍵はSHA-2の署名方式を優先する
+			candidates = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, algorithm := range candidates {
+			if !slices.Contains(algorithms, algorithm) {
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	return algorithms
+}
+
+// dialSSH はSSHサーバーに接続する
+// ssh.Dial と異なり、ハンドシェイクにも config.Timeout を適用する
+func dialSSH(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(config.Timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// Save はファイルをSFTPサーバーに保存する
+func (s *SFTPBackupSession) Save(localFilePath, relativePath string) error {
+	return s.SaveContext(context.Background(), localFilePath, relativePath)
+}
+
+// SaveContext はファイルをSFTPサーバーに保存する
+// ctx またはセッションがキャンセルされると転送を中断し、書き込み途中の一時ファイルは削除する
+func (s *SFTPBackupSession) SaveContext(ctx context.Context, localFilePath, relativePath string) error {
+	// 入力検証
+	if localFilePath == "" || relativePath == "" {
+		return fmt.Errorf("%w: empty file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	start := time.Now()
+	remotePath, err := s.remotePath(relativePath)
+	var copied copyResult
+	if err == nil {
+		copied, err = s.saveFile(ctx, localFilePath, remotePath)
+	}
+	s.results.add(FileResult{
+		SourcePath:   localFilePath,
+		RelativePath: relativePath,
+		Destination:  remotePath,
+		BytesWritten: copied.written,
+		Duration:     time.Since(start),
+		Checksum:     copied.checksum,
+		Err:          err,
+	})
+
+	return err
+}
+
+// saveFile はファイルをリモートのパスに転送する
+func (s *SFTPBackupSession) saveFile(ctx context.Context, localFilePath, remotePath string) (copyResult, error) {
+	file, err := os.Open(localFilePath)
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to stat source file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return copyResult{}, fmt.Errorf("%w: source is not a regular file", ErrInvalidConfig)
+	}
+
+	var modTime time.Time
+	if s.config.PreserveTimes {
+		modTime = info.ModTime()
+	}
+	copied, err := s.upload(&contextReader{ctx: ctx, r: file}, remotePath, info.Mode().Perm(), modTime)
+	if err != nil {
+		return copied, fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	return copied, nil
+}
+
+// SaveReader はReaderから読み込んだデータをSFTPサーバーに保存する
+// sizeHint はデータサイズが分かっている場合の値（不明な場合は負の値）で、SFTPでは使用しない
+func (s *SFTPBackupSession) SaveReader(ctx context.Context, r io.Reader, relativePath string, sizeHint int64) error {
+	// 入力検証
+	if r == nil || relativePath == "" {
+		return fmt.Errorf("%w: empty reader or file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	start := time.Now()
+	remotePath, err := s.remotePath(relativePath)
+	var copied copyResult
+	if err == nil {
+		copied, err = s.upload(&contextReader{ctx: ctx, r: r}, remotePath, streamFileMode, time.Time{})
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrBackupFailed, err)
+		}
+	}
+	s.results.add(FileResult{
+		RelativePath: relativePath,
+		Destination:  remotePath,
+		BytesWritten: copied.written,
+		Duration:     time.Since(start),
+		Checksum:     copied.checksum,
+		Err:          err,
+	})
+
+	return err
+}
+
+// SaveDir は srcDir 以下のファイルを relativePrefix 以下に保存する
+// 失敗したファイルがあっても残りの保存を続け、最後に *BackupError を返す
+func (s *SFTPBackupSession) SaveDir(ctx context.Context, srcDir, relativePrefix string, opts SaveDirOptions) error {
+	return walkDir(ctx, srcDir, relativePrefix, opts, func(entry dirEntry) *FileError {
+		var err error
+		if entry.linkTarget != "" {
+			err = s.saveSymlink(ctx, entry.path, entry.linkTarget, entry.relativePath)
+		} else {
+			err = s.SaveContext(ctx, entry.path, entry.relativePath)
+		}
+		if err == nil {
+			return nil
+		}
+		destination, _ := s.remotePath(entry.relativePath)
+		return &FileError{
+			RelativePath: entry.relativePath,
+			Destination:  destination,
+			Err:          err,
+		}
+	})
+}
+
+// saveSymlink はシンボリックリンクをリンクのまま保存する
+// 一時的な名前で作成してからリネームするため、既存のファイルはリンクに置き換わる
+// ctx またはセッションがキャンセルされると次の操作の前に中断し、作成した一時的なリンクは削除する
+func (s *SFTPBackupSession) saveSymlink(ctx context.Context, linkPath, target, relativePath string) error {
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	start := time.Now()
+	remotePath, err := s.remotePath(relativePath)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = s.client.MkdirAll(path.Dir(remotePath))
+	}
+	var tempPath string
+	if err == nil {
+		tempPath, err = remoteTempPath(remotePath)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = s.client.Symlink(target, tempPath)
+	}
+	if err == nil {
+		if err = ctx.Err(); err == nil {
+			err = s.rename(tempPath, remotePath)
+		}
+		if err != nil {
+			_ = s.client.Remove(tempPath)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+	s.results.add(FileResult{
+		SourcePath:   linkPath,
+		RelativePath: relativePath,
+		Destination:  remotePath,
+		Duration:     time.Since(start),
+		Err:          err,
+	})
+
+	return err
+}
+
+// upload は r の内容をリモートの一時ファイルに書き込み、remotePath にリネームする
+// 親ディレクトリがなければ作成し、modTime がゼロでなければ更新日時に設定する
+// リネームの前に一時ファイルのサイズを確認し、書き込んだサイズと一致しない場合は ErrIntegrityCheckFailed を返す
+func (s *SFTPBackupSession) upload(r io.Reader, remotePath string, mode os.FileMode, modTime time.Time) (copyResult, error) {
+	var result copyResult
+
+	if err := s.client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return result, fmt.Errorf("failed to create remote directory: %w", err)
+	}
+
+	tempPath, err := remoteTempPath(remotePath)
+	if err != nil {
+		return result, err
+	}
+	file, err := s.client.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return result, fmt.Errorf("failed to create remote temporary file: %w", err)
+	}
+
+	// リネームまで完了しなかった場合は一時ファイルを削除
+	committed := false
+	defer func() {
+		if !committed {
+			_ = file.Close()
+			_ = s.client.Remove(tempPath)
+		}
+	}()
+
+	// 転送と同時にチェックサムを計算
+	hash := sha256.New()
+	result.written, err = io.Copy(file, io.TeeReader(r, hash))
+	if err != nil {
+		return result, fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	if err := file.Chmod(mode); err != nil {
+		return result, fmt.Errorf("failed to set file permissions: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return result, fmt.Errorf("failed to close remote temporary file: %w", err)
+	}
+
+	info, err := s.client.Stat(tempPath)
+	if err != nil {
+		return result, fmt.Errorf("failed to stat remote temporary file: %w", err)
+	}
+	if info.Size() != result.written {
+		return result, fmt.Errorf("%w: wrote %d bytes but remote file has %d bytes", ErrIntegrityCheckFailed, result.written, info.Size())
+	}
+
+	// 日時は書き込みが終わってから設定する
+	if !modTime.IsZero() {
+		if err := s.client.Chtimes(tempPath, modTime, modTime); err != nil {
+			return result, fmt.Errorf("failed to set file times: %w", err)
+		}
+	}
+
+	if err := s.rename(tempPath, remotePath); err != nil {
+		return result, fmt.Errorf("failed to rename remote temporary file: %w", err)
+	}
+	committed = true
+
+	result.checksum = hex.EncodeToString(hash.Sum(nil))
+	return result, nil
+}
+
+// rename は tempPath を remotePath にリネームする
+func (s *SFTPBackupSession) rename(tempPath, remotePath string) error {
+	return replaceRemoteFile(s.client, tempPath, remotePath)
+}
+
+// sftpRenamer は replaceRemoteFile が使うSFTPクライアントの操作
+type sftpRenamer interface {
+	HasExtension(extension string) (string, bool)
+	PosixRename(oldname, newname string) error
+	Rename(oldname, newname string) error
+	Remove(path string) error
+	Lstat(path string) (os.FileInfo, error)
+}
+
+// replaceRemoteFile は tempPath を remotePath にリネームする
+// posix-rename拡張があれば既存のファイルをアトミックに置き換える
+// なければ既存のファイルを退避してからリネームし、失敗した場合は退避したファイルを元に戻す
+// 退避したファイルはリネームが完了してから削除する
+func replaceRemoteFile(client sftpRenamer, tempPath, remotePath string) error {
+	if _, ok := client.HasExtension(posixRenameExtension); ok {
+		return client.PosixRename(tempPath, remotePath)
+	}
+
+	// SFTPv3のリネームは既存のファイルを上書きできない
+	err := client.Rename(tempPath, remotePath)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := client.Lstat(remotePath); statErr != nil {
+		// 既存のファイルがなければリネーム自体の失敗
+		return err
+	}
+
+	sidePath, err := remoteTempPath(remotePath)
+	if err != nil {
+		return err
+	}
+	if err := client.Rename(remotePath, sidePath); err != nil {
+		return fmt.Errorf("failed to move existing remote file aside: %w", err)
+	}
+	if err := client.Rename(tempPath, remotePath); err != nil {
+		if restoreErr := client.Rename(sidePath, remotePath); restoreErr != nil {
+			return fmt.Errorf("%w (failed to restore existing remote file from %s: %v)", err, sidePath, restoreErr)
+		}
+		return err
+	}
+	_ = client.Remove(sidePath)
+	return nil
+}
+
+// remoteTempPath は remotePath と同じディレクトリの一時ファイルのパスを返す
+func remoteTempPath(remotePath string) (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate temporary file name: %w", err)
+	}
+	name := "." + path.Base(remotePath) + "." + hex.EncodeToString(random) + tempFileSuffix
+	return path.Join(path.Dir(remotePath), name), nil
+}
+
+// remotePath は相対パスからリモートのパスを構築する
+// ルートディレクトリの外を指す相対パスは ErrInvalidConfig になる
+func (s *SFTPBackupSession) remotePath(relativePath string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(relativePath)) {
+		return "", fmt.Errorf("%w: unsafe path %q", ErrInvalidConfig, relativePath)
+	}
+	return path.Join(s.config.RootDir, filepath.ToSlash(relativePath)), nil
+}
+
+// List はルートディレクトリ以下で相対パスが prefix で始まるファイルとシンボリックリンクを相対パス順に返す
+// 書き込み途中の一時ファイルは含まない
+func (s *SFTPBackupSession) List(ctx context.Context, prefix string) ([]BackupInfo, error) {
+	var infos []BackupInfo
+	walker := s.client.Walk(s.config.RootDir)
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// 列挙中に削除された
+				continue
+			}
+			return nil, fmt.Errorf("failed to list backups: %w", err)
+		}
+
+		info := walker.Stat()
+		if !(info.Mode().IsRegular() || info.Mode()&fs.ModeSymlink != 0) || strings.HasSuffix(info.Name(), tempFileSuffix) {
+			continue
+		}
+		rel := relativeRemotePath(s.config.RootDir, walker.Path())
+		if !strings.HasPrefix(rel, prefix) {
+			continue
+		}
+		infos = append(infos, s.backupInfo(rel, walker.Path(), info))
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].RelativePath < infos[j].RelativePath
+	})
+	return infos, nil
+}
+
+// relativeRemotePath はルートディレクトリ以下のリモートのパスから相対パスを返す
+func relativeRemotePath(rootDir, remotePath string) string {
+	if rootDir == "." {
+		return remotePath
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(remotePath, rootDir), "/")
+}
+
+// Stat は保存済みのバックアップの情報を返す
+// 内容を読まないため、Checksum は含まれない
+func (s *SFTPBackupSession) Stat(ctx context.Context, relativePath string) (BackupInfo, error) {
+	remotePath, err := s.remotePath(relativePath)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return BackupInfo{}, err
+	}
+
+	info, err := s.client.Lstat(remotePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return BackupInfo{}, fmt.Errorf("%w: %s", ErrNotFound, relativePath)
+	}
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to stat backup file: %w", err)
+	}
+	if info.IsDir() {
+		return BackupInfo{}, fmt.Errorf("%w: %s is a directory", ErrNotFound, relativePath)
+	}
+	return s.backupInfo(filepath.ToSlash(filepath.Clean(relativePath)), remotePath, info), nil
+}
+
+// backupInfo はリモートのファイルの情報から BackupInfo を作る
+func (s *SFTPBackupSession) backupInfo(relativePath, remotePath string, info os.FileInfo) BackupInfo {
+	result := BackupInfo{
+		RelativePath: relativePath,
+		Destination:  remotePath,
+		Size:         info.Size(),
+		ModTime:      info.ModTime(),
+		Metadata: map[string]string{
+			"mode": info.Mode().Perm().String(),
+		},
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if target, err := s.client.ReadLink(remotePath); err == nil {
+			result.Metadata[symlinkMetadataKey] = target
+		}
+	}
+	return result
+}
+
+// beginSave は保存処理の開始を記録する
+// クローズ済みのセッションでは ErrSessionClosed を返す
+func (s *SFTPBackupSession) beginSave() error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	s.saves.Add(1)
+	return nil
+}
+
+// WaitForCompletion は他のゴルーチンで実行中の保存の完了を待つ
+func (s *SFTPBackupSession) WaitForCompletion(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.saves.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("backup timeout: %w", ctx.Err())
+	case <-done:
+		return nil
+	}
+}
+
+// Results はこれまでに保存したファイルごとの結果を返す
+func (s *SFTPBackupSession) Results() []FileResult {
+	return s.results.snapshot()
+}
+
+// Close は実行中の保存をキャンセルし、それらが終了するまで待ってから接続を閉じる
+func (s *SFTPBackupSession) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+
+	s.cancel()
+	s.saves.Wait()
+
+	_ = s.client.Close()
+	if s.agent != nil {
+		_ = s.agent.Close()
+	}
+	if err := s.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("failed to close ssh connection: %w", err)
+	}
+	return nil
+}
+
+// validateSFTPConfig はSFTPバックアップ設定を検証する
+func validateSFTPConfig(config SFTPBackupSessionConfig) error {
+	if config.Host == "" {
+		return fmt.Errorf("%w: host is required", ErrInvalidConfig)
+	}
+
+	if config.User == "" {
+		return fmt.Errorf("%w: user is required", ErrInvalidConfig)
+	}
+
+	if config.RootDir == "" {
+		return fmt.Errorf("%w: root directory is required", ErrInvalidConfig)
+	}
+
+	if config.Port < 0 || config.Port > 65535 {
+		return fmt.Errorf("%w: invalid port: %d", ErrInvalidConfig, config.Port)
+	}
+
+	if len(config.PrivateKey) > 0 && config.PrivateKeyFile != "" {
+		return fmt.Errorf("%w: private key and private key file cannot both be specified", ErrInvalidConfig)
+	}
+
+	if len(config.PrivateKey) == 0 && config.PrivateKeyFile == "" && !config.UseAgent && config.Password == "" {
+		return fmt.Errorf("%w: at least one authentication method is required", ErrInvalidConfig)
+	}
+
+	if config.DialTimeout < 0 {
+		return fmt.Errorf("%w: dial timeout must not be negative", ErrInvalidConfig)
+	}
+
+	return nil
+}
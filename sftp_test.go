@@ -0,0 +1,402 @@
+package safebackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSFTPServer はテスト用にプロセス内で動かすSSH/SFTPサーバー
+// SFTPサーバーはローカルのファイルシステムをそのまま公開する
+type testSFTPServer struct {
+	host       string
+	port       int
+	knownHosts string // サーバーのホスト鍵を記録したknown_hostsファイル
+	clientKey  []byte // 認証に使えるPEM形式の秘密鍵
+	password   string // 認証に使えるパスワード
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// newTestSFTPServer はSFTPサーバーを起動し、テストの終了時に停止する
+func newTestSFTPServer(t *testing.T) *testSFTPServer {
+	t.Helper()
+
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	require.NoError(t, err)
+
+	clientPublic, clientPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authorized, err := ssh.NewPublicKey(clientPublic)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(clientPrivate, "")
+	require.NoError(t, err)
+
+	server := &testSFTPServer{
+		clientKey: pem.EncodeToMemory(block),
+		password:  "secret",
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.ErrUnexpectedEOF
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == server.password {
+				return nil, nil
+			}
+			return nil, io.ErrUnexpectedEOF
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().(*net.TCPAddr)
+	server.host, server.port = addr.IP.String(), addr.Port
+
+	server.knownHosts = filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostSigner.PublicKey())
+	require.NoError(t, os.WriteFile(server.knownHosts, []byte(line+"\n"), 0600))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.mu.Unlock()
+			go server.serve(conn, config)
+		}
+	}()
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		for _, conn := range server.conns {
+			_ = conn.Close()
+		}
+	})
+	return server
+}
+
+// serve は1つの接続でSFTPサブシステムの要求に応える
+func (s *testSFTPServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if ok {
+					go func() {
+						server, err := sftp.NewServer(channel)
+						if err != nil {
+							return
+						}
+						_ = server.Serve()
+						_ = server.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// config はサーバーに秘密鍵で接続する設定を返す
+func (s *testSFTPServer) config(rootDir string) SFTPBackupSessionConfig {
+	return SFTPBackupSessionConfig{
+		Host:           s.host,
+		Port:           s.port,
+		User:           "backup",
+		PrivateKey:     s.clientKey,
+		KnownHostsFile: s.knownHosts,
+		RootDir:        rootDir,
+		DialTimeout:    5 * time.Second,
+	}
+}
+
+// remoteTempFiles は rootDir 以下に残った一時ファイルを返す
+func remoteTempFiles(t *testing.T, rootDir string) []string {
+	var temps []string
+	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, tempFileSuffix) {
+			temps = append(temps, path)
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return temps
+}
+
+func TestSFTPBackupSession(t *testing.T) {
+	server := newTestSFTPServer(t)
+
+	newSession := func(t *testing.T, config SFTPBackupSessionConfig) *SFTPBackupSession {
+		session, err := NewSFTPBackupSession(config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = session.Close() })
+		return session
+	}
+
+	content := compressibleTestData(1000)
+	srcDir := t.TempDir()
+	srcPath := filepath.Join(srcDir, "app.log")
+	require.NoError(t, os.WriteFile(srcPath, content, 0640))
+	past := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(srcPath, past, past))
+
+	t.Run("Conformance", func(t *testing.T) {
+		testBackupSessionConformance(t, func(t *testing.T) BackupSession {
+			return newSession(t, server.config(filepath.Join(t.TempDir(), "backups")))
+		})
+	})
+
+	t.Run("TempFileAndRename", func(t *testing.T) {
+		rootDir := filepath.Join(t.TempDir(), "remote", "backups")
+		config := server.config(rootDir)
+		config.PreserveTimes = true
+		session := newSession(t, config)
+
+		// ルートディレクトリと親ディレクトリは自動で作成され、権限と更新日時を引き継ぐ
+		require.NoError(t, session.Save(srcPath, "logs/2024/app.log"))
+
+		remote := filepath.Join(rootDir, "logs", "2024", "app.log")
+		data, err := os.ReadFile(remote)
+		require.NoError(t, err)
+		require.Equal(t, content, data)
+
+		info, err := os.Stat(remote)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+		require.True(t, past.Equal(info.ModTime()))
+		require.Equal(t, filepath.ToSlash(remote), session.Results()[0].Destination)
+		require.Empty(t, remoteTempFiles(t, rootDir))
+
+		// 既存のファイルはリネームで置き換える
+		require.NoError(t, session.SaveReader(context.Background(), strings.NewReader("replaced"), "logs/2024/app.log", -1))
+		data, err = os.ReadFile(remote)
+		require.NoError(t, err)
+		require.Equal(t, "replaced", string(data))
+		require.Empty(t, remoteTempFiles(t, rootDir))
+
+		// 一時ファイルは一覧に含めない
+		require.NoError(t, os.WriteFile(filepath.Join(rootDir, "logs", ".x"+tempFileSuffix), nil, 0644))
+		infos, err := session.List(context.Background(), "")
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+
+		stat, err := session.Stat(context.Background(), "logs/2024/app.log")
+		require.NoError(t, err)
+		require.Equal(t, streamFileMode.String(), stat.Metadata["mode"])
+	})
+
+	t.Run("SymlinkPreserve", func(t *testing.T) {
+		tree := createTestTree(t)
+		rootDir := t.TempDir()
+		session := newSession(t, server.config(rootDir))
+
+		err := session.SaveDir(context.Background(), tree, "tree", SaveDirOptions{Symlinks: SymlinkPreserve})
+		require.NoError(t, err)
+
+		target, err := os.Readlink(filepath.Join(rootDir, "tree", "link-file"))
+		require.NoError(t, err)
+		require.Equal(t, "a.txt", target)
+
+		info, err := session.Stat(context.Background(), "tree/link-file")
+		require.NoError(t, err)
+		require.Equal(t, "a.txt", info.Metadata[symlinkMetadataKey])
+		require.Empty(t, remoteTempFiles(t, rootDir))
+
+		// シンボリックリンクの保存もセッションのキャンセルで中断し、一時ファイルを残さない
+		session.cancel()
+		err = session.saveSymlink(context.Background(), filepath.Join(srcDir, "link"), "app.log", "link")
+		require.ErrorIs(t, err, ErrBackupFailed)
+		_, err = os.Lstat(filepath.Join(rootDir, "link"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+		require.Empty(t, remoteTempFiles(t, rootDir))
+	})
+
+	t.Run("PasswordAuth", func(t *testing.T) {
+		config := server.config(t.TempDir())
+		config.PrivateKey = nil
+		config.Password = server.password
+		session := newSession(t, config)
+		require.NoError(t, session.Save(srcPath, "app.log"))
+
+		config.Password = "wrong"
+		_, err := NewSFTPBackupSession(config)
+		require.Error(t, err)
+	})
+
+	t.Run("PrivateKeyFile", func(t *testing.T) {
+		keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+		require.NoError(t, os.WriteFile(keyFile, server.clientKey, 0600))
+
+		config := server.config(t.TempDir())
+		config.PrivateKey = nil
+		config.PrivateKeyFile = keyFile
+		session := newSession(t, config)
+		require.NoError(t, session.Save(srcPath, "app.log"))
+	})
+
+	t.Run("UnknownHostKey", func(t *testing.T) {
+		// 別のホスト鍵を記録したknown_hostsでは接続しない
+		public, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		otherKey, err := ssh.NewPublicKey(public)
+		require.NoError(t, err)
+		knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+		addr := net.JoinHostPort(server.host, strconv.Itoa(server.port))
+		line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, otherKey)
+		require.NoError(t, os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+		config := server.config(t.TempDir())
+		config.KnownHostsFile = knownHostsFile
+		_, err = NewSFTPBackupSession(config)
+		require.Error(t, err)
+
+		// 記録されていないホストにも接続しない
+		require.NoError(t, os.WriteFile(knownHostsFile, nil, 0600))
+		_, err = NewSFTPBackupSession(config)
+		require.Error(t, err)
+	})
+
+	t.Run("UnsafePath", func(t *testing.T) {
+		rootDir := filepath.Join(t.TempDir(), "root")
+		session := newSession(t, server.config(rootDir))
+
+		err := session.Save(srcPath, "../escape.log")
+		require.ErrorIs(t, err, ErrInvalidConfig)
+		_, err = os.Stat(filepath.Join(filepath.Dir(rootDir), "escape.log"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		valid := server.config(t.TempDir())
+		for name, modify := range map[string]func(*SFTPBackupSessionConfig){
+			"NoHost":      func(c *SFTPBackupSessionConfig) { c.Host = "" },
+			"NoUser":      func(c *SFTPBackupSessionConfig) { c.User = "" },
+			"NoRootDir":   func(c *SFTPBackupSessionConfig) { c.RootDir = "" },
+			"BadPort":     func(c *SFTPBackupSessionConfig) { c.Port = 70000 },
+			"NoAuth":      func(c *SFTPBackupSessionConfig) { c.PrivateKey = nil },
+			"BothKeys":    func(c *SFTPBackupSessionConfig) { c.PrivateKeyFile = "/tmp/id_ed25519" },
+			"BadKey":      func(c *SFTPBackupSessionConfig) { c.PrivateKey = []byte("not a key") },
+			"NoKnownHost": func(c *SFTPBackupSessionConfig) { c.KnownHostsFile = filepath.Join(t.TempDir(), "missing") },
+		} {
+			t.Run(name, func(t *testing.T) {
+				config := valid
+				modify(&config)
+				_, err := NewSFTPBackupSession(config)
+				require.ErrorIs(t, err, ErrInvalidConfig)
+			})
+		}
+	})
+}
+
+// sftpv3Renamer はposix-rename拡張を持たないSFTPv3サーバーを模擬する
+// 既存のファイルへのリネームは失敗し、failRenameFrom からのリネームも失敗する
+type sftpv3Renamer struct {
+	*sftp.Client
+	failRenameFrom string
+}
+
+func (r *sftpv3Renamer) HasExtension(extension string) (string, bool) {
+	return "", false
+}
+
+func (r *sftpv3Renamer) Rename(oldname, newname string) error {
+	if _, err := r.Client.Lstat(newname); err == nil {
+		return os.ErrExist
+	}
+	if oldname == r.failRenameFrom {
+		return io.ErrUnexpectedEOF
+	}
+	return r.Client.Rename(oldname, newname)
+}
+
+func TestReplaceRemoteFile(t *testing.T) {
+	server := newTestSFTPServer(t)
+	rootDir := t.TempDir()
+	session, err := NewSFTPBackupSession(server.config(rootDir))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = session.Close() })
+
+	remotePath := filepath.ToSlash(filepath.Join(rootDir, "app.log"))
+	writeTemp := func(t *testing.T, content string) string {
+		tempPath, err := remoteTempPath(remotePath)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.FromSlash(tempPath), []byte(content), 0600))
+		return tempPath
+	}
+
+	t.Run("NewFile", func(t *testing.T) {
+		tempPath := writeTemp(t, "first")
+		require.NoError(t, replaceRemoteFile(&sftpv3Renamer{Client: session.client}, tempPath, remotePath))
+
+		data, err := os.ReadFile(filepath.FromSlash(remotePath))
+		require.NoError(t, err)
+		require.Equal(t, "first", string(data))
+		require.Empty(t, remoteTempFiles(t, rootDir))
+	})
+
+	t.Run("ExistingFile", func(t *testing.T) {
+		tempPath := writeTemp(t, "second")
+		require.NoError(t, replaceRemoteFile(&sftpv3Renamer{Client: session.client}, tempPath, remotePath))
+
+		data, err := os.ReadFile(filepath.FromSlash(remotePath))
+		require.NoError(t, err)
+		require.Equal(t, "second", string(data))
+		require.Empty(t, remoteTempFiles(t, rootDir))
+	})
+
+	t.Run("SecondRenameFails", func(t *testing.T) {
+		// 既存のファイルを退避した後のリネームが失敗しても既存のバックアップは残る
+		tempPath := writeTemp(t, "third")
+		renamer := &sftpv3Renamer{Client: session.client, failRenameFrom: tempPath}
+		require.ErrorIs(t, replaceRemoteFile(renamer, tempPath, remotePath), io.ErrUnexpectedEOF)
+
+		data, err := os.ReadFile(filepath.FromSlash(remotePath))
+		require.NoError(t, err)
+		require.Equal(t, "second", string(data))
+		require.Equal(t, []string{filepath.FromSlash(tempPath)}, remoteTempFiles(t, rootDir))
+	})
+}
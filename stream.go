@@ -0,0 +1,57 @@
+package safebackup
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// contextReader はコンテキストがキャンセルされると読み込みを中断するReader
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read はコンテキストを確認してから読み込む
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// mergeContext は parent と session のどちらかが終了するとキャンセルされるコンテキストを返す
+// 呼び出し元の処理単位のコンテキストとセッション全体のコンテキストを合成するために使う
+func mergeContext(parent, session context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(session, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// readFirstPart はストリームの最初のパート（S3のパートやAzureのブロック）を読み込む
+// sizeHint が partSize より小さい場合は sizeHint+1 バイトのバッファから始め、ストリームがそれより大きい場合にだけ partSize まで広げる
+func readFirstPart(r io.Reader, partSize, sizeHint int64) ([]byte, int, error) {
+	if sizeHint < 0 || sizeHint >= partSize {
+		buf := make([]byte, partSize)
+		n, err := io.ReadFull(r, buf)
+		return buf, n, err
+	}
+
+	buf := make([]byte, sizeHint+1)
+	n, err := io.ReadFull(r, buf)
+	if err != nil {
+		return buf, n, err
+	}
+
+	grown := make([]byte, partSize)
+	copy(grown, buf)
+	m, err := io.ReadFull(r, grown[n:])
+	if errors.Is(err, io.EOF) {
+		// 最初のバッファ分は読めているので途中で終わったことになる
+		err = io.ErrUnexpectedEOF
+	}
+	return grown, n + m, err
+}
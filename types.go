@@ -1,7 +1,11 @@
 package safebackup
 
 import (
+	"net/http"
+	"time"
+
 	cleaner "github.com/ideamans/go-backup-cleaner"
+	"golang.org/x/crypto/ssh"
 )
 
 // LocalBackupSessionConfig はローカルバックアップセッションの設定
@@ -20,6 +24,146 @@ type LocalBackupSessionConfig struct {
 
 	// CleaningConfig はgo-backup-cleanerの設定
 	CleaningConfig cleaner.CleaningConfig
+
+	// OnCleaningComplete はクリーニングが1回終了するたびに呼ばれるコールバック（オプション）
+	OnCleaningComplete func(record CleaningRecord)
+
+	// PreserveMetadata はコピー時に保持するメタデータ（デフォルト: 権限のみ）
+	PreserveMetadata MetadataPreservation
+
+	// Incremental は保存先の既存のファイルと同じ内容のファイルをスキップする方法（デフォルト: スキップしない）
+	// IncrementalSizeModTime には PreserveMetadata.Times が必要（重複排除モードを除く）
+	Incremental IncrementalMode
+
+	// Dedup は重複排除モードの設定（デフォルト: 無効）
+	// 有効な場合、容量不足時のクリーニングはgo-backup-cleanerの代わりに、参照されなくなったチャンクを
+	// 数えながら古いマニフェストから削除する
+	Dedup DedupConfig
+
+	// Compression は保存するファイルの圧縮の設定（デフォルト: 圧縮しない）
+	// 圧縮したファイルは接尾辞 ".safebackup.gz" または ".safebackup.zst" を付けて保存し、リストア時に自動で展開する
+	Compression CompressionConfig
+
+	// KeyProvider はファイルを暗号化するデータ鍵の提供元（オプション、nilの場合は暗号化しない）
+	// 暗号化したファイルは接尾辞 ".safebackup.enc" を付けて保存する（圧縮する場合は圧縮してから暗号化する）
+	KeyProvider KeyProvider
+
+	// ChecksumSidecars は保存したファイルごとに、保存した内容のSHA-256を記録したサイドカーファイルを書く（デフォルト: 書かない）
+	// サイドカーはファイル名に ".safebackup.sha256" を付けたもので、sha256sum -c で検証できる形式
+	// Verify はサイドカーと照合してビット腐敗を検出する
+	ChecksumSidecars bool
+}
+
+// Compression は圧縮形式
+type Compression string
+
+const (
+	// CompressionNone は圧縮しない（デフォルト）
+	CompressionNone Compression = ""
+
+	// CompressionGzip はgzipで圧縮する
+	CompressionGzip Compression = "gzip"
+
+	// CompressionZstd はZstandardで圧縮する
+	CompressionZstd Compression = "zstd"
+)
+
+// CompressionConfig は保存するファイルの圧縮の設定
+// 拡張子が圧縮済みの形式のファイルと、先頭のエントロピーが高いファイルは圧縮せずにそのまま保存する
+// SaveReader で保存するデータは圧縮しない
+type CompressionConfig struct {
+	// Algorithm は圧縮形式
+	Algorithm Compression
+
+	// Level は圧縮レベル（0はデフォルト。gzip: 1〜9、zstd: 1〜22）
+	Level int
+
+	// SkipExtensions は組み込みの一覧に加えて圧縮しないファイルの拡張子（".log" のようにドットを含めて指定する）
+	SkipExtensions []string
+}
+
+// DedupConfig は重複排除モードの設定
+// 有効にすると、ファイルの内容を内容定義チャンキングで分割してハッシュ名のチャンクとして一度だけ保存し、
+// relativePath にはチャンクの一覧を記録した小さなマニフェストを保存する
+// チャンクはルートディレクトリ（S3では Prefix）直下の ".safebackup-chunks" 以下に保存される
+type DedupConfig struct {
+	// Enabled は重複排除モードを有効にする
+	Enabled bool
+
+	// MinChunkSize はチャンクの最小サイズ（デフォルト: 256KB）
+	MinChunkSize int
+
+	// AvgChunkSize はチャンクの平均サイズの目安（デフォルト: 1MB、2のべき乗に切り下げ）
+	AvgChunkSize int
+
+	// MaxChunkSize はチャンクの最大サイズ（デフォルト: 4MB、最大: 64MB）
+	MaxChunkSize int
+}
+
+// IncrementalMode は変更されていないファイルを判定する方法
+// スキップしたファイルは FileResult.Skipped が真になる
+type IncrementalMode int
+
+const (
+	// IncrementalOff は常に保存する（デフォルト）
+	IncrementalOff IncrementalMode = iota
+
+	// IncrementalSizeModTime はサイズと更新日時が一致するファイルをスキップする
+	// ファイルの内容を読まないため速いが、更新日時を変えずに書き換えられたファイルは検出できない
+	IncrementalSizeModTime
+
+	// IncrementalChecksum はSHA-256が一致するファイルをスキップする
+	// S3ではメタデータに記録したチェックサム、なければシングルパートのETag（MD5）と比較する
+	IncrementalChecksum
+)
+
+// MetadataPreservation はローカルバックアップで保持するメタデータの指定
+// 保持できなかった属性は FileResult.UnpreservedMetadata に記録される
+type MetadataPreservation struct {
+	// Times は更新日時とアクセス日時を保持する
+	Times bool
+
+	// Ownership は所有者とグループを保持する（変更には通常root権限が必要）
+	Ownership bool
+
+	// Xattrs は拡張属性を保持する（Linuxのみ。POSIX ACLもxattrとして保持される）
+	Xattrs bool
+}
+
+// SymlinkPolicy は SaveDir がシンボリックリンクをどう扱うかの指定
+type SymlinkPolicy int
+
+const (
+	// SymlinkSkip はシンボリックリンクを保存しない（デフォルト）
+	SymlinkSkip SymlinkPolicy = iota
+
+	// SymlinkFollow はリンク先のファイルやディレクトリを保存する（循環するリンクはエラーとして記録）
+	SymlinkFollow
+
+	// SymlinkPreserve はリンクそのものを保存する
+	// ローカルではシンボリックリンクとして、S3ではリンク先をメタデータに持つ空のオブジェクトとして保存する
+	// WebDAVでは使用できない
+	SymlinkPreserve
+)
+
+// SaveDirOptions は SaveDir の設定
+type SaveDirOptions struct {
+	// Include はgitignore形式のパターン（指定した場合、一致するファイルのみを保存）
+	Include []string
+
+	// Exclude はgitignore形式のパターン（一致するファイルとディレクトリを保存しない）
+	Exclude []string
+
+	// MinSize と MaxSize はファイルサイズの範囲（バイト、0は制限なし）
+	MinSize int64
+	MaxSize int64
+
+	// MinAge と MaxAge は更新日時からの経過時間の範囲（0は制限なし）
+	MinAge time.Duration
+	MaxAge time.Duration
+
+	// Symlinks はシンボリックリンクの扱い
+	Symlinks SymlinkPolicy
 }
 
 // S3BackupSessionConfig はS3バックアップセッションの設定
@@ -37,4 +181,265 @@ type S3BackupSessionConfig struct {
 
 	// ACL設定
 	ACL string // デフォルト: private
+
+	// オブジェクトの属性（WithS3ObjectOptions で Save ごとに上書きできる）
+	ServerSideEncryption SSEConfig         // サーバー側の暗号化（デフォルト: バケットの設定に従う）
+	StorageClass         string            // ストレージクラス（デフォルト: STANDARD）
+	Metadata             map[string]string // ユーザーメタデータ（このライブラリが記録するキーは使えない）
+	ContentType          string            // Content-Type（デフォルト: 拡張子と内容から判定）
+	CacheControl         string            // Cache-Control（オプション）
+	Tags                 map[string]string // オブジェクトのタグ（最大10個）
+
+	// ChecksumAlgorithm はアップロード時にS3に送って検証させる追加のチェックサム（デフォルト: Content-MD5 のみ）
+	ChecksumAlgorithm S3ChecksumAlgorithm
+
+	// マルチパートアップロード設定
+	MultipartThreshold int64 // このサイズ以上のファイルはマルチパートでアップロード（デフォルト: 64MB）
+	PartSize           int64 // パートサイズ（デフォルト: 16MB、最小: 5MB）
+	PartConcurrency    int   // 1ファイルあたりの並列パート数（デフォルト: 4）
+
+	// 並列アップロード設定
+	MaxConcurrentUploads int  // 同時にアップロードするファイル数の上限（デフォルト: 8）
+	UploadQueueSize      int  // アップロード待ち行列の長さ（デフォルト: 64）
+	FailWhenQueueFull    bool // 待ち行列が満杯の場合に Save を待たせずに ErrQueueFull を返す
+
+	// JournalDir はマルチパートアップロードの進捗を記録するディレクトリ（オプション）
+	// 指定するとプロセスの再起動後も中断したファイルのアップロードを再開できる
+	// 失敗したアップロードは再開のために中止せずに残す
+	JournalDir string
+
+	// OrphanedUploadAge はセッション作成時に Prefix 以下の未完了のマルチパートアップロードを
+	// 中止する経過時間（オプション、0の場合は中止しない）
+	OrphanedUploadAge time.Duration
+
+	// Incremental はS3の既存のオブジェクトと同じ内容のファイルをスキップする方法（デフォルト: スキップしない）
+	// 更新日時はアップロード時にメタデータに記録したものと比較する
+	Incremental IncrementalMode
+
+	// Dedup は重複排除モードの設定（デフォルト: 無効）
+	Dedup DedupConfig
+
+	// Compression はアップロードするファイルの圧縮の設定（デフォルト: 圧縮しない）
+	// 圧縮したオブジェクトはメタデータに圧縮形式と元のサイズを記録し、リストア時に自動で展開する
+	Compression CompressionConfig
+
+	// KeyProvider はファイルを暗号化するデータ鍵の提供元（オプション、nilの場合は暗号化しない）
+	// 暗号化したオブジェクトはメタデータに暗号化方式と鍵のIDを記録する（圧縮する場合は圧縮してから暗号化する）
+	KeyProvider KeyProvider
+}
+
+// GCSBackupSessionConfig はGoogle Cloud Storageバックアップセッションの設定
+type GCSBackupSessionConfig struct {
+	// GCS設定
+	Bucket   string
+	Prefix   string // バックアップのプレフィックス（オプション）
+	Endpoint string // カスタムエンドポイント（オプション、エミュレーター等）
+
+	// 認証情報（どちらも指定しない場合はアプリケーションのデフォルト認証情報を使う）
+	// Endpoint を指定して認証情報を指定しない場合は認証しない
+	CredentialsJSON []byte // サービスアカウント等の認証情報のJSON（オプション）
+	CredentialsFile string // 認証情報のJSONファイルのパス（オプション、CredentialsJSON と同時には指定できない）
+
+	// StorageClass はオブジェクトのストレージクラス（デフォルト: バケットのデフォルト）
+	StorageClass string
+
+	// 再開可能アップロード設定
+	ResumableThreshold int64 // このサイズ以上のファイルとサイズ不明のストリームは再開可能アップロードで送る（デフォルト: 16MB）
+	ChunkSize          int   // 再開可能アップロードで1回のリクエストで送るサイズ（デフォルト: 16MB、256KiBの倍数）
+}
+
+// AzureBlobBackupSessionConfig はAzure Blob Storageバックアップセッションの設定
+type AzureBlobBackupSessionConfig struct {
+	// ストレージアカウント
+	AccountName string
+	ServiceURL  string // BlobサービスのURL（オプション、デフォルト: https://<AccountName>.blob.core.windows.net/、Azurite等）
+
+	// 認証（いずれか1つを指定する）
+	AccountKey       string // 共有キー（AccountName が必要）
+	SASToken         string // SASトークン（先頭の "?" は省略可）
+	ConnectionString string // 接続文字列（AccountName と ServiceURL とは同時に指定できない）
+
+	// コンテナ設定
+	Container string
+	Prefix    string // バックアップのプレフィックス（オプション）
+
+	// AccessTier はブロックBLOBのアクセス層（Hot、Cool、Cold、Archive。デフォルト: アカウントのデフォルト）
+	AccessTier string
+
+	// ステージアップロード設定
+	StagedUploadThreshold int64 // このサイズ以上のファイルはブロックをステージしてからコミットする（デフォルト: 64MB）
+	BlockSize             int64 // ブロックのサイズ（デフォルト: 8MB、最大: 4000MiB）
+	BlockConcurrency      int   // 1ファイルあたりの並列にステージするブロック数（デフォルト: 4）
+}
+
+// WebDAVBackupSessionConfig はWebDAVバックアップセッションの設定
+type WebDAVBackupSessionConfig struct {
+	// URL はバックアップを保存するコレクションのURL（例: https://nas.example.com/remote.php/dav/files/user/backups/）
+	// コレクションが存在しない場合は作成する（親のコレクションは存在している必要がある）
+	URL string
+
+	// 認証（オプション）
+	Username   string
+	Password   string
+	AuthMethod string // "basic"、"digest"、または空（サーバーの要求に応じてDigest、Basicの順に選ぶ）
+
+	// AtomicCommit は一時的な名前にPUTしてからMOVEで保存先に移動する
+	// 保存先に書き込み途中のファイルが現れないが、サーバーがMOVEに対応している必要がある
+	AtomicCommit bool
+
+	// HTTPClient はリクエストに使うクライアント（オプション、TLSの設定等）
+	HTTPClient *http.Client
+}
+
+// MemoryBackupSessionConfig はメモリ上のバックアップセッションの設定
+// 遅延と失敗を注入して、アプリケーションのテストで遅いディスクや保存の失敗を再現できる
+type MemoryBackupSessionConfig struct {
+	// Latency は保存ごとに内容を読み込む前に加える遅延
+	Latency time.Duration
+
+	// BytesPerSecond は内容を読み込む速度の上限（0は無制限、遅いディスクの模擬）
+	BytesPerSecond int64
+
+	// FailNth は失敗させる保存の通し番号（1始まり、セッション内のすべての保存で数える）
+	FailNth []int
+
+	// FailPatterns はgitignore形式のパターン（SaveDir のプレフィックスを含む相対パスが一致する保存を失敗させる）
+	FailPatterns []string
+
+	// FailError は注入した失敗の原因として返すエラー（デフォルト: ErrInjectedFault）
+	// 返すエラーは常に ErrBackupFailed も含む
+	FailError error
+}
+
+// SFTPBackupSessionConfig はSFTPバックアップセッションの設定
+type SFTPBackupSessionConfig struct {
+	// 接続先
+	Host string
+	Port int // デフォルト: 22
+	User string
+
+	// 認証（指定したものを秘密鍵、ssh-agent、パスワードの順に試す。少なくとも1つが必要）
+	PrivateKey           []byte // PEM形式の秘密鍵（オプション）
+	PrivateKeyFile       string // 秘密鍵のファイルパス（オプション、PrivateKey と同時には指定できない）
+	PrivateKeyPassphrase string // 秘密鍵のパスフレーズ（オプション）
+	UseAgent             bool   // 環境変数 SSH_AUTH_SOCK のssh-agentの鍵を使う
+	Password             string // パスワード（キーボードインタラクティブ認証にも使う）
+
+	// KnownHostsFile はホスト鍵を検証するknown_hostsファイルのパス（デフォルト: ~/.ssh/known_hosts）
+	// 接続先のホスト鍵が記録されていないか一致しない場合は接続しない
+	KnownHostsFile string
+
+	// HostKeyCallback は known_hosts の代わりに使うホスト鍵の検証（オプション）
+	HostKeyCallback ssh.HostKeyCallback
+
+	// RootDir はリモートのバックアップのルートディレクトリ（存在しない場合は作成する）
+	RootDir string
+
+	// DialTimeout は接続とSSHのハンドシェイクのタイムアウト（デフォルト: 30秒）
+	DialTimeout time.Duration
+
+	// PreserveTimes はリモートのファイルの更新日時を元のファイルに合わせる
+	PreserveTimes bool
+}
+
+// LocalRestoreSessionConfig はローカルのバックアップからリストアするセッションの設定
+type LocalRestoreSessionConfig struct {
+	// RootDir はバックアップのルートディレクトリ（LocalBackupSessionConfig.RootDir と同じ）
+	RootDir string
+
+	// Dedup は重複排除モードで保存したマニフェストからファイルを組み立てる
+	// マニフェストでないファイルはそのままリストアする
+	Dedup bool
+
+	// KeyProvider は暗号化したファイルのデータ鍵を復号する（暗号化したファイルをリストアする場合に必要）
+	KeyProvider KeyProvider
+}
+
+// S3RestoreSessionConfig はS3のバックアップからリストアするセッションの設定
+type S3RestoreSessionConfig struct {
+	// AWS認証情報
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // オプション
+
+	// S3設定（S3BackupSessionConfig と同じ値を指定する）
+	Bucket   string
+	Prefix   string // バックアップのプレフィックス（オプション）
+	Endpoint string // カスタムエンドポイント（オプション）
+
+	// Dedup は重複排除モードで保存したマニフェストからファイルを組み立てる
+	// マニフェストでないオブジェクトはそのままリストアする
+	Dedup bool
+
+	// SSECustomerKey はSSE-Cで暗号化したオブジェクトの鍵（32バイト、SSE-Cを使う場合に必要）
+	// WithS3ObjectOptions で Restore ごとに上書きできる
+	SSECustomerKey []byte
+
+	// KeyProvider は暗号化したオブジェクトのデータ鍵を復号する（暗号化したオブジェクトをリストアする場合に必要）
+	KeyProvider KeyProvider
+}
+
+// S3ChecksumAlgorithm はアップロードの整合性を検証するためにS3に送る追加のチェックサムの方式
+// Content-MD5 は方式にかかわらず常に送る
+type S3ChecksumAlgorithm string
+
+const (
+	// S3ChecksumNone は追加のチェックサムを送らない（Content-MD5 のみ）
+	S3ChecksumNone S3ChecksumAlgorithm = ""
+
+	// S3ChecksumSHA256 はSHA-256を送る（x-amz-checksum-sha256）
+	S3ChecksumSHA256 S3ChecksumAlgorithm = "SHA256"
+
+	// S3ChecksumCRC32C はCRC32Cを送る（x-amz-checksum-crc32c）
+	S3ChecksumCRC32C S3ChecksumAlgorithm = "CRC32C"
+)
+
+// SSEMode はS3のサーバー側の暗号化の方式
+type SSEMode string
+
+const (
+	// SSENone はサーバー側の暗号化を指定しない（バケットのデフォルトの暗号化に従う）
+	SSENone SSEMode = ""
+
+	// SSES3 はS3が管理する鍵で暗号化する（SSE-S3）
+	SSES3 SSEMode = "AES256"
+
+	// SSEKMS はAWS KMSの鍵で暗号化する（SSE-KMS）
+	SSEKMS SSEMode = "aws:kms"
+
+	// SSEC は利用者が指定した鍵で暗号化する（SSE-C）
+	// リストアやオブジェクトの情報の取得にも同じ鍵が必要になる
+	SSEC SSEMode = "SSE-C"
+)
+
+// SSEConfig はS3のサーバー側の暗号化の設定
+type SSEConfig struct {
+	// Mode は暗号化の方式
+	Mode SSEMode
+
+	// KMSKeyID はSSE-KMSで使う鍵のID、ARNまたはエイリアス（オプション、空の場合はAWS管理の鍵）
+	KMSKeyID string
+
+	// KMSEncryptionContext はSSE-KMSの暗号化コンテキスト（オプション）
+	KMSEncryptionContext map[string]string
+
+	// BucketKeyEnabled はSSE-KMSでS3バケットキーを使う
+	BucketKeyEnabled bool
+
+	// CustomerKey はSSE-Cで使う32バイトの鍵
+	CustomerKey []byte
+}
+
+// S3ObjectOptions は Save ごとにセッションの設定を上書きするオブジェクトの属性
+// WithS3ObjectOptions でコンテキストに設定し、SaveContext、SaveReader、SaveDir に渡す
+// 空の項目はセッションの設定に従う。Metadata と Tags はセッションの設定に追加される（同じキーは上書き）
+type S3ObjectOptions struct {
+	ACL                  string
+	ServerSideEncryption *SSEConfig // nilの場合はセッションの設定に従う
+	StorageClass         string
+	Metadata             map[string]string
+	ContentType          string
+	CacheControl         string
+	Tags                 map[string]string
 }
@@ -0,0 +1,753 @@
+package safebackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webdavPropfindBody はPROPFINDで取得するプロパティ
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/><D:getetag/><D:getcontenttype/></D:prop></D:propfind>`
+
+// webdavMultistatus はPROPFINDの応答（207 Multi-Status）
+type webdavMultistatus struct {
+	Responses []webdavResponse `xml:"DAV: response"`
+}
+
+// webdavResponse はPROPFINDの応答のリソースごとの要素
+type webdavResponse struct {
+	Href      string           `xml:"DAV: href"`
+	Propstats []webdavPropstat `xml:"DAV: propstat"`
+}
+
+// webdavPropstat は同じステータスのプロパティの組
+type webdavPropstat struct {
+	Status string     `xml:"DAV: status"`
+	Prop   webdavProp `xml:"DAV: prop"`
+}
+
+// webdavProp はPROPFINDで取得するプロパティ
+type webdavProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength string `xml:"DAV: getcontentlength"`
+	LastModified  string `xml:"DAV: getlastmodified"`
+	ETag          string `xml:"DAV: getetag"`
+	ContentType   string `xml:"DAV: getcontenttype"`
+}
+
+// webdavEntry はPROPFINDで取得したリソースの情報
+type webdavEntry struct {
+	relativePath string // ルートのコレクションからの相対パス（ルート自身は空）
+	collection   bool
+	size         int64 // 不明な場合は-1
+	modTime      time.Time
+	etag         string
+	contentType  string
+}
+
+// WebDAVBackupSession はWebDAVサーバーへのバックアップセッション実装
+// 親のコレクションはMKCOLで作成し、AtomicCommit の場合は一時的な名前にPUTしてからMOVEで保存先に移動する
+// 保存は呼び出し元のゴルーチンで行われ、複数のゴルーチンから同時に呼び出せる
+type WebDAVBackupSession struct {
+	config  WebDAVBackupSessionConfig
+	root    *url.URL // ルートのコレクションのURL（パスの末尾の "/" は除く）
+	client  *http.Client
+	auth    *webdavAuth
+	dirs    sync.Map  // 作成済みのコレクションの相対パス
+	results resultLog // ファイルごとの結果
+	ctx     context.Context
+	cancel  context.CancelFunc // ctx のキャンセル
+	closeMu sync.RWMutex       // closed の排他制御
+	closed  bool
+	saves   sync.WaitGroup // 実行中の保存処理
+}
+
+// NewWebDAVBackupSession はWebDAVバックアップセッションインスタンスを作成
+// 作成時にルートのコレクションにアクセスできることを確認し、存在しない場合は作成する
+func NewWebDAVBackupSession(config WebDAVBackupSessionConfig) (*WebDAVBackupSession, error) {
+	// 設定の検証
+	if err := validateWebDAVConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	root, _ := url.Parse(config.URL)
+	root.Path = strings.TrimSuffix(root.Path, "/")
+	root.RawPath = ""
+
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &WebDAVBackupSession{
+		config: config,
+		root:   root,
+		client: client,
+		auth:   newWebDAVAuth(config.Username, config.Password, config.AuthMethod),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	// ルートのコレクションの確認（Digest認証の要求もここで受け取る）
+	_, err := s.propfind(context.Background(), "", "0")
+	if errors.Is(err, ErrNotFound) {
+		err = s.mkcol(context.Background(), "")
+	}
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to access %s: %w", root.Redacted(), err)
+	}
+	return s, nil
+}
+
+// Save はファイルをWebDAVサーバーに保存する
+func (s *WebDAVBackupSession) Save(localFilePath, relativePath string) error {
+	return s.SaveContext(context.Background(), localFilePath, relativePath)
+}
+
+// SaveContext はファイルをWebDAVサーバーに保存する
+// ctx またはセッションがキャンセルされると転送を中断し、AtomicCommit の場合は一時ファイルを削除する
+func (s *WebDAVBackupSession) SaveContext(ctx context.Context, localFilePath, relativePath string) error {
+	// 入力検証
+	if localFilePath == "" || relativePath == "" {
+		return fmt.Errorf("%w: empty file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	start := time.Now()
+	resourcePath, err := s.resourcePath(relativePath)
+	var destination string
+	var copied copyResult
+	if err == nil {
+		destination = s.resourceURL(resourcePath, false)
+		copied, err = s.saveFile(ctx, localFilePath, resourcePath)
+	}
+	s.results.add(FileResult{
+		SourcePath:   localFilePath,
+		RelativePath: relativePath,
+		Destination:  destination,
+		BytesWritten: copied.written,
+		Duration:     time.Since(start),
+		Checksum:     copied.checksum,
+		Err:          err,
+	})
+
+	return err
+}
+
+// saveFile はファイルのチェックサムを計算してからアップロードする
+// 内容を読み直せるため、認証のやり直しでも送り直せる
+func (s *WebDAVBackupSession) saveFile(ctx context.Context, localFilePath, resourcePath string) (copyResult, error) {
+	file, err := os.Open(localFilePath)
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return copyResult{}, fmt.Errorf("failed to stat source file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return copyResult{}, fmt.Errorf("%w: source is not a regular file", ErrInvalidConfig)
+	}
+	size := info.Size()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, &contextReader{ctx: ctx, r: io.NewSectionReader(file, 0, size)}); err != nil {
+		return copyResult{}, fmt.Errorf("%w: failed to read file: %w", ErrBackupFailed, err)
+	}
+
+	err = s.upload(ctx, resourcePath, size, func() io.Reader {
+		return &contextReader{ctx: ctx, r: io.NewSectionReader(file, 0, size)}
+	}, func() int64 { return size })
+	if err != nil {
+		return copyResult{}, err
+	}
+	return copyResult{written: size, checksum: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// SaveReader はReaderから読み込んだデータをWebDAVサーバーに保存する
+// データはチャンク形式で送るため、サイズが分からなくてもメモリに溜めない
+// sizeHint はデータサイズが分かっている場合の値（不明な場合は負の値）で、WebDAVでは使用しない
+func (s *WebDAVBackupSession) SaveReader(ctx context.Context, r io.Reader, relativePath string, sizeHint int64) error {
+	// 入力検証
+	if r == nil || relativePath == "" {
+		return fmt.Errorf("%w: empty reader or file path", ErrInvalidConfig)
+	}
+
+	if err := s.beginSave(); err != nil {
+		return err
+	}
+	defer s.saves.Done()
+
+	ctx, cancel := mergeContext(ctx, s.ctx)
+	defer cancel()
+
+	start := time.Now()
+	resourcePath, err := s.resourcePath(relativePath)
+	var destination string
+	var copied copyResult
+	if err == nil {
+		destination = s.resourceURL(resourcePath, false)
+
+		// 転送と同時にチェックサムを計算
+		hash := sha256.New()
+		counter := &countingWriter{w: hash}
+		err = s.upload(ctx, resourcePath, -1, func() io.Reader {
+			return io.TeeReader(&contextReader{ctx: ctx, r: r}, counter)
+		}, func() int64 { return counter.n })
+		copied.written = counter.n
+		if err == nil {
+			copied.checksum = hex.EncodeToString(hash.Sum(nil))
+		}
+	}
+	s.results.add(FileResult{
+		RelativePath: relativePath,
+		Destination:  destination,
+		BytesWritten: copied.written,
+		Duration:     time.Since(start),
+		Checksum:     copied.checksum,
+		Err:          err,
+	})
+
+	return err
+}
+
+// SaveDir は srcDir 以下のファイルを relativePrefix 以下に保存する
+// 失敗したファイルがあっても残りの保存を続け、最後に *BackupError を返す
+// WebDAVにはシンボリックリンクがないため、SymlinkPreserve は ErrInvalidConfig になる
+func (s *WebDAVBackupSession) SaveDir(ctx context.Context, srcDir, relativePrefix string, opts SaveDirOptions) error {
+	if opts.Symlinks == SymlinkPreserve {
+		return fmt.Errorf("%w: symbolic links cannot be preserved on WebDAV", ErrInvalidConfig)
+	}
+
+	return walkDir(ctx, srcDir, relativePrefix, opts, func(entry dirEntry) *FileError {
+		err := s.SaveContext(ctx, entry.path, entry.relativePath)
+		if err == nil {
+			return nil
+		}
+		var destination string
+		if resourcePath, err := s.resourcePath(entry.relativePath); err == nil {
+			destination = s.resourceURL(resourcePath, false)
+		}
+		return &FileError{
+			RelativePath: entry.relativePath,
+			Destination:  destination,
+			Err:          err,
+		}
+	})
+}
+
+// upload は newBody の内容を resourcePath に保存する
+// 親のコレクションがなければ作成し、PUTの後にサーバー上のサイズが written と一致することを確認する
+// 一致しない場合は ErrIntegrityCheckFailed を返し、保存先に書き込んだファイルを削除する
+// 返すエラーはすべて ErrBackupFailed を含む
+func (s *WebDAVBackupSession) upload(ctx context.Context, resourcePath string, size int64, newBody func() io.Reader, written func() int64) error {
+	if err := s.ensureCollection(ctx, path.Dir(resourcePath)); err != nil {
+		return fmt.Errorf("%w: %w", ErrBackupFailed, err)
+	}
+
+	target := resourcePath
+	if s.config.AtomicCommit {
+		var err error
+		if target, err = remoteTempPath(resourcePath); err != nil {
+			return fmt.Errorf("%w: %w", ErrBackupFailed, err)
+		}
+	}
+
+	// 保存先に移動するまで完了しなかった場合は一時ファイルを削除
+	committed := false
+	defer func() {
+		if !committed && target != resourcePath {
+			_ = s.delete(context.WithoutCancel(ctx), target)
+		}
+	}()
+
+	if err := s.put(ctx, target, size, newBody); err != nil {
+		return fmt.Errorf("%w: failed to upload file: %w", ErrBackupFailed, err)
+	}
+
+	entries, err := s.propfind(ctx, target, "0")
+	if err != nil {
+		return fmt.Errorf("%w: failed to stat uploaded file: %w", ErrBackupFailed, err)
+	}
+	if remoteSize := entries[0].size; remoteSize >= 0 && remoteSize != written() {
+		if target == resourcePath {
+			_ = s.delete(context.WithoutCancel(ctx), target)
+		}
+		return fmt.Errorf("%w: %w: wrote %d bytes but remote file has %d bytes", ErrBackupFailed, ErrIntegrityCheckFailed, written(), remoteSize)
+	}
+
+	if target != resourcePath {
+		if err := s.move(ctx, target, resourcePath); err != nil {
+			return fmt.Errorf("%w: failed to move temporary file: %w", ErrBackupFailed, err)
+		}
+	}
+	committed = true
+	return nil
+}
+
+// ensureCollection は dir とその親のコレクションをMKCOLで作成する
+// 作成済みのコレクションは記録し、次からはリクエストを送らない
+func (s *WebDAVBackupSession) ensureCollection(ctx context.Context, dir string) error {
+	if dir == "." || dir == "" {
+		return nil
+	}
+
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		collection := strings.Join(parts[:i+1], "/")
+		if _, ok := s.dirs.Load(collection); ok {
+			continue
+		}
+		if err := s.mkcol(ctx, collection); err != nil {
+			return fmt.Errorf("failed to create collection %s: %w", collection, err)
+		}
+		s.dirs.Store(collection, struct{}{})
+	}
+	return nil
+}
+
+// webdavRequestBody はトランスポートが閉じたことを通知するリクエストの本文
+// トランスポートは応答を返した後に本文を閉じる場合があるため、読み込みの完了を待つために使う
+type webdavRequestBody struct {
+	io.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+// Close は本文が閉じられたことを通知する
+func (b *webdavRequestBody) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+// put は newBody が返す内容をPUTする
+// size が負の場合はチャンク形式で送る。サイズが分かっている場合は認証のやり直しで newBody から作り直して送る
+func (s *WebDAVBackupSession) put(ctx context.Context, resourcePath string, size int64, newBody func() io.Reader) error {
+	body := &webdavRequestBody{Reader: newBody(), closed: make(chan struct{})}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.resourceURL(resourcePath, false), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size >= 0 {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(newBody()), nil
+		}
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := s.do(req)
+	<-body.closed
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		drainBody(resp)
+		return nil
+	}
+	return webdavStatusError(resp)
+}
+
+// mkcol はコレクションを作成する（既に存在する場合は何もしない）
+func (s *WebDAVBackupSession) mkcol(ctx context.Context, resourcePath string) error {
+	req, err := http.NewRequestWithContext(ctx, "MKCOL", s.resourceURL(resourcePath, true), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusMethodNotAllowed: // 405は既に存在する
+		drainBody(resp)
+		return nil
+	}
+	return webdavStatusError(resp)
+}
+
+// move は from を to に上書きで移動する
+func (s *WebDAVBackupSession) move(ctx context.Context, from, to string) error {
+	req, err := http.NewRequestWithContext(ctx, "MOVE", s.resourceURL(from, false), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", s.resourceURL(to, false))
+	req.Header.Set("Overwrite", "T")
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent:
+		drainBody(resp)
+		return nil
+	}
+	return webdavStatusError(resp)
+}
+
+// delete はリソースを削除する（存在しない場合は何もしない）
+func (s *WebDAVBackupSession) delete(ctx context.Context, resourcePath string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.resourceURL(resourcePath, false), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		drainBody(resp)
+		return nil
+	}
+	return webdavStatusError(resp)
+}
+
+// propfind はリソースのプロパティを depth（"0" または "1"）の深さまで取得する
+// リソースが存在しない場合は ErrNotFound を返す
+func (s *WebDAVBackupSession) propfind(ctx context.Context, resourcePath, depth string) ([]webdavEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", s.resourceURL(resourcePath, depth != "0"), strings.NewReader(webdavPropfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusNotFound:
+		drainBody(resp)
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, resourcePath)
+	default:
+		return nil, webdavStatusError(resp)
+	}
+	defer drainBody(resp)
+
+	var multistatus webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("failed to parse PROPFIND response: %w", err)
+	}
+
+	var entries []webdavEntry
+	for _, response := range multistatus.Responses {
+		if entry, ok := s.parseResponse(response); ok {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("PROPFIND response has no entry for %s", resourcePath)
+	}
+	return entries, nil
+}
+
+// parseResponse はPROPFINDの応答の要素からリソースの情報を取り出す
+// ルートのコレクションの外を指す要素は false を返す
+func (s *WebDAVBackupSession) parseResponse(response webdavResponse) (webdavEntry, bool) {
+	href, err := url.Parse(response.Href)
+	if err != nil {
+		return webdavEntry{}, false
+	}
+	p := strings.TrimSuffix(href.Path, "/")
+	if p != s.root.Path && !strings.HasPrefix(p, s.root.Path+"/") {
+		return webdavEntry{}, false
+	}
+
+	entry := webdavEntry{
+		relativePath: strings.TrimPrefix(strings.TrimPrefix(p, s.root.Path), "/"),
+		size:         -1,
+	}
+	for _, propstat := range response.Propstats {
+		// 取得できなかったプロパティ（404等）は使わない
+		if fields := strings.Fields(propstat.Status); len(fields) < 2 || fields[1] != "200" {
+			continue
+		}
+		prop := propstat.Prop
+		if prop.ResourceType.Collection != nil {
+			entry.collection = true
+		}
+		if size, err := strconv.ParseInt(strings.TrimSpace(prop.ContentLength), 10, 64); err == nil {
+			entry.size = size
+		}
+		if modTime, err := http.ParseTime(strings.TrimSpace(prop.LastModified)); err == nil {
+			entry.modTime = modTime
+		}
+		if prop.ETag != "" {
+			entry.etag = prop.ETag
+		}
+		if prop.ContentType != "" {
+			entry.contentType = prop.ContentType
+		}
+	}
+	return entry, true
+}
+
+// do はリクエストに認証情報を付けて送る
+// 認証を要求された場合は、本文を送り直せるリクエストに限り認証情報を付けて送り直す
+func (s *WebDAVBackupSession) do(req *http.Request) (*http.Response, error) {
+	nonce, err := s.auth.authorize(req)
+	if err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized || !s.auth.challenge(resp, nonce) || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	drainBody(resp)
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.auth.authorize(retry); err != nil {
+		return nil, err
+	}
+	return s.client.Do(retry)
+}
+
+// drainBody は接続を再利用できるように応答の本文を読み捨てて閉じる
+func drainBody(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+}
+
+// webdavStatusError は想定外のステータスの応答をエラーにする
+func webdavStatusError(resp *http.Response) error {
+	drainBody(resp)
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%s %s: authentication failed: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.Status)
+	}
+	return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.Status)
+}
+
+// resourcePath は相対パスをルートのコレクションからのパスに正規化する
+// ルートのコレクションの外を指す相対パスは ErrInvalidConfig になる
+func (s *WebDAVBackupSession) resourcePath(relativePath string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(relativePath)) {
+		return "", fmt.Errorf("%w: unsafe path %q", ErrInvalidConfig, relativePath)
+	}
+	return path.Clean(filepath.ToSlash(relativePath)), nil
+}
+
+// resourceURL はルートのコレクションからのパスのURLを返す
+// コレクションのURLは "/" で終わる
+func (s *WebDAVBackupSession) resourceURL(resourcePath string, collection bool) string {
+	u := *s.root
+	u.Path = s.root.Path + "/" + resourcePath
+	if collection && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+// List はルートのコレクション以下で相対パスが prefix で始まるファイルを相対パス順に返す
+// Depth: infinity を許可しないサーバーが多いため、コレクションを1階層ずつたどる
+// 内容を読まないため Checksum は含まれず、書き込み途中の一時ファイルも含まない
+func (s *WebDAVBackupSession) List(ctx context.Context, prefix string) ([]BackupInfo, error) {
+	var infos []BackupInfo
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := s.propfind(ctx, dir, "1")
+		if err != nil {
+			if dir != "" && errors.Is(err, ErrNotFound) {
+				// 列挙中に削除された
+				return nil
+			}
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.relativePath == dir {
+				// コレクション自身
+				continue
+			}
+			if entry.collection {
+				child := entry.relativePath + "/"
+				if strings.HasPrefix(child, prefix) || strings.HasPrefix(prefix, child) {
+					if err := walk(entry.relativePath); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if strings.HasSuffix(entry.relativePath, tempFileSuffix) || !strings.HasPrefix(entry.relativePath, prefix) {
+				continue
+			}
+			infos = append(infos, s.backupInfo(entry))
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].RelativePath < infos[j].RelativePath
+	})
+	return infos, nil
+}
+
+// Stat は保存済みのバックアップの情報を返す
+// 内容を読まないため、Checksum は含まれない
+func (s *WebDAVBackupSession) Stat(ctx context.Context, relativePath string) (BackupInfo, error) {
+	resourcePath, err := s.resourcePath(relativePath)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	entries, err := s.propfind(ctx, resourcePath, "0")
+	if errors.Is(err, ErrNotFound) {
+		return BackupInfo{}, fmt.Errorf("%w: %s", ErrNotFound, relativePath)
+	}
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to stat backup file: %w", err)
+	}
+	if entries[0].collection {
+		return BackupInfo{}, fmt.Errorf("%w: %s is a directory", ErrNotFound, relativePath)
+	}
+	return s.backupInfo(entries[0]), nil
+}
+
+// backupInfo はPROPFINDで取得したリソースの情報から BackupInfo を作る
+func (s *WebDAVBackupSession) backupInfo(entry webdavEntry) BackupInfo {
+	info := BackupInfo{
+		RelativePath: entry.relativePath,
+		Destination:  s.resourceURL(entry.relativePath, false),
+		Size:         entry.size,
+		ModTime:      entry.modTime,
+		Metadata:     map[string]string{},
+	}
+	if entry.etag != "" {
+		info.Metadata["etag"] = entry.etag
+	}
+	if entry.contentType != "" {
+		info.Metadata["content-type"] = entry.contentType
+	}
+	return info
+}
+
+// beginSave は保存処理の開始を記録する
+// クローズ済みのセッションでは ErrSessionClosed を返す
+func (s *WebDAVBackupSession) beginSave() error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	s.saves.Add(1)
+	return nil
+}
+
+// WaitForCompletion は他のゴルーチンで実行中の保存の完了を待つ
+func (s *WebDAVBackupSession) WaitForCompletion(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.saves.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("backup timeout: %w", ctx.Err())
+	case <-done:
+		return nil
+	}
+}
+
+// Results はこれまでに保存したファイルごとの結果を返す
+func (s *WebDAVBackupSession) Results() []FileResult {
+	return s.results.snapshot()
+}
+
+// Close は実行中の保存をキャンセルし、それらが終了するまで待つ
+func (s *WebDAVBackupSession) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closeMu.Unlock()
+
+	s.cancel()
+	s.saves.Wait()
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// validateWebDAVConfig はWebDAVバックアップ設定を検証する
+func validateWebDAVConfig(config WebDAVBackupSessionConfig) error {
+	if config.URL == "" {
+		return fmt.Errorf("%w: URL is required", ErrInvalidConfig)
+	}
+
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return fmt.Errorf("%w: invalid URL: %w", ErrInvalidConfig, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: URL must be an absolute http or https URL", ErrInvalidConfig)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials must be set with Username and Password, not in the URL", ErrInvalidConfig)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%w: URL must not have a query or fragment", ErrInvalidConfig)
+	}
+
+	switch config.AuthMethod {
+	case "", webdavAuthBasic, webdavAuthDigest:
+	default:
+		return fmt.Errorf("%w: invalid auth method: %s", ErrInvalidConfig, config.AuthMethod)
+	}
+
+	if config.Username == "" && (config.Password != "" || config.AuthMethod != "") {
+		return fmt.Errorf("%w: username is required for authentication", ErrInvalidConfig)
+	}
+
+	return nil
+}
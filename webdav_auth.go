@@ -0,0 +1,229 @@
+package safebackup
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// webdavAuthBasic はBasic認証
+	webdavAuthBasic = "basic"
+
+	// webdavAuthDigest はDigest認証
+	webdavAuthDigest = "digest"
+)
+
+// webdavDigestChallenge はサーバーが WWW-Authenticate で送ったDigest認証のパラメータ
+type webdavDigestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string // MD5、MD5-sess、SHA-256、SHA-256-sess
+	qop       bool   // qop=auth に対応している
+	stale     bool   // nonceの期限が切れたため拒否した
+}
+
+// webdavAuth はWebDAVのリクエストに認証情報を付ける
+// AuthMethod を指定しない場合は、最初に受け取った認証の要求に応じてDigest認証、Basic認証の順に選ぶ
+type webdavAuth struct {
+	username string
+	password string
+	method   string // 設定された認証方法（空の場合はサーバーの要求に応じて選ぶ）
+
+	mu     sync.Mutex
+	scheme string // 使用中の認証方法
+	digest *webdavDigestChallenge
+	nc     uint32 // 現在のnonceで送ったリクエスト数
+}
+
+// newWebDAVAuth は認証情報を付けるための webdavAuth を作る
+// Basic認証を指定した場合は、要求される前から認証情報を付ける
+func newWebDAVAuth(username, password, method string) *webdavAuth {
+	auth := &webdavAuth{username: username, password: password, method: method}
+	if method == webdavAuthBasic {
+		auth.scheme = webdavAuthBasic
+	}
+	return auth
+}
+
+// authorize は使用中の認証方法の Authorization ヘッダーを req に付ける
+// Digest認証の場合は使ったnonceを返す
+func (a *webdavAuth) authorize(req *http.Request) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch a.scheme {
+	case webdavAuthBasic:
+		req.SetBasicAuth(a.username, a.password)
+	case webdavAuthDigest:
+		a.nc++
+		header, err := a.digestAuthorization(req.Method, req.URL.RequestURI(), a.nc)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", header)
+		return a.digest.nonce, nil
+	}
+	return "", nil
+}
+
+// challenge は401の応答の WWW-Authenticate から認証方法を選ぶ
+// nonce は拒否されたリクエストに使ったDigest認証のnonce（使っていない場合は空）
+// 認証情報を付けて送り直す意味がある場合（新しい要求や新しいnonce）に true を返す
+func (a *webdavAuth) challenge(resp *http.Response, nonce string) bool {
+	if a.username == "" {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var digest *webdavDigestChallenge
+	var basic bool
+	for _, value := range resp.Header.Values("WWW-Authenticate") {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(value), " ")
+		switch strings.ToLower(scheme) {
+		case "digest":
+			parsed := parseAuthParams(params)
+			challenge := &webdavDigestChallenge{
+				realm:     parsed["realm"],
+				nonce:     parsed["nonce"],
+				opaque:    parsed["opaque"],
+				algorithm: parsed["algorithm"],
+				stale:     strings.EqualFold(parsed["stale"], "true"),
+			}
+			if challenge.algorithm == "" {
+				challenge.algorithm = "MD5"
+			}
+			for _, qop := range strings.Split(parsed["qop"], ",") {
+				if strings.TrimSpace(qop) == "auth" {
+					challenge.qop = true
+				}
+			}
+			// 対応しているアルゴリズムの最初の要求を使う
+			if digest == nil && challenge.nonce != "" && digestHash(challenge.algorithm) != nil {
+				digest = challenge
+			}
+		case "basic":
+			basic = true
+		}
+	}
+
+	if digest != nil && a.method != webdavAuthBasic {
+		// 送ったnonceのまま期限切れでもなく拒否された場合は認証情報が誤っている
+		if nonce == digest.nonce && !digest.stale {
+			return false
+		}
+		// 並行するリクエストが先に新しいnonceを受け取っていれば、それまでのカウントを引き継ぐ
+		if a.scheme != webdavAuthDigest || a.digest.nonce != digest.nonce {
+			a.scheme = webdavAuthDigest
+			a.digest = digest
+			a.nc = 0
+		}
+		return true
+	}
+	if basic && a.method != webdavAuthDigest && a.scheme != webdavAuthBasic {
+		a.scheme = webdavAuthBasic
+		return true
+	}
+	return false
+}
+
+// digestAuthorization はRFC 7616のDigest認証の Authorization ヘッダーの値を作る
+func (a *webdavAuth) digestAuthorization(method, uri string, nc uint32) (string, error) {
+	challenge := a.digest
+	newHash := digestHash(challenge.algorithm)
+	h := func(s string) string {
+		hash := newHash()
+		hash.Write([]byte(s))
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate cnonce: %w", err)
+	}
+	cnonce := hex.EncodeToString(random)
+	count := fmt.Sprintf("%08x", nc)
+
+	ha1 := h(a.username + ":" + challenge.realm + ":" + a.password)
+	if strings.HasSuffix(strings.ToLower(challenge.algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + challenge.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var response string
+	if challenge.qop {
+		response = h(strings.Join([]string{ha1, challenge.nonce, count, cnonce, "auth", ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + challenge.nonce + ":" + ha2)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username=%q, realm=%q, nonce=%q, uri=%q, algorithm=%s, response=%q`,
+		a.username, challenge.realm, challenge.nonce, uri, challenge.algorithm, response)
+	if challenge.qop {
+		fmt.Fprintf(&b, `, qop=auth, nc=%s, cnonce=%q`, count, cnonce)
+	}
+	if challenge.opaque != "" {
+		fmt.Fprintf(&b, `, opaque=%q`, challenge.opaque)
+	}
+	return b.String(), nil
+}
+
+// digestHash はDigest認証のアルゴリズムのハッシュ関数を返す（対応していない場合はnil）
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// parseAuthParams は認証の要求のパラメータ（key=value または key="value" のカンマ区切り）を解析する
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			// 引用符の中ではカンマを区切りとして扱わず、\ でエスケープされた文字をそのまま使う
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			s = rest[end:]
+		}
+		params[key] = value.String()
+	}
+}